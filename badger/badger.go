@@ -1,6 +1,7 @@
 package badger
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -53,13 +54,26 @@ func (w DeviceConfigWrapper) GetType() ConfigType {
 	return DeviceConfigType
 }
 
-// MpesaConfigWrapper wraps the hypothetical mpesaconfig.MpesaConfig
+// MpesaConfigWrapper holds the M-Pesa account an ISP collects payments into.
+// It is stored encrypted, see Store.SaveConfig.
 type MpesaConfigWrapper struct {
-	// mpesaconfig.MpesaConfig
-	ID    string
-	ISPID string
-	Name  string
-	// Add other M-Pesa specific fields
+	ID              string
+	ISPID           string
+	Name            string
+	Environment     string // sandbox or live
+	BaseURL         string // Daraja host, defaults to the environment's host
+	Shortcode       string
+	TillNo          string
+	Passkey         string
+	ConsumerKey     string
+	ConsumerSecret  string
+	TransactionType string
+	CallbackURL     string
+
+	// Refunds are made by the account's own initiator
+	InitiatorName      string
+	SecurityCredential string
+	B2CShortcode       string
 }
 
 // GetID implements StorableConfig
@@ -135,12 +149,25 @@ func (w DatabaseConfigWrapper) GetType() ConfigType {
 
 // Store represents the generic storage layer
 type Store struct {
-	db *badger.DB
+	db   *badger.DB
+	aead cipher.AEAD // Encrypts secret config types, nil without an encryption key
 }
 
-// NewStore creates a new storage instance
+// NewStore creates a new storage instance in DataDir. Secret configs are
+// encrypted with BADGER_ENCRYPTION_KEY.
 func NewStore() (*Store, error) {
-	opts := badger.DefaultOptions(strings.TrimSpace(os.Getenv("DataDir")))
+	return OpenStore(strings.TrimSpace(os.Getenv("DataDir")), strings.TrimSpace(os.Getenv("BADGER_ENCRYPTION_KEY")))
+}
+
+// OpenStore opens the store in dir. encryptionKey is a hex encoded 32 byte
+// key; without it secret config types cannot be saved or read.
+func OpenStore(dir, encryptionKey string) (*Store, error) {
+	aead, err := newAEAD(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(dir)
 	opts.Logger = nil 
 
 	db, err := badger.Open(opts)
@@ -148,7 +175,7 @@ func NewStore() (*Store, error) {
 		return nil, fmt.Errorf("failed to open BadgerDB: %w", err)
 	}
 
-	return &Store{db: db}, nil
+	return &Store{db: db, aead: aead}, nil
 }
 
 // Close closes the database
@@ -162,6 +189,10 @@ func (s *Store) SaveConfig(config StorableConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal config of type %s: %w", config.GetType(), err)
 	}
+	data, err = s.seal(config.GetType(), data)
+	if err != nil {
+		return err
+	}
 
 	key := []byte(fmt.Sprintf("%s:%s", config.GetType(), config.GetID()))
 
@@ -196,13 +227,17 @@ func (s *Store) GetConfig(configType ConfigType, id string, out interface{}) err
 		}
 
 		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, out)
+			data, err := s.open(configType, val)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(data, out)
 		})
 	})
 
 	if err != nil {
 		if err == badger.ErrKeyNotFound {
-			return fmt.Errorf("%s config not found: %s", configType, id)
+			return fmt.Errorf("%w: %s %s", ErrConfigNotFound, configType, id)
 		}
 		return fmt.Errorf("failed to get %s config: %w", configType, err)
 	}
@@ -246,7 +281,11 @@ func (s *Store) ListConfigsByISP(ispID string, configType ConfigType, outSlice i
 
 			configValue := reflect.New(elementType).Interface()
 			err = configItem.Value(func(val []byte) error {
-				return json.Unmarshal(val, configValue)
+				data, err := s.open(configType, val)
+				if err != nil {
+					return err
+				}
+				return json.Unmarshal(data, configValue)
 			})
 			if err != nil {
 				return err
@@ -272,7 +311,7 @@ func (s *Store) DeleteConfig(configType ConfigType, id string) error {
 		return txn.Delete(key)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete %s config: %w", configType, id, err)
+		return fmt.Errorf("failed to delete %s config %s: %w", configType, id, err)
 	}
 
 	// Optionally delete the ISP reference as well
@@ -344,6 +383,37 @@ func (s *Store) ListMpesaConfigsByISP(ispID string) ([]MpesaConfigWrapper, error
 	return wrappers, nil
 }
 
+// GetMpesaConfigByISP returns the M-Pesa account of an ISP, saved under the
+// ISP's ID. It returns ErrConfigNotFound when the ISP has none.
+func (s *Store) GetMpesaConfigByISP(ispID string) (*MpesaConfigWrapper, error) {
+	var config MpesaConfigWrapper
+	if err := s.GetConfig(MpesaConfigType, ispID, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// SaveMpesaConfigForISP saves the M-Pesa account of an ISP, replacing any
+// earlier one
+func (s *Store) SaveMpesaConfigForISP(config MpesaConfigWrapper) error {
+	if config.ISPID == "" {
+		return fmt.Errorf("mpesa config has no ISP")
+	}
+	config.ID = config.ISPID
+	return s.SaveConfig(config)
+}
+
+// DeleteMpesaConfigForISP removes the M-Pesa account of an ISP and its ISP reference
+func (s *Store) DeleteMpesaConfigForISP(ispID string) error {
+	if err := s.DeleteConfig(MpesaConfigType, ispID); err != nil {
+		return err
+	}
+	ispKey := []byte(fmt.Sprintf("isp:%s:%s:%s", ispID, MpesaConfigType, ispID))
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(ispKey)
+	})
+}
+
 func (s *Store) ListRadiusConfigsByISP(ispID string) ([]RadiusConfigWrapper, error) {
 	var wrappers []RadiusConfigWrapper
 	err := s.ListConfigsByISP(ispID, RadiusConfigType, &wrappers)
@@ -0,0 +1,115 @@
+package badger_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/badger"
+)
+
+const (
+	testKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	otherKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func openStore(t *testing.T, dir, key string) *badger.Store {
+	t.Helper()
+
+	store, err := badger.OpenStore(dir, key)
+	if err != nil {
+		t.Fatalf("OpenStore() error = %v", err)
+	}
+	return store
+}
+
+func testAccount() badger.MpesaConfigWrapper {
+	return badger.MpesaConfigWrapper{
+		ISPID:          "7",
+		Name:           "Tecsurf",
+		Environment:    "sandbox",
+		Shortcode:      "600100",
+		Passkey:        "isp-passkey",
+		ConsumerKey:    "isp-consumer-key",
+		ConsumerSecret: "isp-consumer-secret",
+	}
+}
+
+func TestMpesaConfigRoundTrip(t *testing.T) {
+	store := openStore(t, t.TempDir(), testKey)
+	defer store.Close()
+
+	if err := store.SaveMpesaConfigForISP(testAccount()); err != nil {
+		t.Fatalf("SaveMpesaConfigForISP() error = %v", err)
+	}
+
+	got, err := store.GetMpesaConfigByISP("7")
+	if err != nil {
+		t.Fatalf("GetMpesaConfigByISP() error = %v", err)
+	}
+	want := testAccount()
+	want.ID = "7"
+	if *got != want {
+		t.Errorf("GetMpesaConfigByISP() = %+v, want %+v", *got, want)
+	}
+
+	listed, err := store.ListMpesaConfigsByISP("7")
+	if err != nil || len(listed) != 1 || listed[0] != want {
+		t.Errorf("ListMpesaConfigsByISP() = %+v, %v, want the saved account", listed, err)
+	}
+
+	if err := store.DeleteMpesaConfigForISP("7"); err != nil {
+		t.Fatalf("DeleteMpesaConfigForISP() error = %v", err)
+	}
+	if _, err := store.GetMpesaConfigByISP("7"); !errors.Is(err, badger.ErrConfigNotFound) {
+		t.Errorf("GetMpesaConfigByISP() after delete error = %v, want ErrConfigNotFound", err)
+	}
+	if listed, _ := store.ListMpesaConfigsByISP("7"); len(listed) != 0 {
+		t.Errorf("ListMpesaConfigsByISP() after delete = %+v, want none", listed)
+	}
+}
+
+func TestMpesaConfigEncryptedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	store := openStore(t, dir, testKey)
+	if err := store.SaveMpesaConfigForISP(testAccount()); err != nil {
+		t.Fatalf("SaveMpesaConfigForISP() error = %v", err)
+	}
+	store.Close()
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "no key", key: ""},
+		{name: "other key", key: otherKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openStore(t, dir, tt.key)
+			defer store.Close()
+
+			if got, err := store.GetMpesaConfigByISP("7"); err == nil {
+				t.Errorf("GetMpesaConfigByISP() = %+v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestSaveMpesaConfigRequiresKey(t *testing.T) {
+	store := openStore(t, t.TempDir(), "")
+	defer store.Close()
+
+	if err := store.SaveMpesaConfigForISP(testAccount()); !errors.Is(err, badger.ErrNoEncryptionKey) {
+		t.Errorf("SaveMpesaConfigForISP() error = %v, want ErrNoEncryptionKey", err)
+	}
+}
+
+func TestOpenStoreRejectsBadKey(t *testing.T) {
+	for _, key := range []string{"short", strings.Repeat("zz", 32), testKey[:32]} {
+		if store, err := badger.OpenStore(t.TempDir(), key); err == nil {
+			store.Close()
+			t.Errorf("OpenStore() with key %q succeeded, want an error", key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package badger
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrConfigNotFound is returned when no config is stored under a type and ID
+var ErrConfigNotFound = errors.New("config not found")
+
+// ErrNoEncryptionKey is returned when a secret config is saved or read
+// without BADGER_ENCRYPTION_KEY
+var ErrNoEncryptionKey = errors.New("BADGER_ENCRYPTION_KEY is required to store secret configs")
+
+// secretConfigTypes are encrypted at rest as they hold credentials
+var secretConfigTypes = map[ConfigType]bool{
+	MpesaConfigType: true,
+}
+
+// sealedPrefix marks values encrypted by seal
+var sealedPrefix = []byte("enc:v1:")
+
+// newAEAD returns the AES-256-GCM cipher for a hex encoded key, or nil for no key
+func newAEAD(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := hex.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("BADGER_ENCRYPTION_KEY must be 64 hex characters (32 bytes)")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the value of a secret config type, other types are stored as is
+func (s *Store) seal(configType ConfigType, data []byte) ([]byte, error) {
+	if !secretConfigTypes[configType] {
+		return data, nil
+	}
+	if s.aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := append(append([]byte{}, sealedPrefix...), nonce...)
+	// The config type is authenticated so a value cannot be moved to another type
+	return s.aead.Seal(sealed, nonce, data, []byte(configType)), nil
+}
+
+// open decrypts a value written by seal. Secret configs stored in plain text
+// are refused.
+func (s *Store) open(configType ConfigType, val []byte) ([]byte, error) {
+	if !bytes.HasPrefix(val, sealedPrefix) {
+		if secretConfigTypes[configType] {
+			return nil, fmt.Errorf("%s config is not encrypted", configType)
+		}
+		return val, nil
+	}
+	if s.aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+
+	val = val[len(sealedPrefix):]
+	if len(val) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("%s config is truncated", configType)
+	}
+	nonce, ciphertext := val[:s.aead.NonceSize()], val[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, ciphertext, []byte(configType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s config: %w", configType, err)
+	}
+	return data, nil
+}
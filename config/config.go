@@ -109,6 +109,9 @@ type DeviceConfig struct {
 	PoolSize    int    `json:"poolSize"` // Number of connections to maintain
 	ISPID       string `json:"ispId"`    // Associated ISP
 	Description string `json:"description,omitempty"`
+
+	FailureThreshold int `json:"failureThreshold,omitempty"` // Consecutive failures before the circuit opens
+	CircuitCooldown  int `json:"circuitCooldown,omitempty"`  // Seconds an open circuit rejects calls
 }
 
 // MongoConfig - MongoDB configuration variables
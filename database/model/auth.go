@@ -5,6 +5,7 @@ package model
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,6 +36,16 @@ const (
 	PasswordRecoveryKeyPrefix  string = "gorest-pass-recover-"
 )
 
+// Roles of an account
+const (
+	RolePlatformAdmin string = "platform_admin" // manages every ISP
+	RoleISPAdmin      string = "isp_admin"      // manages the ISP of the account
+	RoleISPSupport    string = "isp_support"    // supports the subscribers of the ISP of the account
+)
+
+// ISPScopePrefix - JWT scope of an account tied to an ISP, followed by the ISP ID
+const ISPScopePrefix string = "isp:"
+
 // Auth model - `auths` table
 type Auth struct {
 	AuthID      uint64         `gorm:"primaryKey" json:"authID,omitempty"`
@@ -47,6 +58,33 @@ type Auth struct {
 	EmailHash   string         `gorm:"index" json:"-"`
 	Password    string         `json:"password"`
 	VerifyEmail int8           `json:"-"`
+	Role        string         `gorm:"size:32" json:"-"`
+	ISPID       *int64         `gorm:"index" json:"-"` // nil for platform admins
+}
+
+// Scope returns the JWT scope of the account: the ISP it belongs to
+func (v Auth) Scope() string {
+	if v.ISPID == nil {
+		return ""
+	}
+	return ISPScope(*v.ISPID)
+}
+
+// ISPScope returns the JWT scope of the accounts of an ISP
+func ISPScope(ispID int64) string {
+	return ISPScopePrefix + strconv.FormatInt(ispID, 10)
+}
+
+// ParseISPScope returns the ISP ID of a JWT scope
+func ParseISPScope(scope string) (int64, bool) {
+	if !strings.HasPrefix(scope, ISPScopePrefix) {
+		return 0, false
+	}
+	ispID, err := strconv.ParseInt(strings.TrimPrefix(scope, ISPScopePrefix), 10, 64)
+	if err != nil || ispID <= 0 {
+		return 0, false
+	}
+	return ispID, true
 }
 
 // UnmarshalJSON ...
@@ -69,8 +69,8 @@ func Login(payload model.AuthPayload) (httpResponse model.HTTPResponse, httpStat
 	claims := middleware.MyCustomClaims{}
 	claims.AuthID = v.AuthID
 	// claims.Email
-	// claims.Role
-	// claims.Scope
+	claims.Role = v.Role
+	claims.Scope = v.Scope()
 	// claims.TwoFA
 	// claims.SiteLan
 	// claims.Custom1
@@ -151,6 +151,17 @@ func Refresh(claims middleware.MyCustomClaims) (httpResponse model.HTTPResponse,
 		return
 	}
 
+	// role and ISP may have changed since the last login
+	v, err := service.GetAuthByID(claims.AuthID)
+	if err != nil {
+		log.WithError(err).Error("error code: 1014.3")
+		httpResponse.Message = "internal server error"
+		httpStatusCode = http.StatusInternalServerError
+		return
+	}
+	claims.Role = v.Role
+	claims.Scope = v.Scope()
+
 	// issue new tokens
 	accessJWT, _, err := middleware.GetJWT(claims, "access")
 	if err != nil {
@@ -14,7 +14,8 @@ import (
 	"github.com/ortupik/wifigo/mikrotik"
 	"github.com/ortupik/wifigo/queue"
 	nconfig "github.com/ortupik/wifigo/server/config"
-	//migrate "github.com/ortupik/wifigo/server/database/migrate"
+	migrate "github.com/ortupik/wifigo/server/database/migrate"
+	"github.com/ortupik/wifigo/server/handler"
 	"github.com/ortupik/wifigo/server/router"
 	service "github.com/ortupik/wifigo/server/service"
 	"github.com/ortupik/wifigo/websocket"
@@ -49,6 +50,9 @@ func main() {
 		//handleError(migrate.MigrateRadiusModels(*configure), "Failed to run radius migrations")
 		handleError(migrate.Seed(), "Failed to run app seeders")
 		//handleError(migrate.SeedRadiusData(), "Failed to run radius seeders")*/
+
+		// Make the account in PLATFORM_ADMIN_EMAIL platform admin
+		handleError(migrate.SeedPlatformAdmin(), "Failed to seed the platform admin")
 	}
 
 	if gconfig.IsRedis() {
@@ -91,9 +95,26 @@ func main() {
 	// Initialize handlers for queues
 	MikrotikQueueHandler := queue.NewMikrotikQueueHandler(mikrotikService, wsHub)
 	databaseQueueHandler := queue.NewDatabaseQueueHandler(wsHub)
+	expiryQueueHandler := queue.NewExpiryQueueHandler(queueClient, wsHub)
+	dataCapQueueHandler := queue.NewDataCapQueueHandler(queueClient, wsHub)
+	mpesaStkHandler, err := handler.NewMpesaStkHandler()
+	handleError(err, "Failed to initialize M-Pesa")
+	mpesaStkHandler.UseAccountStore(store)
+	paymentProviders, err := handler.LoadPaymentProviders(mpesaStkHandler)
+	handleError(err, "Failed to initialize payment providers")
+	reconcileCallbacks := handler.NewMpesaCallbackHandler(queueClient, wsHub)
+	reconcileCallbacks.UseProviders(paymentProviders)
+	mpesaReconcileHandler := handler.NewMpesaReconcileHandler(mpesaStkHandler, reconcileCallbacks, wsHub)
+	mpesaReconcileHandler.UseProviders(paymentProviders)
+	mpesaRefundHandler := handler.NewMpesaRefundHandler(mpesaStkHandler, wsHub)
+	mpesaRefundHandler.UseProviders(paymentProviders)
 	handlers := &queue.Handlers{
-		MikrotikQueueHandler: *MikrotikQueueHandler,
-		DatabaseQueueHandler: *databaseQueueHandler,
+		MikrotikQueueHandler:  *MikrotikQueueHandler,
+		DatabaseQueueHandler:  *databaseQueueHandler,
+		ExpiryQueueHandler:    *expiryQueueHandler,
+		DataCapQueueHandler:   dataCapQueueHandler,
+		MpesaReconcileHandler: mpesaReconcileHandler,
+		MpesaRefundHandler:    mpesaRefundHandler,
 	}
 	// Initialize and start queue server in a goroutine
 	queueServer, err := queue.NewServer(redisAddr, mikrotikManager, wsHub, handlers) // Pass handlers
@@ -108,6 +129,31 @@ func main() {
 		}
 	}()
 
+	// Schedule periodic jobs
+	scheduler := queue.NewScheduler(redisAddr)
+	_, err = scheduler.RegisterExpiryScan()
+	handleError(err, "Failed to schedule subscription expiry scan")
+	_, err = scheduler.RegisterDataCapScan()
+	handleError(err, "Failed to schedule data cap scan")
+	_, err = scheduler.RegisterMpesaReconcile()
+	handleError(err, "Failed to schedule M-Pesa reconciliation")
+	if mpesaStkHandler.Config().AutoRefundAfter > 0 {
+		_, err = scheduler.RegisterMpesaAutoRefund()
+		handleError(err, "Failed to schedule M-Pesa automatic refunds")
+	}
+	handleError(scheduler.Start(), "Failed to start scheduler")
+
+	// Start the embedded RADIUS server when configured
+	radiusConfig, err := handler.LoadRadiusServerConfig()
+	handleError(err, "Failed to load RADIUS server configuration")
+	var radiusServer *service.RadiusServer
+	if radiusConfig != nil {
+		radiusHandler := service.NewRadiusHandler(service.RadiusDBStore{}, radiusConfig.DefaultSecret)
+		radiusServer, err = service.StartRadiusServer(*radiusConfig, radiusHandler)
+		handleError(err, "Failed to start RADIUS server")
+		log.Printf("RADIUS server listening on %s and %s", radiusServer.AuthAddr(), radiusServer.AcctAddr())
+	}
+
 	// Set up router with our dependencies
 	r, err := router.SetupRouter(configure, store, mikrotikManager, queueClient, wsHub)
 	handleError(err, "Failed to setup router")
@@ -136,6 +182,15 @@ func main() {
 	// Wait for connections to drain
 	log.Println("Shutting down server...")
 
+	// Stop scheduling periodic jobs
+	scheduler.Shutdown()
+
+	// Stop answering the NAS before the database goes away
+	if radiusServer != nil {
+		radiusServer.Shutdown()
+		log.Println("RADIUS server shut down successfully.")
+	}
+
 	// Close queue server gracefully
 	queueServer.GracefullyShutdown()
 	log.Println("Queue server shut down successfully.")
@@ -0,0 +1,119 @@
+package mikrotik
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState represents the state of a device circuit breaker
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // Calls flow normally
+	CircuitOpen     CircuitState = "open"      // Calls fail fast until the cooldown ends
+	CircuitHalfOpen CircuitState = "half-open" // One trial call is allowed through
+)
+
+const (
+	// DefaultFailureThreshold is the number of consecutive failures that opens the circuit
+	DefaultFailureThreshold = 5
+	// DefaultCircuitCooldown is how long an open circuit rejects calls
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+// circuitBreaker fails fast for a cooldown window after N consecutive failures
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// newCircuitBreaker creates a closed circuit breaker
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// allow reports whether a call may proceed, moving an expired open circuit to half-open
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.trial = true
+		return true
+	case CircuitHalfOpen:
+		// Only the single trial call goes through until it reports back
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success closes the circuit and resets the failure count
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = CircuitClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed call and opens the circuit once the threshold is reached
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon gives up a call that neither failed nor succeeded, letting a
+// half-open circuit make another trial call
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// snapshot returns the current state, consecutive failure count and when the circuit closes again
+func (b *circuitBreaker) snapshot() (CircuitState, int, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var retryAt time.Time
+	if b.state == CircuitOpen {
+		retryAt = b.openedAt.Add(b.cooldown)
+	}
+	return b.state, b.failures, retryAt
+}
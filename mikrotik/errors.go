@@ -0,0 +1,63 @@
+package mikrotik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by DevicePool so callers (e.g. queue handlers) can decide whether to retry
+var (
+	// ErrDeviceUnavailable means no connection to the device could be obtained
+	ErrDeviceUnavailable = errors.New("mikrotik device unavailable")
+	// ErrCircuitOpen means the device failed repeatedly and calls are being rejected until the cooldown ends
+	ErrCircuitOpen = errors.New("mikrotik circuit open")
+	// ErrTimeout means the call did not complete before its deadline
+	ErrTimeout = errors.New("mikrotik call timed out")
+	// ErrUnknownDevice means the manager has no device with the requested ID
+	ErrUnknownDevice = errors.New("unknown mikrotik device")
+)
+
+// CircuitOpenError is returned while a device's circuit breaker rejects calls.
+// It matches ErrCircuitOpen with errors.Is.
+type CircuitOpenError struct {
+	DeviceID string
+	RetryAt  time.Time // When the circuit lets a call through again, zero while a trial call is in flight
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.RetryAt.IsZero() {
+		return fmt.Sprintf("%s: device %s, trial call in flight", ErrCircuitOpen, e.DeviceID)
+	}
+	return fmt.Sprintf("%s: device %s, retry after %s", ErrCircuitOpen, e.DeviceID, e.RetryAt.Format(time.RFC3339))
+}
+
+// Is makes the error match ErrCircuitOpen
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// RetryAfter returns how long until the circuit lets a call through again,
+// zero when it may already have
+func (e *CircuitOpenError) RetryAfter() time.Duration {
+	if d := time.Until(e.RetryAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// IsRetryable reports whether an error from the pool is transient and worth retrying
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrDeviceUnavailable) ||
+		errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrTimeout)
+}
+
+// contextError maps a finished context to the pool's typed errors
+func contextError(ctx context.Context, deviceID string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: device %s: %w", ErrTimeout, deviceID, ctx.Err())
+	}
+	return fmt.Errorf("device %s: %w", deviceID, ctx.Err())
+}
@@ -0,0 +1,6 @@
+package mikrotik
+
+// CheckHealth runs one round of the background health checker
+func (p *DevicePool) CheckHealth() {
+	p.checkHealth()
+}
@@ -0,0 +1,239 @@
+package mikrotik
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+)
+
+// DeviceState represents the health of a MikroTik device pool
+type DeviceState string
+
+const (
+	StateHealthy  DeviceState = "healthy"  // All pooled connections answer pings
+	StateDegraded DeviceState = "degraded" // Some connections are missing or failing
+	StateDown     DeviceState = "down"     // No usable connection to the device
+)
+
+const (
+	// DefaultHealthCheckInterval is how often pooled connections are pinged
+	DefaultHealthCheckInterval = 30 * time.Second
+	// DefaultPingTimeout bounds a single health ping
+	DefaultPingTimeout = 5 * time.Second
+
+	minRedialBackoff = 1 * time.Second
+	maxRedialBackoff = 2 * time.Minute
+
+	// pingCommand is cheap on every RouterOS version and needs no extra policy
+	pingCommand = "/system/identity/print"
+)
+
+var errPingTimeout = errors.New("health ping timed out")
+
+// DeviceHealth is a snapshot of a device pool's health
+type DeviceHealth struct {
+	DeviceID    string      `json:"device_id"`
+	ISPID       string      `json:"isp_id,omitempty"`
+	State       DeviceState `json:"state"`
+	PoolSize    int         `json:"pool_size"`
+	Idle        int         `json:"idle"`
+	InUse       int         `json:"in_use"`
+	LastError   string      `json:"last_error,omitempty"`
+	LastErrorAt time.Time   `json:"last_error_at,omitempty"`
+	LastSuccess time.Time   `json:"last_success,omitempty"`
+	LastCheck   time.Time   `json:"last_check,omitempty"`
+	NextRedial  time.Time   `json:"next_redial,omitempty"`
+
+	Circuit             CircuitState `json:"circuit"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	CircuitRetryAt      time.Time    `json:"circuit_retry_at,omitempty"`
+}
+
+// Health returns a snapshot of the pool's current health
+func (p *DevicePool) Health() DeviceHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.health
+	h.DeviceID = p.config.ID
+	h.ISPID = p.config.ISPID
+	h.PoolSize = p.config.PoolSize
+	h.Idle = len(p.clients)
+	h.InUse = p.inUse
+	h.NextRedial = p.nextRedial
+	h.Circuit, h.ConsecutiveFailures, h.CircuitRetryAt = p.breaker.snapshot()
+	return h
+}
+
+// startHealthCheck runs the background health checker until the pool is closed
+func (p *DevicePool) startHealthCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.checkHealth()
+			}
+		}
+	}()
+}
+
+// checkHealth pings every idle connection, evicts broken ones and refills the pool
+func (p *DevicePool) checkHealth() {
+	idle := len(p.clients)
+	for i := 0; i < idle; i++ {
+		var client *routeros.Client
+		select {
+		case client = <-p.clients:
+		default:
+			// Execute took the remaining clients while we were checking
+		}
+		if client == nil {
+			break
+		}
+
+		if err := pingClient(client, DefaultPingTimeout); err != nil {
+			log.Printf("mikrotik: evicting broken connection to %s: %v", p.config.ID, err)
+			client.Close()
+			p.recordFailure(err)
+			continue
+		}
+
+		p.recordSuccess()
+		p.breaker.success()
+		p.putIdle(client)
+	}
+
+	p.refill()
+
+	p.mu.Lock()
+	p.health.LastCheck = time.Now()
+	p.updateState()
+	p.mu.Unlock()
+}
+
+// refill redials missing connections, backing off exponentially while the device stays unreachable
+func (p *DevicePool) refill() {
+	p.mu.Lock()
+	missing := p.config.PoolSize - len(p.clients) - p.inUse
+	waiting := time.Now().Before(p.nextRedial)
+	p.mu.Unlock()
+
+	if missing <= 0 || waiting {
+		return
+	}
+
+	for i := 0; i < missing; i++ {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		client, err := p.dial()
+		if err != nil {
+			p.mu.Lock()
+			if p.backoff == 0 {
+				p.backoff = minRedialBackoff
+			} else {
+				p.backoff *= 2
+				if p.backoff > maxRedialBackoff {
+					p.backoff = maxRedialBackoff
+				}
+			}
+			p.nextRedial = time.Now().Add(p.backoff)
+			p.mu.Unlock()
+
+			log.Printf("mikrotik: redial of %s failed, next attempt in %s: %v", p.config.ID, p.backoff, err)
+			p.recordFailure(err)
+			return
+		}
+
+		p.mu.Lock()
+		p.backoff = 0
+		p.nextRedial = time.Time{}
+		p.mu.Unlock()
+
+		p.recordSuccess()
+		p.breaker.success()
+		p.putIdle(client)
+	}
+}
+
+// putIdle puts a healthy client back into the idle channel, closing it if the pool is full
+func (p *DevicePool) putIdle(client *routeros.Client) {
+	select {
+	case p.clients <- client:
+	default:
+		client.Close()
+	}
+}
+
+// recordSuccess marks the device as reachable
+func (p *DevicePool) recordSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.health.LastSuccess = time.Now()
+	p.updateState()
+}
+
+// recordFailure stores the last error seen on the device
+func (p *DevicePool) recordFailure(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.health.LastError = err.Error()
+	p.health.LastErrorAt = time.Now()
+	p.updateState()
+}
+
+// updateState derives the device state from the pool occupancy; p.mu must be held
+func (p *DevicePool) updateState() {
+	available := len(p.clients) + p.inUse
+	switch {
+	case available == 0:
+		p.health.State = StateDown
+	case available < p.config.PoolSize || p.health.LastErrorAt.After(p.health.LastSuccess):
+		p.health.State = StateDegraded
+	default:
+		p.health.State = StateHealthy
+	}
+}
+
+// pingClient runs a cheap command on the client and closes it if no answer arrives in time
+func pingClient(client *routeros.Client, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Run(pingCommand)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		// Closing the connection unblocks the pending read
+		client.Close()
+		return errPingTimeout
+	}
+}
+
+// isConnectionError reports whether err means the connection itself is unusable,
+// as opposed to a !trap reply from a healthy router
+func isConnectionError(err error) bool {
+	var deviceErr *routeros.DeviceError
+	return err != nil && !errors.As(err, &deviceErr)
+}
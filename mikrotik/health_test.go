@@ -0,0 +1,82 @@
+package mikrotik_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+)
+
+func newHealthPool(t *testing.T, srv *routerostest.Server) *mikrotik.DevicePool {
+	t.Helper()
+	manager := mikrotik.NewManager()
+	t.Cleanup(manager.Close)
+
+	cfg := srv.DeviceConfig("router1")
+	cfg.PoolSize = 2
+	if err := manager.AddDevice(cfg); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+	pool, err := manager.GetDevice("router1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if h := pool.Health(); h.State != mikrotik.StateHealthy || h.Idle != 2 {
+		t.Fatalf("health of a new pool = %+v, want healthy with 2 idle clients", h)
+	}
+	return pool
+}
+
+func TestHealthCheckReplacesDroppedConnections(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	pool := newHealthPool(t, srv)
+
+	srv.DropConnections()
+	pool.CheckHealth()
+
+	h := pool.Health()
+	if h.State != mikrotik.StateHealthy || h.Idle != 2 || h.LastCheck.IsZero() {
+		t.Errorf("health after a reboot = %+v, want healthy with 2 idle clients", h)
+	}
+	if h.LastError == "" {
+		t.Error("the broken connections were not recorded")
+	}
+	if got := srv.Logins(); got != 4 {
+		t.Errorf("logins = %d, want the 2 broken connections redialled (4)", got)
+	}
+}
+
+func TestHealthCheckBacksOffUntilTheDeviceIsBack(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	pool := newHealthPool(t, srv)
+
+	srv.RefuseLogins(true)
+	srv.DropConnections()
+	pool.CheckHealth()
+
+	h := pool.Health()
+	if h.State != mikrotik.StateDown || h.Idle != 0 {
+		t.Fatalf("health while down = %+v, want down with no idle clients", h)
+	}
+	if h.NextRedial.IsZero() || !h.NextRedial.After(time.Now()) {
+		t.Fatalf("NextRedial = %v, want a redial scheduled after a backoff", h.NextRedial)
+	}
+
+	// Back online, but the pool waits out the backoff before redialling
+	srv.RefuseLogins(false)
+	pool.CheckHealth()
+	if got := srv.Logins(); got != 2 {
+		t.Errorf("logins during the backoff = %d, want none after the first 2", got)
+	}
+
+	time.Sleep(time.Until(h.NextRedial) + 10*time.Millisecond)
+	pool.CheckHealth()
+
+	h = pool.Health()
+	if h.State != mikrotik.StateHealthy || h.Idle != 2 || !h.NextRedial.IsZero() {
+		t.Errorf("health after the backoff = %+v, want healthy with 2 idle clients and no redial pending", h)
+	}
+}
@@ -0,0 +1,205 @@
+package hotspot
+
+import (
+	"context"
+	"fmt"
+)
+
+// BindingType is the type of a hotspot IP binding
+type BindingType string
+
+const (
+	BindingRegular  BindingType = "regular"
+	BindingBypassed BindingType = "bypassed"
+	BindingBlocked  BindingType = "blocked"
+)
+
+// IPBinding is an entry of /ip/hotspot/ip-binding
+type IPBinding struct {
+	ID         string
+	MACAddress string
+	Address    string
+	ToAddress  string
+	Server     string
+	Type       BindingType
+	Comment    string
+	Disabled   bool
+}
+
+func ipBindingFromMap(m map[string]string) (IPBinding, error) {
+	r := record{m: m}
+	b := IPBinding{
+		ID:         r.str(".id"),
+		MACAddress: r.str("mac-address"),
+		Address:    r.str("address"),
+		ToAddress:  r.str("to-address"),
+		Server:     r.str("server"),
+		Type:       BindingType(r.str("type")),
+		Comment:    r.str("comment"),
+		Disabled:   r.boolean("disabled"),
+	}
+	return b, r.err
+}
+
+// ListIPBindings returns the IP bindings matching q
+func (c *Client) ListIPBindings(ctx context.Context, q *Query) ([]IPBinding, error) {
+	rows, err := c.print(ctx, pathIPBinding, q)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]IPBinding, 0, len(rows))
+	for _, row := range rows {
+		b, err := ipBindingFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hotspot ip-binding %s: %w", row[".id"], err)
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// AddIPBinding creates an IP binding and returns its ".id"
+func (c *Client) AddIPBinding(ctx context.Context, b IPBinding) (string, error) {
+	if b.MACAddress == "" && b.Address == "" {
+		return "", fmt.Errorf("hotspot ip-binding needs a MAC address or an address")
+	}
+
+	var a attrs
+	a.str("mac-address", b.MACAddress)
+	a.str("address", b.Address)
+	a.str("to-address", b.ToAddress)
+	a.str("server", b.Server)
+	a.str("type", string(b.Type))
+	a.str("comment", b.Comment)
+	return c.add(ctx, pathIPBinding, a)
+}
+
+// RemoveIPBindings removes IP bindings by ".id"
+func (c *Client) RemoveIPBindings(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathIPBinding, ids...)
+}
+
+// WalledGardenEntry is an entry of /ip/hotspot/walled-garden
+type WalledGardenEntry struct {
+	ID         string
+	Server     string
+	DstHost    string
+	DstPort    string
+	Path       string
+	Method     string
+	Action     string
+	SrcAddress string
+	DstAddress string
+	Comment    string
+	Hits       int64
+	Disabled   bool
+}
+
+func walledGardenFromMap(m map[string]string) (WalledGardenEntry, error) {
+	r := record{m: m}
+	w := WalledGardenEntry{
+		ID:         r.str(".id"),
+		Server:     r.str("server"),
+		DstHost:    r.str("dst-host"),
+		DstPort:    r.str("dst-port"),
+		Path:       r.str("path"),
+		Method:     r.str("method"),
+		Action:     r.str("action"),
+		SrcAddress: r.str("src-address"),
+		DstAddress: r.str("dst-address"),
+		Comment:    r.str("comment"),
+		Hits:       r.bytes("hits"),
+		Disabled:   r.boolean("disabled"),
+	}
+	return w, r.err
+}
+
+// ListWalledGarden returns the walled-garden entries matching q
+func (c *Client) ListWalledGarden(ctx context.Context, q *Query) ([]WalledGardenEntry, error) {
+	rows, err := c.print(ctx, pathWalledGarden, q)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]WalledGardenEntry, 0, len(rows))
+	for _, row := range rows {
+		w, err := walledGardenFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse walled-garden entry %s: %w", row[".id"], err)
+		}
+		entries = append(entries, w)
+	}
+	return entries, nil
+}
+
+// AddWalledGarden creates a walled-garden entry and returns its ".id"
+func (c *Client) AddWalledGarden(ctx context.Context, w WalledGardenEntry) (string, error) {
+	var a attrs
+	a.str("server", w.Server)
+	a.str("dst-host", w.DstHost)
+	a.str("dst-port", w.DstPort)
+	a.str("path", w.Path)
+	a.str("method", w.Method)
+	a.str("action", w.Action)
+	a.str("src-address", w.SrcAddress)
+	a.str("dst-address", w.DstAddress)
+	a.str("comment", w.Comment)
+	return c.add(ctx, pathWalledGarden, a)
+}
+
+// RemoveWalledGarden removes walled-garden entries by ".id"
+func (c *Client) RemoveWalledGarden(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathWalledGarden, ids...)
+}
+
+// Cookie is an entry of /ip/hotspot/cookie: a remembered login
+type Cookie struct {
+	ID         string
+	User       string
+	Domain     string
+	MACAddress string
+	ExpiresIn  Duration
+	MACCookie  bool
+}
+
+func cookieFromMap(m map[string]string) (Cookie, error) {
+	r := record{m: m}
+	ck := Cookie{
+		ID:         r.str(".id"),
+		User:       r.str("user"),
+		Domain:     r.str("domain"),
+		MACAddress: r.str("mac-address"),
+		ExpiresIn:  r.duration("expires-in"),
+		MACCookie:  r.boolean("mac-cookie"),
+	}
+	return ck, r.err
+}
+
+// ListCookies returns the hotspot cookies matching q
+func (c *Client) ListCookies(ctx context.Context, q *Query) ([]Cookie, error) {
+	rows, err := c.print(ctx, pathCookie, q)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies := make([]Cookie, 0, len(rows))
+	for _, row := range rows {
+		ck, err := cookieFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hotspot cookie %s: %w", row[".id"], err)
+		}
+		cookies = append(cookies, ck)
+	}
+	return cookies, nil
+}
+
+// FindCookiesByUser returns the cookies remembered for a hotspot user
+func (c *Client) FindCookiesByUser(ctx context.Context, user string) ([]Cookie, error) {
+	return c.ListCookies(ctx, NewQuery().Eq("user", user))
+}
+
+// RemoveCookies removes hotspot cookies by ".id" so the user must log in again
+func (c *Client) RemoveCookies(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathCookie, ids...)
+}
@@ -0,0 +1,90 @@
+// Package hotspot is a typed client for the RouterOS /ip/hotspot API.
+//
+// It sits on top of a mikrotik.DevicePool and turns raw API sentences and
+// map[string]string replies into Go structs.
+package hotspot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-routeros/routeros/v3"
+)
+
+// RouterOS menu paths used by this package
+const (
+	pathHost         = "/ip/hotspot/host"
+	pathActive       = "/ip/hotspot/active"
+	pathUser         = "/ip/hotspot/user"
+	pathUserProfile  = "/ip/hotspot/user/profile"
+	pathIPBinding    = "/ip/hotspot/ip-binding"
+	pathWalledGarden = "/ip/hotspot/walled-garden"
+	pathCookie       = "/ip/hotspot/cookie"
+)
+
+// Runner executes a RouterOS command; *mikrotik.DevicePool implements it
+type Runner interface {
+	RunContext(ctx context.Context, command string, args ...string) (*routeros.Reply, error)
+}
+
+// Client is a typed hotspot API client for a single device
+type Client struct {
+	pool Runner
+}
+
+// NewClient creates a hotspot client on top of a device pool
+func NewClient(pool Runner) *Client {
+	return &Client{pool: pool}
+}
+
+// print runs "<path>/print" with the given query and returns the raw rows
+func (c *Client) print(ctx context.Context, path string, q *Query) ([]map[string]string, error) {
+	reply, err := c.pool.RunContext(ctx, path+"/print", q.Words()...)
+	if err != nil {
+		return nil, fmt.Errorf("%s/print failed: %w", path, err)
+	}
+
+	rows := make([]map[string]string, 0, len(reply.Re))
+	for _, re := range reply.Re {
+		rows = append(rows, re.Map)
+	}
+	return rows, nil
+}
+
+// add runs "<path>/add" and returns the ".id" of the new entry
+func (c *Client) add(ctx context.Context, path string, args []string) (string, error) {
+	reply, err := c.pool.RunContext(ctx, path+"/add", args...)
+	if err != nil {
+		return "", fmt.Errorf("%s/add failed: %w", path, err)
+	}
+
+	if reply.Done != nil {
+		return reply.Done.Map["ret"], nil
+	}
+	return "", nil
+}
+
+// set runs "<path>/set" on the entry with the given ".id"
+func (c *Client) set(ctx context.Context, path, id string, args []string) error {
+	if id == "" {
+		return fmt.Errorf("%s/set: empty id", path)
+	}
+
+	args = append([]string{"=.id=" + id}, args...)
+	if _, err := c.pool.RunContext(ctx, path+"/set", args...); err != nil {
+		return fmt.Errorf("%s/set failed: %w", path, err)
+	}
+	return nil
+}
+
+// remove runs "<path>/remove" on the entries with the given ".id"s
+func (c *Client) remove(ctx context.Context, path string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := c.pool.RunContext(ctx, path+"/remove", "=.id="+joinIDs(ids)); err != nil {
+		return fmt.Errorf("%s/remove failed: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package hotspot_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/go-routeros/routeros/v3/proto"
+
+	"github.com/ortupik/wifigo/mikrotik/hotspot"
+)
+
+// fakeRunner records the commands run and answers them with reply
+type fakeRunner struct {
+	command string
+	args    []string
+	reply   *routeros.Reply
+	err     error
+}
+
+func (f *fakeRunner) RunContext(_ context.Context, command string, args ...string) (*routeros.Reply, error) {
+	f.command = command
+	f.args = args
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.reply == nil {
+		return &routeros.Reply{Done: &proto.Sentence{Word: "!done", Map: map[string]string{}}}, nil
+	}
+	return f.reply, nil
+}
+
+func TestClientCommands(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		call    func(c *hotspot.Client) error
+		command string
+		args    []string
+	}{
+		{
+			name:    "find active by user",
+			call:    func(c *hotspot.Client) error { _, err := c.FindActiveByUser(ctx, "0712345678@tecsurf"); return err },
+			command: "/ip/hotspot/active/print",
+			args:    []string{"?user=0712345678@tecsurf"},
+		},
+		{
+			name:    "list active without a query",
+			call:    func(c *hotspot.Client) error { _, err := c.ListActive(ctx, nil); return err },
+			command: "/ip/hotspot/active/print",
+		},
+		{
+			name: "login",
+			call: func(c *hotspot.Client) error {
+				return c.Login(ctx, hotspot.LoginRequest{IP: "10.5.50.2", User: "0712345678", Password: "secret", MACAddress: "AA:BB:CC:DD:EE:FF"})
+			},
+			command: "/ip/hotspot/active/login",
+			args:    []string{"=ip=10.5.50.2", "=user=0712345678", "=password=secret", "=mac-address=AA:BB:CC:DD:EE:FF"},
+		},
+		{
+			name:    "logout",
+			call:    func(c *hotspot.Client) error { return c.Logout(ctx, "*1", "*2") },
+			command: "/ip/hotspot/active/remove",
+			args:    []string{"=.id=*1,*2"},
+		},
+		{
+			name: "update user",
+			call: func(c *hotspot.Client) error {
+				return c.UpdateUser(ctx, "*3", hotspot.User{Profile: "daily", LimitUptime: hotspot.Duration(24 * time.Hour)})
+			},
+			command: "/ip/hotspot/user/set",
+			args:    []string{"=.id=*3", "=profile=daily", "=limit-uptime=1d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			if err := tt.call(hotspot.NewClient(runner)); err != nil {
+				t.Fatal(err)
+			}
+			if runner.command != tt.command || !reflect.DeepEqual(runner.args, tt.args) {
+				t.Errorf("ran %s %q, want %s %q", runner.command, runner.args, tt.command, tt.args)
+			}
+		})
+	}
+}
+
+func TestClientParsesReplies(t *testing.T) {
+	runner := &fakeRunner{reply: &routeros.Reply{
+		Re: []*proto.Sentence{{Word: "!re", Map: map[string]string{
+			".id":       "*A",
+			"user":      "0712345678",
+			"address":   "10.5.50.2",
+			"uptime":    "1h2m3s",
+			"bytes-in":  "2048",
+			"bytes-out": "4096",
+			"radius":    "true",
+		}}},
+		Done: &proto.Sentence{Word: "!done"},
+	}}
+	c := hotspot.NewClient(runner)
+
+	sessions, err := c.FindActiveByUser(context.Background(), "0712345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hotspot.ActiveSession{
+		ID:       "*A",
+		User:     "0712345678",
+		Address:  "10.5.50.2",
+		Uptime:   hotspot.Duration(time.Hour + 2*time.Minute + 3*time.Second),
+		BytesIn:  2048,
+		BytesOut: 4096,
+		Radius:   true,
+	}
+	if len(sessions) != 1 || sessions[0] != want {
+		t.Fatalf("FindActiveByUser() = %+v, want [%+v]", sessions, want)
+	}
+
+	runner.reply.Re[0].Map["bytes-in"] = "lots"
+	if _, err := c.FindActiveByUser(context.Background(), "0712345678"); err == nil {
+		t.Error("FindActiveByUser() parsed a bad counter without an error")
+	}
+}
+
+func TestClientAddReturnsID(t *testing.T) {
+	runner := &fakeRunner{reply: &routeros.Reply{Done: &proto.Sentence{Word: "!done", Map: map[string]string{"ret": "*1F"}}}}
+	id, err := hotspot.NewClient(runner).AddUser(context.Background(), hotspot.User{Name: "0712345678", Password: "secret"})
+	if err != nil || id != "*1F" {
+		t.Fatalf("AddUser() = %q, %v, want *1F", id, err)
+	}
+	if want := []string{"=name=0712345678", "=password=secret"}; !reflect.DeepEqual(runner.args, want) {
+		t.Errorf("AddUser() sent %q, want %q", runner.args, want)
+	}
+}
+
+func TestClientRejects(t *testing.T) {
+	ctx := context.Background()
+	failed := errors.New("connection reset")
+	tests := []struct {
+		name   string
+		runner *fakeRunner
+		call   func(c *hotspot.Client) error
+		ran    bool
+	}{
+		{name: "login without ip", runner: &fakeRunner{}, call: func(c *hotspot.Client) error { return c.Login(ctx, hotspot.LoginRequest{User: "a"}) }},
+		{name: "login without user", runner: &fakeRunner{}, call: func(c *hotspot.Client) error { return c.Login(ctx, hotspot.LoginRequest{IP: "10.5.50.2"}) }},
+		{name: "add user without name", runner: &fakeRunner{}, call: func(c *hotspot.Client) error { _, err := c.AddUser(ctx, hotspot.User{}); return err }},
+		{name: "set without id", runner: &fakeRunner{}, call: func(c *hotspot.Client) error { return c.UpdateUser(ctx, "", hotspot.User{}) }},
+		{name: "runner error", runner: &fakeRunner{err: failed}, call: func(c *hotspot.Client) error { _, err := c.ListUsers(ctx, nil); return err }, ran: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call(hotspot.NewClient(tt.runner))
+			if err == nil {
+				t.Fatal("want an error")
+			}
+			if tt.ran != (tt.runner.command != "") {
+				t.Errorf("ran %q, want ran = %v", tt.runner.command, tt.ran)
+			}
+			if tt.runner.err != nil && !errors.Is(err, tt.runner.err) {
+				t.Errorf("error = %v, want it to wrap %v", err, tt.runner.err)
+			}
+		})
+	}
+
+	runner := &fakeRunner{}
+	if err := hotspot.NewClient(runner).Logout(ctx); err != nil || runner.command != "" {
+		t.Errorf("Logout() with no ids ran %q, %v, want nothing", runner.command, err)
+	}
+}
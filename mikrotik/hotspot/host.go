@@ -0,0 +1,91 @@
+package hotspot
+
+import (
+	"context"
+	"fmt"
+)
+
+// Host is an entry of /ip/hotspot/host: a device seen on a hotspot interface
+type Host struct {
+	ID         string
+	MACAddress string
+	Address    string
+	ToAddress  string
+	Server     string
+	FoundBy    string
+	Comment    string
+	Uptime     Duration
+	IdleTime   Duration
+	BytesIn    int64
+	BytesOut   int64
+	PacketsIn  int64
+	PacketsOut int64
+	Authorized bool
+	Bypassed   bool
+	DHCP       bool
+	Dynamic    bool
+}
+
+func hostFromMap(m map[string]string) (Host, error) {
+	r := record{m: m}
+	h := Host{
+		ID:         r.str(".id"),
+		MACAddress: r.str("mac-address"),
+		Address:    r.str("address"),
+		ToAddress:  r.str("to-address"),
+		Server:     r.str("server"),
+		FoundBy:    r.str("found-by"),
+		Comment:    r.str("comment"),
+		Uptime:     r.duration("uptime"),
+		IdleTime:   r.duration("idle-time"),
+		BytesIn:    r.bytes("bytes-in"),
+		BytesOut:   r.bytes("bytes-out"),
+		PacketsIn:  r.bytes("packets-in"),
+		PacketsOut: r.bytes("packets-out"),
+		Authorized: r.boolean("authorized"),
+		Bypassed:   r.boolean("bypassed"),
+		DHCP:       r.boolean("DHCP"),
+		Dynamic:    r.boolean("dynamic"),
+	}
+	return h, r.err
+}
+
+// ListHosts returns the hotspot hosts matching q
+func (c *Client) ListHosts(ctx context.Context, q *Query) ([]Host, error) {
+	rows, err := c.print(ctx, pathHost, q)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]Host, 0, len(rows))
+	for _, row := range rows {
+		h, err := hostFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hotspot host %s: %w", row[".id"], err)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// FindHostByAddress returns the host with the given IP address, or nil if there is none
+func (c *Client) FindHostByAddress(ctx context.Context, address string) (*Host, error) {
+	return firstHost(c.ListHosts(ctx, NewQuery().Eq("address", address)))
+}
+
+// FindHostByMAC returns the host with the given MAC address, or nil if there is none
+func (c *Client) FindHostByMAC(ctx context.Context, mac string) (*Host, error) {
+	return firstHost(c.ListHosts(ctx, NewQuery().Eq("mac-address", mac)))
+}
+
+// RemoveHosts removes hosts by ".id", dropping them from the hotspot until they are seen again
+func (c *Client) RemoveHosts(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathHost, ids...)
+}
+
+func firstHost(hosts []Host, err error) (*Host, error) {
+	if err != nil || len(hosts) == 0 {
+		return nil, err
+	}
+	return &hosts[0], nil
+}
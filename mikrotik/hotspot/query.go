@@ -0,0 +1,117 @@
+package hotspot
+
+import "strings"
+
+// Query builds RouterOS API query words for print commands.
+//
+// Conditions are pushed onto a stack and combined in reverse polish notation,
+// so NewQuery().Eq("user", "a").Eq("user", "b").Or() matches either user.
+// A nil *Query matches every entry.
+type Query struct {
+	words    []string
+	proplist []string
+}
+
+// NewQuery creates an empty query
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// Eq matches entries whose key equals value
+func (q *Query) Eq(key, value string) *Query {
+	q.words = append(q.words, "?"+key+"="+value)
+	return q
+}
+
+// Lt matches entries whose key is less than value
+func (q *Query) Lt(key, value string) *Query {
+	q.words = append(q.words, "?<"+key+"="+value)
+	return q
+}
+
+// Gt matches entries whose key is greater than value
+func (q *Query) Gt(key, value string) *Query {
+	q.words = append(q.words, "?>"+key+"="+value)
+	return q
+}
+
+// Has matches entries that have key set
+func (q *Query) Has(key string) *Query {
+	q.words = append(q.words, "?"+key)
+	return q
+}
+
+// Missing matches entries that do not have key set
+func (q *Query) Missing(key string) *Query {
+	q.words = append(q.words, "?-"+key)
+	return q
+}
+
+// Not negates the top condition on the stack
+func (q *Query) Not() *Query {
+	q.words = append(q.words, "?#!")
+	return q
+}
+
+// And combines the top two conditions on the stack with a logical and
+func (q *Query) And() *Query {
+	q.words = append(q.words, "?#&")
+	return q
+}
+
+// Or combines the top two conditions on the stack with a logical or
+func (q *Query) Or() *Query {
+	q.words = append(q.words, "?#|")
+	return q
+}
+
+// Proplist limits the returned properties to the given keys
+func (q *Query) Proplist(keys ...string) *Query {
+	q.proplist = append(q.proplist, keys...)
+	return q
+}
+
+// Words returns the API words for the query
+func (q *Query) Words() []string {
+	if q == nil {
+		return nil
+	}
+
+	words := make([]string, 0, len(q.words)+1)
+	if len(q.proplist) > 0 {
+		words = append(words, "=.proplist="+strings.Join(q.proplist, ","))
+	}
+	return append(words, q.words...)
+}
+
+// attrs collects "=key=value" words for add and set commands, skipping empty values
+type attrs []string
+
+func (a *attrs) str(key, value string) {
+	if value != "" {
+		*a = append(*a, "="+key+"="+value)
+	}
+}
+
+func (a *attrs) duration(key string, value Duration) {
+	if value > 0 {
+		*a = append(*a, "="+key+"="+value.String())
+	}
+}
+
+func (a *attrs) bytes(key string, value int64) {
+	if value > 0 {
+		*a = append(*a, "="+key+"="+formatInt(value))
+	}
+}
+
+func (a *attrs) integer(key string, value int) {
+	if value > 0 {
+		*a = append(*a, "="+key+"="+formatInt(int64(value)))
+	}
+}
+
+// joinIDs joins several ".id"s the way RouterOS expects for multi-item commands
+func joinIDs(ids []string) string {
+	return strings.Join(ids, ",")
+}
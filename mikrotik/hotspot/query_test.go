@@ -0,0 +1,33 @@
+package hotspot_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ortupik/wifigo/mikrotik/hotspot"
+)
+
+func TestQueryWords(t *testing.T) {
+	var none *hotspot.Query
+	tests := []struct {
+		name  string
+		query *hotspot.Query
+		want  []string
+	}{
+		{name: "nil", query: none, want: nil},
+		{name: "empty", query: hotspot.NewQuery(), want: []string{}},
+		{name: "eq", query: hotspot.NewQuery().Eq("user", "0712345678"), want: []string{"?user=0712345678"}},
+		{name: "lt and gt", query: hotspot.NewQuery().Gt("bytes-in", "100").Lt("bytes-in", "200").And(), want: []string{"?>bytes-in=100", "?<bytes-in=200", "?#&"}},
+		{name: "or", query: hotspot.NewQuery().Eq("user", "a").Eq("user", "b").Or(), want: []string{"?user=a", "?user=b", "?#|"}},
+		{name: "has and missing", query: hotspot.NewQuery().Has("comment").Missing("mac-address"), want: []string{"?comment", "?-mac-address"}},
+		{name: "not", query: hotspot.NewQuery().Eq("blocked", "true").Not(), want: []string{"?blocked=true", "?#!"}},
+		{name: "proplist first", query: hotspot.NewQuery().Eq("user", "a").Proplist(".id", "user").Proplist("address"), want: []string{"=.proplist=.id,user,address", "?user=a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.Words(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Words() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package hotspot
+
+import (
+	"context"
+	"fmt"
+)
+
+// User is an entry of /ip/hotspot/user: a local hotspot account
+type User struct {
+	ID              string
+	Server          string
+	Name            string
+	Password        string
+	Address         string
+	MACAddress      string
+	Profile         string
+	Email           string
+	Comment         string
+	LimitUptime     Duration
+	LimitBytesIn    int64
+	LimitBytesOut   int64
+	LimitBytesTotal int64
+	Uptime          Duration
+	BytesIn         int64
+	BytesOut        int64
+	Disabled        bool
+	Dynamic         bool
+}
+
+func userFromMap(m map[string]string) (User, error) {
+	r := record{m: m}
+	u := User{
+		ID:              r.str(".id"),
+		Server:          r.str("server"),
+		Name:            r.str("name"),
+		Password:        r.str("password"),
+		Address:         r.str("address"),
+		MACAddress:      r.str("mac-address"),
+		Profile:         r.str("profile"),
+		Email:           r.str("email"),
+		Comment:         r.str("comment"),
+		LimitUptime:     r.duration("limit-uptime"),
+		LimitBytesIn:    r.bytes("limit-bytes-in"),
+		LimitBytesOut:   r.bytes("limit-bytes-out"),
+		LimitBytesTotal: r.bytes("limit-bytes-total"),
+		Uptime:          r.duration("uptime"),
+		BytesIn:         r.bytes("bytes-in"),
+		BytesOut:        r.bytes("bytes-out"),
+		Disabled:        r.boolean("disabled"),
+		Dynamic:         r.boolean("dynamic"),
+	}
+	return u, r.err
+}
+
+func (u User) attrs() attrs {
+	var a attrs
+	a.str("server", u.Server)
+	a.str("name", u.Name)
+	a.str("password", u.Password)
+	a.str("address", u.Address)
+	a.str("mac-address", u.MACAddress)
+	a.str("profile", u.Profile)
+	a.str("email", u.Email)
+	a.str("comment", u.Comment)
+	a.duration("limit-uptime", u.LimitUptime)
+	a.bytes("limit-bytes-in", u.LimitBytesIn)
+	a.bytes("limit-bytes-out", u.LimitBytesOut)
+	a.bytes("limit-bytes-total", u.LimitBytesTotal)
+	if u.Disabled {
+		a.str("disabled", formatBool(true))
+	}
+	return a
+}
+
+// ListUsers returns the hotspot users matching q
+func (c *Client) ListUsers(ctx context.Context, q *Query) ([]User, error) {
+	rows, err := c.print(ctx, pathUser, q)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(rows))
+	for _, row := range rows {
+		u, err := userFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hotspot user %s: %w", row[".id"], err)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// FindUser returns the hotspot user with the given name, or nil if there is none
+func (c *Client) FindUser(ctx context.Context, name string) (*User, error) {
+	users, err := c.ListUsers(ctx, NewQuery().Eq("name", name))
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// AddUser creates a hotspot user and returns its ".id"
+func (c *Client) AddUser(ctx context.Context, u User) (string, error) {
+	if u.Name == "" {
+		return "", fmt.Errorf("hotspot user name is empty")
+	}
+	return c.add(ctx, pathUser, u.attrs())
+}
+
+// UpdateUser overwrites the non-empty fields of the user with the given ".id"
+func (c *Client) UpdateUser(ctx context.Context, id string, u User) error {
+	return c.set(ctx, pathUser, id, u.attrs())
+}
+
+// RemoveUsers removes hotspot users by ".id"
+func (c *Client) RemoveUsers(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathUser, ids...)
+}
+
+// UserProfile is an entry of /ip/hotspot/user/profile
+type UserProfile struct {
+	ID               string
+	Name             string
+	AddressPool      string
+	RateLimit        string
+	SharedUsers      int
+	SessionTimeout   Duration
+	IdleTimeout      Duration
+	KeepaliveTimeout Duration
+	MACCookieTimeout Duration
+	AddMACCookie     bool
+	Default          bool
+}
+
+func userProfileFromMap(m map[string]string) (UserProfile, error) {
+	r := record{m: m}
+	p := UserProfile{
+		ID:               r.str(".id"),
+		Name:             r.str("name"),
+		AddressPool:      r.str("address-pool"),
+		RateLimit:        r.str("rate-limit"),
+		SharedUsers:      r.integer("shared-users"),
+		SessionTimeout:   r.duration("session-timeout"),
+		IdleTimeout:      r.duration("idle-timeout"),
+		KeepaliveTimeout: r.duration("keepalive-timeout"),
+		MACCookieTimeout: r.duration("mac-cookie-timeout"),
+		AddMACCookie:     r.boolean("add-mac-cookie"),
+		Default:          r.boolean("default"),
+	}
+	return p, r.err
+}
+
+func (p UserProfile) attrs() attrs {
+	var a attrs
+	a.str("name", p.Name)
+	a.str("address-pool", p.AddressPool)
+	a.str("rate-limit", p.RateLimit)
+	a.integer("shared-users", p.SharedUsers)
+	a.duration("session-timeout", p.SessionTimeout)
+	a.duration("idle-timeout", p.IdleTimeout)
+	a.duration("keepalive-timeout", p.KeepaliveTimeout)
+	a.duration("mac-cookie-timeout", p.MACCookieTimeout)
+	if p.AddMACCookie {
+		a.str("add-mac-cookie", formatBool(true))
+	}
+	return a
+}
+
+// ListUserProfiles returns the hotspot user profiles matching q
+func (c *Client) ListUserProfiles(ctx context.Context, q *Query) ([]UserProfile, error) {
+	rows, err := c.print(ctx, pathUserProfile, q)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make([]UserProfile, 0, len(rows))
+	for _, row := range rows {
+		p, err := userProfileFromMap(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hotspot user profile %s: %w", row[".id"], err)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// FindUserProfile returns the profile with the given name, or nil if there is none
+func (c *Client) FindUserProfile(ctx context.Context, name string) (*UserProfile, error) {
+	profiles, err := c.ListUserProfiles(ctx, NewQuery().Eq("name", name))
+	if err != nil || len(profiles) == 0 {
+		return nil, err
+	}
+	return &profiles[0], nil
+}
+
+// AddUserProfile creates a hotspot user profile and returns its ".id"
+func (c *Client) AddUserProfile(ctx context.Context, p UserProfile) (string, error) {
+	if p.Name == "" {
+		return "", fmt.Errorf("hotspot user profile name is empty")
+	}
+	return c.add(ctx, pathUserProfile, p.attrs())
+}
+
+// UpdateUserProfile overwrites the non-empty fields of the profile with the given ".id"
+func (c *Client) UpdateUserProfile(ctx context.Context, id string, p UserProfile) error {
+	return c.set(ctx, pathUserProfile, id, p.attrs())
+}
+
+// RemoveUserProfiles removes hotspot user profiles by ".id"
+func (c *Client) RemoveUserProfiles(ctx context.Context, ids ...string) error {
+	return c.remove(ctx, pathUserProfile, ids...)
+}
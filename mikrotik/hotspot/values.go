@@ -0,0 +1,214 @@
+package hotspot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that parses and formats RouterOS time values
+// such as "1w2d03:04:05", "3h5m10s" or "250ms"
+type Duration time.Duration
+
+// Std returns the value as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// String formats the duration the way RouterOS prints it, e.g. "1w2d3h4m5s"
+func (d Duration) String() string {
+	if d <= 0 {
+		return "0s"
+	}
+
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+
+	var b strings.Builder
+	rest := time.Duration(d)
+	for _, u := range units {
+		if n := rest / u.size; n > 0 {
+			b.WriteString(strconv.FormatInt(int64(n), 10))
+			b.WriteString(u.suffix)
+			rest -= n * u.size
+		}
+	}
+	if b.Len() == 0 {
+		return "0s"
+	}
+	return b.String()
+}
+
+// ParseDuration parses a RouterOS time value. Empty values, "none" and
+// "never" parse as zero.
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "", "none", "never", "unlimited":
+		return 0, nil
+	}
+
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && (rest[i] >= '0' && rest[i] <= '9') {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid RouterOS duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid RouterOS duration %q: %w", s, err)
+		}
+		rest = rest[i:]
+
+		// A bare number is a count of seconds
+		if rest == "" {
+			total += time.Duration(n) * time.Second
+			break
+		}
+
+		// A trailing hh:mm:ss clock, e.g. the "03:04:05" in "2d03:04:05"
+		if rest[0] == ':' {
+			clock, err := parseClock(strconv.FormatInt(n, 10) + rest)
+			if err != nil {
+				return 0, fmt.Errorf("invalid RouterOS duration %q: %w", s, err)
+			}
+			total += clock
+			break
+		}
+
+		var unit time.Duration
+		switch {
+		case strings.HasPrefix(rest, "ms"):
+			unit, rest = time.Millisecond, rest[2:]
+		case strings.HasPrefix(rest, "us"):
+			unit, rest = time.Microsecond, rest[2:]
+		case rest[0] == 'w':
+			unit, rest = 7*24*time.Hour, rest[1:]
+		case rest[0] == 'd':
+			unit, rest = 24*time.Hour, rest[1:]
+		case rest[0] == 'h':
+			unit, rest = time.Hour, rest[1:]
+		case rest[0] == 'm':
+			unit, rest = time.Minute, rest[1:]
+		case rest[0] == 's':
+			unit, rest = time.Second, rest[1:]
+		default:
+			return 0, fmt.Errorf("invalid RouterOS duration %q: unknown unit %q", s, rest[:1])
+		}
+		total += time.Duration(n) * unit
+	}
+
+	return Duration(total), nil
+}
+
+// parseClock parses "hh:mm:ss" with an optional fractional second
+func parseClock(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, errors.New("clock must be hh:mm:ss")
+	}
+
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	sec, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
+
+// ParseBool parses RouterOS boolean values ("true", "false", "yes", "no")
+func ParseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true", "yes":
+		return true, nil
+	case "false", "no", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid RouterOS boolean %q", s)
+}
+
+// ParseBytes parses RouterOS byte and packet counters
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "unlimited" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RouterOS counter %q: %w", s, err)
+	}
+	return n, nil
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// record reads typed values from a reply row, keeping the first parse error
+type record struct {
+	m   map[string]string
+	err error
+}
+
+func (r *record) str(key string) string {
+	return r.m[key]
+}
+
+func (r *record) boolean(key string) bool {
+	v, err := ParseBool(r.m[key])
+	r.keep(key, err)
+	return v
+}
+
+func (r *record) duration(key string) Duration {
+	v, err := ParseDuration(r.m[key])
+	r.keep(key, err)
+	return v
+}
+
+func (r *record) bytes(key string) int64 {
+	v, err := ParseBytes(r.m[key])
+	r.keep(key, err)
+	return v
+}
+
+func (r *record) integer(key string) int {
+	return int(r.bytes(key))
+}
+
+func (r *record) keep(key string, err error) {
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("field %s: %w", key, err)
+	}
+}
@@ -0,0 +1,133 @@
+package hotspot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/mikrotik/hotspot"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "1w2d3h4m5s", want: 9*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second},
+		{in: "3h5m10s", want: 3*time.Hour + 5*time.Minute + 10*time.Second},
+		{in: "2d03:04:05", want: 2*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second},
+		{in: "1w00:00:01.5", want: 7*24*time.Hour + 1500*time.Millisecond},
+		{in: "00:30:00", want: 30 * time.Minute},
+		{in: "250ms", want: 250 * time.Millisecond},
+		{in: "1s500ms", want: 1500 * time.Millisecond},
+		{in: "10us", want: 10 * time.Microsecond},
+		{in: "90", want: 90 * time.Second},
+		{in: " 5m ", want: 5 * time.Minute},
+		{in: ""},
+		{in: "none"},
+		{in: "never"},
+		{in: "unlimited"},
+		{in: "5y", wantErr: true},
+		{in: "h5", wantErr: true},
+		{in: "-5s", wantErr: true},
+		{in: "1d03:04", wantErr: true},
+		{in: "1d03:xx:05", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := hotspot.ParseDuration(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDuration(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got.Std() != tt.want {
+				t.Errorf("ParseDuration(%q) = %v, want %v", tt.in, got.Std(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationString(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{in: 9*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second, want: "1w2d3h4m5s"},
+		{in: time.Hour, want: "1h"},
+		{in: 1500 * time.Millisecond, want: "1s500ms"},
+		{in: 0, want: "0s"},
+		{in: -time.Second, want: "0s"},
+		{in: time.Microsecond, want: "0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			d := hotspot.Duration(tt.in)
+			if got := d.String(); got != tt.want {
+				t.Fatalf("Duration(%v).String() = %s, want %s", tt.in, got, tt.want)
+			}
+			if tt.in < time.Millisecond {
+				return
+			}
+			back, err := hotspot.ParseDuration(d.String())
+			if err != nil || back != d {
+				t.Errorf("ParseDuration(%s) = %v, %v, want %v", d, back.Std(), err, tt.in)
+			}
+		})
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0"},
+		{in: "1048576", want: 1048576},
+		{in: " 42 ", want: 42},
+		{in: "9223372036854775807", want: 9223372036854775807},
+		{in: ""},
+		{in: "unlimited"},
+		{in: "10.5KiB", wantErr: true},
+		{in: "1M", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := hotspot.ParseBytes(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBytes(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBytes(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    bool
+		wantErr bool
+	}{
+		{in: "true", want: true},
+		{in: "yes", want: true},
+		{in: "Yes", want: true},
+		{in: "false"},
+		{in: "no"},
+		{in: ""},
+		{in: "1", wantErr: true},
+		{in: "enabled", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := hotspot.ParseBool(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBool(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBool(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package mikrotik
 
 import (
+	"context"
 	"errors"
 	"log"
 	"fmt"
@@ -23,8 +24,27 @@ type DevicePool struct {
 	config  config.DeviceConfig
 	clients chan *routeros.Client
 	mu      sync.Mutex
+
+	// Health checker state, guarded by mu
+	health     DeviceHealth
+	inUse      int
+	backoff    time.Duration
+	nextRedial time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	breaker *circuitBreaker
 }
 
+const (
+	// clientWaitTimeout is how long to wait for an idle client before dialing a new one
+	clientWaitTimeout = 5 * time.Second
+	// DefaultExecuteTimeout bounds Execute calls made without a context
+	DefaultExecuteTimeout = 15 * time.Second
+)
+
 // NewManager creates a new MikroTik manager
 func NewManager() *Manager {
 	return &Manager{
@@ -48,8 +68,14 @@ func (m *Manager) AddDevice(config config.DeviceConfig) error {
 	}
 	
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	previous := m.devices[config.ID]
 	m.devices[config.ID] = pool
+	m.mu.Unlock()
+
+	// Stop the health checker and connections of the pool being replaced
+	if previous != nil {
+		previous.Close()
+	}
 	
 	return nil
 }
@@ -61,7 +87,7 @@ func (m *Manager) GetDevice(deviceID string) (*DevicePool, error) {
 	
 	pool, exists := m.devices[deviceID]
 	if !exists {
-		return nil, fmt.Errorf("no device with ID %s found", deviceID)
+		return nil, fmt.Errorf("%w: no device with ID %s found", ErrUnknownDevice, deviceID)
 	}
 	
 	return pool, nil
@@ -82,6 +108,29 @@ func (m *Manager) GetDevicesByISP(ispID string) []*DevicePool {
 	return results
 }
 
+// GetDeviceHealth returns the health snapshot of a specific device
+func (m *Manager) GetDeviceHealth(deviceID string) (DeviceHealth, error) {
+	pool, err := m.GetDevice(deviceID)
+	if err != nil {
+		return DeviceHealth{}, err
+	}
+
+	return pool.Health(), nil
+}
+
+// HealthReport returns the health snapshot of every managed device
+func (m *Manager) HealthReport() []DeviceHealth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report := make([]DeviceHealth, 0, len(m.devices))
+	for _, pool := range m.devices {
+		report = append(report, pool.Health())
+	}
+
+	return report
+}
+
 // ListAllDevices returns all device configurations
 func (m *Manager) ListAllDevices() []config.DeviceConfig {
 	m.mu.RLock()
@@ -102,7 +151,7 @@ func (m *Manager) RemoveDevice(deviceID string) error {
 	
 	pool, exists := m.devices[deviceID]
 	if !exists {
-		return fmt.Errorf("no device with ID %s found", deviceID)
+		return fmt.Errorf("%w: no device with ID %s found", ErrUnknownDevice, deviceID)
 	}
 	
 	pool.Close()
@@ -126,11 +175,13 @@ func newDevicePool(config config.DeviceConfig) (*DevicePool, error) {
 	p := &DevicePool{
 		config:  config,
 		clients: make(chan *routeros.Client, config.PoolSize),
+		stop:    make(chan struct{}),
+		breaker: newCircuitBreaker(config.FailureThreshold, time.Duration(config.CircuitCooldown)*time.Second),
 	}
 
 	// Create initial connections
 	for i := 0; i < config.PoolSize; i++ {
-		client, err := routeros.Dial(config.Address+":"+config.Port, config.Username, config.Password)
+		client, err := p.dial()
 		if err != nil {
 			// Close the connections we've already established
 			for j := 0; j < i; j++ {
@@ -142,22 +193,55 @@ func newDevicePool(config config.DeviceConfig) (*DevicePool, error) {
 		p.clients <- client
 	}
 
+	p.recordSuccess()
+	p.startHealthCheck(DefaultHealthCheckInterval)
+
 	return p, nil
 }
 
+// dial opens and logs in a new connection to the device
+func (p *DevicePool) dial() (*routeros.Client, error) {
+	return p.dialContext(context.Background())
+}
+
+// dialContext opens and logs in a new connection to the device, honouring ctx
+func (p *DevicePool) dialContext(ctx context.Context) (*routeros.Client, error) {
+	return routeros.DialContext(ctx, p.config.Address+":"+p.config.Port, p.config.Username, p.config.Password)
+}
+
 // GetClient gets a client from the pool
 func (p *DevicePool) GetClient() *routeros.Client {
+	client, err := p.GetClientContext(context.Background())
+	if err != nil {
+		// Return nil if we can't create a new client
+		return nil
+	}
+	return client
+}
+
+// GetClientContext gets a client from the pool, dialing a new one if none is idle in time
+func (p *DevicePool) GetClientContext(ctx context.Context) (*routeros.Client, error) {
+	timer := time.NewTimer(clientWaitTimeout)
+	defer timer.Stop()
+
 	select {
 	case client := <-p.clients:
-		return client
-	case <-time.After(5 * time.Second):
-		// If we can't get a client in 5 seconds, try to create a new one
-		client, err := routeros.Dial(p.config.Address, p.config.Username, p.config.Password)
+		p.trackCheckout(1)
+		return client, nil
+	case <-ctx.Done():
+		return nil, contextError(ctx, p.config.ID)
+	case <-timer.C:
+		// If we can't get a client in time, try to create a new one
+		client, err := p.dialContext(ctx)
 		if err != nil {
-			// Return nil if we can't create a new client
-			return nil
+			p.recordFailure(err)
+			if ctx.Err() != nil {
+				return nil, contextError(ctx, p.config.ID)
+			}
+			return nil, fmt.Errorf("%w: device %s: %w", ErrDeviceUnavailable, p.config.ID, err)
 		}
-		return client
+		p.trackCheckout(1)
+		return client, nil
 	}
 }
 
@@ -166,7 +250,16 @@ func (p *DevicePool) ReturnClient(client *routeros.Client) {
 	if client == nil {
 		return
 	}
-	
+	p.trackCheckout(-1)
+
+	select {
+	case <-p.stop:
+		// The pool was closed while the client was checked out
+		client.Close()
+		return
+	default:
+	}
+
 	select {
 	case p.clients <- client:
 		// Client returned to pool
@@ -178,19 +271,18 @@ func (p *DevicePool) ReturnClient(client *routeros.Client) {
 
 // Execute executes a command on the MikroTik device
 func (p *DevicePool) Execute(command string, args ...string) ([]map[string]string, error) {
-	client := p.GetClient()
-	if client == nil {
-		return nil, errors.New("failed to get client from pool")
-	}
-	defer p.ReturnClient(client)
-
-	sentence := append([]string{command}, args...)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultExecuteTimeout)
+	defer cancel()
 
-	reply, err := client.RunArgs(sentence)
+	return p.ExecuteContext(ctx, command, args...)
+}
 
+// ExecuteContext executes a command on the MikroTik device, giving up when ctx is done.
+// It fails fast with ErrCircuitOpen while the device's circuit breaker is open.
+func (p *DevicePool) ExecuteContext(ctx context.Context, command string, args ...string) ([]map[string]string, error) {
+	reply, err := p.RunContext(ctx, command, args...)
 	if err != nil {
-		log.Println("error:", err)
-		return nil, fmt.Errorf("%w", err)
+		return nil, err
 	}
 
 	var result []map[string]string
@@ -204,11 +296,101 @@ func (p *DevicePool) Execute(command string, args ...string) ([]map[string]strin
 	return result, nil
 }
 
+// RunContext is like ExecuteContext but returns the raw reply, including the !done
+// sentence that carries values such as the ".id" returned by add commands.
+func (p *DevicePool) RunContext(ctx context.Context, command string, args ...string) (*routeros.Reply, error) {
+	if !p.breaker.allow() {
+		_, _, retryAt := p.breaker.snapshot()
+		return nil, &CircuitOpenError{DeviceID: p.config.ID, RetryAt: retryAt}
+	}
 
+	client, err := p.GetClientContext(ctx)
+	if err != nil {
+		p.callFailed(err)
+		return nil, err
+	}
 
+	sentence := append([]string{command}, args...)
+
+	type runResult struct {
+		reply *routeros.Reply
+		err   error
+	}
+	done := make(chan runResult, 1)
+	go func() {
+		reply, err := client.RunArgs(sentence)
+		done <- runResult{reply, err}
+	}()
+
+	var res runResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		// Closing the connection unblocks the pending read; the health checker redials it
+		p.discardClient(client)
+		err := contextError(ctx, p.config.ID)
+		p.callFailed(err)
+		if !errors.Is(err, context.Canceled) {
+			p.recordFailure(ctx.Err())
+		}
+		return nil, err
+	}
+
+	if res.err != nil {
+		log.Println("error:", res.err)
+		if isConnectionError(res.err) {
+			// Don't hand a dead connection to the next caller; the health checker redials it
+			p.discardClient(client)
+			p.breaker.failure()
+			p.recordFailure(res.err)
+			return nil, fmt.Errorf("%w: device %s: %w", ErrDeviceUnavailable, p.config.ID, res.err)
+		}
+		// A !trap reply means the router is up and answering
+		p.ReturnClient(client)
+		p.breaker.success()
+		return nil, fmt.Errorf("%w", res.err)
+	}
+	p.ReturnClient(client)
+	p.breaker.success()
+	p.recordSuccess()
+
+	return res.reply, nil
+}
+
+// callFailed reports a failed call to the circuit breaker. A caller cancelling
+// says nothing about the router, so it only gives up the call's turn.
+func (p *DevicePool) callFailed(err error) {
+	if errors.Is(err, context.Canceled) {
+		p.breaker.abandon()
+		return
+	}
+	p.breaker.failure()
+}
+
+// discardClient closes a checked-out client instead of returning it to the pool
+func (p *DevicePool) discardClient(client *routeros.Client) {
+	p.trackCheckout(-1)
+	client.Close()
+}
+
+// trackCheckout adjusts the number of clients currently checked out of the pool
+func (p *DevicePool) trackCheckout(delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inUse += delta
+	if p.inUse < 0 {
+		p.inUse = 0
+	}
+}
 
 // Close closes all connections in the pool
 func (p *DevicePool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+	p.wg.Wait()
+
 	for i := 0; i < cap(p.clients); i++ {
 		select {
 		case client := <-p.clients:
@@ -0,0 +1,290 @@
+package mikrotik_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-routeros/routeros/v3"
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+)
+
+func newPool(t *testing.T, srv *routerostest.Server) (*mikrotik.Manager, *mikrotik.DevicePool) {
+	t.Helper()
+
+	manager := mikrotik.NewManager()
+	t.Cleanup(manager.Close)
+
+	cfg := srv.DeviceConfig("router1")
+	cfg.FailureThreshold = 2
+	cfg.CircuitCooldown = 60
+	if err := manager.AddDevice(cfg); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+	pool, err := manager.GetDevice("router1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	return manager, pool
+}
+
+func TestManagerDevices(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+
+	manager := mikrotik.NewManager()
+	defer manager.Close()
+
+	for _, id := range []string{"router1", "router2"} {
+		cfg := srv.DeviceConfig(id)
+		cfg.ISPID = "isp-" + id
+		cfg.PoolSize = 2
+		if err := manager.AddDevice(cfg); err != nil {
+			t.Fatalf("AddDevice(%s) error = %v", id, err)
+		}
+	}
+
+	if got := srv.Logins(); got != 4 {
+		t.Errorf("logins = %d, want one per pooled connection (4)", got)
+	}
+	if got := len(manager.ListAllDevices()); got != 2 {
+		t.Errorf("ListAllDevices() returned %d devices, want 2", got)
+	}
+	if got := manager.GetDevicesByISP("isp-router2"); len(got) != 1 {
+		t.Errorf("GetDevicesByISP() returned %d pools, want 1", len(got))
+	}
+
+	report := manager.HealthReport()
+	if len(report) != 2 {
+		t.Fatalf("HealthReport() returned %d entries, want 2", len(report))
+	}
+	for _, h := range report {
+		if h.State != mikrotik.StateHealthy || h.Idle != 2 || h.Circuit != mikrotik.CircuitClosed {
+			t.Errorf("health of %s = %+v, want healthy with 2 idle clients and a closed circuit", h.DeviceID, h)
+		}
+	}
+
+	if err := manager.RemoveDevice("router1"); err != nil {
+		t.Fatalf("RemoveDevice() error = %v", err)
+	}
+	if _, err := manager.GetDevice("router1"); err == nil {
+		t.Error("GetDevice() of a removed device succeeded")
+	}
+	if _, err := manager.GetDeviceHealth("router2"); err != nil {
+		t.Errorf("GetDeviceHealth() error = %v", err)
+	}
+}
+
+func TestManagerAddDeviceErrors(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+
+	manager := mikrotik.NewManager()
+	defer manager.Close()
+
+	if err := manager.AddDevice(srv.DeviceConfig("")); err == nil {
+		t.Error("AddDevice() with an empty ID succeeded")
+	}
+
+	cfg := srv.DeviceConfig("router1")
+	cfg.Password = "wrong"
+	if err := manager.AddDevice(cfg); err == nil {
+		t.Error("AddDevice() with a wrong password succeeded")
+	}
+	if _, err := manager.GetDevice("router1"); err == nil {
+		t.Error("device with a failed login was added to the manager")
+	}
+}
+
+func TestManagerReAddClosesPreviousPool(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+
+	manager := mikrotik.NewManager()
+	defer manager.Close()
+
+	cfg := srv.DeviceConfig("router1")
+	cfg.PoolSize = 2
+	if err := manager.AddDevice(cfg); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+	previous, _ := manager.GetDevice("router1")
+	client := previous.GetClient()
+	if client == nil {
+		t.Fatal("GetClient() returned no client")
+	}
+
+	if err := manager.AddDevice(cfg); err != nil {
+		t.Fatalf("AddDevice() again error = %v", err)
+	}
+	// A client checked out of the replaced pool is closed when it comes back
+	previous.ReturnClient(client)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.Connections() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.Connections(); got != 2 {
+		t.Errorf("open connections = %d, want only the 2 of the new pool", got)
+	}
+	if h := previous.Health(); h.Idle != 0 {
+		t.Errorf("replaced pool still holds %d idle clients", h.Idle)
+	}
+}
+
+func TestDevicePoolExecute(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.SetResource(map[string]string{"version": "7.15 (stable)"})
+
+	_, pool := newPool(t, srv)
+
+	rows, err := pool.Execute("/system/resource/print")
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if len(rows) != 1 || rows[0]["version"] != "7.15 (stable)" {
+		t.Errorf("Execute() = %v, want the resource entry", rows)
+	}
+
+	srv.AddHost("10.5.50.10", "10.5.50.10", "AA:BB:CC:DD:EE:01")
+	srv.AddHost("10.5.50.11", "10.5.50.11", "AA:BB:CC:DD:EE:02")
+	rows, err = pool.Execute("/ip/hotspot/host/print", "=.proplist=mac-address", "?address=10.5.50.11")
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if len(rows) != 1 || rows[0]["mac-address"] != "AA:BB:CC:DD:EE:02" || len(rows[0]) != 1 {
+		t.Errorf("Execute() = %v, want only the matching host's mac-address", rows)
+	}
+}
+
+func TestDevicePoolRunContextAdd(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+
+	_, pool := newPool(t, srv)
+
+	_, err := pool.RunContext(context.Background(), "/ip/hotspot/active/login", "=ip=10.5.50.10", "=user=alice")
+	if err == nil {
+		t.Fatal("login of an unknown host succeeded")
+	}
+
+	reply, err := pool.RunContext(context.Background(), "/ip/hotspot/walled-garden/add", "=dst-host=example.com")
+	if err != nil {
+		t.Fatalf("RunContext() error = %v", err)
+	}
+	id := reply.Done.Map["ret"]
+	if rows := srv.Rows("/ip/hotspot/walled-garden"); len(rows) != 1 || rows[0][".id"] != id {
+		t.Errorf("walled-garden = %v, want one entry with id %q", rows, id)
+	}
+}
+
+func TestDevicePoolTrapIsNotRetryable(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.Trap("/ip/hotspot/host/print", "no such command")
+
+	_, pool := newPool(t, srv)
+
+	for i := 0; i < 3; i++ {
+		_, err := pool.Execute("/ip/hotspot/host/print")
+		var deviceErr *routeros.DeviceError
+		if !errors.As(err, &deviceErr) {
+			t.Fatalf("Execute() error = %v, want a *routeros.DeviceError", err)
+		}
+		if mikrotik.IsRetryable(err) {
+			t.Errorf("IsRetryable(%v) = true, want false for a !trap", err)
+		}
+	}
+
+	// A trap means the router answered: the client goes back to the pool and the circuit stays closed
+	h := pool.Health()
+	if h.Circuit != mikrotik.CircuitClosed || h.Idle != 1 {
+		t.Errorf("health = %+v, want a closed circuit and the client back in the pool", h)
+	}
+	if _, err := pool.Execute("/system/identity/print"); err != nil {
+		t.Errorf("Execute() after a trap error = %v", err)
+	}
+}
+
+func TestDevicePoolConnectionLost(t *testing.T) {
+	srv := routerostest.NewServer()
+	_, pool := newPool(t, srv)
+	srv.Close()
+
+	_, err := pool.Execute("/system/identity/print")
+	if !errors.Is(err, mikrotik.ErrDeviceUnavailable) {
+		t.Fatalf("Execute() error = %v, want ErrDeviceUnavailable", err)
+	}
+	if !mikrotik.IsRetryable(err) {
+		t.Errorf("IsRetryable(%v) = false, want true", err)
+	}
+	if h := pool.Health(); h.Idle != 0 || h.LastError == "" {
+		t.Errorf("health = %+v, want the dead client discarded and the error recorded", h)
+	}
+}
+
+func TestDevicePoolTimeoutOpensCircuit(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.Delay("/system/identity/print", time.Second)
+
+	_, pool := newPool(t, srv)
+
+	// The first call times out on the hung router; the second finds no idle client in time
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := pool.ExecuteContext(ctx, "/system/identity/print")
+		cancel()
+		if !errors.Is(err, mikrotik.ErrTimeout) {
+			t.Fatalf("call %d: ExecuteContext() error = %v, want ErrTimeout", i+1, err)
+		}
+	}
+
+	_, err := pool.ExecuteContext(context.Background(), "/system/identity/print")
+	if !errors.Is(err, mikrotik.ErrCircuitOpen) {
+		t.Fatalf("ExecuteContext() error = %v, want ErrCircuitOpen", err)
+	}
+	if !strings.Contains(err.Error(), "router1") {
+		t.Errorf("error %q does not name the device", err)
+	}
+	var open *mikrotik.CircuitOpenError
+	if !errors.As(err, &open) || open.DeviceID != "router1" {
+		t.Fatalf("ExecuteContext() error = %v, want a CircuitOpenError for router1", err)
+	}
+	// The device's own cooldown of a minute, not the default
+	if d := open.RetryAfter(); d <= 30*time.Second || d > time.Minute {
+		t.Errorf("RetryAfter() = %s, want the rest of the device's one minute cooldown", d)
+	}
+
+	h := pool.Health()
+	if h.Circuit != mikrotik.CircuitOpen || h.ConsecutiveFailures != 2 || h.CircuitRetryAt.IsZero() {
+		t.Errorf("health = %+v, want an open circuit after 2 failures", h)
+	}
+}
+
+func TestDevicePoolCancelledCallsKeepCircuitClosed(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.Delay("/system/identity/print", 200*time.Millisecond)
+
+	_, pool := newPool(t, srv)
+
+	// Callers giving up on a slow but healthy router do not count against it
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err := pool.ExecuteContext(ctx, "/system/identity/print")
+		cancel()
+		if !errors.Is(err, context.Canceled) || mikrotik.IsRetryable(err) {
+			t.Fatalf("call %d: ExecuteContext() error = %v, want a non-retryable context.Canceled", i+1, err)
+		}
+	}
+
+	if h := pool.Health(); h.Circuit != mikrotik.CircuitClosed || h.ConsecutiveFailures != 0 {
+		t.Errorf("health = %+v, want a closed circuit after cancelled calls", h)
+	}
+}
@@ -0,0 +1,220 @@
+// Package radiusclient is a typed client for the RouterOS /radius API, the
+// RADIUS servers a router sends its hotspot logins and accounting to.
+//
+// Entries wifigo manages carry a comment naming them, so Sync updates the
+// router's entry in place instead of adding a new one each time a secret
+// changes.
+package radiusclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-routeros/routeros/v3"
+)
+
+// RouterOS menu paths used by this package
+const (
+	pathRadius         = "/radius"
+	pathRadiusIncoming = "/radius/incoming"
+)
+
+// Default ports of a RADIUS server
+const (
+	DefaultAuthenticationPort = 1812
+	DefaultAccountingPort     = 1813
+)
+
+// Runner executes a RouterOS command; *mikrotik.DevicePool implements it
+type Runner interface {
+	RunContext(ctx context.Context, command string, args ...string) (*routeros.Reply, error)
+}
+
+// Entry is an entry of /radius
+type Entry struct {
+	ID                 string
+	Address            string // Of the RADIUS server
+	Secret             string
+	Service            string // Comma separated, e.g. "hotspot" or "hotspot,ppp"
+	AuthenticationPort int
+	AccountingPort     int
+	SrcAddress         string
+	Timeout            string // RouterOS time, e.g. "3s"
+	Comment            string
+	Disabled           bool
+}
+
+func entryFromMap(m map[string]string) (Entry, error) {
+	e := Entry{
+		ID:         m[".id"],
+		Address:    m["address"],
+		Secret:     m["secret"],
+		Service:    m["service"],
+		SrcAddress: m["src-address"],
+		Timeout:    m["timeout"],
+		Comment:    m["comment"],
+		Disabled:   m["disabled"] == "true" || m["disabled"] == "yes",
+	}
+	var err error
+	if e.AuthenticationPort, err = port(m, "authentication-port"); err != nil {
+		return e, err
+	}
+	if e.AccountingPort, err = port(m, "accounting-port"); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+func port(m map[string]string, key string) (int, error) {
+	if m[key] == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(m[key])
+	if err != nil {
+		return 0, fmt.Errorf("field %s: %w", key, err)
+	}
+	return v, nil
+}
+
+// words returns the attribute words of e for add and set
+func (e Entry) words() []string {
+	var w []string
+	add := func(key, value string) {
+		if value != "" {
+			w = append(w, "="+key+"="+value)
+		}
+	}
+	add("address", e.Address)
+	add("secret", e.Secret)
+	add("service", e.Service)
+	if e.AuthenticationPort > 0 {
+		add("authentication-port", strconv.Itoa(e.AuthenticationPort))
+	}
+	if e.AccountingPort > 0 {
+		add("accounting-port", strconv.Itoa(e.AccountingPort))
+	}
+	add("src-address", e.SrcAddress)
+	add("timeout", e.Timeout)
+	add("comment", e.Comment)
+	return w
+}
+
+// Command returns the terminal command adding e to a router, for operators
+// who configure it by hand
+func Command(e Entry) string {
+	parts := []string{pathRadius + " add"}
+	for _, word := range e.words() {
+		kv := strings.SplitN(strings.TrimPrefix(word, "="), "=", 2)
+		parts = append(parts, kv[0]+"="+quote(kv[1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quote quotes a value for the RouterOS terminal when it needs it
+func quote(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\"\\$;?{}[]") {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, `?`, `\?`)
+	return `"` + r.Replace(v) + `"`
+}
+
+// Client is a typed /radius API client for a single device
+type Client struct {
+	pool Runner
+}
+
+// NewClient creates a /radius client on top of a device pool
+func NewClient(pool Runner) *Client {
+	return &Client{pool: pool}
+}
+
+// FindByComment returns the entries whose comment is comment
+func (c *Client) FindByComment(ctx context.Context, comment string) ([]Entry, error) {
+	reply, err := c.pool.RunContext(ctx, pathRadius+"/print", "?comment="+comment)
+	if err != nil {
+		return nil, fmt.Errorf("%s/print failed: %w", pathRadius, err)
+	}
+
+	entries := make([]Entry, 0, len(reply.Re))
+	for _, re := range reply.Re {
+		e, err := entryFromMap(re.Map)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse radius entry %s: %w", re.Map[".id"], err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Sync makes the entry commented e.Comment match e, adding it when the router
+// has none. It returns the ".id" of the entry and whether it was added.
+func (c *Client) Sync(ctx context.Context, e Entry) (string, bool, error) {
+	if e.Comment == "" {
+		return "", false, fmt.Errorf("%s: an entry needs a comment to be synced", pathRadius)
+	}
+	existing, err := c.FindByComment(ctx, e.Comment)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(existing) == 0 {
+		reply, err := c.pool.RunContext(ctx, pathRadius+"/add", e.words()...)
+		if err != nil {
+			return "", false, fmt.Errorf("%s/add failed: %w", pathRadius, err)
+		}
+		if reply.Done != nil {
+			return reply.Done.Map["ret"], true, nil
+		}
+		return "", true, nil
+	}
+
+	id := existing[0].ID
+	args := append([]string{"=.id=" + id, "=disabled=no"}, e.words()...)
+	if _, err := c.pool.RunContext(ctx, pathRadius+"/set", args...); err != nil {
+		return "", false, fmt.Errorf("%s/set failed: %w", pathRadius, err)
+	}
+	// Duplicates would be asked in turn, with a stale secret
+	if err := c.remove(ctx, existing[1:]); err != nil {
+		return "", false, err
+	}
+	return id, false, nil
+}
+
+// RemoveByComment removes the entries commented comment and returns how many
+// there were
+func (c *Client) RemoveByComment(ctx context.Context, comment string) (int, error) {
+	existing, err := c.FindByComment(ctx, comment)
+	if err != nil {
+		return 0, err
+	}
+	return len(existing), c.remove(ctx, existing)
+}
+
+func (c *Client) remove(ctx context.Context, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	if _, err := c.pool.RunContext(ctx, pathRadius+"/remove", "=.id="+strings.Join(ids, ",")); err != nil {
+		return fmt.Errorf("%s/remove failed: %w", pathRadius, err)
+	}
+	return nil
+}
+
+// AcceptIncoming lets the router take Disconnect and CoA requests on port
+func (c *Client) AcceptIncoming(ctx context.Context, port int) error {
+	args := []string{"=accept=yes"}
+	if port > 0 {
+		args = append(args, "=port="+strconv.Itoa(port))
+	}
+	if _, err := c.pool.RunContext(ctx, pathRadiusIncoming+"/set", args...); err != nil {
+		return fmt.Errorf("%s/set failed: %w", pathRadiusIncoming, err)
+	}
+	return nil
+}
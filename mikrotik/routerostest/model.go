@@ -0,0 +1,348 @@
+package routerostest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default answers req from the in-memory model. Custom handlers may call it to
+// fall through to the built-in behaviour.
+func (s *Server) Default(req Request) Response {
+	if req.Command == PathActive+"/login" {
+		return s.hotspotLogin(req)
+	}
+
+	i := strings.LastIndex(req.Command, "/")
+	if i <= 0 {
+		return TrapResponse("no such command prefix")
+	}
+	path, verb := req.Command[:i], req.Command[i+1:]
+
+	switch verb {
+	case "print":
+		return s.print(path, req)
+	case "add":
+		id := s.Add(path, req.Attrs)
+		return Response{Done: map[string]string{"ret": id}}
+	case "set":
+		return s.set(path, req.Attrs)
+	case "remove":
+		return s.remove(path, req.Attrs[".id"])
+	}
+	return TrapResponse("no such command")
+}
+
+// Add inserts a row under path and returns its ".id"
+func (s *Server) Add(path string, row map[string]string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addLocked(path, row)
+}
+
+func (s *Server) addLocked(path string, row map[string]string) string {
+	entry := make(map[string]string, len(row)+1)
+	for k, v := range row {
+		entry[k] = v
+	}
+	entry[".id"] = s.nextIDLocked()
+	s.tables[path] = append(s.tables[path], entry)
+	return entry[".id"]
+}
+
+// Rows returns a copy of the rows under path
+func (s *Server) Rows(path string) []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows := make([]map[string]string, 0, len(s.tables[path]))
+	for _, row := range s.tables[path] {
+		rows = append(rows, copyRow(row))
+	}
+	return rows
+}
+
+// Reset removes every row under path
+func (s *Server) Reset(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tables, path)
+}
+
+// AddHost adds an /ip/hotspot/host entry and returns its ".id"
+func (s *Server) AddHost(address, toAddress, mac string) string {
+	return s.Add(PathHost, map[string]string{
+		"address":     address,
+		"to-address":  toAddress,
+		"mac-address": mac,
+		"server":      "hotspot1",
+		"authorized":  "false",
+		"bypassed":    "false",
+	})
+}
+
+// AddActive adds an /ip/hotspot/active session and returns its ".id"
+func (s *Server) AddActive(user, address, mac string) string {
+	return s.Add(PathActive, map[string]string{
+		"user":        user,
+		"address":     address,
+		"mac-address": mac,
+		"server":      "hotspot1",
+		"login-by":    "http-chap",
+		"uptime":      "0s",
+		"radius":      "true",
+	})
+}
+
+// SetResource overrides fields of the /system/resource entry
+func (s *Server) SetResource(fields map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range fields {
+		s.tables[PathResource][0][k] = v
+	}
+}
+
+func (s *Server) print(path string, req Request) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var proplist []string
+	if p := req.Attrs[".proplist"]; p != "" {
+		proplist = strings.Split(p, ",")
+	}
+
+	var resp Response
+	for _, row := range s.tables[path] {
+		ok, err := matches(row, req.Queries)
+		if err != "" {
+			return TrapResponse("%s", err)
+		}
+		if !ok {
+			continue
+		}
+
+		out := copyRow(row)
+		if proplist != nil {
+			out = make(map[string]string, len(proplist))
+			for _, k := range proplist {
+				if v, ok := row[k]; ok {
+					out[k] = v
+				}
+			}
+		}
+		resp.Rows = append(resp.Rows, out)
+	}
+	return resp
+}
+
+func (s *Server) set(path string, attrs map[string]string) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := attrs[".id"]
+	if ids == "" {
+		return TrapResponse("no such item")
+	}
+	for _, id := range strings.Split(ids, ",") {
+		row := s.findLocked(path, id)
+		if row == nil {
+			return TrapResponse("no such item")
+		}
+		for k, v := range attrs {
+			if k != ".id" {
+				row[k] = v
+			}
+		}
+	}
+	return Response{}
+}
+
+func (s *Server) remove(path, ids string) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ids == "" {
+		return TrapResponse("no such item")
+	}
+	for _, id := range strings.Split(ids, ",") {
+		if s.findLocked(path, id) == nil {
+			return TrapResponse("no such item")
+		}
+	}
+
+	remove := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		remove[id] = true
+	}
+	kept := s.tables[path][:0]
+	for _, row := range s.tables[path] {
+		if !remove[row[".id"]] {
+			kept = append(kept, row)
+		}
+	}
+	s.tables[path] = kept
+	return Response{}
+}
+
+func (s *Server) findLocked(path, id string) map[string]string {
+	for _, row := range s.tables[path] {
+		if row[".id"] == id {
+			return row
+		}
+	}
+	return nil
+}
+
+// hotspotLogin mimics /ip/hotspot/active/login: the ip must belong to a known
+// host, by address or to-address, that is not logged in yet
+func (s *Server) hotspotLogin(req Request) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip, user := req.Attrs["ip"], req.Attrs["user"]
+	if ip == "" {
+		return TrapResponse("ip not specified")
+	}
+	if user == "" {
+		return TrapResponse("user not specified")
+	}
+
+	var host map[string]string
+	for _, row := range s.tables[PathHost] {
+		if row["address"] == ip || row["to-address"] == ip {
+			host = row
+			break
+		}
+	}
+	if host == nil {
+		return TrapResponse("no such host: %s", ip)
+	}
+
+	for _, row := range s.tables[PathActive] {
+		if row["address"] == host["address"] {
+			return TrapResponse("%s is already logged in", ip)
+		}
+	}
+
+	mac := req.Attrs["mac-address"]
+	if mac == "" {
+		mac = host["mac-address"]
+	}
+	host["authorized"] = "true"
+	s.addLocked(PathActive, map[string]string{
+		"user":        user,
+		"address":     host["address"],
+		"mac-address": mac,
+		"server":      host["server"],
+		"login-by":    "http-chap",
+		"uptime":      "0s",
+		"radius":      "true",
+	})
+	return Response{}
+}
+
+// matches evaluates RouterOS API query words against row. Conditions are pushed
+// on a stack, "?#" words combine them, and whatever is left is and-ed together.
+func matches(row map[string]string, queries []string) (bool, string) {
+	var stack []bool
+	pop := func() bool {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+
+	for _, q := range queries {
+		word := q[1:]
+		switch {
+		case strings.HasPrefix(word, "#"):
+			for _, op := range word[1:] {
+				switch op {
+				case '!':
+					if len(stack) < 1 {
+						return false, "invalid query: nothing to negate"
+					}
+					stack = append(stack, !pop())
+				case '&', '|':
+					if len(stack) < 2 {
+						return false, "invalid query: not enough operands"
+					}
+					b, a := pop(), pop()
+					if op == '&' {
+						stack = append(stack, a && b)
+					} else {
+						stack = append(stack, a || b)
+					}
+				case '.':
+					if len(stack) < 1 {
+						return false, "invalid query: nothing to duplicate"
+					}
+					stack = append(stack, stack[len(stack)-1])
+				default:
+					return false, "invalid query operation: " + string(op)
+				}
+			}
+		case strings.HasPrefix(word, "-"):
+			_, ok := row[word[1:]]
+			stack = append(stack, !ok)
+		case strings.HasPrefix(word, "<"), strings.HasPrefix(word, ">"):
+			kv := strings.SplitN(word[1:], "=", 2)
+			if len(kv) != 2 {
+				return false, "invalid query: " + q
+			}
+			c := compare(row[kv[0]], kv[1])
+			stack = append(stack, (word[0] == '<' && c < 0) || (word[0] == '>' && c > 0))
+		default:
+			kv := strings.SplitN(word, "=", 2)
+			v, ok := row[kv[0]]
+			if len(kv) == 1 {
+				stack = append(stack, ok)
+			} else {
+				stack = append(stack, ok && v == kv[1])
+			}
+		}
+	}
+
+	for _, v := range stack {
+		if !v {
+			return false, ""
+		}
+	}
+	return true, ""
+}
+
+// compare orders two values numerically when both are integers
+func compare(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func copyRow(row map[string]string) map[string]string {
+	out := make(map[string]string, len(row))
+	for k, v := range row {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
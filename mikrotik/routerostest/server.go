@@ -0,0 +1,436 @@
+// Package routerostest provides an in-process fake RouterOS API server for tests.
+//
+// The server speaks the RouterOS API sentence/word protocol over TCP, handles
+// /login and keeps a scriptable in-memory model of the router: every menu path
+// supports print (with queries and .proplist), add, set and remove, and
+// /ip/hotspot/active/login, /system/resource/print and /system/identity/print
+// behave like a real router. Handle, Trap and Delay override individual commands.
+package routerostest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-routeros/routeros/v3/proto"
+	"github.com/ortupik/wifigo/config"
+)
+
+// Menu paths modelled by the server
+const (
+	PathHost     = "/ip/hotspot/host"
+	PathActive   = "/ip/hotspot/active"
+	PathCookie   = "/ip/hotspot/cookie"
+	PathResource = "/system/resource"
+	PathIdentity = "/system/identity"
+)
+
+// Default credentials accepted by a new Server
+const (
+	DefaultUsername = "admin"
+	DefaultPassword = "secret"
+)
+
+// Request is a command sentence received from a client
+type Request struct {
+	Command string            // e.g. "/ip/hotspot/active/login"
+	Attrs   map[string]string // "=key=value" words
+	Queries []string          // "?..." words, in order
+}
+
+// Response is the reply sent for a Request: zero or more !re rows, then !done
+// carrying Done, or a !trap with Trap as its message
+type Response struct {
+	Rows []map[string]string
+	Done map[string]string
+	Trap string
+}
+
+// TrapResponse returns a !trap reply with the given message
+func TrapResponse(format string, args ...interface{}) Response {
+	return Response{Trap: fmt.Sprintf(format, args...)}
+}
+
+// HandlerFunc answers a command in place of the built-in model
+type HandlerFunc func(req Request) Response
+
+// Server is a fake RouterOS API server listening on a local port
+type Server struct {
+	// Username and Password are the credentials accepted by /login
+	Username string
+	Password string
+
+	ln   net.Listener
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	tables   map[string][]map[string]string
+	nextID   int
+	handlers map[string]HandlerFunc
+	delays   map[string]time.Duration
+	conns    map[net.Conn]struct{}
+	requests []Request
+	logins   int
+	refuse   bool
+}
+
+// NewServer starts a fake RouterOS API server on a random local port.
+// Callers should Close it when done.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("routerostest: failed to listen on a port: %v", err))
+	}
+
+	s := &Server{
+		Username: DefaultUsername,
+		Password: DefaultPassword,
+		ln:       ln,
+		done:     make(chan struct{}),
+		tables:   make(map[string][]map[string]string),
+		handlers: make(map[string]HandlerFunc),
+		delays:   make(map[string]time.Duration),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.tables[PathResource] = []map[string]string{{
+		"uptime":       "1d2h3m4s",
+		"version":      "7.14.3 (stable)",
+		"cpu-load":     "3",
+		"free-memory":  "209715200",
+		"total-memory": "268435456",
+		"board-name":   "routerostest",
+	}}
+	s.tables[PathIdentity] = []map[string]string{{"name": "routerostest"}}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// DeviceConfig returns a device configuration that connects to the server
+func (s *Server) DeviceConfig(id string) config.DeviceConfig {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	return config.DeviceConfig{
+		ID:       id,
+		Address:  host,
+		Port:     port,
+		Username: s.Username,
+		Password: s.Password,
+		PoolSize: 1,
+	}
+}
+
+// Close stops accepting connections, drops the open ones and waits for them to finish
+func (s *Server) Close() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.done)
+	s.ln.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// DropConnections closes every open client connection, as a router reboot would
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Connections returns the number of open client connections
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// Logins returns the number of successful /login commands
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins
+}
+
+// RefuseLogins makes every /login fail while refuse is set, as a router that
+// lost the API user would
+func (s *Server) RefuseLogins(refuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refuse = refuse
+}
+
+// Handle makes command answer with h instead of the built-in model. A nil h
+// restores the built-in behaviour. h may call Default to fall through.
+func (s *Server) Handle(command string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h == nil {
+		delete(s.handlers, command)
+		return
+	}
+	s.handlers[command] = h
+}
+
+// Trap makes every call of command fail with a !trap carrying message
+func (s *Server) Trap(command, message string) {
+	s.Handle(command, func(Request) Response {
+		return Response{Trap: message}
+	})
+}
+
+// Delay holds the reply to command for d, to simulate a slow or hung router
+func (s *Server) Delay(command string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d <= 0 {
+		delete(s.delays, command)
+		return
+	}
+	s.delays[command] = d
+}
+
+// Requests returns the commands received so far, excluding /login
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsFor returns the received requests for one command
+func (s *Server) RequestsFor(command string) []Request {
+	var matched []Request
+	for _, req := range s.Requests() {
+		if req.Command == command {
+			matched = append(matched, req)
+		}
+	}
+	return matched
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	w := proto.NewWriter(conn)
+	loggedIn := false
+
+	for {
+		words, err := readSentence(conn)
+		if err != nil {
+			return
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		req, tag := parseRequest(words)
+
+		var resp Response
+		switch {
+		case req.Command == "/login":
+			s.mu.Lock()
+			if !s.refuse && req.Attrs["name"] == s.Username && req.Attrs["password"] == s.Password {
+				loggedIn = true
+				s.logins++
+			} else {
+				resp.Trap = "invalid user name or password (6)"
+			}
+			s.mu.Unlock()
+		case !loggedIn:
+			resp.Trap = "not logged in"
+		default:
+			resp = s.dispatch(req)
+		}
+
+		if !s.wait(req.Command) {
+			return
+		}
+		if err := writeResponse(w, resp, tag); err != nil {
+			return
+		}
+	}
+}
+
+// wait applies the configured delay for command. It reports false if the
+// server was closed meanwhile.
+func (s *Server) wait(command string) bool {
+	s.mu.Lock()
+	d := s.delays[command]
+	s.mu.Unlock()
+
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Server) dispatch(req Request) Response {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	h := s.handlers[req.Command]
+	s.mu.Unlock()
+
+	if h != nil {
+		return h(req)
+	}
+	return s.Default(req)
+}
+
+// readSentence reads the words of one API sentence. The proto package reader
+// only understands reply sentences, so query words are decoded here.
+func readSentence(r io.Reader) ([]string, error) {
+	var words []string
+	for {
+		n, err := readLength(r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return words, nil
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		words = append(words, string(b))
+	}
+}
+
+func readLength(r io.Reader) (int64, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+
+	first := int64(b[0])
+	var extra int
+	switch {
+	case first&0x80 == 0x00:
+		return first, nil
+	case first&0xC0 == 0x80:
+		first &^= 0xC0
+		extra = 1
+	case first&0xE0 == 0xC0:
+		first &^= 0xE0
+		extra = 2
+	case first&0xF0 == 0xE0:
+		first &^= 0xF0
+		extra = 3
+	default:
+		first = 0
+		extra = 4
+	}
+
+	if _, err := io.ReadFull(r, b[:extra]); err != nil {
+		return 0, err
+	}
+	n := first
+	for _, c := range b[:extra] {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+func parseRequest(words []string) (Request, string) {
+	req := Request{Command: words[0], Attrs: make(map[string]string)}
+	tag := ""
+	for _, word := range words[1:] {
+		switch {
+		case strings.HasPrefix(word, ".tag="):
+			tag = word[len(".tag="):]
+		case strings.HasPrefix(word, "="):
+			kv := strings.SplitN(word[1:], "=", 2)
+			if len(kv) == 1 {
+				kv = append(kv, "")
+			}
+			req.Attrs[kv[0]] = kv[1]
+		case strings.HasPrefix(word, "?"):
+			req.Queries = append(req.Queries, word)
+		}
+	}
+	return req, tag
+}
+
+func writeResponse(w proto.Writer, resp Response, tag string) error {
+	sentence := func(word string, m map[string]string) error {
+		w.BeginSentence()
+		w.WriteWord(word)
+		for _, k := range sortedKeys(m) {
+			w.WriteWord("=" + k + "=" + m[k])
+		}
+		if tag != "" {
+			w.WriteWord(".tag=" + tag)
+		}
+		return w.EndSentence()
+	}
+
+	if resp.Trap != "" {
+		if err := sentence("!trap", map[string]string{"message": resp.Trap}); err != nil {
+			return err
+		}
+		return sentence("!done", nil)
+	}
+
+	for _, row := range resp.Rows {
+		if err := sentence("!re", row); err != nil {
+			return err
+		}
+	}
+	return sentence("!done", resp.Done)
+}
+
+// nextIDLocked allocates a RouterOS style ".id". s.mu must be held.
+func (s *Server) nextIDLocked() string {
+	s.nextID++
+	return "*" + strings.ToUpper(strconv.FormatInt(int64(s.nextID), 16))
+}
@@ -71,7 +71,7 @@ func (c *Client) EnqueueTask(ctx context.Context, taskType string, payload inter
 }
 
 // EnqueueMikrotikCommand enqueues a MikroTik command task
-func (c *Client) EnqueueMikrotikCommand(ctx context.Context, action string, payload interface{}, priority string) (*asynq.TaskInfo, error) {
+func (c *Client) EnqueueMikrotikCommand(ctx context.Context, action string, payload interface{}, priority string, opts ...asynq.Option) (*asynq.TaskInfo, error) {
 	raw, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal MikrotikCommandPayload: %w", err)
@@ -82,12 +82,12 @@ func (c *Client) EnqueueMikrotikCommand(ctx context.Context, action string, payl
 		Action:  action,
 		Payload: raw,
 	}
-	return c.EnqueueTask(ctx, TypeMikrotikCommand, genericPayload, priority)
+	return c.EnqueueTask(ctx, TypeMikrotikCommand, genericPayload, priority, opts...)
 }
 
 
 // EnqueueDatabaseOperation enqueues a database operation task
-func (c *Client) EnqueueDatabaseOperation(ctx context.Context, action string, payload interface{}, priority string) (*asynq.TaskInfo, error) {
+func (c *Client) EnqueueDatabaseOperation(ctx context.Context, action string, payload interface{}, priority string, opts ...asynq.Option) (*asynq.TaskInfo, error) {
 	raw, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal database payload: %w", err)
@@ -98,7 +98,7 @@ func (c *Client) EnqueueDatabaseOperation(ctx context.Context, action string, pa
 		Action:  action,
 		Payload: raw,
 	}
-	return c.EnqueueTask(ctx, TypeDatabaseOperation, genericPayload, priority)
+	return c.EnqueueTask(ctx, TypeDatabaseOperation, genericPayload, priority, opts...)
 }
 
 
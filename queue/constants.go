@@ -5,9 +5,17 @@ const (
 	TypeDatabaseOperation = "database:operation"
 	ActionSaveMpesaCallback = "action:save_payment_callback"
 	ActionMikrotikLoginUser = "action:mikrotik_login_user"
+	ActionMikrotikLogoutUser = "action:mikrotik_logout_user"
+	ActionMikrotikKickSession = "action:mikrotik_kick_session"
 	ActionMikrotikCommand = "action:mikrotik_command"
 	
 	QueueCritical  = "critical" // For login/logout, authentication, critical DB updates
 	QueueDefault   = "default"  // For regular commands, standard DB operations
 	QueueReporting = "reporting" // For logs, stats collection, non-critical DB reads/writes
-)
\ No newline at end of file
+)
+const (
+	TypeSubscriptionExpiry = "subscription:expiry_scan"
+	TypeMpesaReconcile     = "mpesa:reconcile_pending"
+	TypeMpesaAutoRefund    = "mpesa:auto_refund"
+	TypeDataCapScan        = "subscription:data_cap_scan"
+)
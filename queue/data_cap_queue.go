@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+// DataCapQueueHandler disconnects hotspot users who have used up the data cap
+// of their plan.
+type DataCapQueueHandler struct {
+	client *Client
+	wsHub  *websocket.Hub
+}
+
+// NewDataCapQueueHandler creates a new DataCapQueueHandler.
+func NewDataCapQueueHandler(client *Client, wsHub *websocket.Hub) *DataCapQueueHandler {
+	return &DataCapQueueHandler{
+		client: client,
+		wsHub:  wsHub,
+	}
+}
+
+// HandleTask sums the usage of every running subscription on a capped plan.
+// Users over their cap are logged out of their device and their subscription
+// is marked exhausted; the others get what is left of their cap for their
+// next session.
+func (h *DataCapQueueHandler) HandleTask(ctx context.Context, task *asynq.Task) error {
+	now := time.Now()
+	quotas, err := service.FindCappedSubscriptions(now)
+	if err != nil {
+		return err
+	}
+
+	exhausted, failed := 0, 0
+	for _, quota := range quotas {
+		if !quota.Exhausted() {
+			if _, err := service.SetUserDataLimit(nil, quota.Username, quota.RemainingBytes(), true); err != nil {
+				log.Printf("Failed to update data limit of %s: %v", quota.Username, err)
+				failed++
+			}
+			continue
+		}
+		exhausted++
+		if err := h.exhaust(ctx, quota, now); err != nil {
+			log.Printf("Failed to end exhausted subscription of %s: %v", quota.Username, err)
+			failed++
+		}
+	}
+
+	if exhausted > 0 {
+		log.Printf("Data cap scan: %d of %d capped subscriptions exhausted, %d failed", exhausted, len(quotas), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to enforce the data cap of %d of %d subscriptions", failed, len(quotas))
+	}
+	return nil
+}
+
+func (h *DataCapQueueHandler) exhaust(ctx context.Context, quota service.DataQuota, now time.Time) error {
+	sub, err := service.MarkSubscriptionExhausted(quota, now)
+	if err != nil {
+		return err
+	}
+
+	if deviceID := sub.DeviceID(); deviceID != "" {
+		logout := dto.MikrotikLogout{
+			DeviceID: deviceID,
+			Username: quota.Username,
+			Address:  sub.Address(),
+			Reason:   "Your data bundle is used up",
+		}
+		if _, err := h.client.EnqueueMikrotikCommand(ctx, ActionMikrotikLogoutUser, logout, QueueCritical); err != nil {
+			return fmt.Errorf("failed to enqueue logout: %w", err)
+		}
+	} else {
+		log.Printf("Exhausted subscription of %s has no device, skipping logout", quota.Username)
+	}
+
+	if ip := sub.Address(); ip != "" {
+		h.wsHub.SendToIP(ip, []byte(fmt.Sprintf(`{"type":"subscription", "status": "exhausted", "message": "Your data bundle is used up", "username": %q, "used_bytes": %d, "limit_bytes": %d}`, quota.Username, quota.UsedBytes, quota.LimitBytes)))
+	}
+	return nil
+}
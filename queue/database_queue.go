@@ -67,6 +67,10 @@ func (h *DatabaseQueueHandler) handleSaveMpesaPayment(ctx context.Context, raw j
     }
 
     paymentID := resp["paymentID"].(int)
+    if duplicate, _ := resp["duplicate"].(bool); duplicate {
+        log.Printf("Payment for %s already recorded (ID: %v), ignoring replay", data.CheckoutRequestID, paymentID)
+        return nil
+    }
     ip, ok := resp["ip"].(string)
     if !ok {
         return fmt.Errorf("failed to get IP for notification")
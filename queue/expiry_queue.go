@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+// DefaultExpiryLookback bounds how far back a scan looks for passed expirations
+const DefaultExpiryLookback = 24 * time.Hour
+
+// ExpiryQueueHandler disconnects hotspot users whose subscription has expired.
+type ExpiryQueueHandler struct {
+	client *Client
+	wsHub  *websocket.Hub
+}
+
+// NewExpiryQueueHandler creates a new ExpiryQueueHandler.
+func NewExpiryQueueHandler(client *Client, wsHub *websocket.Hub) *ExpiryQueueHandler {
+	return &ExpiryQueueHandler{
+		client: client,
+		wsHub:  wsHub,
+	}
+}
+
+// HandleTask scans for expired subscriptions, logs the users out of their
+// device, marks their orders or vouchers expired and tells the client.
+func (h *ExpiryQueueHandler) HandleTask(ctx context.Context, task *asynq.Task) error {
+	var payload ExpiryScanPayload
+	if len(task.Payload()) > 0 {
+		if err := json.Unmarshal(task.Payload(), &payload); err != nil {
+			return fmt.Errorf("failed to unmarshal expiry scan payload: %w", err)
+		}
+	}
+	lookback := payload.Lookback
+	if lookback <= 0 {
+		lookback = DefaultExpiryLookback
+	}
+
+	now := time.Now()
+	expired, err := service.FindExpiredSubscriptions(now.Add(-lookback), now)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, sub := range expired {
+		if err := h.expire(ctx, sub); err != nil {
+			log.Printf("Failed to expire subscription of %s: %v", sub.Username, err)
+			failed++
+		}
+	}
+
+	if len(expired) > 0 {
+		log.Printf("Expiry scan: %d expired subscriptions, %d failed", len(expired), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to expire %d of %d subscriptions", failed, len(expired))
+	}
+	return nil
+}
+
+func (h *ExpiryQueueHandler) expire(ctx context.Context, sub service.ExpiredSubscription) error {
+	if deviceID := sub.DeviceID(); deviceID != "" {
+		logout := dto.MikrotikLogout{
+			DeviceID: deviceID,
+			Username: sub.Username,
+			Address:  sub.Address(),
+			Reason:   "Your plan has expired",
+		}
+		if _, err := h.client.EnqueueMikrotikCommand(ctx, ActionMikrotikLogoutUser, logout, QueueCritical); err != nil {
+			return fmt.Errorf("failed to enqueue logout: %w", err)
+		}
+	} else {
+		log.Printf("Subscription %s of %s has no device, skipping logout", sub.Reference(), sub.Username)
+	}
+
+	if err := service.MarkSubscriptionExpired(sub); err != nil {
+		return err
+	}
+
+	if ip := sub.Address(); ip != "" {
+		h.wsHub.SendToIP(ip, []byte(fmt.Sprintf(`{"type":"subscription", "status": "expired", "message": "Your plan has expired", "username": %q, "order": %q}`, sub.Username, sub.Reference())))
+	}
+	return nil
+}
@@ -31,6 +31,8 @@ func NewMikrotikQueueHandler(mikroTikService *service.MikroTikMangerService, wsH
 
 func (h *MikrotikQueueHandler) registerHandlers() {
 	h.actionHandlers[ActionMikrotikLoginUser] = h.handleLoginUser
+	h.actionHandlers[ActionMikrotikLogoutUser] = h.handleLogoutUser
+	h.actionHandlers[ActionMikrotikKickSession] = h.handleKickSession
 	//h.actionHandlers[ActionMikrotikCommand] = h.handleExecuteCommand
 }
 
@@ -61,13 +63,14 @@ func (h *MikrotikQueueHandler) handleLoginUser(ctx context.Context, raw json.Raw
 		return fmt.Errorf("failed to decode payload: %w", err)
 	}
 
-	err := service.LoginHotspotDeviceByAddress(h.mikroTikService, data)
+	err := service.LoginHotspotDeviceByAddress(ctx, h.mikroTikService, data)
 	if err != nil {
 		h.wsHub.SendToIP(data.Address, []byte(fmt.Sprintf(`{"type":"login", "status": "failed", "message": "Could not log you in!", "username": "%v"}`, data.Username)))
-		if ShouldNotRetryError(err) {
-			return asynq.SkipRetry
+		if !isPermanentFailure(err) {
+			return fmt.Errorf("failed to login user: %w", err)
 		}
-		return fmt.Errorf("failed to login user: %w", err)
+		log.Printf("Login of %s on %s failed permanently: %v", data.Username, data.DeviceID, err)
+		return fmt.Errorf("failed to login user: %w: %w", err, asynq.SkipRetry)
 	} else {
 		h.wsHub.SendToIP(data.Address, []byte(fmt.Sprintf(`{"type":"login", "status": "success", "message": "You are now logged in",  "username": "%v"}`, data.Username)))
 		return nil
@@ -75,6 +78,55 @@ func (h *MikrotikQueueHandler) handleLoginUser(ctx context.Context, raw json.Raw
 
 }
 
+// handleLogoutUser ends a user's hotspot access: active sessions and login cookies are removed
+func (h *MikrotikQueueHandler) handleLogoutUser(ctx context.Context, raw json.RawMessage) error {
+	return h.disconnect(ctx, raw, true)
+}
+
+// handleKickSession drops matching active sessions but leaves cookies, so the user may log in again
+func (h *MikrotikQueueHandler) handleKickSession(ctx context.Context, raw json.RawMessage) error {
+	return h.disconnect(ctx, raw, false)
+}
+
+func (h *MikrotikQueueHandler) disconnect(ctx context.Context, raw json.RawMessage, forgetCookies bool) error {
+	var data dto.MikrotikLogout
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("failed to decode payload: %w", err)
+	}
+
+	sessions, err := service.LogoutHotspotUser(ctx, h.mikroTikService, data, forgetCookies)
+	if err != nil {
+		if data.Address != "" {
+			h.wsHub.SendToIP(data.Address, []byte(fmt.Sprintf(`{"type":"logout", "status": "failed", "message": "Could not log you out!", "username": %q}`, data.Username)))
+		}
+		if !isPermanentFailure(err) {
+			return fmt.Errorf("failed to logout user: %w", err)
+		}
+		log.Printf("Logout of %s on %s failed permanently: %v", data.Username, data.DeviceID, err)
+		return fmt.Errorf("failed to logout user: %w: %w", err, asynq.SkipRetry)
+	}
+
+	message := "You have been logged out"
+	if data.Reason != "" {
+		message = data.Reason
+	}
+
+	// Notify every address the user was connected from, plus the one we were asked about
+	notified := make(map[string]bool)
+	addresses := []string{data.Address}
+	for _, session := range sessions {
+		addresses = append(addresses, session.Address)
+	}
+	for _, address := range addresses {
+		if address == "" || notified[address] {
+			continue
+		}
+		notified[address] = true
+		h.wsHub.SendToIP(address, []byte(fmt.Sprintf(`{"type":"logout", "status": "success", "message": %q, "username": %q, "sessions": %d}`, message, data.Username, len(sessions))))
+	}
+	return nil
+}
+
 /*func (h *MikrotikQueueHandler) handleExecuteCommand(ctx context.Context, payload *MikrotikCommandPayload) error {
 	log.Printf("Executing MikroTik command: %s on device: %s", payload.Command, payload.DeviceID)
 
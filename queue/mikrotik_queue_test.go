@@ -0,0 +1,174 @@
+package queue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+	"github.com/ortupik/wifigo/queue"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+func newLoginTask(t *testing.T, login dto.MikrotikLogin) *asynq.Task {
+	t.Helper()
+
+	raw, err := json.Marshal(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(queue.GenericTaskPayload{
+		System:  "mikrotik",
+		Action:  queue.ActionMikrotikLoginUser,
+		Payload: raw,
+		Ip:      login.Address,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asynq.NewTask(queue.TypeMikrotikCommand, data)
+}
+
+func newMikrotikQueueHandler(t *testing.T, srv *routerostest.Server) *queue.MikrotikQueueHandler {
+	t.Helper()
+
+	manager := mikrotik.NewManager()
+	t.Cleanup(manager.Close)
+	if err := manager.AddDevice(srv.DeviceConfig("router1")); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+	return queue.NewMikrotikQueueHandler(service.NewMikroTikManagerService(manager), websocket.NewHub())
+}
+
+func TestHandleLoginUser(t *testing.T) {
+	login := dto.MikrotikLogin{DeviceID: "router1", Address: "192.168.88.20", Username: "0712345678", Password: "secret"}
+
+	tests := []struct {
+		name      string
+		deviceID  string
+		setup     func(srv *routerostest.Server)
+		wantErr   bool
+		wantSkip  bool
+		loggedIn  bool
+		retryable bool
+	}{
+		{
+			name: "logged in",
+			setup: func(srv *routerostest.Server) {
+				srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+			},
+		},
+		{
+			name: "already logged in is not retried",
+			setup: func(srv *routerostest.Server) {
+				srv.AddHost("192.168.88.20", "", "AA:BB:CC:DD:EE:01")
+				srv.AddActive("0712345678", "192.168.88.20", "AA:BB:CC:DD:EE:01")
+			},
+			wantErr:  true,
+			wantSkip: true,
+			loggedIn: true,
+		},
+		{
+			name: "router refusing the login is not retried",
+			setup: func(srv *routerostest.Server) {
+				srv.Handle("/ip/hotspot/active/login", func(req routerostest.Request) routerostest.Response {
+					return routerostest.TrapResponse("invalid username or password")
+				})
+				srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+			},
+			wantErr:  true,
+			wantSkip: true,
+		},
+		{
+			name:     "unknown device is not retried",
+			deviceID: "router2",
+			setup:    func(srv *routerostest.Server) {},
+			wantErr:  true,
+			wantSkip: true,
+		},
+		{
+			name: "router trap is retried",
+			setup: func(srv *routerostest.Server) {
+				srv.Handle("/ip/hotspot/active/login", func(req routerostest.Request) routerostest.Response {
+					return routerostest.TrapResponse("RADIUS server is not responding")
+				})
+				srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+			},
+			wantErr: true,
+		},
+		{
+			name:    "host not found is retried",
+			setup:   func(srv *routerostest.Server) {},
+			wantErr: true,
+		},
+		{
+			name: "unreachable router is retried",
+			setup: func(srv *routerostest.Server) {
+				srv.Close()
+			},
+			wantErr:   true,
+			retryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := routerostest.NewServer()
+			defer srv.Close()
+			h := newMikrotikQueueHandler(t, srv)
+			tt.setup(srv)
+
+			login := login
+			if tt.deviceID != "" {
+				login.DeviceID = tt.deviceID
+			}
+			err := h.HandleTask(context.Background(), newLoginTask(t, login))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleTask() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := errors.Is(err, asynq.SkipRetry); got != tt.wantSkip {
+				t.Errorf("HandleTask() error = %v, SkipRetry %v, want %v", err, got, tt.wantSkip)
+			}
+			// The error handler tells an already logged in user so from the error text
+			if got := queue.ShouldNotRetryError(err); got != tt.loggedIn {
+				t.Errorf("ShouldNotRetryError(%v) = %v, want %v", err, got, tt.loggedIn)
+			}
+			if got := mikrotik.IsRetryable(err); got != tt.retryable {
+				t.Errorf("IsRetryable(%v) = %v, want %v", err, got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestShouldNotRetryError(t *testing.T) {
+	if !queue.ShouldNotRetryError(errors.New("from RouterOS device: 192.168.88.20 is already logged in")) {
+		t.Error("ShouldNotRetryError() = false for an already logged in trap")
+	}
+	if queue.ShouldNotRetryError(errors.New("no such host")) || queue.ShouldNotRetryError(nil) {
+		t.Error("ShouldNotRetryError() = true for an unrelated error")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	task := asynq.NewTask(queue.TypeMikrotikCommand, nil)
+	open := &mikrotik.CircuitOpenError{DeviceID: "router1", RetryAt: time.Now().Add(90 * time.Second)}
+
+	// The device's retry-at time is used even through wrapping
+	if d := queue.RetryDelay(1, fmt.Errorf("login: %w", open), task); d <= 80*time.Second || d > 90*time.Second {
+		t.Errorf("RetryDelay() = %s, want the 90s until the circuit closes", d)
+	}
+	trial := &mikrotik.CircuitOpenError{DeviceID: "router1"}
+	if d := queue.RetryDelay(1, trial, task); d <= 0 || d > 5*time.Second {
+		t.Errorf("RetryDelay() = %s, want a short wait while the trial call is in flight", d)
+	}
+	if d := queue.RetryDelay(1, errors.New("other"), task); d <= 0 {
+		t.Errorf("RetryDelay() = %s, want asynq's backoff for other errors", d)
+	}
+}
@@ -1,6 +1,9 @@
 package queue
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 
 
@@ -26,3 +29,27 @@ type DatabaseOperationPayload struct {
 	Action  string          `json:"action"`
 	Payload json.RawMessage `json:"payload"`
 }
+
+// ExpiryScanPayload configures a subscription expiry scan. Expirations older
+// than Lookback are assumed to have been handled by an earlier scan.
+type ExpiryScanPayload struct {
+	Lookback time.Duration `json:"lookback"`
+}
+
+// DataCapScanPayload configures a data cap scan. Every running subscription on
+// a capped plan is checked, so it has no options yet.
+type DataCapScanPayload struct{}
+
+// MpesaReconcilePayload configures a scan for orders stuck waiting on an STK
+// push result. Orders pending for longer than OlderThan are queried; at most
+// Limit orders are handled per run.
+type MpesaReconcilePayload struct {
+	OlderThan time.Duration `json:"older_than"`
+	Limit     int           `json:"limit"`
+}
+
+// MpesaAutoRefundPayload configures a scan for paid orders whose provisioning
+// failed. At most Limit orders are refunded per run.
+type MpesaAutoRefundPayload struct {
+	Limit int `json:"limit"`
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// ExpiryScanInterval is how often radcheck is scanned for expired subscriptions
+const ExpiryScanInterval = "@every 1m"
+
+// MpesaReconcileInterval is how often orders stuck in PENDING are queried
+const MpesaReconcileInterval = "@every 1m"
+
+// MpesaAutoRefundInterval is how often orders whose provisioning failed are refunded
+const MpesaAutoRefundInterval = "@every 10m"
+
+// DataCapScanInterval is how often the usage of subscriptions on capped plans is summed
+const DataCapScanInterval = "@every 2m"
+
+// Scheduler enqueues periodic tasks on a cron schedule
+type Scheduler struct {
+	scheduler *asynq.Scheduler
+}
+
+// NewScheduler creates a new periodic task scheduler
+func NewScheduler(redisAddr string) *Scheduler {
+	return &Scheduler{
+		scheduler: asynq.NewScheduler(asynq.RedisClientOpt{Addr: redisAddr}, &asynq.SchedulerOpts{
+			Location: time.Local,
+		}),
+	}
+}
+
+// Register schedules taskType to be enqueued with payload on every tick of cronspec
+func (s *Scheduler) Register(cronspec, taskType string, payload interface{}, opts ...asynq.Option) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return s.scheduler.Register(cronspec, asynq.NewTask(taskType, data), opts...)
+}
+
+// RegisterExpiryScan schedules the subscription expiry scan
+func (s *Scheduler) RegisterExpiryScan() (string, error) {
+	return s.Register(ExpiryScanInterval, TypeSubscriptionExpiry, ExpiryScanPayload{},
+		asynq.Queue(QueueDefault),
+		asynq.MaxRetry(1),
+		asynq.Timeout(50*time.Second),
+		// A scan that is still queued when the next tick fires is redundant
+		asynq.Unique(time.Minute),
+	)
+}
+
+// RegisterMpesaReconcile schedules the query of orders stuck waiting on an STK push result
+func (s *Scheduler) RegisterMpesaReconcile() (string, error) {
+	return s.Register(MpesaReconcileInterval, TypeMpesaReconcile, MpesaReconcilePayload{},
+		asynq.Queue(QueueDefault),
+		asynq.MaxRetry(1),
+		asynq.Timeout(50*time.Second),
+		asynq.Unique(time.Minute),
+	)
+}
+
+// RegisterMpesaAutoRefund schedules the refund of paid orders whose provisioning failed
+func (s *Scheduler) RegisterMpesaAutoRefund() (string, error) {
+	return s.Register(MpesaAutoRefundInterval, TypeMpesaAutoRefund, MpesaAutoRefundPayload{},
+		asynq.Queue(QueueDefault),
+		asynq.MaxRetry(1),
+		asynq.Timeout(5*time.Minute),
+		asynq.Unique(10*time.Minute),
+	)
+}
+
+// RegisterDataCapScan schedules the data cap scan
+func (s *Scheduler) RegisterDataCapScan() (string, error) {
+	return s.Register(DataCapScanInterval, TypeDataCapScan, DataCapScanPayload{},
+		asynq.Queue(QueueDefault),
+		asynq.MaxRetry(1),
+		asynq.Timeout(110*time.Second),
+		asynq.Unique(2*time.Minute),
+	)
+}
+
+// Start starts the scheduler
+func (s *Scheduler) Start() error {
+	return s.scheduler.Start()
+}
+
+// Shutdown stops the scheduler
+func (s *Scheduler) Shutdown() {
+	s.scheduler.Shutdown()
+}
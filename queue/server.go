@@ -3,11 +3,15 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hibiken/asynq"
 	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
 	"github.com/ortupik/wifigo/websocket"
 )
 
@@ -28,6 +32,14 @@ type Handler interface {
 type Handlers struct {
 	MikrotikQueueHandler MikrotikQueueHandler // Use the struct directly, not the pointer
 	DatabaseQueueHandler      DatabaseQueueHandler      // Use the struct directly, not the pointer
+	ExpiryQueueHandler   ExpiryQueueHandler
+	// DataCapQueueHandler logs out users over the data cap of their plan
+	DataCapQueueHandler *DataCapQueueHandler
+	// MpesaReconcileHandler settles orders whose STK callback never arrived.
+	// It lives with the M-Pesa handlers, so it is supplied as an interface.
+	MpesaReconcileHandler Handler
+	// MpesaRefundHandler refunds paid orders whose provisioning failed
+	MpesaRefundHandler Handler
 	// Add other handlers here as needed.
 }
 
@@ -42,8 +54,9 @@ func NewServer(redisAddr string, manager *mikrotik.Manager, wsHub *websocket.Hub
 				QueueDefault:   3, // Process 3 default tasks at a time
 				QueueReporting: 2, // Process 2 reporting tasks at a time
 			},
-			Concurrency:  10, // Maximum number of concurrent tasks
-			ErrorHandler: NewErrorHandler(wsHub),
+			Concurrency:    10, // Maximum number of concurrent tasks
+			ErrorHandler:   NewErrorHandler(wsHub),
+			RetryDelayFunc: RetryDelay,
 		},
 	)
 	if server == nil {
@@ -68,6 +81,16 @@ func (s *Server) Start() error {
 
 	mux.HandleFunc(TypeMikrotikCommand, s.handlers.MikrotikQueueHandler.HandleTask)
 	mux.HandleFunc(TypeDatabaseOperation, s.handlers.DatabaseQueueHandler.HandleTask)
+	mux.HandleFunc(TypeSubscriptionExpiry, s.handlers.ExpiryQueueHandler.HandleTask)
+	if s.handlers.DataCapQueueHandler != nil {
+		mux.HandleFunc(TypeDataCapScan, s.handlers.DataCapQueueHandler.HandleTask)
+	}
+	if s.handlers.MpesaReconcileHandler != nil {
+		mux.HandleFunc(TypeMpesaReconcile, s.handlers.MpesaReconcileHandler.HandleTask)
+	}
+	if s.handlers.MpesaRefundHandler != nil {
+		mux.HandleFunc(TypeMpesaAutoRefund, s.handlers.MpesaRefundHandler.HandleTask)
+	}
 
 	return s.server.Start(mux)
 }
@@ -93,6 +116,32 @@ func ShouldNotRetryError(err error) bool {
 	return strings.Contains(errMsg, "is already logged in")
 }
 
+// isPermanentFailure reports whether a MikroTik task failed in a way a retry
+// cannot fix. Anything not listed here, such as a RouterOS trap about a
+// missing host or an unresponsive RADIUS server, is retried.
+func isPermanentFailure(err error) bool {
+	return ShouldNotRetryError(err) ||
+		errors.Is(err, mikrotik.ErrUnknownDevice) ||
+		strings.Contains(err.Error(), "invalid username or password")
+}
+
+// minCircuitRetryDelay is the shortest wait before retrying into a circuit
+// that is about to close or is making its trial call
+const minCircuitRetryDelay = time.Second
+
+// RetryDelay waits out an open MikroTik circuit instead of retrying into it,
+// and falls back to asynq's exponential backoff for everything else
+func RetryDelay(n int, err error, task *asynq.Task) time.Duration {
+	var open *mikrotik.CircuitOpenError
+	if errors.As(err, &open) {
+		if d := open.RetryAfter(); d > minCircuitRetryDelay {
+			return d
+		}
+		return minCircuitRetryDelay
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, task)
+}
+
 func NewErrorHandler(wsHub *websocket.Hub) asynq.ErrorHandlerFunc {
 	return func(ctx context.Context, task *asynq.Task, err error) {
 		fmt.Printf("❌ Task %s failed: %v\n", task.Type(), err)
@@ -108,6 +157,8 @@ func NewErrorHandler(wsHub *websocket.Hub) asynq.ErrorHandlerFunc {
 
 			if ShouldNotRetryError(err) {
 				msg = `{"type":"login","status":"success","message":"You are already logged in"}`
+			} else if payload.Action == ActionMikrotikLoginUser && retriesExhausted(ctx, err) {
+				flagFailedLogin(payload.Payload, err)
 			}
 			wsHub.SendToIP(payload.Ip, []byte(fmt.Sprintf(msg)))
 
@@ -121,3 +172,25 @@ func NewErrorHandler(wsHub *websocket.Hub) asynq.ErrorHandlerFunc {
 		}
 	}
 }
+
+// retriesExhausted reports whether a failed task will not be retried again
+func retriesExhausted(ctx context.Context, err error) bool {
+	if errors.Is(err, asynq.SkipRetry) {
+		return true
+	}
+	retried, ok := asynq.GetRetryCount(ctx)
+	maxRetry, okMax := asynq.GetMaxRetry(ctx)
+	return ok && okMax && retried >= maxRetry
+}
+
+// flagFailedLogin marks the order of a hotspot login that kept failing as
+// paid but not provisioned, so that it can be refunded
+func flagFailedLogin(raw json.RawMessage, err error) {
+	var login dto.MikrotikLogin
+	if jsonErr := json.Unmarshal(raw, &login); jsonErr != nil || login.OrderID == 0 {
+		return
+	}
+	if flagErr := service.MarkProvisioningFailed(login.OrderID, fmt.Sprintf("MikroTik login of %s failed: %v", login.Username, err)); flagErr != nil {
+		fmt.Printf("Failed to flag order %d after its login failed: %v\n", login.OrderID, flagErr)
+	}
+}
@@ -0,0 +1,233 @@
+package radius
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Standard attribute types
+const (
+	AttrUserName             byte = 1
+	AttrUserPassword         byte = 2
+	AttrCHAPPassword         byte = 3
+	AttrNASIPAddress         byte = 4
+	AttrNASPort              byte = 5
+	AttrServiceType          byte = 6
+	AttrFramedProtocol       byte = 7
+	AttrFramedIPAddress      byte = 8
+	AttrFilterID             byte = 11
+	AttrReplyMessage         byte = 18
+	AttrState                byte = 24
+	AttrClass                byte = 25
+	AttrVendorSpecific       byte = 26
+	AttrSessionTimeout       byte = 27
+	AttrIdleTimeout          byte = 28
+	AttrCalledStationID      byte = 30
+	AttrCallingStationID     byte = 31
+	AttrNASIdentifier        byte = 32
+	AttrAcctStatusType       byte = 40
+	AttrAcctDelayTime        byte = 41
+	AttrAcctInputOctets      byte = 42
+	AttrAcctOutputOctets     byte = 43
+	AttrAcctSessionID        byte = 44
+	AttrAcctSessionTime      byte = 46
+	AttrAcctTerminateCause   byte = 49
+	AttrAcctInputGigawords   byte = 52
+	AttrAcctOutputGigawords  byte = 53
+	AttrEventTimestamp       byte = 55
+	AttrCHAPChallenge        byte = 60
+	AttrNASPortType          byte = 61
+	AttrConnectInfo          byte = 77
+	AttrMessageAuthenticator byte = 80
+	AttrAcctInterimInterval  byte = 85
+	AttrNASPortID            byte = 87
+	AttrErrorCause           byte = 101
+)
+
+// Acct-Status-Type values (RFC 2866 section 5.1)
+const (
+	AcctStatusStart         uint32 = 1
+	AcctStatusStop          uint32 = 2
+	AcctStatusInterimUpdate uint32 = 3
+	AcctStatusAccountingOn  uint32 = 7
+	AcctStatusAccountingOff uint32 = 8
+)
+
+// terminateCauses names the Acct-Terminate-Cause values (RFC 2866 section 5.10)
+var terminateCauses = []string{
+	1: "User-Request", 2: "Lost-Carrier", 3: "Lost-Service", 4: "Idle-Timeout",
+	5: "Session-Timeout", 6: "Admin-Reset", 7: "Admin-Reboot", 8: "Port-Error",
+	9: "NAS-Error", 10: "NAS-Request", 11: "NAS-Reboot", 12: "Port-Unneeded",
+	13: "Port-Preempted", 14: "Port-Suspended", 15: "Service-Unavailable",
+	16: "Callback", 17: "User-Error", 18: "Host-Request",
+}
+
+// TerminateCause returns the FreeRADIUS name of an Acct-Terminate-Cause, or
+// the number for a value it does not know
+func TerminateCause(v uint32) string {
+	if int(v) < len(terminateCauses) && terminateCauses[v] != "" {
+		return terminateCauses[v]
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// nasPortTypes names the common NAS-Port-Type values (RFC 2865 section 5.41)
+var nasPortTypes = map[uint32]string{
+	0: "Async", 5: "Virtual", 15: "Ethernet", 19: "Wireless-802.11", 20: "Wireless-Other",
+}
+
+// NASPortType returns the FreeRADIUS name of a NAS-Port-Type, or the number
+// for a value it does not know
+func NASPortType(v uint32) string {
+	if name, ok := nasPortTypes[v]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// VendorMikrotik is the IANA enterprise number of MikroTik
+const VendorMikrotik uint32 = 14988
+
+// MikroTik vendor attribute types
+const (
+	MikrotikRecvLimit           byte = 1
+	MikrotikXmitLimit           byte = 2
+	MikrotikGroup               byte = 3
+	MikrotikRateLimit           byte = 8
+	MikrotikRealm               byte = 9
+	MikrotikAddressList         byte = 19
+	MikrotikTotalLimit          byte = 17
+	MikrotikTotalLimitGigawords byte = 18
+)
+
+// ErrorCause values of Disconnect and CoA NAKs (RFC 5176 section 3.5)
+const (
+	ErrorCauseResidualSessionRemoved     = 201
+	ErrorCauseUnsupportedAttribute       = 401
+	ErrorCauseMissingAttribute           = 402
+	ErrorCauseNASIdentificationMismatch  = 403
+	ErrorCauseInvalidRequest             = 404
+	ErrorCauseUnsupportedService         = 405
+	ErrorCauseUnsupportedExtension       = 406
+	ErrorCauseAdministrativelyProhibited = 501
+	ErrorCauseRequestNotRoutable         = 502
+	ErrorCauseSessionNotFound            = 503
+	ErrorCauseSessionNotRemovable        = 504
+	ErrorCauseOtherProxyProcessingError  = 505
+	ErrorCauseResourcesUnavailable       = 506
+	ErrorCauseRequestInitiated           = 507
+)
+
+// ErrUnknownAttribute is returned for an attribute name the dictionary does
+// not know how to encode
+var ErrUnknownAttribute = errors.New("unknown RADIUS attribute")
+
+// String returns a text or string attribute
+func String(t byte, s string) Attribute {
+	return Attribute{Type: t, Value: []byte(s)}
+}
+
+// Integer returns a 32 bit integer attribute
+func Integer(t byte, v uint32) Attribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, v)
+	return Attribute{Type: t, Value: value}
+}
+
+// IPAddr returns an IPv4 address attribute
+func IPAddr(t byte, ip net.IP) (Attribute, error) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return Attribute{}, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	return Attribute{Type: t, Value: []byte(v4)}, nil
+}
+
+// VendorAttribute wraps the vendor attribute vendorType of vendorID in a
+// Vendor-Specific attribute
+func VendorAttribute(vendorID uint32, vendorType byte, value []byte) Attribute {
+	v := make([]byte, 6, 6+len(value))
+	binary.BigEndian.PutUint32(v[:4], vendorID)
+	v[4] = vendorType
+	v[5] = byte(len(value) + 2)
+	return Attribute{Type: AttrVendorSpecific, Value: append(v, value...)}
+}
+
+type attrKind int
+
+const (
+	kindText attrKind = iota
+	kindInteger
+	kindIPAddr
+)
+
+type dictEntry struct {
+	vendor uint32 // 0 for a standard attribute
+	typ    byte
+	kind   attrKind
+}
+
+// dictionary lists the reply attributes the hotspot sets, by their
+// FreeRADIUS name
+var dictionary = map[string]dictEntry{
+	"Framed-IP-Address":              {typ: AttrFramedIPAddress, kind: kindIPAddr},
+	"Filter-Id":                      {typ: AttrFilterID, kind: kindText},
+	"Reply-Message":                  {typ: AttrReplyMessage, kind: kindText},
+	"Class":                          {typ: AttrClass, kind: kindText},
+	"Session-Timeout":                {typ: AttrSessionTimeout, kind: kindInteger},
+	"Idle-Timeout":                   {typ: AttrIdleTimeout, kind: kindInteger},
+	"Acct-Interim-Interval":          {typ: AttrAcctInterimInterval, kind: kindInteger},
+	"Mikrotik-Recv-Limit":            {vendor: VendorMikrotik, typ: MikrotikRecvLimit, kind: kindInteger},
+	"Mikrotik-Xmit-Limit":            {vendor: VendorMikrotik, typ: MikrotikXmitLimit, kind: kindInteger},
+	"Mikrotik-Group":                 {vendor: VendorMikrotik, typ: MikrotikGroup, kind: kindText},
+	"Mikrotik-Rate-Limit":            {vendor: VendorMikrotik, typ: MikrotikRateLimit, kind: kindText},
+	"Mikrotik-Realm":                 {vendor: VendorMikrotik, typ: MikrotikRealm, kind: kindText},
+	"Mikrotik-Address-List":          {vendor: VendorMikrotik, typ: MikrotikAddressList, kind: kindText},
+	"Mikrotik-Total-Limit":           {vendor: VendorMikrotik, typ: MikrotikTotalLimit, kind: kindInteger},
+	"Mikrotik-Total-Limit-Gigawords": {vendor: VendorMikrotik, typ: MikrotikTotalLimitGigawords, kind: kindInteger},
+}
+
+// KnownAttribute reports whether EncodeAttribute can encode the attribute name
+func KnownAttribute(name string) bool {
+	_, ok := dictionary[name]
+	return ok
+}
+
+// EncodeAttribute encodes a reply attribute stored by name and text value, as
+// in radreply and radgroupreply
+func EncodeAttribute(name, value string) (Attribute, error) {
+	entry, ok := dictionary[name]
+	if !ok {
+		return Attribute{}, fmt.Errorf("%w: %s", ErrUnknownAttribute, name)
+	}
+
+	var raw []byte
+	switch entry.kind {
+	case kindText:
+		if len(value) > 247 {
+			return Attribute{}, fmt.Errorf("%s is too long", name)
+		}
+		raw = []byte(value)
+	case kindInteger:
+		v, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return Attribute{}, fmt.Errorf("%s must be a 32 bit integer: %w", name, err)
+		}
+		raw = Integer(0, uint32(v)).Value
+	case kindIPAddr:
+		ip := net.ParseIP(strings.TrimSpace(value)).To4()
+		if ip == nil {
+			return Attribute{}, fmt.Errorf("%s must be an IPv4 address", name)
+		}
+		raw = []byte(ip)
+	}
+
+	if entry.vendor != 0 {
+		return VendorAttribute(entry.vendor, entry.typ, raw), nil
+	}
+	return Attribute{Type: entry.typ, Value: raw}, nil
+}
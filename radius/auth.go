@@ -0,0 +1,110 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidPassword is returned for a User-Password that cannot be decrypted
+var ErrInvalidPassword = errors.New("invalid User-Password")
+
+// AddUserPassword adds password to an Access-Request as an encrypted
+// User-Password (RFC 2865 section 5.2). The request's authenticator is drawn
+// first when it has none, since the password is encrypted with it.
+func (p *Packet) AddUserPassword(password string, secret []byte) error {
+	if p.Authenticator == ([16]byte{}) {
+		if _, err := rand.Read(p.Authenticator[:]); err != nil {
+			return err
+		}
+	}
+	if len(password) > 128 {
+		return fmt.Errorf("%w: longer than 128 octets", ErrInvalidPassword)
+	}
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+
+	value := make([]byte, len(padded))
+	prev := p.Authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		b := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			value[i+j] = padded[i+j] ^ b[j]
+		}
+		prev = value[i : i+16]
+	}
+	p.Add(Attribute{Type: AttrUserPassword, Value: value})
+	return nil
+}
+
+// DecryptUserPassword decrypts a User-Password sent in a request with
+// authenticator
+func DecryptUserPassword(value []byte, authenticator [16]byte, secret []byte) (string, error) {
+	if len(value) < 16 || len(value) > 128 || len(value)%16 != 0 {
+		return "", fmt.Errorf("%w: %d octets", ErrInvalidPassword, len(value))
+	}
+	password := make([]byte, len(value))
+	prev := authenticator[:]
+	for i := 0; i < len(value); i += 16 {
+		b := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			password[i+j] = value[i+j] ^ b[j]
+		}
+		prev = value[i : i+16]
+	}
+	return string(bytes.TrimRight(password, "\x00")), nil
+}
+
+// VerifyCHAP checks a CHAP-Password against the cleartext password. The
+// challenge is the CHAP-Challenge attribute, or the request authenticator
+// when there is none (RFC 2865 section 2.2).
+func VerifyCHAP(password string, chapPassword, challenge []byte) bool {
+	if len(chapPassword) != 17 {
+		return false
+	}
+	h := md5.New()
+	h.Write(chapPassword[:1]) // CHAP identifier
+	h.Write([]byte(password))
+	h.Write(challenge)
+	return subtle.ConstantTimeCompare(h.Sum(nil), chapPassword[1:]) == 1
+}
+
+// CHAPChallenge returns the challenge a CHAP-Password of p answers
+func (p *Packet) CHAPChallenge() []byte {
+	if challenge, ok := p.Get(AttrCHAPChallenge); ok {
+		return challenge
+	}
+	return p.Authenticator[:]
+}
+
+// verifyRequestMessageAuthenticator checks the Message-Authenticator of
+// request b, if it has one (RFC 3579 section 3.2)
+func verifyRequestMessageAuthenticator(b, secret []byte) (present, ok bool) {
+	for i := headerLen; i+2 <= len(b); i += int(b[i+1]) {
+		if b[i+1] < 2 {
+			return false, false
+		}
+		if b[i] != AttrMessageAuthenticator {
+			continue
+		}
+		if b[i+1] != 18 || i+18 > len(b) {
+			return true, false
+		}
+		signed := make([]byte, len(b))
+		copy(signed, b)
+		for j := i + 2; j < i+18; j++ {
+			signed[j] = 0
+		}
+		mac := hmac.New(md5.New, secret)
+		mac.Write(signed)
+		return true, hmac.Equal(mac.Sum(nil), b[i+2:i+18])
+	}
+	return false, false
+}
@@ -0,0 +1,142 @@
+package radius
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultCoAPort is the UDP port a NAS listens on for Disconnect and CoA
+	// requests (RFC 5176)
+	DefaultCoAPort = 3799
+	// DefaultTimeout is how long the client waits for each answer
+	DefaultTimeout = 2 * time.Second
+	// DefaultRetries is how many times an unanswered request is sent again
+	DefaultRetries = 2
+)
+
+var (
+	// ErrNAK means the NAS refused the request; the error is a *NAKError
+	ErrNAK = errors.New("RADIUS request refused")
+	// ErrNoResponse means the NAS did not answer any attempt
+	ErrNoResponse = errors.New("no RADIUS response")
+)
+
+// NAKError is a Disconnect-NAK or CoA-NAK
+type NAKError struct {
+	Code       Code
+	ErrorCause uint32 // 0 when the NAS sent none
+}
+
+func (e *NAKError) Error() string {
+	if e.ErrorCause == 0 {
+		return e.Code.String()
+	}
+	return fmt.Sprintf("%s, Error-Cause %d", e.Code, e.ErrorCause)
+}
+
+// Is lets errors.Is match a NAKError with ErrNAK
+func (e *NAKError) Is(target error) bool {
+	return target == ErrNAK
+}
+
+// Client sends Disconnect and CoA requests to a NAS over UDP
+type Client struct {
+	Timeout time.Duration // Per attempt
+	Retries int           // Attempts after the first
+}
+
+// NewClient creates a client with the default timeout and retries
+func NewClient() *Client {
+	return &Client{Timeout: DefaultTimeout, Retries: DefaultRetries}
+}
+
+// Disconnect asks the NAS at addr to end the sessions attrs identify,
+// usually User-Name with Acct-Session-Id and Framed-IP-Address
+func (c *Client) Disconnect(ctx context.Context, addr string, secret []byte, attrs []Attribute) error {
+	return c.send(ctx, addr, secret, CodeDisconnectRequest, CodeDisconnectACK, attrs)
+}
+
+// CoA asks the NAS at addr to apply the attributes in attrs to the sessions
+// they identify
+func (c *Client) CoA(ctx context.Context, addr string, secret []byte, attrs []Attribute) error {
+	return c.send(ctx, addr, secret, CodeCoARequest, CodeCoAACK, attrs)
+}
+
+func (c *Client) send(ctx context.Context, addr string, secret []byte, code, ack Code, attrs []Attribute) error {
+	req := NewPacket(code)
+	req.Attributes = attrs
+	resp, err := c.Exchange(ctx, addr, secret, req)
+	if err != nil {
+		return err
+	}
+	switch resp.Code {
+	case ack:
+		return nil
+	case ack + 1: // The NAK follows the ACK
+		cause, _ := resp.GetInteger(AttrErrorCause)
+		return &NAKError{Code: resp.Code, ErrorCause: cause}
+	}
+	return fmt.Errorf("unexpected %s to %s", resp.Code, code)
+}
+
+// Exchange sends req to addr, signed with secret, and returns the first
+// answer with a matching identifier and a valid Response Authenticator.
+// Unanswered requests are sent again, unchanged, up to Retries times.
+func (c *Client) Exchange(ctx context.Context, addr string, secret []byte, req *Packet) (*Packet, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("RADIUS shared secret is empty")
+	}
+	b, err := req.Encode(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	buf := make([]byte, MaxPacketLen)
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(b); err != nil {
+			return nil, fmt.Errorf("failed to send %s to %s: %w", req.Code, addr, err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break // Send again
+				}
+				return nil, fmt.Errorf("failed to read answer from %s: %w", addr, err)
+			}
+			resp, err := Parse(buf[:n])
+			if err != nil || resp.Identifier != req.Identifier || !VerifyResponse(buf[:n], req, secret) {
+				continue // Not the answer to this request, or forged
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("%w to %s from %s after %d attempts", ErrNoResponse, req.Code, addr, c.Retries+1)
+}
@@ -0,0 +1,99 @@
+package radius_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/radius/radiustest"
+)
+
+func newTestClient() *radius.Client {
+	return &radius.Client{Timeout: 100 * time.Millisecond, Retries: 2}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+
+	attrs := []radius.Attribute{
+		radius.String(radius.AttrUserName, "0712345678@Tecsurf"),
+		radius.String(radius.AttrAcctSessionID, "81a00003"),
+	}
+	if err := newTestClient().Disconnect(context.Background(), nas.Addr(), []byte(nas.Secret()), attrs); err != nil {
+		t.Fatalf("Disconnect() error = %v", err)
+	}
+
+	requests := nas.Requests()
+	if len(requests) != 1 || requests[0].Code != radius.CodeDisconnectRequest {
+		t.Fatalf("NAS received %d requests, want one Disconnect-Request", len(requests))
+	}
+	if got := requests[0].GetString(radius.AttrAcctSessionID); got != "81a00003" {
+		t.Errorf("Acct-Session-Id = %q, want 81a00003", got)
+	}
+}
+
+func TestClientCoANAK(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	nas.Handle(func(req *radius.Packet) *radius.Packet {
+		return radiustest.NAK(req, radius.ErrorCauseSessionNotFound)
+	})
+
+	err := newTestClient().CoA(context.Background(), nas.Addr(), []byte(nas.Secret()), nil)
+	if !errors.Is(err, radius.ErrNAK) {
+		t.Fatalf("CoA() error = %v, want ErrNAK", err)
+	}
+	var nak *radius.NAKError
+	if !errors.As(err, &nak) || nak.Code != radius.CodeCoANAK || nak.ErrorCause != radius.ErrorCauseSessionNotFound {
+		t.Errorf("CoA() error = %#v, want a CoA-NAK with Error-Cause 503", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	nas.Drop(2)
+
+	if err := newTestClient().CoA(context.Background(), nas.Addr(), []byte(nas.Secret()), nil); err != nil {
+		t.Fatalf("CoA() error = %v, want the third attempt answered", err)
+	}
+	requests := nas.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("NAS received %d requests, want 3", len(requests))
+	}
+	if requests[0].Identifier != requests[2].Identifier || requests[0].Authenticator != requests[2].Authenticator {
+		t.Error("retransmissions should repeat the request unchanged")
+	}
+}
+
+func TestClientNoResponse(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	nas.Handle(func(req *radius.Packet) *radius.Packet { return nil })
+
+	client := &radius.Client{Timeout: 50 * time.Millisecond, Retries: 1}
+	err := client.Disconnect(context.Background(), nas.Addr(), []byte(nas.Secret()), nil)
+	if !errors.Is(err, radius.ErrNoResponse) {
+		t.Fatalf("Disconnect() error = %v, want ErrNoResponse", err)
+	}
+	if got := len(nas.Requests()); got != 2 {
+		t.Errorf("NAS received %d requests, want 2", got)
+	}
+}
+
+func TestClientWrongSecret(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+
+	client := &radius.Client{Timeout: 50 * time.Millisecond}
+	err := client.Disconnect(context.Background(), nas.Addr(), []byte("wrong"), nil)
+	if !errors.Is(err, radius.ErrNoResponse) {
+		t.Fatalf("Disconnect() error = %v, want ErrNoResponse", err)
+	}
+	if nas.Rejected() != 1 {
+		t.Errorf("NAS rejected %d requests, want 1", nas.Rejected())
+	}
+}
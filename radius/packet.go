@@ -0,0 +1,305 @@
+// Package radius encodes and decodes RADIUS packets (RFC 2865, 2866), serves
+// Access and Accounting requests, and sends Disconnect and CoA requests to a
+// NAS (RFC 5176).
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Code is the type of a RADIUS packet
+type Code byte
+
+// Packet codes
+const (
+	CodeAccessRequest      Code = 1
+	CodeAccessAccept       Code = 2
+	CodeAccessReject       Code = 3
+	CodeAccountingRequest  Code = 4
+	CodeAccountingResponse Code = 5
+	CodeAccessChallenge    Code = 11
+	CodeDisconnectRequest  Code = 40
+	CodeDisconnectACK      Code = 41
+	CodeDisconnectNAK      Code = 42
+	CodeCoARequest         Code = 43
+	CodeCoAACK             Code = 44
+	CodeCoANAK             Code = 45
+)
+
+func (c Code) String() string {
+	switch c {
+	case CodeAccessRequest:
+		return "Access-Request"
+	case CodeAccessAccept:
+		return "Access-Accept"
+	case CodeAccessReject:
+		return "Access-Reject"
+	case CodeAccountingRequest:
+		return "Accounting-Request"
+	case CodeAccountingResponse:
+		return "Accounting-Response"
+	case CodeAccessChallenge:
+		return "Access-Challenge"
+	case CodeDisconnectRequest:
+		return "Disconnect-Request"
+	case CodeDisconnectACK:
+		return "Disconnect-ACK"
+	case CodeDisconnectNAK:
+		return "Disconnect-NAK"
+	case CodeCoARequest:
+		return "CoA-Request"
+	case CodeCoAACK:
+		return "CoA-ACK"
+	case CodeCoANAK:
+		return "CoA-NAK"
+	}
+	return fmt.Sprintf("Code(%d)", byte(c))
+}
+
+const (
+	headerLen = 20
+	// MaxPacketLen is the largest packet RFC 2865 allows
+	MaxPacketLen = 4096
+)
+
+// ErrMalformedPacket is returned for bytes that are not a RADIUS packet
+var ErrMalformedPacket = errors.New("malformed RADIUS packet")
+
+// Attribute is a RADIUS attribute. Vendor-Specific attributes keep their
+// vendor id and sub-attribute in Value; see VendorAttribute.
+type Attribute struct {
+	Type  byte
+	Value []byte
+}
+
+// Packet is a RADIUS packet
+type Packet struct {
+	Code          Code
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []Attribute
+}
+
+// NewPacket returns a packet of code with a random identifier
+func NewPacket(code Code) *Packet {
+	var id [1]byte
+	_, _ = rand.Read(id[:])
+	return &Packet{Code: code, Identifier: id[0]}
+}
+
+// Add appends an attribute to the packet
+func (p *Packet) Add(attr Attribute) {
+	p.Attributes = append(p.Attributes, attr)
+}
+
+// Get returns the value of the first attribute of type t
+func (p *Packet) Get(t byte) ([]byte, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type == t {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// GetString returns the first attribute of type t as a string
+func (p *Packet) GetString(t byte) string {
+	v, _ := p.Get(t)
+	return string(v)
+}
+
+// GetInteger returns the first attribute of type t as a 32 bit integer
+func (p *Packet) GetInteger(t byte) (uint32, bool) {
+	v, ok := p.Get(t)
+	if !ok || len(v) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(v), true
+}
+
+// GetVendor returns the value of the first vendor attribute vendorType of
+// vendorID
+func (p *Packet) GetVendor(vendorID uint32, vendorType byte) ([]byte, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type != AttrVendorSpecific || len(attr.Value) < 6 {
+			continue
+		}
+		if binary.BigEndian.Uint32(attr.Value[:4]) == vendorID && attr.Value[4] == vendorType {
+			length := int(attr.Value[5])
+			if length < 2 || 4+length > len(attr.Value) {
+				continue
+			}
+			return attr.Value[6 : 4+length], true
+		}
+	}
+	return nil, false
+}
+
+// marshal writes the packet with authenticator auth
+func (p *Packet) marshal(auth [16]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(headerLen)
+	buf.Write([]byte{byte(p.Code), p.Identifier, 0, 0})
+	buf.Write(auth[:])
+	for _, attr := range p.Attributes {
+		if len(attr.Value) > 253 {
+			return nil, fmt.Errorf("attribute %d is %d bytes, at most 253 fit", attr.Type, len(attr.Value))
+		}
+		buf.WriteByte(attr.Type)
+		buf.WriteByte(byte(len(attr.Value) + 2))
+		buf.Write(attr.Value)
+	}
+	if buf.Len() > MaxPacketLen {
+		return nil, fmt.Errorf("packet is %d bytes, at most %d fit", buf.Len(), MaxPacketLen)
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+// Encode signs a request whose authenticator is the MD5 of the packet and
+// secret: Accounting, Disconnect and CoA requests (RFC 2866, 5176). An
+// Access-Request keeps its random authenticator instead, drawn here when it
+// has none. A Message-Authenticator attribute in the packet is filled in first.
+func (p *Packet) Encode(secret []byte) ([]byte, error) {
+	if p.Code == CodeAccessRequest {
+		if p.Authenticator == ([16]byte{}) {
+			if _, err := rand.Read(p.Authenticator[:]); err != nil {
+				return nil, err
+			}
+		}
+		b, err := p.marshal(p.Authenticator)
+		if err != nil {
+			return nil, err
+		}
+		signMessageAuthenticator(b, secret)
+		return b, nil
+	}
+
+	b, err := p.marshal([16]byte{})
+	if err != nil {
+		return nil, err
+	}
+	signMessageAuthenticator(b, secret)
+	sum := md5Sum(b, secret)
+	copy(b[4:20], sum[:])
+	copy(p.Authenticator[:], sum[:])
+	return b, nil
+}
+
+// EncodeResponse signs a response to request with the Response
+// Authenticator of RFC 2865
+func (p *Packet) EncodeResponse(request *Packet, secret []byte) ([]byte, error) {
+	p.Identifier = request.Identifier
+	b, err := p.marshal(request.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+	signMessageAuthenticator(b, secret)
+	sum := md5Sum(b, secret)
+	copy(b[4:20], sum[:])
+	copy(p.Authenticator[:], sum[:])
+	return b, nil
+}
+
+// Parse decodes a packet without checking its authenticator
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedPacket, len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < headerLen || length > len(b) || length > MaxPacketLen {
+		return nil, fmt.Errorf("%w: length %d of %d bytes", ErrMalformedPacket, length, len(b))
+	}
+	b = b[:length] // Octets past the length are padding (RFC 2865 section 3)
+
+	p := &Packet{Code: Code(b[0]), Identifier: b[1]}
+	copy(p.Authenticator[:], b[4:20])
+	for rest := b[headerLen:]; len(rest) > 0; {
+		if len(rest) < 2 || int(rest[1]) < 2 || int(rest[1]) > len(rest) {
+			return nil, fmt.Errorf("%w: truncated attribute", ErrMalformedPacket)
+		}
+		value := make([]byte, int(rest[1])-2)
+		copy(value, rest[2:rest[1]])
+		p.Attributes = append(p.Attributes, Attribute{Type: rest[0], Value: value})
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+// VerifyRequest checks the authenticator of an Accounting, Disconnect or CoA
+// request b against secret
+func VerifyRequest(b, secret []byte) bool {
+	b, ok := trimPacket(b)
+	if !ok {
+		return false
+	}
+	signed := make([]byte, len(b))
+	copy(signed, b)
+	for i := 4; i < 20; i++ {
+		signed[i] = 0
+	}
+	sum := md5Sum(signed, secret)
+	return hmac.Equal(sum[:], b[4:20])
+}
+
+// VerifyResponse checks the Response Authenticator of response b to request
+func VerifyResponse(b []byte, request *Packet, secret []byte) bool {
+	b, ok := trimPacket(b)
+	if !ok {
+		return false
+	}
+	signed := make([]byte, len(b))
+	copy(signed, b)
+	copy(signed[4:20], request.Authenticator[:])
+	sum := md5Sum(signed, secret)
+	return hmac.Equal(sum[:], b[4:20])
+}
+
+// trimPacket cuts the padding after the length of packet b
+func trimPacket(b []byte) ([]byte, bool) {
+	if len(b) < headerLen {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < headerLen || length > len(b) {
+		return nil, false
+	}
+	return b[:length], true
+}
+
+func md5Sum(b, secret []byte) [16]byte {
+	h := md5.New()
+	h.Write(b)
+	h.Write(secret)
+	var sum [16]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// signMessageAuthenticator fills in the HMAC-MD5 of a Message-Authenticator
+// attribute of packet b (RFC 3579). The authenticator field of b must hold
+// what it is signed over: zeros for a request, the request's authenticator
+// for a response.
+func signMessageAuthenticator(b, secret []byte) {
+	for i := headerLen; i+2 <= len(b); i += int(b[i+1]) {
+		if b[i+1] < 2 {
+			return
+		}
+		if b[i] == AttrMessageAuthenticator && b[i+1] == 18 {
+			for j := i + 2; j < i+18; j++ {
+				b[j] = 0
+			}
+			mac := hmac.New(md5.New, secret)
+			mac.Write(b)
+			copy(b[i+2:i+18], mac.Sum(nil))
+			return
+		}
+	}
+}
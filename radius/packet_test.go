@@ -0,0 +1,117 @@
+package radius_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ortupik/wifigo/radius"
+)
+
+func TestEncodeParseRoundTrip(t *testing.T) {
+	secret := []byte("s3cret")
+	req := radius.NewPacket(radius.CodeCoARequest)
+	req.Add(radius.String(radius.AttrUserName, "0712345678@Tecsurf"))
+	req.Add(radius.String(radius.AttrAcctSessionID, "81a00003"))
+	rateLimit, err := radius.EncodeAttribute("Mikrotik-Rate-Limit", "2048k/2048k")
+	if err != nil {
+		t.Fatalf("EncodeAttribute() error = %v", err)
+	}
+	req.Add(rateLimit)
+
+	b, err := req.Encode(secret)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if !radius.VerifyRequest(b, secret) {
+		t.Error("VerifyRequest() = false for a request signed with the secret")
+	}
+	if radius.VerifyRequest(b, []byte("other")) {
+		t.Error("VerifyRequest() = true for another secret")
+	}
+
+	got, err := radius.Parse(b)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got.Code != radius.CodeCoARequest || got.Identifier != req.Identifier || got.Authenticator != req.Authenticator {
+		t.Errorf("Parse() header = %s %d, want %s %d", got.Code, got.Identifier, req.Code, req.Identifier)
+	}
+	if name := got.GetString(radius.AttrUserName); name != "0712345678@Tecsurf" {
+		t.Errorf("User-Name = %q", name)
+	}
+	if v, ok := got.GetVendor(radius.VendorMikrotik, radius.MikrotikRateLimit); !ok || string(v) != "2048k/2048k" {
+		t.Errorf("Mikrotik-Rate-Limit = %q, %v", v, ok)
+	}
+}
+
+func TestResponseAuthenticator(t *testing.T) {
+	secret := []byte("s3cret")
+	req := radius.NewPacket(radius.CodeDisconnectRequest)
+	if _, err := req.Encode(secret); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	resp := &radius.Packet{Code: radius.CodeDisconnectACK}
+	b, err := resp.EncodeResponse(req, secret)
+	if err != nil {
+		t.Fatalf("EncodeResponse() error = %v", err)
+	}
+	if !radius.VerifyResponse(b, req, secret) {
+		t.Error("VerifyResponse() = false for a response signed with the secret")
+	}
+	if radius.VerifyResponse(b, req, []byte("other")) {
+		t.Error("VerifyResponse() = true for another secret")
+	}
+	padded := append(append([]byte(nil), b...), 0, 0, 0)
+	if !radius.VerifyResponse(padded, req, secret) {
+		t.Error("VerifyResponse() = false for a response with padding")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"short":                 {1, 2, 0, 20},
+		"length past end":       append([]byte{40, 1, 0, 40}, make([]byte, 16)...),
+		"truncated attribute":   append(append([]byte{40, 1, 0, 23}, make([]byte, 16)...), 1, 9, 'a'),
+		"zero length attribute": append(append([]byte{40, 1, 0, 22}, make([]byte, 16)...), 1, 0),
+	}
+	for name, b := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := radius.Parse(b); !errors.Is(err, radius.ErrMalformedPacket) {
+				t.Errorf("Parse() error = %v, want ErrMalformedPacket", err)
+			}
+		})
+	}
+}
+
+func TestEncodeAttribute(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "Session-Timeout", value: "3600", want: []byte{27, 0, 0, 0x0e, 0x10}},
+		{name: "Framed-IP-Address", value: "10.5.50.2", want: []byte{8, 10, 5, 50, 2}},
+		{name: "Mikrotik-Total-Limit", value: "1048576", want: []byte{26, 0, 0, 0x3a, 0x8c, 17, 6, 0, 0x10, 0, 0}},
+		{name: "Session-Timeout", value: "an hour", wantErr: true},
+		{name: "Framed-IP-Address", value: "fe80::1", wantErr: true},
+		{name: "Cisco-AVPair", value: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.value, func(t *testing.T) {
+			attr, err := radius.EncodeAttribute(tt.name, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeAttribute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := append([]byte{attr.Type}, attr.Value...)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("EncodeAttribute() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
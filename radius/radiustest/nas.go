@@ -0,0 +1,176 @@
+// Package radiustest provides an in-process fake NAS for tests.
+//
+// The NAS listens on a local UDP port for Disconnect and CoA requests (RFC
+// 5176), checks their authenticator against its secret and ACKs them. Handle
+// overrides the answer, Drop leaves requests unanswered to exercise retries.
+package radiustest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ortupik/wifigo/radius"
+)
+
+// DefaultSecret is the shared secret of a new NAS
+const DefaultSecret = "testing123"
+
+// HandlerFunc answers a request in place of the default ACK. Returning nil
+// leaves the request unanswered.
+type HandlerFunc func(req *radius.Packet) *radius.Packet
+
+// NAS is a fake NAS listening on a local UDP port
+type NAS struct {
+	secret []byte
+
+	conn net.PacketConn
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	handler  HandlerFunc
+	drop     int
+	requests []*radius.Packet
+	rejected int
+}
+
+// NewNAS starts a fake NAS sharing secret, DefaultSecret when empty, on a
+// random local port. Callers should Close it when done.
+func NewNAS(secret string) *NAS {
+	if secret == "" {
+		secret = DefaultSecret
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("radiustest: failed to listen on a port: %v", err))
+	}
+	n := &NAS{
+		secret: []byte(secret),
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	n.wg.Add(1)
+	go n.serve()
+	return n
+}
+
+// Addr returns the host:port the NAS listens on
+func (n *NAS) Addr() string {
+	return n.conn.LocalAddr().String()
+}
+
+// Secret returns the shared secret of the NAS
+func (n *NAS) Secret() string {
+	return string(n.secret)
+}
+
+// Close stops the NAS
+func (n *NAS) Close() {
+	close(n.done)
+	n.conn.Close()
+	n.wg.Wait()
+}
+
+// Handle answers requests with h
+func (n *NAS) Handle(h HandlerFunc) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handler = h
+}
+
+// Drop leaves the next count requests unanswered
+func (n *NAS) Drop(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drop = count
+}
+
+// Requests returns the requests received with a valid authenticator,
+// retransmissions included
+func (n *NAS) Requests() []*radius.Packet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*radius.Packet(nil), n.requests...)
+}
+
+// Rejected returns how many requests failed the authenticator check
+func (n *NAS) Rejected() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rejected
+}
+
+// Answer returns the default answer to req: an ACK, or a NAK with Error-Cause
+// 404 for a request that is neither Disconnect nor CoA
+func Answer(req *radius.Packet) *radius.Packet {
+	switch req.Code {
+	case radius.CodeDisconnectRequest:
+		return &radius.Packet{Code: radius.CodeDisconnectACK}
+	case radius.CodeCoARequest:
+		return &radius.Packet{Code: radius.CodeCoAACK}
+	}
+	return NAK(req, radius.ErrorCauseInvalidRequest)
+}
+
+// NAK returns the NAK to req carrying cause
+func NAK(req *radius.Packet, cause uint32) *radius.Packet {
+	code := radius.CodeCoANAK
+	if req.Code == radius.CodeDisconnectRequest {
+		code = radius.CodeDisconnectNAK
+	}
+	resp := &radius.Packet{Code: code}
+	resp.Add(radius.Integer(radius.AttrErrorCause, cause))
+	return resp
+}
+
+func (n *NAS) serve() {
+	defer n.wg.Done()
+
+	buf := make([]byte, radius.MaxPacketLen)
+	for {
+		size, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		secret := n.secret
+		req, err := radius.Parse(buf[:size])
+		if err != nil || !radius.VerifyRequest(buf[:size], secret) {
+			n.mu.Lock()
+			n.rejected++
+			n.mu.Unlock()
+			continue
+		}
+
+		n.mu.Lock()
+		n.requests = append(n.requests, req)
+		handler := n.handler
+		dropped := n.drop > 0
+		if dropped {
+			n.drop--
+		}
+		n.mu.Unlock()
+		if dropped {
+			continue
+		}
+
+		if handler == nil {
+			handler = Answer
+		}
+		resp := handler(req)
+		if resp == nil {
+			continue
+		}
+		b, err := resp.EncodeResponse(req, secret)
+		if err != nil {
+			continue
+		}
+		_, _ = n.conn.WriteTo(b, addr)
+	}
+}
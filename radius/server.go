@@ -0,0 +1,177 @@
+package radius
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("radius: server closed")
+
+// Request is a request received by a Server, with the secret it was checked
+// against
+type Request struct {
+	*Packet
+	RemoteAddr net.Addr
+	Secret     []byte
+}
+
+// Handler answers the requests of a Server. Returning nil sends no answer.
+type Handler interface {
+	ServeRADIUS(ctx context.Context, req *Request) *Packet
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(ctx context.Context, req *Request) *Packet
+
+// ServeRADIUS calls f
+func (f HandlerFunc) ServeRADIUS(ctx context.Context, req *Request) *Packet {
+	return f(ctx, req)
+}
+
+// SecretSource returns the secret shared with the client at addr, nil for a
+// client the server does not know
+type SecretSource func(addr net.Addr) ([]byte, error)
+
+// Server answers Access-Requests and Accounting-Requests over UDP. Requests
+// from unknown clients or failing their authenticator check are dropped, as
+// RFC 2865 requires.
+type Server struct {
+	Handler Handler
+	Secret  SecretSource
+	// RequireMessageAuthenticator drops Access-Requests without a
+	// Message-Authenticator attribute
+	RequireMessageAuthenticator bool
+
+	mu     sync.Mutex
+	conns  map[net.PacketConn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ListenAndServe listens on the UDP address addr and serves requests until
+// Shutdown
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve answers requests received on conn until Shutdown
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.PacketConn]struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	buf := make([]byte, MaxPacketLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn, addr, b)
+		}()
+	}
+}
+
+// Shutdown stops serving, waiting for the requests being handled
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) handle(conn net.PacketConn, addr net.Addr, b []byte) {
+	secret, err := s.Secret(addr)
+	if err != nil {
+		log.Printf("RADIUS: failed to find the secret of %s: %v", addr, err)
+		return
+	}
+	if len(secret) == 0 {
+		log.Printf("RADIUS: dropped request from unknown client %s", addr)
+		return
+	}
+
+	packet, err := Parse(b)
+	if err != nil {
+		log.Printf("RADIUS: dropped request from %s: %v", addr, err)
+		return
+	}
+	switch packet.Code {
+	case CodeAccessRequest:
+		present, ok := verifyRequestMessageAuthenticator(b, secret)
+		if (present && !ok) || (!present && s.RequireMessageAuthenticator) {
+			log.Printf("RADIUS: dropped Access-Request from %s with a bad Message-Authenticator", addr)
+			return
+		}
+	case CodeAccountingRequest:
+		if !VerifyRequest(b, secret) {
+			log.Printf("RADIUS: dropped Accounting-Request from %s with a bad authenticator", addr)
+			return
+		}
+	default:
+		log.Printf("RADIUS: dropped %s from %s", packet.Code, addr)
+		return
+	}
+
+	s.mu.Lock()
+	ctx := s.ctx
+	s.mu.Unlock()
+	resp := s.Handler.ServeRADIUS(ctx, &Request{Packet: packet, RemoteAddr: addr, Secret: secret})
+	if resp == nil {
+		return
+	}
+	if resp.Code == CodeAccessAccept || resp.Code == CodeAccessReject || resp.Code == CodeAccessChallenge {
+		// Sign Access responses, first, against forged answers (BlastRADIUS)
+		resp.Attributes = append([]Attribute{{Type: AttrMessageAuthenticator, Value: make([]byte, 16)}}, resp.Attributes...)
+	}
+	out, err := resp.EncodeResponse(packet, secret)
+	if err != nil {
+		log.Printf("RADIUS: failed to encode %s to %s: %v", resp.Code, addr, err)
+		return
+	}
+	if _, err := conn.WriteTo(out, addr); err != nil {
+		log.Printf("RADIUS: failed to answer %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,132 @@
+package radius_test
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+)
+
+func TestUserPasswordRoundTrip(t *testing.T) {
+	secret := []byte("testing123")
+	for _, password := range []string{"", "secret", "exactly16octets!", "a password longer than one block of sixteen"} {
+		p := radius.NewPacket(radius.CodeAccessRequest)
+		if err := p.AddUserPassword(password, secret); err != nil {
+			t.Fatalf("AddUserPassword(%q) error = %v", password, err)
+		}
+		value, _ := p.Get(radius.AttrUserPassword)
+		if len(value)%16 != 0 || len(value) == 0 {
+			t.Errorf("User-Password of %q is %d octets, want a multiple of 16", password, len(value))
+		}
+		got, err := radius.DecryptUserPassword(value, p.Authenticator, secret)
+		if err != nil || got != password {
+			t.Errorf("DecryptUserPassword() = %q, %v, want %q", got, err, password)
+		}
+	}
+
+	if _, err := radius.DecryptUserPassword(make([]byte, 15), [16]byte{}, secret); !errors.Is(err, radius.ErrInvalidPassword) {
+		t.Errorf("DecryptUserPassword() of 15 octets error = %v, want ErrInvalidPassword", err)
+	}
+}
+
+func chapPassword(id byte, password string, challenge []byte) []byte {
+	sum := md5.Sum(append(append([]byte{id}, password...), challenge...))
+	return append([]byte{id}, sum[:]...)
+}
+
+func TestVerifyCHAP(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	if !radius.VerifyCHAP("secret", chapPassword(7, "secret", challenge), challenge) {
+		t.Error("VerifyCHAP() = false for the right password")
+	}
+	if radius.VerifyCHAP("secret", chapPassword(7, "wrong", challenge), challenge) {
+		t.Error("VerifyCHAP() = true for a wrong password")
+	}
+	if radius.VerifyCHAP("secret", []byte{7}, challenge) {
+		t.Error("VerifyCHAP() = true for a truncated CHAP-Password")
+	}
+}
+
+// startServer serves h on a local port, sharing secret with every client
+func startServer(t *testing.T, secret string, h radius.HandlerFunc) (*radius.Server, string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &radius.Server{
+		Handler: h,
+		Secret:  func(net.Addr) ([]byte, error) { return []byte(secret), nil },
+	}
+	go s.Serve(conn)
+	t.Cleanup(s.Shutdown)
+	return s, conn.LocalAddr().String()
+}
+
+func TestServerAccessRequest(t *testing.T) {
+	_, addr := startServer(t, "testing123", func(ctx context.Context, req *radius.Request) *radius.Packet {
+		value, _ := req.Get(radius.AttrUserPassword)
+		password, err := radius.DecryptUserPassword(value, req.Authenticator, req.Secret)
+		if err != nil || password != "secret" {
+			return &radius.Packet{Code: radius.CodeAccessReject}
+		}
+		resp := &radius.Packet{Code: radius.CodeAccessAccept}
+		resp.Add(radius.Integer(radius.AttrSessionTimeout, 3600))
+		return resp
+	})
+	client := &radius.Client{Timeout: 200 * time.Millisecond}
+
+	for _, tt := range []struct {
+		password string
+		want     radius.Code
+	}{
+		{"secret", radius.CodeAccessAccept},
+		{"wrong", radius.CodeAccessReject},
+	} {
+		req := radius.NewPacket(radius.CodeAccessRequest)
+		req.Add(radius.String(radius.AttrUserName, "0712345678@Tecsurf"))
+		req.Add(radius.Attribute{Type: radius.AttrMessageAuthenticator, Value: make([]byte, 16)})
+		if err := req.AddUserPassword(tt.password, []byte("testing123")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Exchange(context.Background(), addr, []byte("testing123"), req)
+		if err != nil {
+			t.Fatalf("Exchange(%q) error = %v", tt.password, err)
+		}
+		if resp.Code != tt.want {
+			t.Errorf("password %q answered %s, want %s", tt.password, resp.Code, tt.want)
+		}
+		if _, ok := resp.Get(radius.AttrMessageAuthenticator); !ok {
+			t.Errorf("%s has no Message-Authenticator", resp.Code)
+		}
+	}
+}
+
+func TestServerDropsForgedRequests(t *testing.T) {
+	handled := make(chan struct{}, 2)
+	_, addr := startServer(t, "testing123", func(ctx context.Context, req *radius.Request) *radius.Packet {
+		handled <- struct{}{}
+		return &radius.Packet{Code: radius.CodeAccountingResponse}
+	})
+	client := &radius.Client{Timeout: 100 * time.Millisecond}
+
+	acct := radius.NewPacket(radius.CodeAccountingRequest)
+	acct.Add(radius.Integer(radius.AttrAcctStatusType, radius.AcctStatusStart))
+	if _, err := client.Exchange(context.Background(), addr, []byte("wrong"), acct); !errors.Is(err, radius.ErrNoResponse) {
+		t.Errorf("Accounting-Request with a wrong secret error = %v, want ErrNoResponse", err)
+	}
+
+	access := radius.NewPacket(radius.CodeAccessRequest)
+	access.Add(radius.Attribute{Type: radius.AttrMessageAuthenticator, Value: make([]byte, 16)})
+	if _, err := client.Exchange(context.Background(), addr, []byte("wrong"), access); !errors.Is(err, radius.ErrNoResponse) {
+		t.Errorf("Access-Request with a wrong Message-Authenticator error = %v, want ErrNoResponse", err)
+	}
+
+	if len(handled) != 0 {
+		t.Errorf("handler saw %d forged requests", len(handled))
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"github.com/spf13/viper"
 )
@@ -21,6 +22,24 @@ func Config() error {
 		return fmt.Errorf("failed to read mpesa.yaml: %w", err)
 	}
 
+	// Load the optional airtel config
+	viper.SetConfigName("airtel")
+	if err := viper.MergeInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to read airtel.yaml: %w", err)
+		}
+	}
+
+	// Load the optional radius config
+	viper.SetConfigName("radius")
+	if err := viper.MergeInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to read radius.yaml: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,112 @@
+//go:build integration
+
+package controller_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestExpiryScanExpiresSubscriptionsOnce(t *testing.T) {
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil || gdatabase.GetDB(gconfig.RadiusDB) == nil {
+		t.Skipf("app and radius databases not available: %v", err)
+	}
+	db := gdatabase.GetDB(gconfig.AppDB)
+	radius := gdatabase.GetDB(gconfig.RadiusDB)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	d := seedTenant(t, db, "e"+suffix)
+
+	now := time.Now()
+	expiredAt := now.Add(-time.Minute).Truncate(time.Second)
+
+	// A user with two paid orders, the older one never expired
+	username := "itest-expired-" + suffix
+	var orders []model.Order
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour} {
+		order := model.Order{
+			OrderNumber: "itest-expiry-" + strconv.Itoa(i) + suffix,
+			Status:      model.OrderStatusPaid,
+			Username:    username,
+			Ip:          "10.5.50.90",
+			DeviceID:    d.device.ID,
+			CreatedAt:   now.Add(-age),
+		}
+		if err := db.Omit(clause.Associations).Create(&order).Error; err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+		t.Cleanup(func() { db.Delete(&order) })
+		orders = append(orders, order)
+	}
+
+	// A redeemed voucher, which has no order
+	err := db.Model(&d.voucher).Updates(map[string]interface{}{
+		"status":    model.VoucherStatusRedeemed,
+		"DeviceID":  d.device.ID,
+		"ip":        "10.5.50.91",
+		"expiresAt": expiredAt,
+	}).Error
+	if err != nil {
+		t.Fatalf("failed to redeem voucher: %v", err)
+	}
+
+	for _, user := range []string{username, d.voucher.Code} {
+		check := model.RadCheck{Username: user, Attribute: "Expiration", Op: ":=", Value: expiredAt.Format(model.RadiusExpirationLayout)}
+		if err := radius.Create(&check).Error; err != nil {
+			t.Fatalf("failed to create expiration: %v", err)
+		}
+		t.Cleanup(func() { radius.Delete(&check) })
+	}
+
+	scan := func() map[string]service.ExpiredSubscription {
+		t.Helper()
+		expired, err := service.FindExpiredSubscriptions(now.Add(-time.Hour), now)
+		if err != nil {
+			t.Fatalf("FindExpiredSubscriptions() error = %v", err)
+		}
+		found := make(map[string]service.ExpiredSubscription)
+		for _, sub := range expired {
+			if sub.Username == username || sub.Username == d.voucher.Code {
+				found[sub.Username] = sub
+			}
+		}
+		return found
+	}
+
+	found := scan()
+	if sub, ok := found[username]; !ok || sub.Order == nil || sub.Order.ID != orders[1].ID {
+		t.Errorf("expired subscription of %s = %+v, want its latest order %d", username, sub, orders[1].ID)
+	}
+	if sub, ok := found[d.voucher.Code]; !ok || sub.Voucher == nil || sub.DeviceID() != d.device.ID || sub.Address() != "10.5.50.91" {
+		t.Errorf("expired subscription of voucher %s = %+v, want the voucher's device and address", d.voucher.Code, sub)
+	}
+	for _, sub := range found {
+		if err := service.MarkSubscriptionExpired(sub); err != nil {
+			t.Fatalf("MarkSubscriptionExpired() error = %v", err)
+		}
+	}
+
+	// Both orders end together, so the next scan has nothing left to log out
+	for _, order := range orders {
+		if status := orderStatus(order.ID); status != model.OrderStatusExpired {
+			t.Errorf("order %s status = %s, want %s", order.OrderNumber, status, model.OrderStatusExpired)
+		}
+	}
+	var voucher model.Voucher
+	if err := db.First(&voucher, d.voucher.ID).Error; err != nil || voucher.Status != model.VoucherStatusExpired {
+		t.Errorf("voucher = %+v, %v, want it expired", voucher, err)
+	}
+	if found := scan(); len(found) != 0 {
+		t.Errorf("second scan found %+v, want nothing", found)
+	}
+}
@@ -17,6 +17,38 @@ var input dto.HotspotUserInput
 
 // --- Controller Functions ---
 
+// hotspotUserAllowed answers the request and returns false when the caller
+// may not manage the hotspot user username
+func hotspotUserAllowed(c *gin.Context, username string) bool {
+	tenant, ok := radiusHandler.CallerTenant(c)
+	if !ok {
+		return false
+	}
+	if resp, statusCode := radiusHandler.AuthorizeHotspotUser(tenant, username); resp != nil {
+		grenderer.Render(c, resp, statusCode)
+		return false
+	}
+	return true
+}
+
+// radiusGroupsAllowed answers the request and returns false when the caller
+// may not put users in groups
+func radiusGroupsAllowed(c *gin.Context, groups []dto.RadUserGroupInput) bool {
+	tenant, ok := radiusHandler.CallerTenant(c)
+	if !ok {
+		return false
+	}
+	names := make([]string, 0, len(groups))
+	for _, group := range groups {
+		names = append(names, group.Groupname)
+	}
+	if resp, statusCode := radiusHandler.AuthorizeRadiusGroups(tenant, names...); resp != nil {
+		grenderer.Render(c, resp, statusCode)
+		return false
+	}
+	return true
+}
+
 // CreateHotspotUser - POST /hotspot/users
 // Creates a new hotspot user by adding entries in radcheck, radreply, and radusergroup.
 func CreateHotspotUser(c *gin.Context) {
@@ -26,6 +58,18 @@ func CreateHotspotUser(c *gin.Context) {
 		return
 	}
 
+	tenant, ok := radiusHandler.CallerTenant(c)
+	if !ok {
+		return
+	}
+	if resp, statusCode := radiusHandler.AuthorizeNewHotspotUser(tenant, input.Username); resp != nil {
+		grenderer.Render(c, resp, statusCode)
+		return
+	}
+	if !radiusGroupsAllowed(c, input.Groups) {
+		return
+	}
+
 	// Call handler to create the user in the database
 	// The handler will need to process the input struct and create/update
 	// entries in radcheck, radreply, and radusergroup.
@@ -42,6 +86,9 @@ func GetHotspotUser(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	// Call handler to get user details from the database
 	// The handler will query radcheck, radreply, and radusergroup tables for the username.
@@ -51,6 +98,22 @@ func GetHotspotUser(c *gin.Context) {
 	grenderer.Render(c, resp, statusCode)
 }
 
+// GetHotspotUserUsage - GET /hotspot/users/:username/usage
+// Returns the data used by the user's running subscription against its plan's data cap.
+func GetHotspotUserUsage(c *gin.Context) {
+	username := strings.TrimSpace(c.Params.ByName("username"))
+	if username == "" {
+		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
+		return
+	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
+
+	resp, statusCode := radiusHandler.GetHotspotUserUsage(username)
+	grenderer.Render(c, resp, statusCode)
+}
+
 // UpdateHotspotUser - PUT /hotspot/users/:username
 // Updates the configuration for an existing hotspot user.
 // This might involve adding, modifying, or deleting entries in radcheck, radreply, and radusergroup.
@@ -60,6 +123,9 @@ func UpdateHotspotUser(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	// Bind JSON request body to input struct
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -73,6 +139,9 @@ func UpdateHotspotUser(c *gin.Context) {
 		return
 	}
 	input.Username = username // Use the username from the path
+	if !radiusGroupsAllowed(c, input.Groups) {
+		return
+	}
 
 	// Call handler to update the user configuration
 	// The handler will compare the desired state (input) with the current state in the DB
@@ -90,6 +159,9 @@ func DeleteHotspotUser(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	// Call handler to delete the user from the database
 	// The handler will delete all entries for the username from radcheck, radreply, and radusergroup.
@@ -109,6 +181,9 @@ func AddOrUpdateRadCheckAttribute(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	var input dto.RadCheckInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -128,6 +203,9 @@ func DeleteRadCheckAttribute(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username and attribute are required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	resp, statusCode := radiusHandler.DeleteRadCheckAttribute(username, attribute)
 	grenderer.Render(c, resp, statusCode)
@@ -140,6 +218,9 @@ func AddOrUpdateRadReplyAttribute(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	var input dto.RadReplyInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -159,6 +240,9 @@ func DeleteRadReplyAttribute(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username and attribute are required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	resp, statusCode := radiusHandler.DeleteRadReplyAttribute(username, attribute)
 	grenderer.Render(c, resp, statusCode)
@@ -171,12 +255,18 @@ func AddRadUserGroup(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username is required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	var input dto.RadUserGroupInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		grenderer.Render(c, gin.H{"message": err.Error()}, http.StatusBadRequest)
 		return
 	}
+	if !radiusGroupsAllowed(c, []dto.RadUserGroupInput{input}) {
+		return
+	}
 
 	resp, statusCode := radiusHandler.AddRadUserGroup(username, input)
 	grenderer.Render(c, resp, statusCode)
@@ -190,6 +280,9 @@ func DeleteRadUserGroup(c *gin.Context) {
 		grenderer.Render(c, gin.H{"message": "Username and groupname are required"}, http.StatusBadRequest)
 		return
 	}
+	if !hotspotUserAllowed(c, username) {
+		return
+	}
 
 	resp, statusCode := radiusHandler.DeleteRadUserGroup(username, groupname)
 	grenderer.Render(c, resp, statusCode)
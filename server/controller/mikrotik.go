@@ -3,6 +3,7 @@ package controller
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/queue"
 	"github.com/ortupik/wifigo/server/database/model"
 	"github.com/ortupik/wifigo/server/handler"
 )
@@ -11,9 +12,9 @@ type MikroTikController struct {
 	handler *handler.MikrotikQueueHandler
 }
 
-func NewMikroTikController(manager *mikrotik.Manager) *MikroTikController {
+func NewMikroTikController(manager *mikrotik.Manager, queueClient *queue.Client) *MikroTikController {
 	return &MikroTikController{
-		handler: handler.NewMikrotikQueueHandler(manager),
+		handler: handler.NewMikrotikQueueHandler(manager, queueClient),
 	}
 }
 
@@ -64,3 +65,45 @@ func (ctrl *MikroTikController) GetDeviceStats(c *gin.Context) {
 func (ctrl *MikroTikController) TestDeviceConnection(c *gin.Context) {
 	handler.TestMikroTikDeviceConnection(c, nil)
 }
+
+// GetDevicesHealth handles GET /devices/health
+func (ctrl *MikroTikController) GetDevicesHealth(c *gin.Context) {
+	ctrl.handler.GetMikroTikDevicesHealth(c)
+}
+
+// GetDeviceHealth handles GET /devices/:id/health
+func (ctrl *MikroTikController) GetDeviceHealth(c *gin.Context) {
+	deviceID := c.Param("id")
+	ctrl.handler.GetMikroTikDeviceHealth(deviceID, c)
+}
+
+// DisconnectUser handles POST /devices/:id/logout
+func (ctrl *MikroTikController) DisconnectUser(c *gin.Context) {
+	deviceID := c.Param("id")
+	ctrl.handler.DisconnectHotspotUser(deviceID, c)
+}
+
+// GetDeviceNas handles GET /devices/:id/radius
+func (ctrl *MikroTikController) GetDeviceNas(c *gin.Context) {
+	ctrl.handler.GetDeviceNas(c.Param("id"), c)
+}
+
+// CreateDeviceNas handles POST /devices/:id/radius
+func (ctrl *MikroTikController) CreateDeviceNas(c *gin.Context) {
+	ctrl.handler.CreateDeviceNas(c.Param("id"), c)
+}
+
+// UpdateDeviceNas handles PUT /devices/:id/radius
+func (ctrl *MikroTikController) UpdateDeviceNas(c *gin.Context) {
+	ctrl.handler.UpdateDeviceNas(c.Param("id"), c)
+}
+
+// DeleteDeviceNas handles DELETE /devices/:id/radius
+func (ctrl *MikroTikController) DeleteDeviceNas(c *gin.Context) {
+	ctrl.handler.DeleteDeviceNas(c.Param("id"), c)
+}
+
+// RotateDeviceNasSecret handles POST /devices/:id/radius/rotate-secret
+func (ctrl *MikroTikController) RotateDeviceNasSecret(c *gin.Context) {
+	ctrl.handler.RotateDeviceNasSecret(c.Param("id"), c)
+}
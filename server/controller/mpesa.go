@@ -1,12 +1,16 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
 	"github.com/ortupik/wifigo/server/database/model"
 	"github.com/ortupik/wifigo/server/dto"
 	"github.com/ortupik/wifigo/server/handler"
@@ -15,18 +19,24 @@ import (
 
 type MpesaController struct {
 	MpesaStkHandler *handler.MpesaStkHandler
+	Providers       *handler.PaymentProviders // M-Pesa first, then Airtel Money when configured
 }
 
-func NewMpesaController() *MpesaController {
+func NewMpesaController() (*MpesaController, error) {
 	mpesaStkhandler, err := handler.NewMpesaStkHandler()
 	if(err != nil) {
-		fmt.Println(err)
-		return nil
+		return nil, err
+	}
+
+	providers, err := handler.LoadPaymentProviders(mpesaStkhandler)
+	if err != nil {
+		return nil, err
 	}
 
 	return &MpesaController{
 		MpesaStkHandler : mpesaStkhandler,
-	}
+		Providers:       providers,
+	}, nil
 }
 
 func (mc *MpesaController) ExpressStkHandler(c *gin.Context) {
@@ -40,10 +50,24 @@ func (mc *MpesaController) ExpressStkHandler(c *gin.Context) {
 		return
 	}
 
-	//fetch (fetch Realm based on domain from badger key value)
-	realm := "Tecsurf"
+	plan, err := mc.MpesaStkHandler.GetServicePlan(req.PlanID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid plan"})
+		return
+	}
+
+	// The plan's ISP decides the realm and which providers the customer may pay with
+	isp, err := mc.MpesaStkHandler.GetCheckoutISP(plan, req.IspID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The plan is not offered by any ISP"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	if(username == ""){
-        username = req.Phone + "@" + realm
+        username = isp.SubscriberUsername(req.Phone)
 	}
 
 	//check if user is Home User from req.IsHomeUser(true ? then username changes not to use phone)
@@ -58,51 +82,48 @@ func (mc *MpesaController) ExpressStkHandler(c *gin.Context) {
 		}
 	}
 
-	plan, err := mc.MpesaStkHandler.GetServicePlan(req.PlanID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid plan"})
-		return
-	}
-
 	amount := plan.Price
 
 	if req.DeviceCount > 1 {
 		amount = int(math.Round(float64(amount)  * float64(req.DeviceCount) * 0.7)) // Apply 30% discount
 	}
 
-	res, err := mc.MpesaStkHandler.SendStkPush(req.Phone, fmt.Sprintf("%d", amount))
+	provider, err := mc.Providers.ForCheckout(req.Provider, plan, &isp)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "STK Push failed: " + err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "providers": mc.Providers.Names()})
 		return
 	}
 
-	if errCode, exists := res["errorCode"]; exists {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errorCode":    fmt.Sprint(errCode),
-			"errorMessage": fmt.Sprint(res["errorMessage"]),
-			"requestId":    fmt.Sprint(res["requestId"]),
-		})
-		return
+	order := model.Order{
+		OrderNumber:   fmt.Sprintf("ORD-%d", time.Now().UnixNano()),
+		Status:        "PENDING",
+		Amount:        amount,
+		Username:      username,
+		Ip:            req.Ip,
+		Mac:           req.Mac,
+		Phone:         req.Phone,
+		ISP:           strconv.FormatInt(isp.ID, 10),
+		Zone:          req.Zone,
+		DeviceID:      req.DeviceID,
+		IsHomeUser:    isHomeUser,
+		Devices:       req.DeviceCount,
+		ServicePlanID: plan.ID,
+		Provider:      provider.Name(),
 	}
 
-	order := model.Order{
-		OrderNumber:       fmt.Sprintf("ORD-%d", time.Now().UnixNano()),
-		Status:            "PENDING",
-		Amount:            amount,
-		Username:          username,
-		Ip:                req.Ip,
-		Mac:               req.Mac,
-		Phone:             req.Phone,
-		ISP:               req.IspID,
-		Zone:              req.Zone,
-		DeviceID:          req.DeviceID,
-		IsHomeUser:        isHomeUser,
-		Devices:           req.DeviceCount,
-		ServicePlanID:     plan.ID,
-		ResultDesc:        fmt.Sprint(res["ResponseDescription"]),
-		CheckoutRequestID: fmt.Sprint(res["CheckoutRequestID"]),
-		MerchantRequestID: fmt.Sprint(res["MerchantRequestID"]),
-		ResponseCode:      fmt.Sprint(res["ResponseCode"]),
+	// Each ISP collects into its own account
+	if err := provider.Initiate(&order); err != nil {
+		var rejected *handler.PaymentRequestError
+		if errors.As(err, &rejected) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errorCode":    rejected.Code,
+				"errorMessage": rejected.Message,
+				"requestId":    rejected.RequestID,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment request failed: " + err.Error()})
+		return
 	}
 
 	handler.CreateOrder(c, nil, order)
@@ -119,3 +140,34 @@ func (mc *MpesaController) GetTransactionStatus(c *gin.Context) {
 
 	handler.GetOrder(orderNumber, c, nil)
 }
+
+// GetAmountMismatchReport lists payments whose amount differed from their order
+func (mc *MpesaController) GetAmountMismatchReport(c *gin.Context) {
+	handler.GetPaymentMismatches(c, nil)
+}
+
+// RegisterC2BURLs registers the C2B validation and confirmation URLs with Safaricom,
+// for the short code of the ISP in the isp_id query parameter or the default one
+func (mc *MpesaController) RegisterC2BURLs(c *gin.Context) {
+	stk, err := mc.MpesaStkHandler.ForISP(c.Query("isp_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res, err := stk.RegisterC2BURLs()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "response": res})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// GetC2BPayments lists C2B payments, the unmatched ones by default
+func (mc *MpesaController) GetC2BPayments(c *gin.Context) {
+	handler.GetC2BPayments(c, nil)
+}
+
+// GetRefunds lists refunds, optionally filtered by status
+func (mc *MpesaController) GetRefunds(c *gin.Context) {
+	handler.GetRefunds(c, nil)
+}
@@ -0,0 +1,1051 @@
+//go:build integration
+
+// End-to-end tests of the checkout pipeline: STK push -> Daraja callback (or
+// STK query reconciliation) -> RADIUS user -> MikroTik login. Daraja and the router are faked in process;
+// MySQL and Redis come from the repository's .env and config.yaml, and the
+// tests are skipped when they are not available.
+//
+//	go test -tags integration ./server/controller/
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+	"github.com/ortupik/wifigo/queue"
+	nconfig "github.com/ortupik/wifigo/server/config"
+	"github.com/ortupik/wifigo/server/controller"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/airteltest"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+const (
+	flowDeviceID = "itest-router"
+	flowClientIP = "10.5.50.77"
+	flowMAC      = "AA:BB:CC:00:00:77"
+)
+
+func TestMain(m *testing.M) {
+	// .env, config.yaml and config/mpesa.yaml are looked up from the repository root
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+type flowEnv struct {
+	app        *httptest.Server
+	daraja     *darajatest.Server
+	airtel     *airteltest.Server
+	router     *routerostest.Server
+	reconciler *handler.MpesaReconcileHandler
+	refunds    *handler.MpesaRefundHandler
+	mpesa      *handler.MpesaConfig
+	isp        model.ISP
+	plan       model.ServicePlan
+}
+
+func setupFlow(t *testing.T) *flowEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := nconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil || gdatabase.GetDB(gconfig.RadiusDB) == nil {
+		t.Skipf("app and radius databases not available: %v", err)
+	}
+	if _, err := gdatabase.InitRedis(); err != nil || gdatabase.GetRedis() == nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	configure := gconfig.GetConfig()
+	redisAddr := configure.Database.REDIS.Env.Host + ":" + configure.Database.REDIS.Env.Port
+
+	env := &flowEnv{
+		daraja: darajatest.NewServer(),
+		airtel: airteltest.NewServer(),
+		router: routerostest.NewServer(),
+	}
+	t.Cleanup(env.daraja.Close)
+	t.Cleanup(env.airtel.Close)
+	t.Cleanup(env.router.Close)
+	env.router.AddHost(flowClientIP, "", flowMAC)
+
+	manager := mikrotik.NewManager()
+	t.Cleanup(manager.Close)
+	if err := manager.AddDevice(env.router.DeviceConfig(flowDeviceID)); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+
+	wsHub := websocket.NewHub()
+	queueClient, err := queue.NewClient(redisAddr)
+	if err != nil {
+		t.Fatalf("queue.NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { queueClient.Close() })
+
+	handlers := &queue.Handlers{
+		MikrotikQueueHandler: *queue.NewMikrotikQueueHandler(service.NewMikroTikManagerService(manager), wsHub),
+		DatabaseQueueHandler: *queue.NewDatabaseQueueHandler(wsHub),
+		ExpiryQueueHandler:   *queue.NewExpiryQueueHandler(queueClient, wsHub),
+	}
+	queueServer, err := queue.NewServer(redisAddr, manager, wsHub, handlers)
+	if err != nil {
+		t.Fatalf("queue.NewServer() error = %v", err)
+	}
+	if err := queueServer.Start(); err != nil {
+		t.Fatalf("queue server Start() error = %v", err)
+	}
+	t.Cleanup(queueServer.GracefullyShutdown)
+
+	mpesaConfig := &handler.MpesaConfig{
+		BaseURL:            env.daraja.URL,
+		Shortcode:          env.daraja.Shortcode,
+		Passkey:            env.daraja.Passkey,
+		ConsumerKey:        env.daraja.ConsumerKey,
+		ConsumerSecret:     env.daraja.ConsumerSecret,
+		TillNo:             "3192988",
+		TransactionType:    "CustomerBuyGoodsOnline",
+		AccountReference:   "Test Hotspot",
+		TransactionDesc:    "Wifi Payment",
+		InitiatorName:      "testapi",
+		SecurityCredential: "credential",
+	}
+	airtelConfig := &handler.AirtelConfig{
+		Environment:      handler.AirtelEnvStaging,
+		BaseURL:          env.airtel.URL,
+		ClientID:         env.airtel.ClientID,
+		ClientSecret:     env.airtel.ClientSecret,
+		CallbackURLToken: fmt.Sprintf("airtel-%d", time.Now().UnixNano()),
+		CallbackKey:      "airtel-callback-key",
+	}
+	if err := airtelConfig.Resolve(); err != nil {
+		t.Fatalf("airtel Resolve() error = %v", err)
+	}
+	airtel, err := handler.NewAirtelProviderWithConfig(airtelConfig)
+	if err != nil {
+		t.Fatalf("NewAirtelProviderWithConfig() error = %v", err)
+	}
+	env.airtel.CallbackKey = airtelConfig.CallbackKey
+
+	stk := handler.NewMpesaStkHandlerWithConfig(mpesaConfig)
+	providers := handler.NewPaymentProviders(handler.NewMpesaProvider(stk), airtel)
+	mpesaController := &controller.MpesaController{MpesaStkHandler: stk, Providers: providers}
+	callbackHandler := handler.NewMpesaCallbackHandler(queueClient, wsHub)
+	callbackHandler.UseProviders(providers)
+	env.reconciler = handler.NewMpesaReconcileHandler(stk, callbackHandler, wsHub)
+	env.reconciler.UseProviders(providers)
+	env.mpesa = mpesaConfig
+	env.refunds = handler.NewMpesaRefundHandler(stk, wsHub)
+	env.refunds.UseProviders(providers)
+
+	r := gin.New()
+	r.POST("/api/v1/mpesa/checkout", mpesaController.ExpressStkHandler)
+	r.POST("/api/v1/mpesa/callback", callbackHandler.MpesaStkHandlerCallback)
+	r.POST("/api/v1/mpesa/callback/:token", callbackHandler.MpesaStkHandlerCallback)
+	r.GET("/api/v1/mpesa/reports/amount-mismatches", mpesaController.GetAmountMismatchReport)
+	r.POST("/api/v1/mpesa/c2b/validation/:token", callbackHandler.MpesaC2BValidation)
+	r.POST("/api/v1/mpesa/c2b/confirmation/:token", callbackHandler.MpesaC2BConfirmation)
+	r.POST("/api/v1/mpesa/c2b/register", mpesaController.RegisterC2BURLs)
+	r.GET("/api/v1/mpesa/c2b/payments", mpesaController.GetC2BPayments)
+	r.POST("/api/v1/mpesa/c2b/payments/:transId/allocate", callbackHandler.AllocateC2BPayment)
+	r.POST("/api/v1/mpesa/refunds/result/:token", callbackHandler.MpesaRefundResult)
+	r.POST("/api/v1/mpesa/refunds/timeout/:token", callbackHandler.MpesaRefundTimeout)
+	r.POST("/api/v1/mpesa/orders/:orderNumber/refund", env.refunds.RequestRefund)
+	r.POST("/api/v1/airtel/callback/:token", callbackHandler.PaymentCallback(airtel))
+	env.app = httptest.NewServer(r)
+	t.Cleanup(env.app.Close)
+	env.airtel.CallbackURL = env.app.URL + "/api/v1/airtel/callback/" + airtelConfig.CallbackURLToken
+	mpesaConfig.CallbackURL = env.app.URL + "/api/v1/mpesa/callback"
+	mpesaConfig.C2BConfirmationURL = env.app.URL + "/api/v1/mpesa/c2b/confirmation"
+	mpesaConfig.C2BValidationURL = env.app.URL + "/api/v1/mpesa/c2b/validation"
+	mpesaConfig.C2BURLToken = fmt.Sprintf("c2b-%d", time.Now().UnixNano())
+	callbackHandler.RequireC2BToken(mpesaConfig.C2BURLToken)
+	mpesaConfig.RefundResultURL = env.app.URL + "/api/v1/mpesa/refunds/result"
+	mpesaConfig.RefundTimeoutURL = env.app.URL + "/api/v1/mpesa/refunds/timeout"
+
+	db := gdatabase.GetDB(gconfig.AppDB)
+	env.isp = model.ISP{Name: fmt.Sprintf("itest-%d", time.Now().UnixNano()), Realm: "Tecsurf"}
+	if err := db.Create(&env.isp).Error; err != nil {
+		t.Fatalf("failed to create ISP: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&env.isp) })
+	env.plan = model.ServicePlan{
+		ISPID:    env.isp.ID,
+		Name:     fmt.Sprintf("itest-%d", time.Now().UnixNano()),
+		Price:    10,
+		Duration: 3600,
+		IsActive: true,
+	}
+	if err := db.Create(&env.plan).Error; err != nil {
+		t.Fatalf("failed to create service plan: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&env.plan) })
+
+	return env
+}
+
+// checkout starts a purchase for phone and returns the created order
+func (env *flowEnv) checkout(t *testing.T, phone string) model.Order {
+	t.Helper()
+
+	return env.checkoutWith(t, phone, "")
+}
+
+// checkoutWith starts a purchase for phone paid with provider
+func (env *flowEnv) checkoutWith(t *testing.T, phone, provider string) model.Order {
+	t.Helper()
+
+	username := env.isp.SubscriberUsername(phone)
+	t.Cleanup(func() {
+		db := gdatabase.GetDB(gconfig.AppDB)
+		db.Where("Phone = ?", "254"+phone[1:]).Delete(&model.Payment{})
+		db.Where("phone = ?", phone).Delete(&model.PaymentMismatch{})
+		db.Where("phone = ?", phone).Delete(&model.CustomerCredit{})
+		db.Where("msisdn = ?", "254"+phone[1:]).Delete(&model.MpesaC2BPayment{})
+		db.Where("phone = ?", "254"+phone[1:]).Delete(&model.Refund{})
+		db.Where("phone = ?", phone).Delete(&model.Order{})
+		radius := gdatabase.GetDB(gconfig.RadiusDB)
+		radius.Where("username = ?", username).Delete(&model.RadCheck{})
+		radius.Where("username = ?", username).Delete(&model.RadUserGroup{})
+	})
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"phone":     phone,
+		"plan_id":   env.plan.ID,
+		"device_id": flowDeviceID,
+		"devices":   1,
+		"ip":        flowClientIP,
+		"mac":       flowMAC,
+		"provider":  provider,
+	})
+	resp, err := http.Post(env.app.URL+"/api/v1/mpesa/checkout", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("checkout request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var order model.Order
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode checkout response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || order.CheckoutRequestID == "" || order.Status != model.OrderStatusPending {
+		t.Fatalf("checkout returned %d %+v, want a pending order", resp.StatusCode, order)
+	}
+	if order.Username != username || order.Amount != env.plan.Price {
+		t.Errorf("order = %+v, want user %s paying %d", order, username, env.plan.Price)
+	}
+	return order
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func orderStatus(orderID int) string {
+	var order model.Order
+	gdatabase.GetDB(gconfig.AppDB).First(&order, orderID)
+	return order.Status
+}
+
+func randomPhone() string {
+	return fmt.Sprintf("07%08d", rand.Intn(1e8))
+}
+
+func TestCheckoutPaidLogsUserIn(t *testing.T) {
+	env := setupFlow(t)
+
+	order := env.checkout(t, randomPhone())
+
+	callbacks := env.daraja.WaitCallbacks(1, 10*time.Second)
+	if len(callbacks) != 1 || callbacks[0].StatusCode != http.StatusOK {
+		t.Fatalf("callbacks = %+v, want one accepted callback", callbacks)
+	}
+
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+
+	var payment model.Payment
+	if err := gdatabase.GetDB(gconfig.AppDB).Where("CheckoutRequestID = ?", order.CheckoutRequestID).First(&payment).Error; err != nil {
+		t.Fatalf("payment not saved: %v", err)
+	}
+	if payment.ResultCode != 0 || payment.MpesaReceiptNumber == nil || payment.Amount.IntPart() != int64(env.plan.Price) {
+		t.Errorf("payment = %+v, want a successful payment of %d with a receipt", payment, env.plan.Price)
+	}
+
+	var checks []model.RadCheck
+	gdatabase.GetDB(gconfig.RadiusDB).Where("username = ?", order.Username).Find(&checks)
+	if len(checks) == 0 {
+		t.Errorf("no radcheck attributes created for %s", order.Username)
+	}
+
+	eventually(t, "hotspot login on the router", func() bool {
+		for _, session := range env.router.Rows(routerostest.PathActive) {
+			if session["user"] == order.Username && session["address"] == flowClientIP {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestCheckoutCancelledDoesNotLogIn(t *testing.T) {
+	env := setupFlow(t)
+
+	phone := randomPhone()
+	env.daraja.SetResult("254"+phone[1:], darajatest.ResultCancelled)
+	order := env.checkout(t, phone)
+
+	callbacks := env.daraja.WaitCallbacks(1, 10*time.Second)
+	if len(callbacks) != 1 || callbacks[0].StatusCode != http.StatusOK {
+		t.Fatalf("callbacks = %+v, want one accepted callback", callbacks)
+	}
+
+	eventually(t, "order to be marked failed", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaymentFailed
+	})
+
+	if logins := env.router.RequestsFor(routerostest.PathActive + "/login"); len(logins) != 0 {
+		t.Errorf("router received %d login attempts for a cancelled payment", len(logins))
+	}
+}
+
+// reconcile runs the stuck order query for order as if it had been pending for age
+func (env *flowEnv) reconcile(t *testing.T, order model.Order, age time.Duration) {
+	t.Helper()
+
+	db := gdatabase.GetDB(gconfig.AppDB)
+	if err := db.Model(&model.Order{}).Where("id = ?", order.ID).Update("created_at", time.Now().Add(-age)).Error; err != nil {
+		t.Fatalf("failed to backdate order: %v", err)
+	}
+	if err := db.Preload("ServicePlan").First(&order, order.ID).Error; err != nil {
+		t.Fatalf("failed to reload order: %v", err)
+	}
+	if err := env.reconciler.ReconcileOrder(context.Background(), order); err != nil {
+		t.Fatalf("ReconcileOrder() error = %v", err)
+	}
+}
+
+func TestReconcileMissedCallback(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+	env.reconcile(t, order, 5*time.Minute)
+
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		for _, session := range env.router.Rows(routerostest.PathActive) {
+			if session["user"] == order.Username {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestReconcileFailedPaymentTimesOut(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	phone := randomPhone()
+	env.daraja.SetResult("254"+phone[1:], darajatest.ResultUnreachable)
+	order := env.checkout(t, phone)
+	env.reconcile(t, order, 5*time.Minute)
+
+	if got := orderStatus(order.ID); got != model.OrderStatusTimeout {
+		t.Errorf("order status = %q, want %q", got, model.OrderStatusTimeout)
+	}
+	if logins := env.router.RequestsFor(routerostest.PathActive + "/login"); len(logins) != 0 {
+		t.Errorf("router received %d login attempts for a failed payment", len(logins))
+	}
+}
+
+func TestReconcileLeavesUnansweredOrderPending(t *testing.T) {
+	env := setupFlow(t)
+
+	phone := randomPhone()
+	env.daraja.SetResult("254"+phone[1:], darajatest.ResultPending)
+	order := env.checkout(t, phone)
+
+	env.reconcile(t, order, 5*time.Minute)
+	if got := orderStatus(order.ID); got != model.OrderStatusPending {
+		t.Errorf("order status = %q, want it left pending", got)
+	}
+
+	env.reconcile(t, order, handler.DefaultPendingMaxAge+time.Hour)
+	if got := orderStatus(order.ID); got != model.OrderStatusTimeout {
+		t.Errorf("order status = %q after %v, want %q", got, handler.DefaultPendingMaxAge, model.OrderStatusTimeout)
+	}
+}
+
+func TestReplayedCallbackIsIgnored(t *testing.T) {
+	env := setupFlow(t)
+
+	order := env.checkout(t, randomPhone())
+	if callbacks := env.daraja.WaitCallbacks(1, 10*time.Second); len(callbacks) != 1 {
+		t.Fatalf("callbacks = %+v, want one", callbacks)
+	}
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+
+	radius := gdatabase.GetDB(gconfig.RadiusDB)
+	var before model.RadCheck
+	radius.Where("username = ? AND attribute = ?", order.Username, "Expiration").First(&before)
+
+	// Safaricom delivers the same result again
+	for i := 0; i < 2; i++ {
+		cb, err := env.daraja.SendCallback(order.CheckoutRequestID)
+		if err != nil || cb.StatusCode != http.StatusOK {
+			t.Fatalf("replayed callback = %+v, %v, want it acknowledged", cb, err)
+		}
+	}
+	// Give any wrongly queued work the chance to run
+	time.Sleep(2 * time.Second)
+
+	var payments int64
+	gdatabase.GetDB(gconfig.AppDB).Model(&model.Payment{}).Where("CheckoutRequestID = ?", order.CheckoutRequestID).Count(&payments)
+	if payments != 1 {
+		t.Errorf("payments for %s = %d, want 1", order.CheckoutRequestID, payments)
+	}
+
+	var after model.RadCheck
+	radius.Where("username = ? AND attribute = ?", order.Username, "Expiration").First(&after)
+	if after.Value != before.Value {
+		t.Errorf("Expiration changed from %q to %q on a replayed callback", before.Value, after.Value)
+	}
+
+	if logins := env.router.RequestsFor(routerostest.PathActive + "/login"); len(logins) != 1 {
+		t.Errorf("router received %d login attempts, want 1", len(logins))
+	}
+}
+
+func TestForgedCallbackIsRejected(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+	db := gdatabase.GetDB(gconfig.AppDB)
+	db.First(&order, order.ID)
+	t.Cleanup(func() {
+		db.Where("CheckoutRequestID = ?", order.CheckoutRequestID).Delete(&model.MpesaCallbackRejection{})
+	})
+
+	var push darajatest.StkPush
+	for _, p := range env.daraja.Pushes() {
+		if p.CheckoutRequestID == order.CheckoutRequestID {
+			push = p
+		}
+	}
+	otherPhone := push
+	otherPhone.PhoneNumber = "254799999999"
+
+	tests := []struct {
+		name   string
+		path   string
+		push   darajatest.StkPush
+		reason string
+	}{
+		{name: "no token", path: "/api/v1/mpesa/callback", push: push, reason: model.CallbackRejectToken},
+		{name: "guessed token", path: "/api/v1/mpesa/callback/0123456789abcdef", push: push, reason: model.CallbackRejectToken},
+		{name: "wrong phone", path: "/api/v1/mpesa/callback/" + order.CallbackToken, push: otherPhone, reason: model.CallbackRejectPhone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := darajatest.CallbackBody(tt.push, darajatest.ResultSuccess, "FORGED001", time.Now())
+			resp, err := http.Post(env.app.URL+tt.path, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("callback request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("forged callback returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+			}
+
+			var rejections int64
+			db.Model(&model.MpesaCallbackRejection{}).
+				Where("CheckoutRequestID = ? AND reason = ?", order.CheckoutRequestID, tt.reason).Count(&rejections)
+			if rejections == 0 {
+				t.Errorf("no %s rejection recorded", tt.reason)
+			}
+		})
+	}
+
+	if got := orderStatus(order.ID); got != model.OrderStatusPending {
+		t.Errorf("order status = %q after forged callbacks, want it pending", got)
+	}
+
+	// The genuine callback is still accepted
+	if cb, err := env.daraja.SendCallback(order.CheckoutRequestID); err != nil || cb.StatusCode != http.StatusOK {
+		t.Fatalf("genuine callback = %+v, %v, want it accepted", cb, err)
+	}
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+}
+
+// pushFor returns the STK push the fake Daraja received for order
+func (env *flowEnv) pushFor(t *testing.T, checkoutRequestID string) darajatest.StkPush {
+	t.Helper()
+
+	for _, push := range env.daraja.Pushes() {
+		if push.CheckoutRequestID == checkoutRequestID {
+			return push
+		}
+	}
+	t.Fatalf("no STK push with CheckoutRequestID %s", checkoutRequestID)
+	return darajatest.StkPush{}
+}
+
+// payAmount delivers a successful callback for push that reports amount as paid
+func payAmount(t *testing.T, push darajatest.StkPush, amount string) {
+	t.Helper()
+
+	push.Amount = amount
+	body := darajatest.CallbackBody(push, darajatest.ResultSuccess, fmt.Sprintf("AMT%d", time.Now().UnixNano()%1e9), time.Now())
+	resp, err := http.Post(push.CallBackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("callback request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("callback returned %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestUnderpaymentRequestsTopUp(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+	payAmount(t, env.pushFor(t, order.CheckoutRequestID), "4")
+
+	eventually(t, "order to be partially paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPartiallyPaid
+	})
+	if logins := env.router.RequestsFor(routerostest.PathActive + "/login"); len(logins) != 0 {
+		t.Fatalf("router received %d login attempts for an underpaid order", len(logins))
+	}
+
+	var topUp model.Order
+	eventually(t, "top-up order", func() bool {
+		return gdatabase.GetDB(gconfig.AppDB).Where("parentOrderId = ?", order.ID).First(&topUp).Error == nil
+	})
+	if topUp.Amount != env.plan.Price-4 || topUp.Status != model.OrderStatusPending || topUp.Username != order.Username {
+		t.Errorf("top-up order = %+v, want a pending order for the remaining %d", topUp, env.plan.Price-4)
+	}
+	if push := env.pushFor(t, topUp.CheckoutRequestID); push.Amount != fmt.Sprint(env.plan.Price-4) {
+		t.Errorf("top-up push amount = %s, want %d", push.Amount, env.plan.Price-4)
+	}
+
+	var mismatch model.PaymentMismatch
+	if err := gdatabase.GetDB(gconfig.AppDB).Where("orderId = ?", order.ID).First(&mismatch).Error; err != nil {
+		t.Fatalf("underpayment not recorded: %v", err)
+	}
+	if mismatch.Kind != model.MismatchUnderpaid || mismatch.Difference.IntPart() != int64(4-env.plan.Price) {
+		t.Errorf("mismatch = %+v, want an underpayment of %d", mismatch, env.plan.Price-4)
+	}
+
+	// Paying the top-up provisions the subscription
+	if cb, err := env.daraja.SendCallback(topUp.CheckoutRequestID); err != nil || cb.StatusCode != http.StatusOK {
+		t.Fatalf("top-up callback = %+v, %v, want it accepted", cb, err)
+	}
+	eventually(t, "top-up to be paid", func() bool {
+		return orderStatus(topUp.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+
+	// The underpaid order is settled with its top-up, not left open
+	if status := orderStatus(order.ID); status != model.OrderStatusToppedUp {
+		t.Errorf("underpaid order status = %s, want %s", status, model.OrderStatusToppedUp)
+	}
+	if err := gdatabase.GetDB(gconfig.AppDB).First(&mismatch, mismatch.ID).Error; err != nil || mismatch.Resolution != model.MismatchToppedUp {
+		t.Errorf("underpayment = %+v, %v, want it resolved by the top-up", mismatch, err)
+	}
+}
+
+func TestTopUpCallbackBeforeItsPushReturns(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+
+	// The top-up is paid and its callback delivered before Daraja answers the push
+	env.daraja.AutoCallback = true
+	env.daraja.CallbackFirst = true
+	payAmount(t, env.pushFor(t, order.CheckoutRequestID), "4")
+
+	var topUp model.Order
+	eventually(t, "top-up order", func() bool {
+		return gdatabase.GetDB(gconfig.AppDB).Where("parentOrderId = ? AND CheckoutRequestID <> ''", order.ID).First(&topUp).Error == nil
+	})
+	eventually(t, "top-up to be paid", func() bool {
+		return orderStatus(topUp.ID) == model.OrderStatusPaid
+	})
+	for _, cb := range env.daraja.Callbacks() {
+		if cb.CheckoutRequestID == topUp.CheckoutRequestID && cb.StatusCode != http.StatusOK {
+			t.Errorf("top-up callback returned %d, want %d", cb.StatusCode, http.StatusOK)
+		}
+	}
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+	if status := orderStatus(order.ID); status != model.OrderStatusToppedUp {
+		t.Errorf("underpaid order status = %s, want %s", status, model.OrderStatusToppedUp)
+	}
+}
+
+func TestOverpaymentIsCredited(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+	payAmount(t, env.pushFor(t, order.CheckoutRequestID), fmt.Sprint(env.plan.Price+5))
+
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+
+	var credit model.CustomerCredit
+	if err := gdatabase.GetDB(gconfig.AppDB).Where("orderId = ?", order.ID).First(&credit).Error; err != nil {
+		t.Fatalf("overpayment not credited: %v", err)
+	}
+	if credit.Amount.IntPart() != 5 || credit.Phone != order.Phone {
+		t.Errorf("credit = %+v, want 5 for %s", credit, order.Phone)
+	}
+
+	resp, err := http.Get(env.app.URL + "/api/v1/mpesa/reports/amount-mismatches?kind=overpaid&phone=" + order.Phone)
+	if err != nil {
+		t.Fatalf("report request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var report struct {
+		Data []handler.PaymentMismatchReport
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if len(report.Data) != 1 || report.Data[0].OrderID != order.ID || report.Data[0].Resolution != model.MismatchCredited {
+		t.Errorf("report = %+v, want the credited overpayment of order %d", report.Data, order.ID)
+	}
+}
+
+// registerC2B registers the app's C2B URLs with the fake Daraja
+func (env *flowEnv) registerC2B(t *testing.T) {
+	t.Helper()
+
+	resp, err := http.Post(env.app.URL+"/api/v1/mpesa/c2b/register", "application/json", nil)
+	if err != nil {
+		t.Fatalf("C2B registration request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(env.daraja.C2BRegistrations()) != 1 {
+		t.Fatalf("C2B registration returned %d, want the URLs registered", resp.StatusCode)
+	}
+}
+
+// payC2B delivers a C2B confirmation for payment and removes its record afterwards
+func (env *flowEnv) payC2B(t *testing.T, payment darajatest.C2BPayment) model.MpesaC2BPayment {
+	t.Helper()
+
+	db := gdatabase.GetDB(gconfig.AppDB)
+	t.Cleanup(func() {
+		db.Where("transId = ?", payment.TransID).Delete(&model.MpesaC2BPayment{})
+		db.Where("CheckoutRequestID = ?", handler.C2BCheckoutRequestID(payment.TransID)).Delete(&model.Payment{})
+	})
+
+	status, err := env.daraja.SendC2BPayment(payment)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("C2B confirmation = %d, %v, want it accepted", status, err)
+	}
+	var recorded model.MpesaC2BPayment
+	if err := db.Where("transId = ?", payment.TransID).First(&recorded).Error; err != nil {
+		t.Fatalf("C2B payment not recorded: %v", err)
+	}
+	return recorded
+}
+
+func c2bTransID() string {
+	return fmt.Sprintf("C2B%09d", rand.Intn(1e9))
+}
+
+func TestC2BPaymentMatchedByOrderNumber(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+	env.registerC2B(t)
+
+	order := env.checkout(t, randomPhone())
+	// Paid from another phone, for the order named as account number
+	recorded := env.payC2B(t, darajatest.C2BPayment{
+		TransID:       c2bTransID(),
+		Amount:        fmt.Sprint(env.plan.Price),
+		MSISDN:        "254" + randomPhone()[1:],
+		BillRefNumber: order.OrderNumber,
+	})
+	if recorded.Status != model.C2BStatusMatched || recorded.OrderID == nil || *recorded.OrderID != order.ID {
+		t.Errorf("C2B payment = %+v, want it matched to order %d", recorded, order.ID)
+	}
+
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+}
+
+func TestPushPaidAfterC2BSettledTheOrderIsCredited(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+	env.registerC2B(t)
+
+	order := env.checkout(t, randomPhone())
+	env.payC2B(t, darajatest.C2BPayment{
+		TransID:       c2bTransID(),
+		Amount:        fmt.Sprint(env.plan.Price),
+		MSISDN:        "254" + order.Phone[1:],
+		BillRefNumber: order.OrderNumber,
+	})
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+
+	// The customer also completes the STK push, and Safaricom retries its callback
+	for i := 0; i < 2; i++ {
+		if cb, err := env.daraja.SendCallback(order.CheckoutRequestID); err != nil || cb.StatusCode != http.StatusOK {
+			t.Fatalf("STK callback = %+v, %v, want it accepted", cb, err)
+		}
+	}
+
+	db := gdatabase.GetDB(gconfig.AppDB)
+	eventually(t, "STK payment to be recorded", func() bool {
+		var count int64
+		db.Model(&model.Payment{}).Where("CheckoutRequestID = ?", order.CheckoutRequestID).Count(&count)
+		return count == 1
+	})
+	var credits []model.CustomerCredit
+	eventually(t, "STK payment to be credited", func() bool {
+		return db.Where("orderId = ?", order.ID).Find(&credits).Error == nil && len(credits) > 0
+	})
+	if len(credits) != 1 || credits[0].Amount.IntPart() != int64(env.plan.Price) {
+		t.Errorf("credits = %+v, want one of %d", credits, env.plan.Price)
+	}
+	var mismatch model.PaymentMismatch
+	if err := db.Where("CheckoutRequestID = ?", order.CheckoutRequestID).First(&mismatch).Error; err != nil || mismatch.Kind != model.MismatchOverpaid {
+		t.Errorf("mismatch = %+v, %v, want the STK payment reported as an overpayment", mismatch, err)
+	}
+	if logins := env.router.RequestsFor(routerostest.PathActive + "/login"); len(logins) != 1 {
+		t.Errorf("router received %d login attempts, want only the one for the C2B payment", len(logins))
+	}
+}
+
+func TestC2BPaymentMatchedByPhoneAfterCancelledPush(t *testing.T) {
+	env := setupFlow(t)
+	env.registerC2B(t)
+
+	phone := randomPhone()
+	env.daraja.SetResult("254"+phone[1:], darajatest.ResultCancelled)
+	order := env.checkout(t, phone)
+	eventually(t, "order to be marked failed", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaymentFailed
+	})
+
+	// The customer pays from the M-Pesa menu instead, with a hashed MSISDN
+	sum := sha256.Sum256([]byte("254" + phone[1:]))
+	recorded := env.payC2B(t, darajatest.C2BPayment{
+		TransID: c2bTransID(),
+		Amount:  fmt.Sprint(env.plan.Price),
+		MSISDN:  hex.EncodeToString(sum[:]),
+	})
+	if recorded.Status != model.C2BStatusMatched || recorded.OrderID == nil || *recorded.OrderID != order.ID {
+		t.Errorf("C2B payment = %+v, want it matched to order %d", recorded, order.ID)
+	}
+
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+}
+
+func TestUnmatchedC2BPaymentIsAllocated(t *testing.T) {
+	env := setupFlow(t)
+	env.registerC2B(t)
+
+	transID := c2bTransID()
+	recorded := env.payC2B(t, darajatest.C2BPayment{
+		TransID:       transID,
+		Amount:        fmt.Sprint(env.plan.Price),
+		MSISDN:        "254" + randomPhone()[1:],
+		BillRefNumber: "no-such-order",
+	})
+	if recorded.Status != model.C2BStatusUnmatched || recorded.OrderID != nil {
+		t.Fatalf("C2B payment = %+v, want it parked as unmatched", recorded)
+	}
+
+	resp, err := http.Get(env.app.URL + "/api/v1/mpesa/c2b/payments?limit=100")
+	if err != nil {
+		t.Fatalf("C2B payments request failed: %v", err)
+	}
+	var list struct {
+		Data []model.MpesaC2BPayment
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode C2B payments: %v", err)
+	}
+	listed := false
+	for _, payment := range list.Data {
+		listed = listed || payment.TransID == transID
+	}
+	if !listed {
+		t.Errorf("unmatched C2B payments do not include %s", transID)
+	}
+
+	phone := randomPhone()
+	env.daraja.SetResult("254"+phone[1:], darajatest.ResultCancelled)
+	order := env.checkout(t, phone)
+	eventually(t, "order to be marked failed", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaymentFailed
+	})
+
+	allocate := func() int {
+		body, _ := json.Marshal(map[string]string{"order_number": order.OrderNumber})
+		resp, err := http.Post(env.app.URL+"/api/v1/mpesa/c2b/payments/"+transID+"/allocate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("allocation request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := allocate(); status != http.StatusOK {
+		t.Fatalf("allocation returned %d, want %d", status, http.StatusOK)
+	}
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	eventually(t, "hotspot login on the router", func() bool {
+		return len(env.router.RequestsFor(routerostest.PathActive+"/login")) == 1
+	})
+
+	// A payment is allocated once
+	if status := allocate(); status != http.StatusConflict {
+		t.Errorf("second allocation returned %d, want %d", status, http.StatusConflict)
+	}
+}
+
+// paidOrder checks out for a new phone and waits for the order to be paid
+func (env *flowEnv) paidOrder(t *testing.T) model.Order {
+	t.Helper()
+
+	order := env.checkout(t, randomPhone())
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+	return order
+}
+
+func (env *flowEnv) requestRefund(t *testing.T, order model.Order, method string) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"method": method, "reason": "integration test"})
+	resp, err := http.Post(env.app.URL+"/api/v1/mpesa/orders/"+order.OrderNumber+"/refund", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("refund request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func orderRefund(orderID int) model.Refund {
+	var refund model.Refund
+	gdatabase.GetDB(gconfig.AppDB).Where("orderId = ?", orderID).Order("id DESC").Limit(1).Find(&refund)
+	return refund
+}
+
+func TestRefundReversesPayment(t *testing.T) {
+	env := setupFlow(t)
+	order := env.paidOrder(t)
+
+	if status := env.requestRefund(t, order, model.RefundMethodReversal); status != http.StatusAccepted {
+		t.Fatalf("refund returned %d, want %d", status, http.StatusAccepted)
+	}
+	eventually(t, "order to be refunded", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusRefunded
+	})
+
+	var payment model.Payment
+	gdatabase.GetDB(gconfig.AppDB).Where("orderId = ? AND ResultCode = 0", order.ID).First(&payment)
+	requests := env.daraja.Refunds()
+	if len(requests) != 1 || payment.MpesaReceiptNumber == nil || requests[0].TransactionID != *payment.MpesaReceiptNumber {
+		t.Errorf("refund requests = %+v, want the payment's receipt reversed", requests)
+	}
+	refund := orderRefund(order.ID)
+	if refund.Status != model.RefundStatusCompleted || refund.TransactionID == "" || refund.Automatic {
+		t.Errorf("refund = %+v, want a completed manual refund", refund)
+	}
+	if payment.RefundStatus != model.RefundStatusCompleted {
+		t.Errorf("payment refund status = %q, want %q", payment.RefundStatus, model.RefundStatusCompleted)
+	}
+
+	// A payment is refunded once
+	if status := env.requestRefund(t, order, model.RefundMethodB2C); status != http.StatusConflict {
+		t.Errorf("second refund returned %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestRefundFailedInQueueMayBeRetried(t *testing.T) {
+	env := setupFlow(t)
+	order := env.paidOrder(t)
+
+	env.daraja.SetRefundResult(darajatest.Result{ResultCode: 2001, ResultDesc: "The initiator information is invalid."})
+	if status := env.requestRefund(t, order, model.RefundMethodB2C); status != http.StatusAccepted {
+		t.Fatalf("refund returned %d, want %d", status, http.StatusAccepted)
+	}
+	eventually(t, "refund to fail", func() bool {
+		return orderRefund(order.ID).Status == model.RefundStatusFailed
+	})
+	if status := orderStatus(order.ID); status != model.OrderStatusPaid {
+		t.Errorf("order status = %q after a failed refund, want %q", status, model.OrderStatusPaid)
+	}
+
+	env.daraja.SetRefundResult(darajatest.ResultSuccess)
+	if status := env.requestRefund(t, order, model.RefundMethodB2C); status != http.StatusAccepted {
+		t.Fatalf("retried refund returned %d, want %d", status, http.StatusAccepted)
+	}
+	eventually(t, "order to be refunded", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusRefunded
+	})
+}
+
+func TestFailedProvisioningIsRefundedAutomatically(t *testing.T) {
+	env := setupFlow(t)
+	order := env.paidOrder(t)
+
+	env.mpesa.RefundMethod = model.RefundMethodB2C
+	env.mpesa.AutoRefundAfter = time.Minute
+
+	// Provisioning failed two minutes ago
+	if err := service.MarkProvisioningFailed(order.ID, "radius unavailable"); err != nil {
+		t.Fatalf("MarkProvisioningFailed() error = %v", err)
+	}
+	gdatabase.GetDB(gconfig.AppDB).Model(&model.Order{}).Where("id = ?", order.ID).
+		Update("provisioningFailedAt", time.Now().Add(-2*time.Minute))
+
+	if err := env.refunds.HandleTask(context.Background(), asynq.NewTask(queue.TypeMpesaAutoRefund, nil)); err != nil {
+		t.Fatalf("HandleTask() error = %v", err)
+	}
+	eventually(t, "order to be refunded", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusRefunded
+	})
+
+	requests := env.daraja.Refunds()
+	if len(requests) != 1 || requests[0].PartyB != "254"+order.Phone[1:] {
+		t.Errorf("refund requests = %+v, want one B2C payment to %s", requests, order.Phone)
+	}
+	if refund := orderRefund(order.ID); !refund.Automatic || refund.RequestedBy != "system" {
+		t.Errorf("refund = %+v, want an automatic refund", refund)
+	}
+}
+
+func TestAirtelCheckoutPaidAndRefunded(t *testing.T) {
+	env := setupFlow(t)
+
+	order := env.checkoutWith(t, randomPhone(), model.PaymentProviderAirtel)
+	if order.Provider != model.PaymentProviderAirtel || len(env.daraja.Pushes()) != 0 {
+		t.Fatalf("order = %+v, want an Airtel Money order and no STK push", order)
+	}
+	if status, err := env.airtel.SendCallback(order.CheckoutRequestID); err != nil || status != http.StatusOK {
+		t.Fatalf("Airtel callback returned %d, %v, want %d", status, err, http.StatusOK)
+	}
+	eventually(t, "order to be paid", func() bool {
+		return orderStatus(order.ID) == model.OrderStatusPaid
+	})
+
+	var payment model.Payment
+	if err := gdatabase.GetDB(gconfig.AppDB).Where("CheckoutRequestID = ?", order.CheckoutRequestID).First(&payment).Error; err != nil {
+		t.Fatalf("payment not recorded: %v", err)
+	}
+	airtelMoneyID := env.airtel.Payments()[0].AirtelMoneyID
+	if payment.Provider != model.PaymentProviderAirtel || payment.MpesaReceiptNumber == nil || *payment.MpesaReceiptNumber != airtelMoneyID {
+		t.Errorf("payment = %+v, want an Airtel Money payment with ID %s", payment, airtelMoneyID)
+	}
+
+	// Airtel refunds synchronously, the refund is finished at once
+	if status := env.requestRefund(t, order, model.RefundMethodReversal); status != http.StatusAccepted {
+		t.Fatalf("refund returned %d, want %d", status, http.StatusAccepted)
+	}
+	if refund := orderRefund(order.ID); refund.Status != model.RefundStatusCompleted {
+		t.Errorf("refund = %+v, want it completed", refund)
+	}
+	if refunds := env.airtel.Refunds(); len(refunds) != 1 || refunds[0] != airtelMoneyID {
+		t.Errorf("Airtel refunds = %v, want %s refunded", refunds, airtelMoneyID)
+	}
+}
+
+func TestAirtelCallbackForMpesaOrderIsRejected(t *testing.T) {
+	env := setupFlow(t)
+	env.daraja.AutoCallback = false
+
+	order := env.checkout(t, randomPhone())
+	body := airteltest.CallbackBody(airteltest.Payment{ID: order.CheckoutRequestID, AirtelMoneyID: "MP-FORGED"},
+		airteltest.ResultSuccess, env.airtel.CallbackKey)
+	resp, err := http.Post(env.airtel.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("callback request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Airtel callback for an M-Pesa order returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if status := orderStatus(order.ID); status != model.OrderStatusPending {
+		t.Errorf("order status = %s, want it still pending", status)
+	}
+}
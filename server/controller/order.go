@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// GetOrders - GET /orders
+// Lists the orders of the caller's ISP
+func GetOrders(c *gin.Context) {
+	handler.GetOrders(c, nil)
+}
+
+// UpdateOrder - PUT /orders
+func UpdateOrder(c *gin.Context) {
+	handler.UpdateOrder(c, nil)
+}
+
+// DeleteOrder - DELETE /orders/:id
+func DeleteOrder(c *gin.Context) {
+	handler.DeleteOrder(c, nil)
+}
+
+// GetPayments - GET /payments
+// Lists the payments towards orders of the caller's ISP
+func GetPayments(c *gin.Context) {
+	handler.GetPayments(c, nil)
+}
+
+// GetPayment - POST /payments/find
+// Finds the payment matching the fields in the body
+func GetPayment(c *gin.Context) {
+	handler.GetPayment(c, nil)
+}
+
+// CreatePayment - POST /payments
+func CreatePayment(c *gin.Context) {
+	handler.CreatePayment(c, nil)
+}
+
+// UpdatePayment - PUT /payments
+func UpdatePayment(c *gin.Context) {
+	handler.UpdatePayment(c, nil)
+}
+
+// DeletePayment - DELETE /payments
+func DeletePayment(c *gin.Context) {
+	handler.DeletePayment(c, nil)
+}
@@ -93,7 +93,14 @@ func HowtoController(c *gin.Context) {
 	voucher := username
 
 	if(voucher == ""){
-		voucher = phone + "@Tecsurf"
+		// Subscribers sign in as phone@realm of the ISP they paid
+		ispID, _ := strconv.ParseInt(c.Query("isp"), 10, 64)
+		isp, err := handler.GetISP(ispID)
+		if err != nil {
+			renderErrorPage(c, "ISP not found", "Not Found", http.StatusNotFound)
+			return
+		}
+		voucher = isp.SubscriberUsername(phone)
 	}
 
 	c.HTML(http.StatusOK, "howto.html", gin.H{
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	grenderer "github.com/ortupik/wifigo/lib/renderer"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// GetRoles - GET /roles
+func GetRoles(c *gin.Context) {
+	resp, statusCode := handler.GetRoles()
+
+	grenderer.Render(c, resp.Message, statusCode)
+}
+
+// GetAccountRole - GET /accounts/:id/role
+func GetAccountRole(c *gin.Context) {
+	tenant, ok := handler.CallerTenant(c)
+	if !ok {
+		return
+	}
+	authID, err := strconv.ParseUint(strings.TrimSpace(c.Params.ByName("id")), 10, 64)
+	if err != nil {
+		grenderer.Render(c, gin.H{"message": "invalid account id"}, http.StatusBadRequest)
+		return
+	}
+
+	resp, statusCode := handler.GetAccountRole(tenant, authID)
+
+	if reflect.TypeOf(resp.Message).Kind() == reflect.String {
+		grenderer.Render(c, resp, statusCode)
+		return
+	}
+
+	grenderer.Render(c, resp.Message, statusCode)
+}
+
+// AssignRole - PUT /accounts/:id/role
+func AssignRole(c *gin.Context) {
+	tenant, ok := handler.CallerTenant(c)
+	if !ok {
+		return
+	}
+	authID, err := strconv.ParseUint(strings.TrimSpace(c.Params.ByName("id")), 10, 64)
+	if err != nil {
+		grenderer.Render(c, gin.H{"message": "invalid account id"}, http.StatusBadRequest)
+		return
+	}
+	input := handler.RoleInput{}
+
+	// bind JSON
+	if err := c.ShouldBindJSON(&input); err != nil {
+		grenderer.Render(c, gin.H{"message": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	resp, statusCode := handler.AssignRole(tenant, authID, input)
+
+	if reflect.TypeOf(resp.Message).Kind() == reflect.String {
+		grenderer.Render(c, resp, statusCode)
+		return
+	}
+
+	grenderer.Render(c, resp.Message, statusCode)
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// GetServicePlans - GET /plans
+func GetServicePlans(c *gin.Context) {
+	handler.GetServicePlans(c, nil)
+}
+
+// GetServicePlan - GET /plans/:id
+func GetServicePlan(c *gin.Context) {
+	handler.GetServicePlan(c, nil)
+}
+
+// CreateServicePlan - POST /plans
+// Creates a service plan and its RADIUS group
+func CreateServicePlan(c *gin.Context) {
+	handler.CreateServicePlan(c, nil)
+}
+
+// UpdateServicePlan - PUT /plans/:id
+// Edits a service plan and regenerates its RADIUS group
+func UpdateServicePlan(c *gin.Context) {
+	handler.UpdateServicePlan(c, nil)
+}
+
+// SyncServicePlanGroups - POST /plans/radius/sync
+func SyncServicePlanGroups(c *gin.Context) {
+	handler.SyncServicePlanGroups(c)
+}
+
+// GetRadiusGroupDrift - GET /plans/radius/drift
+func GetRadiusGroupDrift(c *gin.Context) {
+	handler.GetRadiusGroupDrift(c)
+}
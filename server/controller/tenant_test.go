@@ -0,0 +1,285 @@
+//go:build integration
+
+package controller_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/server/controller"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// tenantData is what one ISP owns in the tenant tests
+type tenantData struct {
+	isp     model.ISP
+	device  model.MikroTikDevice
+	order   model.Order
+	payment model.Payment
+	batch   model.VoucherBatch
+	voucher model.Voucher
+}
+
+// seedTenant creates an ISP with a device, an order, a payment and a voucher
+func seedTenant(t *testing.T, db *gorm.DB, suffix string) tenantData {
+	t.Helper()
+	var d tenantData
+	d.isp = model.ISP{Name: "itest-" + suffix, Realm: "itest" + suffix}
+	if err := db.Create(&d.isp).Error; err != nil {
+		t.Fatalf("failed to create ISP: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.isp) })
+
+	d.device = model.MikroTikDevice{ID: "itest-router-" + suffix, Address: "10.0.0.1", Port: "8728", Username: "admin", Status: model.StatusInactive, ISPID: &d.isp.ID}
+	if err := db.Create(&d.device).Error; err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.device) })
+
+	d.order = model.Order{OrderNumber: "itest-order-" + suffix, Status: model.OrderStatusPending, Username: d.isp.SubscriberUsername("0712345678"), ISP: strconv.FormatInt(d.isp.ID, 10)}
+	if err := db.Omit(clause.Associations).Create(&d.order).Error; err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.order) })
+
+	d.payment = model.Payment{CheckoutRequestID: "itest-payment-" + suffix, ResultDesc: "ok", OrderID: &d.order.ID}
+	if err := db.Omit(clause.Associations).Create(&d.payment).Error; err != nil {
+		t.Fatalf("failed to create payment: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.payment) })
+
+	d.batch = model.VoucherBatch{Name: "itest-batch-" + suffix, ISPID: d.isp.ID, Quantity: 1, Devices: 1}
+	if err := db.Omit(clause.Associations).Create(&d.batch).Error; err != nil {
+		t.Fatalf("failed to create voucher batch: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.batch) })
+
+	d.voucher = model.Voucher{Code: strings.ToUpper("itest" + suffix), BatchID: d.batch.ID, ISPID: d.isp.ID, Status: model.VoucherStatusUnused}
+	if err := db.Create(&d.voucher).Error; err != nil {
+		t.Fatalf("failed to create voucher: %v", err)
+	}
+	t.Cleanup(func() { db.Delete(&d.voucher) })
+	return d
+}
+
+// tenantApp serves the admin APIs to an account of the given ISP
+func tenantApp(ispID int64) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("authID", uint64(1))
+		c.Set("role", gmodel.RoleISPAdmin)
+		c.Set("scope", gmodel.ISPScope(ispID))
+		c.Next()
+	}, handler.TenantRequired())
+
+	devices := controller.NewMikroTikController(mikrotik.NewManager(), nil)
+	r.GET("/devices", devices.GetDevices)
+	r.GET("/devices/:id", devices.GetDevice)
+	r.PUT("/devices/:id", devices.UpdateDevice)
+	r.DELETE("/devices/:id", devices.DeleteDevice)
+	r.GET("/orders", func(c *gin.Context) { handler.GetOrders(c, nil) })
+	r.PUT("/orders", func(c *gin.Context) { handler.UpdateOrder(c, nil) })
+	r.DELETE("/orders/:id", func(c *gin.Context) { handler.DeleteOrder(c, nil) })
+	r.POST("/payments/find", func(c *gin.Context) { handler.GetPayment(c, nil) })
+	r.PUT("/payments", func(c *gin.Context) { handler.UpdatePayment(c, nil) })
+	r.POST("/payments", func(c *gin.Context) { handler.CreatePayment(c, nil) })
+	r.GET("/hotspot/users/:username", controller.GetHotspotUser)
+	r.DELETE("/hotspot/users/:username", controller.DeleteHotspotUser)
+	r.POST("/hotspot/users", controller.CreateHotspotUser)
+	r.GET("/vouchers", controller.GetVouchers)
+	r.PATCH("/vouchers/:code", controller.UpdateVoucher)
+	r.GET("/vouchers/batches", controller.GetVoucherBatches)
+	r.GET("/vouchers/batches/:id", controller.GetVoucherBatch)
+	r.GET("/vouchers/batches/:id/csv", controller.ExportVoucherBatchCSV)
+	return r
+}
+
+func TestCrossTenantAccessIsRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil || gdatabase.GetDB(gconfig.RadiusDB) == nil {
+		t.Skipf("app and radius databases not available: %v", err)
+	}
+	db := gdatabase.GetDB(gconfig.AppDB)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ours := seedTenant(t, db, "a"+suffix)
+	theirs := seedTenant(t, db, "b"+suffix)
+	app := tenantApp(ours.isp.ID)
+
+	call := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{name: "read device", method: http.MethodGet, path: "/devices/" + theirs.device.ID, want: http.StatusNotFound},
+		{name: "update device", method: http.MethodPut, path: "/devices/" + theirs.device.ID, body: gin.H{"address": "10.9.9.9"}, want: http.StatusNotFound},
+		{name: "delete device", method: http.MethodDelete, path: "/devices/" + theirs.device.ID, want: http.StatusNotFound},
+		{name: "update order", method: http.MethodPut, path: "/orders", body: gin.H{"ID": theirs.order.ID, "Status": "paid"}, want: http.StatusNotFound},
+		{name: "delete order", method: http.MethodDelete, path: fmt.Sprintf("/orders/%d", theirs.order.ID), want: http.StatusNotFound},
+		{name: "read payment", method: http.MethodPost, path: "/payments/find", body: gin.H{"ID": theirs.payment.ID}, want: http.StatusNotFound},
+		{name: "update payment", method: http.MethodPut, path: "/payments", body: gin.H{"ID": theirs.payment.ID, "ResultDesc": "changed"}, want: http.StatusNotFound},
+		{name: "payment towards their order", method: http.MethodPost, path: "/payments", body: gin.H{"CheckoutRequestID": "itest-x-" + suffix, "OrderID": theirs.order.ID}, want: http.StatusNotFound},
+		{name: "read hotspot user", method: http.MethodGet, path: "/hotspot/users/" + theirs.order.Username, want: http.StatusNotFound},
+		{name: "delete hotspot user", method: http.MethodDelete, path: "/hotspot/users/" + theirs.order.Username, want: http.StatusNotFound},
+		{name: "create hotspot user in their realm", method: http.MethodPost, path: "/hotspot/users", body: gin.H{"username": theirs.isp.SubscriberUsername("0722000000")}, want: http.StatusForbidden},
+		{name: "read voucher batch", method: http.MethodGet, path: fmt.Sprintf("/vouchers/batches/%d", theirs.batch.ID), want: http.StatusNotFound},
+		{name: "export voucher batch", method: http.MethodGet, path: fmt.Sprintf("/vouchers/batches/%d/csv", theirs.batch.ID), want: http.StatusNotFound},
+		{name: "void voucher", method: http.MethodPatch, path: "/vouchers/" + theirs.voucher.Code, body: gin.H{"status": model.VoucherStatusVoid}, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := call(tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("%s %s = %d %s, want %d", tt.method, tt.path, w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	// Nothing of the other ISP was changed
+	var device model.MikroTikDevice
+	if err := db.First(&device, "id = ?", theirs.device.ID).Error; err != nil || device.Address != theirs.device.Address {
+		t.Errorf("device of the other ISP = %+v, %v, want it unchanged", device, err)
+	}
+	var order model.Order
+	if err := db.First(&order, theirs.order.ID).Error; err != nil || order.Status != theirs.order.Status {
+		t.Errorf("order of the other ISP = %+v, %v, want it unchanged", order, err)
+	}
+
+	// Lists only hold what the caller's ISP owns
+	w := call(http.MethodGet, "/orders?limit=1000", nil)
+	var orders struct{ Data []model.Order }
+	if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil {
+		t.Fatalf("GET /orders = %d %s", w.Code, w.Body.String())
+	}
+	for _, o := range orders.Data {
+		if o.ISP != ours.order.ISP {
+			t.Errorf("GET /orders listed order %s of ISP %s", o.OrderNumber, o.ISP)
+		}
+	}
+	w = call(http.MethodGet, "/devices", nil)
+	if bytes.Contains(w.Body.Bytes(), []byte(theirs.device.ID)) || !bytes.Contains(w.Body.Bytes(), []byte(ours.device.ID)) {
+		t.Errorf("GET /devices = %s, want only %s", w.Body.String(), ours.device.ID)
+	}
+	w = call(http.MethodGet, "/vouchers?limit=1000", nil)
+	var vouchers struct{ Data []model.Voucher }
+	if err := json.Unmarshal(w.Body.Bytes(), &vouchers); err != nil {
+		t.Fatalf("GET /vouchers = %d %s", w.Code, w.Body.String())
+	}
+	for _, v := range vouchers.Data {
+		if v.ISPID != ours.isp.ID {
+			t.Errorf("GET /vouchers listed voucher %s of ISP %d", v.Code, v.ISPID)
+		}
+	}
+	w = call(http.MethodGet, "/vouchers/batches?limit=1000", nil)
+	var batches struct{ Data []model.VoucherBatch }
+	if err := json.Unmarshal(w.Body.Bytes(), &batches); err != nil {
+		t.Fatalf("GET /vouchers/batches = %d %s", w.Code, w.Body.String())
+	}
+	for _, b := range batches.Data {
+		if b.ISPID != ours.isp.ID {
+			t.Errorf("GET /vouchers/batches listed batch %s of ISP %d", b.Name, b.ISPID)
+		}
+	}
+	var voucher model.Voucher
+	if err := db.First(&voucher, theirs.voucher.ID).Error; err != nil || voucher.Status != model.VoucherStatusUnused {
+		t.Errorf("voucher of the other ISP = %+v, %v, want it unused", voucher, err)
+	}
+
+	// The caller's own data is reachable
+	if w := call(http.MethodGet, "/devices/"+ours.device.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("GET own device = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodPost, "/payments/find", gin.H{"ID": ours.payment.ID}); w.Code != http.StatusOK {
+		t.Errorf("find own payment = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodGet, fmt.Sprintf("/vouchers/batches/%d", ours.batch.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("GET own voucher batch = %d %s, want 200", w.Code, w.Body.String())
+	}
+}
+
+func TestISPAdminAssignsRolesInOwnISPOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil || gdatabase.GetDB(gconfig.RadiusDB) == nil {
+		t.Skipf("app and radius databases not available: %v", err)
+	}
+	db := gdatabase.GetDB(gconfig.AppDB)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ours := seedTenant(t, db, "a"+suffix)
+	theirs := seedTenant(t, db, "b"+suffix)
+
+	account := func(name string, ispID *int64) gmodel.Auth {
+		auth := gmodel.Auth{Email: name + "-" + suffix + "@itest.local", ISPID: ispID}
+		if err := db.Create(&auth).Error; err != nil {
+			t.Fatalf("failed to create account: %v", err)
+		}
+		t.Cleanup(func() { db.Unscoped().Delete(&auth) })
+		return auth
+	}
+	own := account("own", &ours.isp.ID)
+	other := account("other", &theirs.isp.ID)
+	unassigned := account("unassigned", nil)
+
+	app := tenantApp(ours.isp.ID)
+	app.PUT("/accounts/:id/role", controller.AssignRole)
+
+	tests := []struct {
+		name string
+		auth gmodel.Auth
+		want int
+	}{
+		{name: "account of own ISP", auth: own, want: http.StatusOK},
+		{name: "account of another ISP", auth: other, want: http.StatusNotFound},
+		{name: "account of no ISP", auth: unassigned, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, _ := json.Marshal(gin.H{"role": gmodel.RoleISPSupport})
+			req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/accounts/%d/role", tt.auth.AuthID), bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("PUT role of %s = %d %s, want %d", tt.auth.Email, w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	var auth gmodel.Auth
+	if err := db.First(&auth, unassigned.AuthID).Error; err != nil || auth.ISPID != nil || auth.Role != "" {
+		t.Errorf("account of no ISP = %+v, %v, want it left without ISP and role", auth, err)
+	}
+}
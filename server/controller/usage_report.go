@@ -0,0 +1,19 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// GetUsageSummary - GET /reports/usage
+// Totals RADIUS accounting sessions in a date range
+func GetUsageSummary(c *gin.Context) {
+	handler.GetUsageSummary(c)
+}
+
+// GetUsageReport - GET /reports/usage/:dimension
+// Aggregates RADIUS accounting sessions by user, NAS, realm or time bucket
+func GetUsageReport(c *gin.Context) {
+	handler.GetUsageReport(c)
+}
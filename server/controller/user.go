@@ -17,16 +17,24 @@ import (
 
 // GetUsers - GET /users
 func GetUsers(c *gin.Context) {
-	resp, statusCode := handler.GetUsers()
+	tenant, ok := handler.CallerTenant(c)
+	if !ok {
+		return
+	}
+	resp, statusCode := handler.GetUsers(tenant)
 
 	grenderer.Render(c, resp, statusCode)
 }
 
 // GetUser - GET /users/:id
 func GetUser(c *gin.Context) {
+	tenant, ok := handler.CallerTenant(c)
+	if !ok {
+		return
+	}
 	id := strings.TrimSpace(c.Params.ByName("id"))
 
-	resp, statusCode := handler.GetUser(id)
+	resp, statusCode := handler.GetUser(tenant, id)
 
 	if reflect.TypeOf(resp.Message).Kind() == reflect.String {
 		grenderer.Render(c, resp, statusCode)
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// CreateVoucherBatch - POST /vouchers/batches
+// Generates a batch of vouchers for a service plan
+func CreateVoucherBatch(c *gin.Context) {
+	handler.CreateVoucherBatch(c, nil)
+}
+
+// GetVoucherBatches - GET /vouchers/batches
+func GetVoucherBatches(c *gin.Context) {
+	handler.GetVoucherBatches(c, nil)
+}
+
+// GetVoucherBatch - GET /vouchers/batches/:id
+func GetVoucherBatch(c *gin.Context) {
+	handler.GetVoucherBatch(c)
+}
+
+// ExportVoucherBatchCSV - GET /vouchers/batches/:id/csv
+func ExportVoucherBatchCSV(c *gin.Context) {
+	handler.ExportVoucherBatchCSV(c)
+}
+
+// PrintVoucherBatch - GET /vouchers/batches/:id/print
+// Renders the unused vouchers as a printable sheet
+func PrintVoucherBatch(c *gin.Context) {
+	handler.PrintVoucherBatch(c)
+}
+
+// GetVouchers - GET /vouchers
+func GetVouchers(c *gin.Context) {
+	handler.GetVouchers(c, nil)
+}
+
+// UpdateVoucher - PATCH /vouchers/:code
+// Changes the seller of a voucher or voids it
+func UpdateVoucher(c *gin.Context) {
+	handler.UpdateVoucher(c, nil)
+}
@@ -0,0 +1,67 @@
+//go:build integration
+
+package controller_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3"
+
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+func TestVoucherRedemptionOnAnotherISPHotspot(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil || gdatabase.GetDB(gconfig.RadiusDB) == nil {
+		t.Skipf("app and radius databases not available: %v", err)
+	}
+	db := gdatabase.GetDB(gconfig.AppDB)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ours := seedTenant(t, db, "a"+suffix)
+	theirs := seedTenant(t, db, "b"+suffix)
+
+	vouchers := handler.NewVoucherHandler(nil, nil)
+	vouchers.UseThrottle(handler.NewRedeemThrottle(limiter.Rate{Period: time.Hour, Limit: 2}, limiter.Rate{Period: time.Hour, Limit: 100}))
+	app := gin.New()
+	app.POST("/vouchers/redeem", vouchers.RedeemVoucher)
+
+	redeem := func(code, deviceID string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(dto.VoucherRedeemRequest{Code: code, Ip: "10.5.50.20", Mac: "AA:BB:CC:00:00:20", DeviceID: deviceID})
+		req := httptest.NewRequest(http.MethodPost, "/vouchers/redeem", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	// Their voucher is unknown on our hotspot, exactly like a wrong code
+	if w := redeem(theirs.voucher.Code, ours.device.ID); w.Code != http.StatusNotFound {
+		t.Errorf("redeem on another ISP's hotspot = %d %s, want 404", w.Code, w.Body.String())
+	}
+	if w := redeem("ZZ"+theirs.voucher.Code, ours.device.ID); w.Code != http.StatusNotFound {
+		t.Errorf("redeem of an unknown code = %d %s, want 404", w.Code, w.Body.String())
+	}
+	var voucher model.Voucher
+	if err := db.First(&voucher, theirs.voucher.ID).Error; err != nil || voucher.Status != model.VoucherStatusUnused {
+		t.Errorf("voucher = %+v, %v, want it still unused", voucher, err)
+	}
+
+	// Two failures later the device is turned away, even with a valid code
+	if w := redeem(theirs.voucher.Code, theirs.device.ID); w.Code != http.StatusTooManyRequests {
+		t.Errorf("redeem after too many failures = %d %s, want 429", w.Code, w.Body.String())
+	}
+}
@@ -1,13 +1,17 @@
 package migrate
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/ortupik/wifigo/config"
 	gconfig "github.com/ortupik/wifigo/config"
 	gdatabase "github.com/ortupik/wifigo/database"
 	gmodel "github.com/ortupik/wifigo/database/model"
+	gservice "github.com/ortupik/wifigo/service"
 
 	"github.com/ortupik/wifigo/server/database/model"
 	"gorm.io/gorm"
@@ -21,6 +25,13 @@ type tempEmail gmodel.TempEmail
 type user model.User
 
 type payment model.Payment
+type mpesaCallbackRejection model.MpesaCallbackRejection
+type mpesaC2BPayment model.MpesaC2BPayment
+type paymentMismatch model.PaymentMismatch
+type customerCredit model.CustomerCredit
+type refund model.Refund
+type voucherBatch model.VoucherBatch
+type voucher model.Voucher
 type order model.Order
 type isp model.ISP
 type servicePlan model.ServicePlan
@@ -36,6 +47,13 @@ func DropAllTables() error {
 		&twoFABackup{},
 		&twoFA{},
 		&auth{},
+		&mpesaCallbackRejection{},
+		&mpesaC2BPayment{},
+		&paymentMismatch{},
+		&customerCredit{},
+		&refund{},
+		&voucher{},
+		&voucherBatch{},
 		&payment{},
 		&order{},
 		&servicePlan{},
@@ -70,6 +88,13 @@ func StartMigration(configure gconfig.Configuration) error {
 			&servicePlan{}, // ServicePlan needs to exist before Order
 			&order{},       // Order needs User and ServicePlan
 			&payment{},     // Payment needs Order (and maybe User)
+			&mpesaCallbackRejection{},
+			&mpesaC2BPayment{},
+			&paymentMismatch{},
+			&customerCredit{},
+			&refund{},
+			&voucherBatch{},
+			&voucher{},
 			&device{},      // Add device to be migrated
 		); err != nil {
 			return err
@@ -92,6 +117,7 @@ func Seed() error {
 		Name:    "Tecsurf",
 		LogoURL: "https://example.com/tecsurf-logo.png", // Replace with actual URL
 		DnsName: "tecsurf.co.ke",                       // Add the DnsName here
+		Realm:   "Tecsurf",
 	}
 
 	// Check if Tecsurf ISP already exists
@@ -107,30 +133,31 @@ func Seed() error {
 			return err
 		}
 	} else {
+		tecsurf = existingISP
 		fmt.Println("Tecsurf ISP already exists")
 	}
 
 	// Seed Service Plans
 	servicePlans := []model.ServicePlan{
-		{Name: "min1", Description: "1 Minute plan @ 3 Mbps for 1 device", Price: 1, Duration: 60, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Minute", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "min20", Description: "20 Minutes plan @ 3 Mbps for 1 device", Price: 5, Duration: 1200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "20 Minutes", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "hour2", Description: "2 Hours plan @ 3 Mbps for 1 device", Price: 10, Duration: 7200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "2 Hours", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "hour6", Description: "6 Hours plan @ 3 Mbps for 1 device", Price: 20, Duration: 21600, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "6 Hours", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "hour12", Description: "12 Hours plan @ 3 Mbps for 1 device", Price: 27, Duration: 43200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "12 Hours", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "daily", Description: "1 Day plan @ 3 Mbps for 1 device", Price: 35, Duration: 86400, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Day", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "daily3", Description: "3 Days plan @ 3 Mbps for 1 device", Price: 85, Duration: 259200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "3 Days", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "weekly", Description: "1 Week plan @ 3 Mbps for 1 device", Price: 150, Duration: 604800, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Week", Speed: "3 Mbps", ServiceType: "Hotspot"},
-		{Name: "monthly", Description: "1 Month plan @ 3 Mbps for 1 device", Price: 450, Duration: 2592000, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "3 Mbps", ServiceType: "Hotspot"},
-
-		{Name: "dailyHome", Description: "1 Day plan @ 5 Mbps for 5 devices", Price: 60, Duration: 86400, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Day", Speed: "5 Mbps", ServiceType: "Home"},
-		{Name: "daily3Home", Description: "3 Days plan @ 5 Mbps for 5 devices", Price: 150, Duration: 259200, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "3 Days", Speed: "5 Mbps", ServiceType: "Home"},
-		{Name: "weeklyHome", Description: "1 Week plan @ 5 Mbps for 5 devices", Price: 250, Duration: 604800, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Week", Speed: "5 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome5", Description: "1 Month plan @ 5 Mbps with unlimited devices", Price: 1400, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome10", Description: "1 Month plan @ 10 Mbps with unlimited devices", Price: 2200, Duration: 2592000, SpeedLimitMbps: "10", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "10 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome20", Description: "1 Month plan @ 20 Mbps with unlimited devices", Price: 3000, Duration: 2592000, SpeedLimitMbps: "20", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "20 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome500", Description: "1 Month plan @ 5 Mbps for 3 devices", Price: 500, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome700", Description: "1 Month plan @ 3 Mbps for 2 devices", Price: 700, Duration: 2592000, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "3 Mbps", ServiceType: "Home"},
-		{Name: "monthlyHome1000", Description: "1 Month plan @ 5 Mbps for 5 devices", Price: 1000, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home"},
+		{Name: "min1", Description: "1 Minute plan @ 3 Mbps for 1 device", Price: 1, Duration: 60, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Minute", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "min20", Description: "20 Minutes plan @ 3 Mbps for 1 device", Price: 5, Duration: 1200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "20 Minutes", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "hour2", Description: "2 Hours plan @ 3 Mbps for 1 device", Price: 10, Duration: 7200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "2 Hours", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "hour6", Description: "6 Hours plan @ 3 Mbps for 1 device", Price: 20, Duration: 21600, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "6 Hours", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "hour12", Description: "12 Hours plan @ 3 Mbps for 1 device", Price: 27, Duration: 43200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "12 Hours", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "daily", Description: "1 Day plan @ 3 Mbps for 1 device", Price: 35, Duration: 86400, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Day", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "daily3", Description: "3 Days plan @ 3 Mbps for 1 device", Price: 85, Duration: 259200, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "3 Days", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "weekly", Description: "1 Week plan @ 3 Mbps for 1 device", Price: 150, Duration: 604800, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Week", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+		{Name: "monthly", Description: "1 Month plan @ 3 Mbps for 1 device", Price: 450, Duration: 2592000, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "3 Mbps", ServiceType: "Hotspot", Devices: 1},
+
+		{Name: "dailyHome", Description: "1 Day plan @ 5 Mbps for 5 devices", Price: 60, Duration: 86400, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Day", Speed: "5 Mbps", ServiceType: "Home", Devices: 5},
+		{Name: "daily3Home", Description: "3 Days plan @ 5 Mbps for 5 devices", Price: 150, Duration: 259200, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "3 Days", Speed: "5 Mbps", ServiceType: "Home", Devices: 5},
+		{Name: "weeklyHome", Description: "1 Week plan @ 5 Mbps for 5 devices", Price: 250, Duration: 604800, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Week", Speed: "5 Mbps", ServiceType: "Home", Devices: 5},
+		{Name: "monthlyHome5", Description: "1 Month plan @ 5 Mbps with unlimited devices", Price: 1400, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home", Devices: 0},
+		{Name: "monthlyHome10", Description: "1 Month plan @ 10 Mbps with unlimited devices", Price: 2200, Duration: 2592000, SpeedLimitMbps: "10", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "10 Mbps", ServiceType: "Home", Devices: 0},
+		{Name: "monthlyHome20", Description: "1 Month plan @ 20 Mbps with unlimited devices", Price: 3000, Duration: 2592000, SpeedLimitMbps: "20", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "20 Mbps", ServiceType: "Home", Devices: 0},
+		{Name: "monthlyHome500", Description: "1 Month plan @ 5 Mbps for 3 devices", Price: 500, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home", Devices: 3},
+		{Name: "monthlyHome700", Description: "1 Month plan @ 3 Mbps for 2 devices", Price: 700, Duration: 2592000, SpeedLimitMbps: "3", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "3 Mbps", ServiceType: "Home", Devices: 2},
+		{Name: "monthlyHome1000", Description: "1 Month plan @ 5 Mbps for 5 devices", Price: 1000, Duration: 2592000, SpeedLimitMbps: "5", IsActive: true, CreatedAt: time.Now(), UpdatedAt: time.Now(), Validity: "1 Month", Speed: "5 Mbps", ServiceType: "Home", Devices: 5},
 	}
 	// Loop through the plans and create them if they don't exist
 	for _, plan := range servicePlans {
@@ -163,6 +190,7 @@ func Seed() error {
 	devicesToSeed[1].Name = &name2
 
 	for _, d := range devicesToSeed {
+		d.ISPID = &tecsurf.ID // Associate the device with Tecsurf ISP
 		var existingDevice model.MikroTikDevice
 		if err := db.Where("id = ?", d.ID).First(&existingDevice).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
@@ -178,6 +206,41 @@ func Seed() error {
 		}
 	}
 
+	return SeedPlatformAdmin()
+}
+
+// PlatformAdminEmailEnv names the environment variable holding the email of
+// the account to make platform admin
+const PlatformAdminEmailEnv = "PLATFORM_ADMIN_EMAIL"
+
+// SeedPlatformAdmin - makes the account registered with the email in
+// PLATFORM_ADMIN_EMAIL a platform admin of no single ISP. Nothing is done
+// when the variable is empty or the account is not registered yet.
+func SeedPlatformAdmin() error {
+	email := strings.TrimSpace(os.Getenv(PlatformAdminEmailEnv))
+	if email == "" {
+		return nil
+	}
+	db := gdatabase.GetDB(config.AppDB)
+
+	auth, err := gservice.GetUserByEmail(email, false)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fmt.Printf("Platform admin '%s' is not registered yet\n", email)
+			return nil
+		}
+		return fmt.Errorf("failed to look up platform admin '%s': %w", email, err)
+	}
+	if auth.Role == gmodel.RolePlatformAdmin && auth.ISPID == nil {
+		fmt.Printf("Platform admin '%s' already exists\n", email)
+		return nil
+	}
+
+	err = db.Model(auth).Updates(map[string]interface{}{"role": gmodel.RolePlatformAdmin, "isp_id": nil}).Error
+	if err != nil {
+		return fmt.Errorf("failed to make '%s' platform admin: %w", email, err)
+	}
+	fmt.Printf("Platform admin '%s' created\n", email)
 	return nil
 }
 
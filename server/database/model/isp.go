@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strings"
 	"time"
 )
 
@@ -19,6 +20,28 @@ type ISP struct {
 	DeviceID     *string        `gorm:"column:deviceId"` // Device ID, nullable, for ISP-level association if needed
 	ServicePlans []ServicePlan  `gorm:"foreignKey:ISPID"` // One-to-Many: ISP has many ServicePlans
 	DnsName      string         `gorm:"column:dns_name"`
+	PaymentProviders string     `gorm:"column:paymentProviders"` // Comma separated providers accepted, empty for all
+	Realm        string         `gorm:"column:realm;size:64"` // Suffix of the subscribers' usernames, the name without spaces when empty
+}
+
+// UsernameRealm returns the realm the usernames of the ISP's subscribers end in
+func (i ISP) UsernameRealm() string {
+	if i.Realm != "" {
+		return i.Realm
+	}
+	return strings.Join(strings.Fields(i.Name), "")
+}
+
+// SubscriberUsername returns the RADIUS username of the subscriber paying
+// with phone
+func (i ISP) SubscriberUsername(phone string) string {
+	return phone + "@" + i.UsernameRealm()
+}
+
+// HasSubscriber reports whether username is in the ISP's realm
+func (i ISP) HasSubscriber(username string) bool {
+	realm := i.UsernameRealm()
+	return realm != "" && strings.HasSuffix(username, "@"+realm)
 }
 
 // ServicePlan struct represents a service plan offered by the ISP.
@@ -37,6 +60,18 @@ type ServicePlan struct {
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 	ISPID         int64        `gorm:"column:isp_id"` // Foreign Key to ISP
+	PaymentProviders string    `gorm:"column:paymentProviders"` // Comma separated providers accepted, empty for the ISP's
+	Devices       int          `gorm:"column:devices"`     // Simultaneous sessions of a subscriber, 0 for no limit
+	IdleTimeout   int          `gorm:"column:idleTimeout"` // Seconds, 0 for the default of 10 minutes
+	BurstLimitMbps     string  `gorm:"column:burstLimitMbps"`     // Burst rate like SpeedLimitMbps, empty for no burst
+	BurstThresholdMbps string  `gorm:"column:burstThresholdMbps"` // Average rate below which bursting is allowed, 3/4 of SpeedLimitMbps when empty
+	BurstTime          int     `gorm:"column:burstTime"`          // Seconds the average rate is taken over, 0 for 8
 	// DeviceID is now NOT in ServicePlan
 	//Orders      []Order    // One-to-Many relationship: Orders for this service plan - removed for now
 }
+
+// GroupName returns the RADIUS group subscribers of the plan are put in. Its
+// radgroupcheck and radgroupreply attributes are generated from the plan.
+func (p ServicePlan) GroupName() string {
+	return p.Name
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -25,6 +26,7 @@ type MikroTikDevice struct {
 	CreatedAt time.Time    `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt time.Time    `json:"updated_at" gorm:"autoUpdateTime"`
 	Status    DeviceStatus `json:"status" gorm:"type:enum('active','inactive','maintenance');default:'active'" validate:"oneof=active inactive maintenance"`
+	ISPID     *int64       `json:"isp_id" gorm:"column:isp_id;index"` // ISP that runs the device, nil until one is assigned
 }
 
 // TableName specifies the table name for GORM
@@ -63,6 +65,14 @@ func (d *MikroTikDevice) GetName() string {
 	return *d.Name
 }
 
+// GetISPID returns the ID of the device's ISP or empty string if not set
+func (d *MikroTikDevice) GetISPID() string {
+	if d.ISPID == nil {
+		return ""
+	}
+	return strconv.FormatInt(*d.ISPID, 10)
+}
+
 // IsActive returns true if the device status is active
 func (d *MikroTikDevice) IsActive() bool {
 	return d.Status == StatusActive
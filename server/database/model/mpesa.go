@@ -1,5 +1,7 @@
 package model
 import (
+   "time"
+
    "github.com/shopspring/decimal"
 )
 
@@ -31,4 +33,74 @@ type MpesaCallbackPayload struct {
 	MpesaReceiptNumber string          `json:"MpesaReceiptNumber"`
 	TransactionDate    string          `json:"TransactionDate"`
 	PhoneNumber        string          `json:"PhoneNumber"`
-}
\ No newline at end of file
+
+	// OrderID identifies the order when the payment is not its STK push, as
+	// for C2B payments; otherwise the order is found by CheckoutRequestID
+	OrderID int `json:"OrderID,omitempty"`
+
+	// Provider is the payment provider that reported the result, M-Pesa when empty
+	Provider string `json:"Provider,omitempty"`
+}
+// Reasons an M-Pesa callback is rejected
+const (
+	CallbackRejectSourceIP = "source_ip"      // Sender is not in the configured allowlist
+	CallbackRejectToken    = "callback_token" // CallBackURL token does not match the order
+	CallbackRejectPhone    = "phone_mismatch"
+	CallbackRejectProvider = "provider_mismatch" // Callback from another payment provider than the order's
+)
+
+// MpesaCallbackRejection is an audit record of an M-Pesa callback that failed verification
+type MpesaCallbackRejection struct {
+	ID                int    `gorm:"primaryKey;autoIncrement;column:id"`
+	CheckoutRequestID string `gorm:"column:CheckoutRequestID;index:rejectionCheckoutRequestID"`
+	SourceIP          string `gorm:"column:sourceIp;index:rejectionSourceIp"`
+	Reason            string `gorm:"column:reason;index:rejectionReason"`
+	Details           string `gorm:"type:text;column:details"`
+	Body              string `gorm:"type:text;column:body"` // Raw request body as received
+
+	CreatedAt time.Time
+}
+
+// C2BConfirmation is the body Safaricom POSTs to the C2B validation and confirmation URLs
+type C2BConfirmation struct {
+	TransactionType   string `json:"TransactionType"`
+	TransID           string `json:"TransID"`
+	TransTime         string `json:"TransTime"` // YYYYMMDDHHmmss
+	TransAmount       string `json:"TransAmount"`
+	BusinessShortCode string `json:"BusinessShortCode"`
+	BillRefNumber     string `json:"BillRefNumber"` // Account number the customer typed
+	InvoiceNumber     string `json:"InvoiceNumber"`
+	OrgAccountBalance string `json:"OrgAccountBalance"`
+	ThirdPartyTransID string `json:"ThirdPartyTransID"`
+	MSISDN            string `json:"MSISDN"` // Plain, masked with '*' or hashed, depending on the account
+	FirstName         string `json:"FirstName"`
+	MiddleName        string `json:"MiddleName"`
+	LastName          string `json:"LastName"`
+}
+
+// How a C2B payment was allocated to an order
+const (
+	C2BStatusReceived  = "received"  // Recorded, not yet applied to an order
+	C2BStatusMatched   = "matched"   // Applied to the order it was matched with
+	C2BStatusUnmatched = "unmatched" // No order could be settled, awaiting manual allocation
+	C2BStatusAllocated = "allocated" // Applied to an order by an administrator
+)
+
+// MpesaC2BPayment is a payment made to the short code outside an STK push
+type MpesaC2BPayment struct {
+	ID            int             `gorm:"primaryKey;autoIncrement;column:id"`
+	TransID       string          `gorm:"column:transId;type:varchar(64);uniqueIndex:c2bTransId;not null"`
+	TransType     string          `gorm:"column:transType"`
+	TransTime     string          `gorm:"column:transTime"`
+	Amount        decimal.Decimal `gorm:"type:decimal(20,2);column:amount"`
+	ShortCode     string          `gorm:"column:shortCode"`
+	BillRefNumber string          `gorm:"column:billRefNumber;index:c2bBillRefNumber"`
+	InvoiceNumber string          `gorm:"column:invoiceNumber"`
+	MSISDN        string          `gorm:"column:msisdn;index:c2bMsisdn"`
+	FirstName     string          `gorm:"column:firstName"`
+	Status        string          `gorm:"column:status;index:c2bStatus"`
+	OrderID       *int            `gorm:"column:orderId;index:c2bOrderId"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
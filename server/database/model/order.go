@@ -35,6 +35,13 @@ type Order struct {
 	DeviceID          string          `gorm:"column:DeviceID;"`
 	IsHomeUser        bool           `gorm:"column:isHomeUser;default:false"` // Nullable boolean with default false
 	Devices           int             `gorm:"column:devices;default:1;not null"`
+	CallbackToken     string          `gorm:"column:callbackToken;type:varchar(64)" json:"-"` // Secret embedded in the STK push CallBackURL
+	AmountPaid        int             `gorm:"column:amountPaid;default:0"`                    // Paid towards the order so far
+	ParentOrderID     *int            `gorm:"column:parentOrderId;index:parentOrderId"`       // Set on the top-up of an underpaid order
+	ProvisioningFailedAt *time.Time   `gorm:"column:provisioningFailedAt;index:provisioningFailedAt"` // Paid but the RADIUS user or login could not be set up
+	ProvisioningError    string       `gorm:"type:text;column:provisioningError"`
+	RefundStatus         string       `gorm:"column:refundStatus;index:orderRefundStatus"` // Status of the latest refund, see Refund
+	Provider             string       `gorm:"column:provider;default:'mpesa'"`                // Payment provider the customer pays with
 
 	// Link to the Service Plan ordered (non-nullable)
 	ServicePlanID int         `gorm:"column:servicePlanId;index:servicePlanId"` // Foreign key field for ServicePlan
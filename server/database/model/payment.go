@@ -10,14 +10,16 @@ import (
 type Payment struct {
 	ID                 int             `gorm:"primaryKey;autoIncrement;column:id"`
 	Amount             decimal.Decimal `gorm:"type:decimal(20,2);column:Amount"`
-	MpesaReceiptNumber *string         `gorm:"column:MpesaReceiptNumber;index:mpesaReceiptNumber"` // Nullable
+	MpesaReceiptNumber *string         `gorm:"column:MpesaReceiptNumber;uniqueIndex:paymentMpesaReceiptNumber"` // Nullable, unique per M-Pesa transaction
 	Phone              *string         `gorm:"column:Phone;index:phone"`                           // Nullable
 	TransactionDate    string          `gorm:"column:TransactionDate;"`       // Nullable, keeping as string to match DESCRIBE
 	MerchantRequestID  *string         `gorm:"column:MerchantRequestID;"`   // Nullable
-	CheckoutRequestID  string          `gorm:"column:CheckoutRequestID;index:checkoutRequestID;not null"`
+	CheckoutRequestID  string          `gorm:"column:CheckoutRequestID;uniqueIndex:paymentCheckoutRequestID;not null"` // One payment per STK push
 	ResultCode         int             `gorm:"column:ResultCode;default:0;not null"`
 	ResultDesc         string          `gorm:"type:text;column:ResultDesc;not null"`
 	Username *string `gorm:"column:username;index:username"`
+	RefundStatus string `gorm:"column:refundStatus"` // Status of the latest refund, see Refund
+	Provider     string `gorm:"column:provider;default:'mpesa';index:paymentProvider"` // Payment provider that collected it, see PaymentProviderMpesa
 
 	// Foreign Key to Order (assuming the relationship)
 	OrderID *int   `gorm:"column:orderId;index:orderId"`
@@ -27,4 +29,88 @@ type Payment struct {
 	UpdatedAt time.Time
 }
 
+// Payment providers orders can be paid with
+const (
+	PaymentProviderMpesa  = "mpesa"  // M-Pesa STK push and C2B
+	PaymentProviderAirtel = "airtel" // Airtel Money collections
+)
+
+// Kinds of payment amount mismatch
+const (
+	MismatchUnderpaid = "underpaid"
+	MismatchOverpaid  = "overpaid"
+)
+
+// How a payment amount mismatch was handled
+const (
+	MismatchAwaitingTopUp = "awaiting_topup" // A top-up STK push is requested for the rest
+	MismatchCredited      = "credited"       // The excess is held as customer credit
+	MismatchToppedUp      = "topped_up"      // The top-up order for the rest was paid
+)
+
+// PaymentMismatch records a successful payment whose amount differs from its order
+type PaymentMismatch struct {
+	ID                int             `gorm:"primaryKey;autoIncrement;column:id"`
+	OrderID           int             `gorm:"column:orderId;index:mismatchOrderId"`
+	OrderNumber       string          `gorm:"column:orderNumber"`
+	CheckoutRequestID string          `gorm:"column:CheckoutRequestID;uniqueIndex:mismatchCheckoutRequestID"`
+	Phone             string          `gorm:"column:phone;index:mismatchPhone"`
+	Username          string          `gorm:"column:username"`
+	Kind              string          `gorm:"column:kind;index:mismatchKind"`
+	Expected          decimal.Decimal `gorm:"type:decimal(20,2);column:expected"`
+	Paid              decimal.Decimal `gorm:"type:decimal(20,2);column:paid"`
+	Difference        decimal.Decimal `gorm:"type:decimal(20,2);column:difference"` // Paid minus expected
+	Resolution        string          `gorm:"column:resolution"`
 
+	CreatedAt time.Time
+}
+
+// CustomerCredit is an entry in a customer's credit ledger; the balance is the sum of the entries
+type CustomerCredit struct {
+	ID        int             `gorm:"primaryKey;autoIncrement;column:id"`
+	Phone     string          `gorm:"column:phone;index:creditPhone"`
+	Username  string          `gorm:"column:username;index:creditUsername"`
+	Amount    decimal.Decimal `gorm:"type:decimal(20,2);column:amount"`
+	Reason    string          `gorm:"column:reason"`
+	OrderID   *int            `gorm:"column:orderId;index:creditOrderId"`
+	PaymentID *int            `gorm:"column:paymentId"`
+
+	CreatedAt time.Time
+}
+
+// Refund methods
+const (
+	RefundMethodReversal = "reversal" // Reverses the customer's M-Pesa transaction
+	RefundMethodB2C      = "b2c"      // Pays the amount back to the customer's phone
+)
+
+// Refund statuses, in the order a refund goes through them
+const (
+	RefundStatusRequested = "requested" // Recorded, not yet sent to Safaricom
+	RefundStatusSubmitted = "submitted" // Accepted by Daraja, awaiting the result callback
+	RefundStatusCompleted = "completed"
+	RefundStatusFailed    = "failed"
+)
+
+// Refund is an attempt to return a payment to the customer
+type Refund struct {
+	ID                       int             `gorm:"primaryKey;autoIncrement;column:id"`
+	OrderID                  int             `gorm:"column:orderId;index:refundOrderId"`
+	PaymentID                int             `gorm:"column:paymentId;index:refundPaymentId"`
+	Phone                    string          `gorm:"column:phone;index:refundPhone"`
+	Amount                   decimal.Decimal `gorm:"type:decimal(20,2);column:amount"`
+	Method                   string          `gorm:"column:method"`
+	Status                   string          `gorm:"column:status;index:refundStatus"`
+	Reason                   string          `gorm:"type:text;column:reason"`
+	Automatic                bool            `gorm:"column:automatic;default:false"` // Requested by the failed provisioning scan
+	RequestedBy              string          `gorm:"column:requestedBy"`
+	Token                    string          `gorm:"column:token;type:varchar(64);uniqueIndex:refundToken" json:"-"` // Secret embedded in the result URLs
+	ConversationID           string          `gorm:"column:conversationId;index:refundConversationId"`
+	OriginatorConversationID string          `gorm:"column:originatorConversationId"`
+	TransactionID            string          `gorm:"column:transactionId"` // M-Pesa receipt of the refund
+	ResultCode               int             `gorm:"column:resultCode"`
+	ResultDesc               string          `gorm:"type:text;column:resultDesc"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -2,6 +2,25 @@ package model
 
 import "time"
 
+// RadiusExpirationLayout is the FreeRADIUS format of the radcheck Expiration value
+const RadiusExpirationLayout = "Jan 2 2006 15:04:05"
+
+// RadiusExpirationSQLFormat is RadiusExpirationLayout for MySQL's STR_TO_DATE
+const RadiusExpirationSQLFormat = "%b %e %Y %H:%i:%s"
+
+// Order statuses used across the payment and subscription flow
+const (
+	OrderStatusPending       = "PENDING"
+	OrderStatusPaid          = "paid"
+	OrderStatusPaymentFailed = "payment_failed"
+	OrderStatusExpired       = "expired"
+	OrderStatusTimeout       = "timeout"
+	OrderStatusPartiallyPaid = "partially_paid"
+	OrderStatusToppedUp      = "topped_up" // Underpaid, then completed by its paid top-up order
+	OrderStatusRefunded      = "refunded"
+	OrderStatusExhausted     = "exhausted" // The plan's data cap was used up before it expired
+)
+
 // RadCheck maps to the 'radcheck' table in FreeRADIUS.
 // It stores user authentication details.
 type RadCheck struct {
@@ -109,4 +128,27 @@ type RadAcct struct {
 // TableName overrides the table name to `radacct`.
 func (RadAcct) TableName() string {
 	return "radacct"
-}
\ No newline at end of file
+}
+// Nas maps to the 'nas' table in FreeRADIUS.
+// It lists the RADIUS clients (MikroTik routers) and their shared secrets.
+type Nas struct {
+	ID          int     `gorm:"primaryKey;autoIncrement;column:id" json:"id"`
+	NasName     string  `gorm:"type:varchar(128);not null;column:nasname;index:nasname" json:"nasname"` // IP address or hostname of the NAS
+	ShortName   *string `gorm:"type:varchar(32);column:shortname" json:"shortname"`
+	Type        string  `gorm:"type:varchar(30);default:'other';column:type" json:"type"`
+	Ports       *int    `gorm:"column:ports" json:"ports"`
+	Secret      string  `gorm:"type:varchar(60);not null;default:'secret';column:secret" json:"-"` // Shared secret, also signs Disconnect and CoA requests
+	Server      *string `gorm:"type:varchar(64);column:server" json:"server"`
+	Community   *string `gorm:"type:varchar(50);column:community" json:"community"`
+	Description *string `gorm:"type:varchar(200);default:'RADIUS Client';column:description" json:"description"`
+
+	// Columns of wifigo, FreeRADIUS ignores them
+	DeviceID        *string    `gorm:"type:varchar(64);column:device_id;uniqueIndex" json:"device_id"` // MikroTik device the NAS is, nil for one managed by hand
+	ISPID           *int64     `gorm:"column:isp_id;index" json:"isp_id"`
+	SecretRotatedAt *time.Time `gorm:"column:secret_rotated_at" json:"secret_rotated_at"`
+}
+
+// TableName overrides the table name to `nas`.
+func (Nas) TableName() string {
+	return "nas"
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"time"
+)
+
+// Voucher statuses
+const (
+	VoucherStatusUnused    = "unused"    // Generated and not redeemed yet, RADIUS rejects it
+	VoucherStatusRedeemed  = "redeemed"  // Activated on a device, valid until ExpiresAt
+	VoucherStatusVoid      = "void"      // Withdrawn before it was redeemed
+	VoucherStatusExhausted = "exhausted" // The plan's data cap was used up before it expired
+	VoucherStatusExpired   = "expired"   // The session ended and the device was logged out
+)
+
+// VoucherBatch is a set of vouchers generated together for a service plan,
+// usually printed and handed to one seller
+type VoucherBatch struct {
+	ID            int         `gorm:"primaryKey;autoIncrement;column:id" json:"id"`
+	Name          string      `gorm:"column:name" json:"name"`
+	ISPID         int64       `gorm:"column:isp_id;index:voucherBatchIspId" json:"isp_id"`
+	ServicePlanID int         `gorm:"column:servicePlanId;index:voucherBatchServicePlanId" json:"service_plan_id"`
+	ServicePlan   ServicePlan `json:"service_plan"`
+	Quantity      int         `gorm:"column:quantity" json:"quantity"`
+	Devices       int         `gorm:"column:devices;default:1;not null" json:"devices"` // Simultaneous-Use of each voucher
+	Seller        string      `gorm:"column:seller;index:voucherBatchSeller" json:"seller"`
+	CreatedBy     string      `gorm:"column:createdBy" json:"created_by"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Voucher is a prepaid code for a service plan. The code is both the RADIUS
+// username and password; the session starts when it is redeemed.
+type Voucher struct {
+	ID            int        `gorm:"primaryKey;autoIncrement;column:id" json:"id"`
+	Code          string     `gorm:"uniqueIndex:voucherCode;type:varchar(32);column:code" json:"code"`
+	BatchID       int        `gorm:"column:batchId;index:voucherBatchId" json:"batch_id"`
+	ISPID         int64      `gorm:"column:isp_id;index:voucherIspId" json:"isp_id"`
+	ServicePlanID int        `gorm:"column:servicePlanId" json:"service_plan_id"`
+	Status        string     `gorm:"column:status;default:'unused';index:voucherStatus" json:"status"`
+	Seller        string     `gorm:"column:seller;index:voucherSeller" json:"seller"`
+	RedeemedAt    *time.Time `gorm:"column:redeemedAt;index:voucherRedeemedAt" json:"redeemed_at"`
+	ExpiresAt     *time.Time `gorm:"column:expiresAt" json:"expires_at"` // End of the session, set on redemption
+	Ip            string     `gorm:"column:ip" json:"ip"`
+	Mac           string     `gorm:"column:mac" json:"mac"`
+	DeviceID      string     `gorm:"column:DeviceID" json:"device_id"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
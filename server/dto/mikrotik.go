@@ -5,4 +5,15 @@ type MikrotikLogin struct {
 	Username string
 	Password string
 	DeviceID string
-}
\ No newline at end of file
+	OrderID  int `json:",omitempty"` // Order the login provisions, flagged if the login keeps failing
+}
+
+// MikrotikLogout identifies the hotspot sessions to disconnect on a device.
+// At least one of Username, Address or MacAddress must be set.
+type MikrotikLogout struct {
+	DeviceID   string
+	Username   string
+	Address    string
+	MacAddress string
+	Reason     string
+}
@@ -0,0 +1,20 @@
+package dto
+
+// NasInput registers a MikroTik device as a RADIUS client, or changes its
+// registration. Fields left out keep their value, or their default on create.
+type NasInput struct {
+	NasName     *string `json:"nasname"` // Address RADIUS requests come from, the device address by default
+	ShortName   *string `json:"shortname"`
+	Type        *string `json:"type"`
+	Secret      *string `json:"secret"` // Create only, generated when empty
+	Community   *string `json:"community"`
+	Description *string `json:"description"`
+	ISPID       *int64  `json:"isp_id"` // The ISP of the device by default
+	Push        *bool   `json:"push"`   // Configure the router too, true by default
+}
+
+// NasSecretInput rotates the secret of a RADIUS client
+type NasSecretInput struct {
+	Secret *string `json:"secret"` // Generated when empty
+	Push   *bool   `json:"push"`   // Configure the router too, true by default
+}
@@ -10,4 +10,5 @@ var STKPushRequest struct {
 	DeviceCount  int    `json:"devices"`
 	Mac          string `json:"mac"`
 	Ip           string `json:"ip"`
+	Provider     string `json:"provider"` // Payment provider, the plan's first when empty
 }
\ No newline at end of file
@@ -13,6 +13,7 @@ type HotspotSubscriptionRequest struct {
 	ServiceName string
 	Duration    int
 	Devices     int
+	DataLimitMB *int // Data cap of the plan, nil or 0 for none
 }
 // HotspotUser represents the complete user configuration
 type HotspotUser struct {
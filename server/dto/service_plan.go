@@ -0,0 +1,23 @@
+package dto
+
+// ServicePlanInput is the body of a request to create or edit a service plan.
+// Fields left out of an edit keep their value.
+type ServicePlanInput struct {
+	ISPID              *int64  `json:"isp_id"`
+	Name               *string `json:"name"`
+	ServiceType        *string `json:"service_type"`
+	Description        *string `json:"description"`
+	Price              *int    `json:"price"`
+	Duration           *int    `json:"duration"` // Seconds
+	DataLimitMB        *int    `json:"data_limit_mb"`
+	SpeedLimitMbps     *string `json:"speed_limit_mbps"`
+	BurstLimitMbps     *string `json:"burst_limit_mbps"`
+	BurstThresholdMbps *string `json:"burst_threshold_mbps"`
+	BurstTime          *int    `json:"burst_time"`   // Seconds
+	IdleTimeout        *int    `json:"idle_timeout"` // Seconds
+	Devices            *int    `json:"devices"`
+	IsActive           *bool   `json:"is_active"`
+	Validity           *string `json:"validity"`
+	Speed              *string `json:"speed"`
+	PaymentProviders   *string `json:"payment_providers"`
+}
@@ -0,0 +1,10 @@
+package dto
+
+// VoucherRedeemRequest is posted by the captive portal to redeem a voucher for
+// the device at Ip behind the hotspot DeviceID
+type VoucherRedeemRequest struct {
+	Code     string `json:"code" binding:"required"`
+	Ip       string `json:"ip" binding:"required"`
+	Mac      string `json:"mac"`
+	DeviceID string `json:"device_id" binding:"required"`
+}
@@ -0,0 +1,496 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+
+	nconfig "github.com/ortupik/wifigo/server/config"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// Airtel Money Open API hosts
+const (
+	AirtelStagingURL = "https://openapiuat.airtel.africa"
+	AirtelLiveURL    = "https://openapi.airtel.africa"
+)
+
+// Airtel Money environments accepted in the `environment` setting
+const (
+	AirtelEnvStaging = "staging"
+	AirtelEnvLive    = "live"
+)
+
+// Airtel Money API paths, relative to the base URL
+const (
+	airtelOAuthPath   = "/auth/oauth2/token"
+	airtelPaymentPath = "/merchant/v1/payments/"
+	airtelStatusPath  = "/standard/v1/payments/"
+	airtelRefundPath  = "/standard/v1/payments/refund"
+)
+
+// Airtel Money transaction statuses
+const (
+	AirtelStatusSuccess    = "TS"
+	AirtelStatusFailed     = "TF"
+	AirtelStatusExpired    = "TE"
+	AirtelStatusInProgress = "TIP"
+	AirtelStatusAmbiguous  = "TA"
+)
+
+// AirtelConfig holds the Airtel Money Collections configuration loaded from
+// the `airtel` block of Viper.
+type AirtelConfig struct {
+	Environment  string `mapstructure:"environment"` // staging or live
+	BaseURL      string `mapstructure:"base_url"`    // API host, defaults to the environment's host
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	Country      string `mapstructure:"country"`  // Defaults to KE
+	Currency     string `mapstructure:"currency"` // Defaults to KES
+
+	// Callbacks are posted to the URL registered on the Airtel portal, ending
+	// in /api/v1/airtel/callback or, when CallbackURLToken is set, in
+	// /api/v1/airtel/callback/<token>
+	CallbackURLToken   string   `mapstructure:"callback_url_token"`
+	CallbackKey        string   `mapstructure:"callback_key"` // Private key of callback authentication, checks the hash when set
+	CallbackAllowedIPs []string `mapstructure:"callback_allowed_ips"`
+}
+
+// LoadAirtelConfig returns the Airtel Money configuration, or nil when it is
+// not configured
+func LoadAirtelConfig() (*AirtelConfig, error) {
+	sub := nconfig.GetConfig().Sub("airtel")
+	if sub == nil {
+		return nil, nil
+	}
+	var config AirtelConfig
+	if err := sub.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal airtel config: %w", err)
+	}
+	if config.ClientID == "" {
+		return nil, nil
+	}
+	if err := config.Resolve(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Resolve normalises the environment and fills in the defaults it implies
+func (c *AirtelConfig) Resolve() error {
+	env := strings.ToLower(strings.TrimSpace(c.Environment))
+	switch env {
+	case AirtelEnvStaging, "sandbox", "uat":
+		c.Environment = AirtelEnvStaging
+		c.BaseURL = orDefault(c.BaseURL, AirtelStagingURL)
+	case AirtelEnvLive, "production":
+		c.Environment = AirtelEnvLive
+		c.BaseURL = orDefault(c.BaseURL, AirtelLiveURL)
+	case "":
+		return fmt.Errorf("airtel environment is not set, use %q or %q", AirtelEnvStaging, AirtelEnvLive)
+	default:
+		return fmt.Errorf("unknown airtel environment %q, use %q or %q", c.Environment, AirtelEnvStaging, AirtelEnvLive)
+	}
+	c.Country = strings.ToUpper(orDefault(c.Country, "KE"))
+	c.Currency = strings.ToUpper(orDefault(c.Currency, "KES"))
+	return nil
+}
+
+// Validate refuses configurations that would take test payments in production
+// or real money outside it, like MpesaConfig.Validate
+func (c *AirtelConfig) Validate(serverEnv string) error {
+	production := strings.ToLower(strings.TrimSpace(serverEnv)) == "production"
+
+	if production && (c.Environment == AirtelEnvStaging || strings.HasPrefix(c.APIURL(""), AirtelStagingURL)) {
+		return fmt.Errorf("refusing to use Airtel Money staging in production (host %s)", c.APIURL(""))
+	}
+	if !production && (c.Environment == AirtelEnvLive || strings.HasPrefix(c.APIURL(""), AirtelLiveURL)) {
+		return fmt.Errorf("refusing to use live Airtel Money with APP_ENV %q, set airtel environment to %q", serverEnv, AirtelEnvStaging)
+	}
+	if c.ClientSecret == "" {
+		return fmt.Errorf("airtel client secret is required")
+	}
+	return nil
+}
+
+// APIURL returns the Airtel Money URL for path
+func (c *AirtelConfig) APIURL(path string) string {
+	return strings.TrimRight(c.BaseURL, "/") + path
+}
+
+// AirtelProvider is the Airtel Money Collections PaymentProvider. Customers
+// approve a USSD push with their PIN and Airtel posts the result to the
+// callback URL registered on its portal.
+type AirtelProvider struct {
+	config         *AirtelConfig
+	httpClient     *http.Client
+	allowedSources []*net.IPNet
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewAirtelProvider creates the Airtel Money provider from the configuration.
+// It returns nil when Airtel Money is not configured.
+func NewAirtelProvider(serverEnv string) (*AirtelProvider, error) {
+	cfg, err := LoadAirtelConfig()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	if err := cfg.Validate(serverEnv); err != nil {
+		return nil, err
+	}
+	return NewAirtelProviderWithConfig(cfg)
+}
+
+// NewAirtelProviderWithConfig creates an AirtelProvider for the given configuration.
+func NewAirtelProviderWithConfig(cfg *AirtelConfig) (*AirtelProvider, error) {
+	sources, err := parseSources(cfg.CallbackAllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	return &AirtelProvider{
+		config:         cfg,
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+		allowedSources: sources,
+	}, nil
+}
+
+// Name implements PaymentProvider
+func (p *AirtelProvider) Name() string {
+	return model.PaymentProviderAirtel
+}
+
+// SourceAllowed reports whether a callback from ip passes callback_allowed_ips
+func (p *AirtelProvider) SourceAllowed(ip string) bool {
+	if len(p.allowedSources) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range p.allowedSources {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// airtelStatus is the status block of every Airtel Money response
+type airtelStatus struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	ResultCode string `json:"result_code"`
+	Success    bool   `json:"success"`
+}
+
+// airtelTransaction is the transaction block of Airtel Money responses and callbacks
+type airtelTransaction struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	StatusCode    string `json:"status_code"`
+	Message       string `json:"message"`
+	AirtelMoneyID string `json:"airtel_money_id"`
+}
+
+type airtelResponse struct {
+	Data struct {
+		Transaction airtelTransaction `json:"transaction"`
+	} `json:"data"`
+	Status airtelStatus `json:"status"`
+}
+
+// accessToken returns a cached OAuth token, fetching a new one when it expired
+func (p *AirtelProvider) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Now().Before(p.expiry) {
+		return p.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"client_id":     p.config.ClientID,
+		"client_secret": p.config.ClientSecret,
+		"grant_type":    "client_credentials",
+	})
+	req, err := http.NewRequest(http.MethodPost, p.config.APIURL(airtelOAuthPath), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Airtel token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "*/*")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request Airtel access token: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Airtel token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("airtel token request failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"` // Seconds, sent as a string
+	}
+	if err := json.Unmarshal(respBody, &token); err != nil {
+		return "", fmt.Errorf("failed to parse Airtel token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("airtel token response has no access token")
+	}
+	ttl, _ := strconv.Atoi(token.ExpiresIn.String())
+	if ttl <= 0 {
+		ttl = 180
+	}
+	// Renew a little early so a token never expires in flight
+	p.token, p.expiry = token.AccessToken, time.Now().Add(time.Duration(ttl)*time.Second*9/10)
+	return p.token, nil
+}
+
+// do sends an authorised request to the Airtel Money API and parses its response
+func (p *AirtelProvider) do(method, path string, payload interface{}) (*airtelResponse, error) {
+	token, err := p.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal Airtel request: %w", err)
+		}
+		body = bytes.NewReader(jsonPayload)
+	}
+	req, err := http.NewRequest(method, p.config.APIURL(path), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Airtel request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("X-Country", p.config.Country)
+	req.Header.Set("X-Currency", p.config.Currency)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send Airtel request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Airtel response: %w", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Let the next request fetch a new token
+		p.mu.Lock()
+		p.token = ""
+		p.mu.Unlock()
+	}
+
+	var result airtelResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("airtel request failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &result, fmt.Errorf("airtel request failed with status %d: %s", resp.StatusCode, result.Status.Message)
+	}
+	return &result, nil
+}
+
+// airtelMsisdn returns phone without the country code, as Airtel expects it
+func airtelMsisdn(phone string) string {
+	return strings.TrimPrefix(formatPhoneNumber(phone), "254")
+}
+
+// newAirtelTransactionID returns the merchant's ID of a new payment
+func newAirtelTransactionID() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate Airtel transaction ID: %w", err)
+	}
+	return "AT" + strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// Initiate sends a USSD push asking the customer to approve the payment. The
+// order's CheckoutRequestID is the merchant transaction ID Airtel reports the
+// result under.
+func (p *AirtelProvider) Initiate(order *model.Order) error {
+	id, err := newAirtelTransactionID()
+	if err != nil {
+		return err
+	}
+	res, err := p.do(http.MethodPost, airtelPaymentPath, map[string]interface{}{
+		"reference": orDefault(order.OrderNumber, "Wifi Payment"),
+		"subscriber": map[string]string{
+			"country":  p.config.Country,
+			"currency": p.config.Currency,
+			"msisdn":   airtelMsisdn(order.Phone),
+		},
+		"transaction": map[string]interface{}{
+			"amount":   order.Amount,
+			"country":  p.config.Country,
+			"currency": p.config.Currency,
+			"id":       id,
+		},
+	})
+	if res != nil && !res.Status.Success {
+		return &PaymentRequestError{
+			Code:      orDefault(res.Status.ResultCode, res.Status.Code),
+			Message:   res.Status.Message,
+			RequestID: id,
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	order.CheckoutRequestID = id
+	order.MerchantRequestID = orDefault(res.Data.Transaction.ID, id)
+	order.ResponseCode = "0" // Accepted, as Daraja reports it, which the checkout page expects
+	order.ResultDesc = orDefault(res.Status.Message, res.Data.Transaction.Status)
+	return nil
+}
+
+// QueryStatus asks Airtel for the status of the order's payment
+func (p *AirtelProvider) QueryStatus(order model.Order) (*PaymentStatus, error) {
+	res, err := p.do(http.MethodGet, airtelStatusPath+order.CheckoutRequestID, nil)
+	if err != nil {
+		return nil, err
+	}
+	transaction := res.Data.Transaction
+	status := &PaymentStatus{
+		ResultDesc:        orDefault(transaction.Message, res.Status.Message),
+		MerchantRequestID: order.MerchantRequestID,
+		TransactionID:     transaction.AirtelMoneyID,
+	}
+	switch transaction.Status {
+	case AirtelStatusSuccess:
+		status.Paid, status.Completed = true, true
+	case AirtelStatusFailed, AirtelStatusExpired:
+		status.Completed = true
+	}
+	return status, nil
+}
+
+// Refund reverses the payment's Airtel Money transaction. Airtel answers at
+// once, so the submission is final. Payouts to the customer (b2c) are not
+// supported.
+func (p *AirtelProvider) Refund(order model.Order, payment model.Payment, method, remarks, token string) (*RefundSubmission, error) {
+	if method != model.RefundMethodReversal {
+		return nil, fmt.Errorf("airtel money refunds support the %q method only", model.RefundMethodReversal)
+	}
+	if payment.MpesaReceiptNumber == nil || *payment.MpesaReceiptNumber == "" {
+		return nil, fmt.Errorf("payment %d has no Airtel Money ID to refund", payment.ID)
+	}
+
+	res, err := p.do(http.MethodPost, airtelRefundPath, map[string]interface{}{
+		"transaction": map[string]string{"airtel_money_id": *payment.MpesaReceiptNumber},
+	})
+	if err != nil {
+		return nil, err
+	}
+	completed := res.Status.Success && strings.EqualFold(res.Data.Transaction.Status, "SUCCESS")
+	return &RefundSubmission{
+		ConversationID: res.Data.Transaction.AirtelMoneyID,
+		Final:          true,
+		Completed:      completed,
+		ResultDesc:     orDefault(res.Status.Message, res.Data.Transaction.Status),
+		TransactionID:  res.Data.Transaction.AirtelMoneyID,
+	}, nil
+}
+
+// airtelCallback is the body Airtel posts to the callback URL
+type airtelCallback struct {
+	Transaction json.RawMessage `json:"transaction"`
+	Hash        string          `json:"hash"`
+}
+
+// AirtelCallbackHash returns the hash Airtel sends with a callback: the base64
+// HMAC-SHA256 of the transaction object, keyed with the callback private key
+func AirtelCallbackHash(key string, transaction []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(transaction)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseCallback checks the callback's URL token and hash and converts it to a
+// callback payload. Airtel does not report the amount and payer, these are
+// taken from the order.
+func (p *AirtelProvider) ParseCallback(r *http.Request, body []byte) (*model.MpesaCallbackPayload, error) {
+	if want := p.config.CallbackURLToken; want != "" {
+		if got := path.Base(r.URL.Path); subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			return nil, &CallbackRejectedError{Reason: model.CallbackRejectToken, Details: "callback URL token does not match callback_url_token"}
+		}
+	}
+
+	var callback airtelCallback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		return nil, fmt.Errorf("failed to parse Airtel callback: %w", err)
+	}
+	if p.config.CallbackKey != "" {
+		want := AirtelCallbackHash(p.config.CallbackKey, callback.Transaction)
+		if subtle.ConstantTimeCompare([]byte(want), []byte(callback.Hash)) != 1 {
+			return nil, &CallbackRejectedError{Reason: model.CallbackRejectToken, Details: "callback hash does not match"}
+		}
+	}
+	var transaction airtelTransaction
+	if err := json.Unmarshal(callback.Transaction, &transaction); err != nil {
+		return nil, fmt.Errorf("failed to parse Airtel callback transaction: %w", err)
+	}
+	if transaction.ID == "" {
+		return nil, fmt.Errorf("airtel callback has no transaction ID")
+	}
+
+	payload := &model.MpesaCallbackPayload{
+		CheckoutRequestID: transaction.ID,
+		MerchantRequestID: transaction.ID,
+		ResultCode:        1,
+		ResultDesc:        transaction.Message,
+		Provider:          p.Name(),
+	}
+	if transaction.StatusCode != AirtelStatusSuccess {
+		return payload, nil
+	}
+
+	payload.ResultCode = 0
+	payload.MpesaReceiptNumber = transaction.AirtelMoneyID
+	payload.TransactionDate = time.Now().Format("2006-01-02 15:04:05")
+	order, err := service.FindOrderByCheckoutRequestID(transaction.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if order != nil {
+		payload.Amount = decimal.NewFromInt(int64(order.Amount))
+		payload.PhoneNumber = formatPhoneNumber(order.Phone)
+	}
+	return payload, nil
+}
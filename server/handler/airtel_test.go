@@ -0,0 +1,175 @@
+package handler_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/airteltest"
+)
+
+func newAirtelProvider(t *testing.T, airtel *airteltest.Server, callbackKey string) *handler.AirtelProvider {
+	t.Helper()
+
+	cfg := &handler.AirtelConfig{
+		Environment:      handler.AirtelEnvStaging,
+		BaseURL:          airtel.URL,
+		ClientID:         airtel.ClientID,
+		ClientSecret:     airtel.ClientSecret,
+		CallbackURLToken: "airtel-token",
+		CallbackKey:      callbackKey,
+	}
+	if err := cfg.Resolve(); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	provider, err := handler.NewAirtelProviderWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewAirtelProviderWithConfig() error = %v", err)
+	}
+	return provider
+}
+
+func TestAirtelConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		baseURL   string
+		serverEnv string
+		wantErr   bool
+	}{
+		{name: "staging in development", env: "staging", serverEnv: "development"},
+		{name: "live in production", env: "live", serverEnv: "production"},
+		{name: "staging in production", env: "staging", serverEnv: "production", wantErr: true},
+		{name: "live in development", env: "live", serverEnv: "development", wantErr: true},
+		{name: "live host in development", env: "staging", baseURL: handler.AirtelLiveURL, serverEnv: "development", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &handler.AirtelConfig{Environment: tt.env, BaseURL: tt.baseURL, ClientID: "id", ClientSecret: "secret"}
+			if err := cfg.Resolve(); err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if err := cfg.Validate(tt.serverEnv); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAirtelInitiateAndQueryStatus(t *testing.T) {
+	airtel := airteltest.NewServer()
+	defer airtel.Close()
+	airtel.SetResult("733000111", airteltest.ResultFailed)
+
+	provider := newAirtelProvider(t, airtel, "")
+
+	paid := model.Order{OrderNumber: "ORD-1", Phone: "0733123456", Amount: 30}
+	if err := provider.Initiate(&paid); err != nil {
+		t.Fatalf("Initiate() error = %v", err)
+	}
+	failed := model.Order{OrderNumber: "ORD-2", Phone: "0733000111", Amount: 30}
+	if err := provider.Initiate(&failed); err != nil {
+		t.Fatalf("Initiate() error = %v", err)
+	}
+
+	payments := airtel.Payments()
+	if len(payments) != 2 {
+		t.Fatalf("payments = %d, want 2", len(payments))
+	}
+	got := payments[0]
+	if got.Msisdn != "733123456" || got.Amount != 30 || got.Currency != "KES" || got.ID != paid.CheckoutRequestID || paid.ResponseCode != "0" {
+		t.Errorf("payment = %+v for order %+v, want KES 30 from 733123456 under the order's CheckoutRequestID", got, paid)
+	}
+	if airtel.TokenRequests() != 1 {
+		t.Errorf("token requests = %d, want the token reused", airtel.TokenRequests())
+	}
+
+	status, err := provider.QueryStatus(paid)
+	if err != nil {
+		t.Fatalf("QueryStatus() error = %v", err)
+	}
+	if !status.Paid || !status.Completed || status.TransactionID != got.AirtelMoneyID {
+		t.Errorf("QueryStatus() = %+v, want paid with Airtel Money ID %s", status, got.AirtelMoneyID)
+	}
+	status, err = provider.QueryStatus(failed)
+	if err != nil {
+		t.Fatalf("QueryStatus() error = %v", err)
+	}
+	if status.Paid || !status.Completed {
+		t.Errorf("QueryStatus() of a failed payment = %+v, want completed unpaid", status)
+	}
+}
+
+func TestAirtelRefund(t *testing.T) {
+	airtel := airteltest.NewServer()
+	defer airtel.Close()
+
+	provider := newAirtelProvider(t, airtel, "")
+	receipt := "MP123456"
+	payment := model.Payment{ID: 1, MpesaReceiptNumber: &receipt}
+
+	res, err := provider.Refund(model.Order{}, payment, model.RefundMethodReversal, "Refund", "tok")
+	if err != nil {
+		t.Fatalf("Refund() error = %v", err)
+	}
+	if !res.Final || !res.Completed || res.TransactionID != receipt {
+		t.Errorf("Refund() = %+v, want a completed final refund", res)
+	}
+	if refunds := airtel.Refunds(); len(refunds) != 1 || refunds[0] != receipt {
+		t.Errorf("refunds = %v, want %s refunded", refunds, receipt)
+	}
+
+	airtel.SetRefundResult(airteltest.ResultFailed)
+	if res, err := provider.Refund(model.Order{}, payment, model.RefundMethodReversal, "Refund", "tok"); err != nil || !res.Final || res.Completed {
+		t.Errorf("Refund() refused by Airtel = %+v, %v, want a failed final refund", res, err)
+	}
+	if _, err := provider.Refund(model.Order{}, payment, model.RefundMethodB2C, "Refund", "tok"); err == nil {
+		t.Error("Refund() with b2c succeeded, want an error")
+	}
+}
+
+func TestAirtelParseCallback(t *testing.T) {
+	payment := airteltest.Payment{ID: "AT0001", AirtelMoneyID: "MP0001"}
+	signed := string(airteltest.CallbackBody(payment, airteltest.ResultFailed, "callback-key"))
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantReason string // Empty when the callback is accepted
+	}{
+		{name: "genuine", path: "/api/v1/airtel/callback/airtel-token", body: signed},
+		{name: "wrong token", path: "/api/v1/airtel/callback/guess", body: signed, wantReason: model.CallbackRejectToken},
+		{name: "no token", path: "/api/v1/airtel/callback", body: signed, wantReason: model.CallbackRejectToken},
+		{name: "forged hash", path: "/api/v1/airtel/callback/airtel-token",
+			body: string(airteltest.CallbackBody(payment, airteltest.ResultFailed, "other-key")), wantReason: model.CallbackRejectToken},
+		{name: "tampered", path: "/api/v1/airtel/callback/airtel-token",
+			body: strings.Replace(signed, "Insufficient funds", "Paid", 1), wantReason: model.CallbackRejectToken},
+	}
+	airtel := airteltest.NewServer()
+	defer airtel.Close()
+	provider := newAirtelProvider(t, airtel, "callback-key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			payload, err := provider.ParseCallback(req, []byte(tt.body))
+
+			var rejected *handler.CallbackRejectedError
+			if tt.wantReason != "" {
+				if !errors.As(err, &rejected) || rejected.Reason != tt.wantReason {
+					t.Errorf("ParseCallback() error = %v, want rejection %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCallback() error = %v", err)
+			}
+			if payload.CheckoutRequestID != "AT0001" || payload.ResultCode == 0 || payload.Provider != model.PaymentProviderAirtel {
+				t.Errorf("ParseCallback() = %+v, want a failed Airtel payment of AT0001", payload)
+			}
+		})
+	}
+}
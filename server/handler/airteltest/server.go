@@ -0,0 +1,409 @@
+// Package airteltest provides a local stand-in for the Airtel Money Open API.
+//
+// The server issues OAuth access tokens, accepts Collections payment requests
+// and refunds, and reports the status of payments. Like Airtel, it posts the
+// payment result to a callback URL configured once for the merchant, signed
+// with the callback key when one is set.
+package airteltest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default credentials accepted by a new Server
+const (
+	DefaultClientID     = "test-client-id"
+	DefaultClientSecret = "test-client-secret"
+)
+
+// Result is the outcome of a payment
+type Result struct {
+	Status  string // TS, TF, TE or TIP
+	Message string
+}
+
+// Common payment results
+var (
+	ResultSuccess = Result{"TS", "Paid successfully"}
+	ResultFailed  = Result{"TF", "Insufficient funds"}
+	ResultExpired = Result{"TE", "Transaction expired"}
+
+	// ResultPending leaves the payment unanswered: no callback is sent and
+	// queries report it as in progress
+	ResultPending = Result{"TIP", "Transaction in progress"}
+)
+
+// Payment is a Collections payment request accepted by the server
+type Payment struct {
+	Reference string
+	Msisdn    string
+	Amount    int
+	Country   string
+	Currency  string
+	ID        string // Merchant transaction ID
+
+	AirtelMoneyID string
+}
+
+// Server is a fake Airtel Money API listening on a local port
+type Server struct {
+	// URL is the base URL to configure as the Airtel Money host
+	URL string
+
+	ClientID     string
+	ClientSecret string
+
+	// CallbackURL receives payment results; none are sent when empty
+	CallbackURL string
+	// CallbackKey signs callbacks when set, see Hash
+	CallbackKey string
+
+	srv    *httptest.Server
+	client *http.Client
+	wg     sync.WaitGroup
+
+	mu            sync.Mutex
+	seq           int
+	tokens        map[string]bool
+	tokenRequests int
+	payments      []Payment
+	results       map[string]Result
+	defaultResult Result
+	refunds       []string
+	refundResult  Result
+}
+
+// NewServer starts a fake Airtel Money server. Callers should Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		ClientID:      DefaultClientID,
+		ClientSecret:  DefaultClientSecret,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		tokens:        make(map[string]bool),
+		results:       make(map[string]Result),
+		defaultResult: ResultSuccess,
+		refundResult:  ResultSuccess,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/oauth2/token", s.handleToken)
+	mux.HandleFunc("/merchant/v1/payments/", s.authorized(s.handlePayment))
+	mux.HandleFunc("/standard/v1/payments/refund", s.authorized(s.handleRefund))
+	mux.HandleFunc("/standard/v1/payments/", s.authorized(s.handleStatus))
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close waits for pending callbacks and shuts the server down
+func (s *Server) Close() {
+	s.wg.Wait()
+	s.srv.Close()
+}
+
+// SetResult sets the result of payments from msisdn (without the country code)
+func (s *Server) SetResult(msisdn string, r Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[msisdn] = r
+}
+
+// SetRefundResult sets the result of refunds, ResultFailed refuses them
+func (s *Server) SetRefundResult(r Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refundResult = r
+}
+
+// TokenRequests returns how many access tokens were issued
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokenRequests
+}
+
+// Payments returns the accepted payment requests
+func (s *Server) Payments() []Payment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Payment(nil), s.payments...)
+}
+
+// Refunds returns the Airtel Money IDs of the accepted refunds
+func (s *Server) Refunds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.refunds...)
+}
+
+// Hash returns the hash Airtel sends with a callback for transaction
+func Hash(key string, transaction []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(transaction)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CallbackBody builds the JSON Airtel would POST for payment with result r,
+// signed with key when it is set
+func CallbackBody(payment Payment, r Result, key string) []byte {
+	transaction := map[string]string{
+		"id":          payment.ID,
+		"message":     r.Message,
+		"status_code": r.Status,
+	}
+	if r.Status == ResultSuccess.Status {
+		transaction["airtel_money_id"] = payment.AirtelMoneyID
+	}
+	raw, _ := json.Marshal(transaction)
+
+	callback := map[string]interface{}{"transaction": json.RawMessage(raw)}
+	if key != "" {
+		callback["hash"] = Hash(key, raw)
+	}
+	body, _ := json.Marshal(callback)
+	return body
+}
+
+// SendCallback delivers the result of the payment with the given ID to
+// CallbackURL and returns the HTTP status of the endpoint
+func (s *Server) SendCallback(id string) (int, error) {
+	s.mu.Lock()
+	var payment *Payment
+	for i := range s.payments {
+		if s.payments[i].ID == id {
+			payment = &s.payments[i]
+			break
+		}
+	}
+	if payment == nil {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("no payment with ID %s", id)
+	}
+	p, result := *payment, s.resultFor(payment.Msisdn)
+	s.mu.Unlock()
+
+	if result == ResultPending {
+		return 0, fmt.Errorf("payment %s is pending", id)
+	}
+	if s.CallbackURL == "" {
+		return 0, fmt.Errorf("no callback URL configured")
+	}
+	resp, err := s.client.Post(s.CallbackURL, "application/json", bytes.NewReader(CallbackBody(p, result, s.CallbackKey)))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// resultFor returns the result of payments from msisdn. Callers hold s.mu.
+func (s *Server) resultFor(msisdn string) Result {
+	if r, ok := s.results[msisdn]; ok {
+		return r
+	}
+	return s.defaultResult
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		GrantType    string `json:"grant_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.GrantType != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if req.ClientID != s.ClientID || req.ClientSecret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	s.tokenRequests++
+	token := fmt.Sprintf("airtel-token-%d", s.seq)
+	s.tokens[token] = true
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": token,
+		"expires_in":   "180",
+		"token_type":   "bearer",
+	})
+}
+
+// authorized rejects requests without a token the server issued or without
+// the country and currency headers
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.mu.Lock()
+		ok := s.tokens[token]
+		s.mu.Unlock()
+		if !ok {
+			writeStatus(w, http.StatusUnauthorized, "401", "Invalid token", false)
+			return
+		}
+		if r.Header.Get("X-Country") == "" || r.Header.Get("X-Currency") == "" {
+			writeStatus(w, http.StatusBadRequest, "400", "X-Country and X-Currency are required", false)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handlePayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStatus(w, http.StatusMethodNotAllowed, "405", "Method not allowed", false)
+		return
+	}
+	var req struct {
+		Reference  string `json:"reference"`
+		Subscriber struct {
+			Country  string `json:"country"`
+			Currency string `json:"currency"`
+			Msisdn   string `json:"msisdn"`
+		} `json:"subscriber"`
+		Transaction struct {
+			Amount   int    `json:"amount"`
+			Country  string `json:"country"`
+			Currency string `json:"currency"`
+			ID       string `json:"id"`
+		} `json:"transaction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatus(w, http.StatusBadRequest, "400", "Invalid request", false)
+		return
+	}
+	if req.Transaction.ID == "" || req.Transaction.Amount <= 0 || strings.HasPrefix(req.Subscriber.Msisdn, "254") {
+		writeStatus(w, http.StatusOK, "400", "Invalid transaction", false)
+		return
+	}
+
+	s.mu.Lock()
+	for _, p := range s.payments {
+		if p.ID == req.Transaction.ID {
+			s.mu.Unlock()
+			writeStatus(w, http.StatusOK, "400", "Duplicate transaction ID", false)
+			return
+		}
+	}
+	s.seq++
+	payment := Payment{
+		Reference:     req.Reference,
+		Msisdn:        req.Subscriber.Msisdn,
+		Amount:        req.Transaction.Amount,
+		Country:       req.Transaction.Country,
+		Currency:      req.Transaction.Currency,
+		ID:            req.Transaction.ID,
+		AirtelMoneyID: "MP" + strconv.FormatInt(time.Now().UnixNano()%1e9, 10) + strconv.Itoa(s.seq),
+	}
+	s.payments = append(s.payments, payment)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"transaction": map[string]string{"id": payment.ID, "status": "Success."},
+		},
+		"status": statusBlock("200", "SUCCESS", true),
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/standard/v1/payments/")
+	s.mu.Lock()
+	var payment *Payment
+	for i := range s.payments {
+		if s.payments[i].ID == id {
+			payment = &s.payments[i]
+			break
+		}
+	}
+	if payment == nil {
+		s.mu.Unlock()
+		writeStatus(w, http.StatusNotFound, "404", "Transaction not found", false)
+		return
+	}
+	p, result := *payment, s.resultFor(payment.Msisdn)
+	s.mu.Unlock()
+
+	transaction := map[string]string{"id": p.ID, "status": result.Status, "message": result.Message}
+	if result == ResultSuccess {
+		transaction["airtel_money_id"] = p.AirtelMoneyID
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":   map[string]interface{}{"transaction": transaction},
+		"status": statusBlock("200", "SUCCESS", true),
+	})
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Transaction struct {
+			AirtelMoneyID string `json:"airtel_money_id"`
+		} `json:"transaction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Transaction.AirtelMoneyID == "" {
+		writeStatus(w, http.StatusBadRequest, "400", "Invalid request", false)
+		return
+	}
+
+	s.mu.Lock()
+	result := s.refundResult
+	if result == ResultSuccess {
+		s.refunds = append(s.refunds, req.Transaction.AirtelMoneyID)
+	}
+	s.mu.Unlock()
+
+	status := "SUCCESS"
+	if result != ResultSuccess {
+		status = "FAILED"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"transaction": map[string]string{"airtel_money_id": req.Transaction.AirtelMoneyID, "status": status},
+		},
+		"status": statusBlock("200", result.Message, result == ResultSuccess),
+	})
+}
+
+func statusBlock(code, message string, success bool) map[string]interface{} {
+	resultCode := "ESB000010"
+	if !success {
+		resultCode = "ESB000001"
+	}
+	return map[string]interface{}{
+		"code":          code,
+		"message":       message,
+		"result_code":   resultCode,
+		"response_code": "DP00800001006",
+		"success":       success,
+	}
+}
+
+func writeStatus(w http.ResponseWriter, httpStatus int, code, message string, success bool) {
+	writeJSON(w, httpStatus, map[string]interface{}{"status": statusBlock(code, message, success)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
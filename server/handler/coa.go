@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	nconfig "github.com/ortupik/wifigo/server/config"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// sessionRequestTimeout bounds the Disconnect and CoA requests of one API call
+const sessionRequestTimeout = 15 * time.Second
+
+// sessionController pushes changes to live sessions; nil leaves them alone
+var sessionController *service.SessionController
+
+// LoadCoAConfig returns the Disconnect and CoA configuration from the
+// `radius.coa` block of Viper, or nil when it is missing or disabled
+func LoadCoAConfig() (*service.CoAConfig, error) {
+	sub := nconfig.GetConfig().Sub("radius.coa")
+	if sub == nil {
+		return nil, nil
+	}
+	var cfg service.CoAConfig
+	if err := sub.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal radius coa config: %w", err)
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// UseSessionController makes the hotspot user API push reply attribute and
+// group changes to active sessions with CoA requests, and disconnect the
+// sessions of deleted users
+func UseSessionController(s *service.SessionController) {
+	sessionController = s
+}
+
+// updateActiveSessions sends the reply attributes of username to its active
+// sessions. It returns nil when there is nothing to report.
+func updateActiveSessions(username string) []service.SessionResult {
+	if sessionController == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionRequestTimeout)
+	defer cancel()
+
+	results, err := sessionController.UpdateUser(ctx, username)
+	if err != nil {
+		log.Printf("Failed to send CoA for %s: %v", username, err)
+		return []service.SessionResult{{Status: service.SessionResultError, Error: err.Error()}}
+	}
+	logSessionResults("CoA", username, results)
+	return results
+}
+
+// disconnectActiveSessions ends the active sessions of username. It returns
+// nil when there is nothing to report.
+func disconnectActiveSessions(username string) []service.SessionResult {
+	if sessionController == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionRequestTimeout)
+	defer cancel()
+
+	results, err := sessionController.DisconnectUser(ctx, username)
+	if err != nil {
+		log.Printf("Failed to disconnect %s: %v", username, err)
+		return []service.SessionResult{{Status: service.SessionResultError, Error: err.Error()}}
+	}
+	logSessionResults("Disconnect", username, results)
+	return results
+}
+
+func logSessionResults(request, username string, results []service.SessionResult) {
+	for _, result := range results {
+		if result.Status != service.SessionResultACK {
+			log.Printf("%s of session %s of %s on %s: %s", request, result.AcctSessionID, username, result.NasIPAddress, result.Error)
+		}
+	}
+}
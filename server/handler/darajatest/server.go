@@ -0,0 +1,691 @@
+// Package darajatest provides a local stand-in for the Safaricom Daraja API.
+//
+// The server issues OAuth access tokens, accepts STK push requests and, like
+// Safaricom, later POSTs the payment result to the request's CallBackURL. The
+// same result is returned when the push is queried.
+// Results are configurable per phone number so tests can drive both the paid
+// and the failed paths of the checkout flow. C2B URLs can be registered and
+// payments made to the short code delivered to them. B2C payments and
+// reversals are accepted and their results posted to the ResultURL.
+package darajatest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default credentials accepted by a new Server
+const (
+	DefaultConsumerKey    = "test-consumer-key"
+	DefaultConsumerSecret = "test-consumer-secret"
+	DefaultShortcode      = "174379"
+	DefaultPasskey        = "test-passkey"
+)
+
+// Result is the outcome reported in an STK push callback
+type Result struct {
+	ResultCode int
+	ResultDesc string
+}
+
+// Common STK push results
+var (
+	ResultSuccess           = Result{0, "The service request is processed successfully."}
+	ResultInsufficientFunds = Result{1, "The balance is insufficient for the transaction."}
+	ResultCancelled         = Result{1032, "Request cancelled by user"}
+	ResultUnreachable       = Result{1037, "DS timeout user cannot be reached"}
+	ResultWrongPin          = Result{2001, "The initiator information is invalid."}
+
+	// ResultPending leaves the push unanswered: no callback is sent and
+	// queries report the transaction as still being processed
+	ResultPending = Result{-1, "The transaction is being processed"}
+)
+
+// StkPush is an STK push request accepted by the server
+type StkPush struct {
+	BusinessShortCode string
+	Password          string
+	Timestamp         string
+	TransactionType   string
+	Amount            string
+	PartyA            string
+	PartyB            string
+	PhoneNumber       string
+	CallBackURL       string
+	AccountReference  string
+	TransactionDesc   string
+
+	MerchantRequestID string    `json:"-"`
+	CheckoutRequestID string    `json:"-"`
+	Receipt           string    `json:"-"` // M-Pesa receipt reported on success, the same on every delivery
+	ReceivedAt        time.Time `json:"-"`
+}
+
+// C2BRegistration is a C2B URL registration accepted by the server
+type C2BRegistration struct {
+	ShortCode       string
+	ResponseType    string
+	ConfirmationURL string
+	ValidationURL   string
+}
+
+// RefundRequest is a B2C payment or transaction reversal accepted by the server
+type RefundRequest struct {
+	Initiator          string
+	InitiatorName      string
+	SecurityCredential string
+	CommandID          string
+	Amount             string
+	PartyA             string
+	PartyB             string // B2C recipient
+	TransactionID      string // Reversed transaction
+	ReceiverParty      string
+	Remarks            string
+	ResultURL          string
+	QueueTimeOutURL    string
+
+	ConversationID           string `json:"-"`
+	OriginatorConversationID string `json:"-"`
+}
+
+// Callback records a callback the server delivered
+type Callback struct {
+	CheckoutRequestID string
+	Result            Result
+	StatusCode        int   // HTTP status returned by the callback endpoint
+	Err               error // Transport error, if the endpoint could not be reached
+}
+
+// Server is a fake Daraja API listening on a local port
+type Server struct {
+	// URL is the base URL to configure as the Daraja host
+	URL string
+
+	// Credentials the server accepts; a push whose Password does not match
+	// Shortcode+Passkey+Timestamp is rejected
+	ConsumerKey    string
+	ConsumerSecret string
+	Shortcode      string
+	Passkey        string
+
+	// CallbackURL overrides the CallBackURL sent in push requests when set
+	CallbackURL string
+	// AutoCallback makes the server deliver the result after CallbackDelay.
+	// Tests that want to control timing disable it and call SendCallback.
+	AutoCallback  bool
+	CallbackDelay time.Duration
+	// CallbackFirst delivers the result before the push is answered, as a
+	// callback overtaking the push response would
+	CallbackFirst bool
+
+	srv    *httptest.Server
+	client *http.Client
+	wg     sync.WaitGroup
+
+	mu            sync.Mutex
+	seq           int
+	tokens        map[string]bool
+	tokenRequests int
+	pushes        []StkPush
+	results       map[string]Result
+	defaultResult Result
+	callbacks     []Callback
+	registrations []C2BRegistration
+	refunds       []RefundRequest
+	refundResult  Result
+}
+
+// NewServer starts a fake Daraja API server. Callers should Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		ConsumerKey:    DefaultConsumerKey,
+		ConsumerSecret: DefaultConsumerSecret,
+		Shortcode:      DefaultShortcode,
+		Passkey:        DefaultPasskey,
+		AutoCallback:   true,
+		CallbackDelay:  10 * time.Millisecond,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		tokens:         make(map[string]bool),
+		results:        make(map[string]Result),
+		defaultResult:  ResultSuccess,
+		refundResult:   ResultSuccess,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/v1/generate", s.handleToken)
+	mux.HandleFunc("/mpesa/stkpush/v1/processrequest", s.authorized(s.handleStkPush))
+	mux.HandleFunc("/mpesa/stkpushquery/v1/query", s.authorized(s.handleStkQuery))
+	mux.HandleFunc("/mpesa/c2b/v1/registerurl", s.authorized(s.handleC2BRegister))
+	mux.HandleFunc("/mpesa/b2c/v1/paymentrequest", s.authorized(s.handleRefund))
+	mux.HandleFunc("/mpesa/reversal/v1/request", s.authorized(s.handleRefund))
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close waits for pending callbacks and shuts the server down
+func (s *Server) Close() {
+	s.wg.Wait()
+	s.srv.Close()
+}
+
+// SetResult sets the result reported for pushes to phone (in 2547XXXXXXXX form)
+func (s *Server) SetResult(phone string, r Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[phone] = r
+}
+
+// SetDefaultResult sets the result reported for phones without a specific one
+func (s *Server) SetDefaultResult(r Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.defaultResult = r
+}
+
+// ExpireTokens invalidates every issued access token
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = make(map[string]bool)
+}
+
+// TokenRequests returns how many access tokens were issued
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokenRequests
+}
+
+// Pushes returns the accepted STK push requests
+func (s *Server) Pushes() []StkPush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]StkPush(nil), s.pushes...)
+}
+
+// Callbacks returns the callbacks delivered so far
+func (s *Server) Callbacks() []Callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Callback(nil), s.callbacks...)
+}
+
+// WaitCallbacks waits until n callbacks were delivered or timeout passes
+func (s *Server) WaitCallbacks(n int, timeout time.Duration) []Callback {
+	deadline := time.Now().Add(timeout)
+	for {
+		callbacks := s.Callbacks()
+		if len(callbacks) >= n || time.Now().After(deadline) {
+			return callbacks
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SetRefundResult sets the result reported for B2C payments and reversals.
+// ResultPending leaves them unanswered.
+func (s *Server) SetRefundResult(r Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refundResult = r
+}
+
+// Refunds returns the accepted B2C payment and reversal requests
+func (s *Server) Refunds() []RefundRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]RefundRequest(nil), s.refunds...)
+}
+
+// RefundResultBody builds the JSON Safaricom would POST to the ResultURL of a refund request
+func RefundResultBody(req RefundRequest, r Result) []byte {
+	result := map[string]interface{}{
+		"ResultType":               0,
+		"ResultCode":               r.ResultCode,
+		"ResultDesc":               r.ResultDesc,
+		"OriginatorConversationID": req.OriginatorConversationID,
+		"ConversationID":           req.ConversationID,
+		"TransactionID":            "",
+	}
+	if r.ResultCode == 0 {
+		result["TransactionID"] = "R" + strings.ToUpper(strconv.FormatInt(time.Now().UnixNano()%1e9, 36))
+	}
+	body, _ := json.Marshal(map[string]interface{}{"Result": result})
+	return body
+}
+
+// SendRefundResult delivers the result of the refund request with the given
+// ConversationID and returns the HTTP status of the endpoint
+func (s *Server) SendRefundResult(conversationID string) (int, error) {
+	s.mu.Lock()
+	var req *RefundRequest
+	for i := range s.refunds {
+		if s.refunds[i].ConversationID == conversationID {
+			req = &s.refunds[i]
+			break
+		}
+	}
+	if req == nil {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("no refund request with ConversationID %s", conversationID)
+	}
+	r, result := *req, s.refundResult
+	s.mu.Unlock()
+
+	if result == ResultPending {
+		return 0, fmt.Errorf("refund request %s is pending", conversationID)
+	}
+	resp, err := s.client.Post(r.ResultURL, "application/json", bytes.NewReader(RefundResultBody(r, result)))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// C2BRegistrations returns the C2B URL registrations accepted so far
+func (s *Server) C2BRegistrations() []C2BRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]C2BRegistration(nil), s.registrations...)
+}
+
+// C2BPayment is a payment a customer makes to the short code from the M-Pesa menu
+type C2BPayment struct {
+	TransID       string
+	Amount        string
+	MSISDN        string // As Safaricom reports it: plain, masked or hashed
+	BillRefNumber string
+	At            time.Time
+}
+
+// C2BBody builds the JSON Safaricom would POST to the C2B URLs for payment
+func C2BBody(shortcode string, payment C2BPayment) []byte {
+	body, _ := json.Marshal(map[string]string{
+		"TransactionType":   "Pay Bill",
+		"TransID":           payment.TransID,
+		"TransTime":         payment.At.Format("20060102150405"),
+		"TransAmount":       payment.Amount,
+		"BusinessShortCode": shortcode,
+		"BillRefNumber":     payment.BillRefNumber,
+		"InvoiceNumber":     "",
+		"OrgAccountBalance": "",
+		"ThirdPartyTransID": "",
+		"MSISDN":            payment.MSISDN,
+		"FirstName":         "Test",
+		"MiddleName":        "",
+		"LastName":          "",
+	})
+	return body
+}
+
+// SendC2BPayment delivers payment to the confirmation URL of the latest C2B
+// registration, as Safaricom does once the customer has paid. It returns the
+// HTTP status of the endpoint.
+func (s *Server) SendC2BPayment(payment C2BPayment) (int, error) {
+	s.mu.Lock()
+	if len(s.registrations) == 0 {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("no C2B URLs registered")
+	}
+	registration := s.registrations[len(s.registrations)-1]
+	s.mu.Unlock()
+
+	if payment.At.IsZero() {
+		payment.At = time.Now()
+	}
+	resp, err := s.client.Post(registration.ConfirmationURL, "application/json", bytes.NewReader(C2BBody(registration.ShortCode, payment)))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// CallbackBody builds the JSON Safaricom would POST for a push with result r
+func CallbackBody(push StkPush, r Result, receipt string, at time.Time) []byte {
+	callback := map[string]interface{}{
+		"MerchantRequestID": push.MerchantRequestID,
+		"CheckoutRequestID": push.CheckoutRequestID,
+		"ResultCode":        r.ResultCode,
+		"ResultDesc":        r.ResultDesc,
+	}
+	if r.ResultCode == 0 {
+		amount, _ := strconv.ParseFloat(push.Amount, 64)
+		phone, _ := strconv.ParseFloat(push.PhoneNumber, 64)
+		date, _ := strconv.ParseFloat(at.Format("20060102150405"), 64)
+		callback["CallbackMetadata"] = map[string]interface{}{
+			"Item": []map[string]interface{}{
+				{"Name": "Amount", "Value": amount},
+				{"Name": "MpesaReceiptNumber", "Value": receipt},
+				{"Name": "Balance"},
+				{"Name": "TransactionDate", "Value": date},
+				{"Name": "PhoneNumber", "Value": phone},
+			},
+		}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"Body": map[string]interface{}{"stkCallback": callback},
+	})
+	return body
+}
+
+// SendCallback delivers the result of the push with the given CheckoutRequestID.
+// Calling it again replays the same callback, as Safaricom's retries do.
+func (s *Server) SendCallback(checkoutRequestID string) (Callback, error) {
+	s.mu.Lock()
+	var push *StkPush
+	for i := range s.pushes {
+		if s.pushes[i].CheckoutRequestID == checkoutRequestID {
+			push = &s.pushes[i]
+			break
+		}
+	}
+	if push == nil {
+		s.mu.Unlock()
+		return Callback{}, fmt.Errorf("no STK push with CheckoutRequestID %s", checkoutRequestID)
+	}
+	p := *push
+	result := s.resultFor(p.PhoneNumber)
+	url := p.CallBackURL
+	if s.CallbackURL != "" {
+		url = s.CallbackURL
+	}
+	s.mu.Unlock()
+
+	if result == ResultPending {
+		return Callback{}, fmt.Errorf("STK push %s is pending", checkoutRequestID)
+	}
+
+	cb := Callback{CheckoutRequestID: checkoutRequestID, Result: result}
+
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(CallbackBody(p, result, p.Receipt, p.ReceivedAt)))
+	if err != nil {
+		cb.Err = err
+	} else {
+		cb.StatusCode = resp.StatusCode
+		resp.Body.Close()
+	}
+
+	s.mu.Lock()
+	s.callbacks = append(s.callbacks, cb)
+	s.mu.Unlock()
+	return cb, cb.Err
+}
+
+// resultFor returns the result configured for phone; s.mu must be held
+func (s *Server) resultFor(phone string) Result {
+	if result, ok := s.results[phone]; ok {
+		return result
+	}
+	return s.defaultResult
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("grant_type") != "client_credentials" {
+		writeError(w, http.StatusBadRequest, "400.008.02", "Invalid grant type passed")
+		return
+	}
+
+	want := base64.StdEncoding.EncodeToString([]byte(s.ConsumerKey + ":" + s.ConsumerSecret))
+	if r.Header.Get("Authorization") != "Basic "+want {
+		writeError(w, http.StatusBadRequest, "400.008.01", "Invalid Authentication passed")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	s.tokenRequests++
+	token := fmt.Sprintf("test-token-%d", s.seq)
+	s.tokens[token] = true
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": token,
+		"expires_in":   "3599",
+	})
+}
+
+// authorized rejects requests without a valid bearer token, like Daraja does
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.mu.Lock()
+		ok := s.tokens[token]
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "404.001.03", "Invalid Access Token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleStkPush(w http.ResponseWriter, r *http.Request) {
+	var push StkPush
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+		return
+	}
+
+	switch {
+	case push.BusinessShortCode != s.Shortcode:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid BusinessShortCode")
+		return
+	case push.Password != base64.StdEncoding.EncodeToString([]byte(s.Shortcode+s.Passkey+push.Timestamp)):
+		writeError(w, http.StatusInternalServerError, "500.001.1001", "Merchant does not exist")
+		return
+	case push.Amount == "" || push.PhoneNumber == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Amount or PhoneNumber")
+		return
+	case push.CallBackURL == "" && s.CallbackURL == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CallBackURL")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	push.MerchantRequestID = fmt.Sprintf("29115-%d-1", s.seq)
+	push.CheckoutRequestID = fmt.Sprintf("ws_CO_%s%04d", time.Now().Format("020120061504"), s.seq)
+	push.Receipt = fmt.Sprintf("TST%s%d", strings.ToUpper(strconv.FormatInt(time.Now().UnixNano()%1e7, 36)), s.seq)
+	push.ReceivedAt = time.Now()
+	s.pushes = append(s.pushes, push)
+	pending := s.resultFor(push.PhoneNumber) == ResultPending
+	s.mu.Unlock()
+
+	if s.AutoCallback && s.CallbackFirst && !pending {
+		if _, err := s.SendCallback(push.CheckoutRequestID); err != nil {
+			fmt.Printf("darajatest: callback for %s failed: %v\n", push.CheckoutRequestID, err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"MerchantRequestID":   push.MerchantRequestID,
+		"CheckoutRequestID":   push.CheckoutRequestID,
+		"ResponseCode":        "0",
+		"ResponseDescription": "Success. Request accepted for processing",
+		"CustomerMessage":     "Success. Request accepted for processing",
+	})
+
+	if s.AutoCallback && !s.CallbackFirst && !pending {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			time.Sleep(s.CallbackDelay)
+			if _, err := s.SendCallback(push.CheckoutRequestID); err != nil {
+				fmt.Printf("darajatest: callback for %s failed: %v\n", push.CheckoutRequestID, err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleStkQuery(w http.ResponseWriter, r *http.Request) {
+	var query struct {
+		BusinessShortCode string
+		Password          string
+		Timestamp         string
+		CheckoutRequestID string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+		return
+	}
+
+	switch {
+	case query.BusinessShortCode != s.Shortcode:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid BusinessShortCode")
+		return
+	case query.Password != base64.StdEncoding.EncodeToString([]byte(s.Shortcode+s.Passkey+query.Timestamp)):
+		writeError(w, http.StatusInternalServerError, "500.001.1001", "Merchant does not exist")
+		return
+	}
+
+	s.mu.Lock()
+	var push *StkPush
+	for i := range s.pushes {
+		if s.pushes[i].CheckoutRequestID == query.CheckoutRequestID {
+			push = &s.pushes[i]
+			break
+		}
+	}
+	var result Result
+	if push != nil {
+		result = s.resultFor(push.PhoneNumber)
+	}
+	s.mu.Unlock()
+
+	switch {
+	case push == nil:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CheckoutRequestID")
+	case result == ResultPending:
+		writeError(w, http.StatusInternalServerError, "500.001.1001", result.ResultDesc)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{
+			"ResponseCode":        "0",
+			"ResponseDescription": "The service request has been accepted successsfully",
+			"MerchantRequestID":   push.MerchantRequestID,
+			"CheckoutRequestID":   push.CheckoutRequestID,
+			"ResultCode":          strconv.Itoa(result.ResultCode),
+			"ResultDesc":          result.ResultDesc,
+		})
+	}
+}
+
+func (s *Server) handleC2BRegister(w http.ResponseWriter, r *http.Request) {
+	var registration C2BRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+		return
+	}
+
+	switch {
+	case registration.ShortCode != s.Shortcode:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ShortCode")
+		return
+	case registration.ResponseType != "Completed" && registration.ResponseType != "Cancelled":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ResponseType")
+		return
+	case registration.ConfirmationURL == "" || registration.ValidationURL == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ConfirmationURL or ValidationURL")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	s.registrations = append(s.registrations, registration)
+	id := fmt.Sprintf("%d-%d-1", s.seq, time.Now().Unix())
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"OriginatorCoversationID": id,
+		"ResponseCode":            "0",
+		"ResponseDescription":     "Success",
+	})
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+		return
+	}
+
+	switch {
+	case req.InitiatorName == "" && req.Initiator == "", req.SecurityCredential == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Initiator")
+		return
+	case req.Amount == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Amount")
+		return
+	case req.ResultURL == "" || req.QueueTimeOutURL == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid ResultURL")
+		return
+	case req.CommandID == "TransactionReversal" && req.TransactionID == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid TransactionID")
+		return
+	case req.CommandID != "TransactionReversal" && req.PartyB == "":
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid PartyB")
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	req.ConversationID = fmt.Sprintf("AG_%s_%06d", time.Now().Format("20060102"), s.seq)
+	req.OriginatorConversationID = fmt.Sprintf("%d-%d-1", s.seq, time.Now().Unix())
+	s.refunds = append(s.refunds, req)
+	pending := s.refundResult == ResultPending
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"ConversationID":           req.ConversationID,
+		"OriginatorConversationID": req.OriginatorConversationID,
+		"ResponseCode":             "0",
+		"ResponseDescription":      "Accept the service request successfully.",
+	})
+
+	if s.AutoCallback && !pending {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			time.Sleep(s.CallbackDelay)
+			if _, err := s.SendRefundResult(req.ConversationID); err != nil {
+				fmt.Printf("darajatest: refund result for %s failed: %v\n", req.ConversationID, err)
+			}
+		}()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{
+		"requestId":    fmt.Sprintf("%d", time.Now().UnixNano()),
+		"errorCode":    code,
+		"errorMessage": message,
+	})
+}
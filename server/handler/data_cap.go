@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// GetHotspotUserUsage returns the data used by the running subscription of
+// username against the data cap of its plan
+func GetHotspotUserUsage(username string) (gin.H, int) {
+	exists, err := userExists(nil, username)
+	if err != nil {
+		return gin.H{"error": "Failed to check if user exists: " + err.Error()}, http.StatusInternalServerError
+	}
+	if !exists {
+		return gin.H{"error": "User not found"}, http.StatusNotFound
+	}
+
+	quota, capped, err := service.FindUserQuota(username, time.Now())
+	if err != nil {
+		return gin.H{"error": err.Error()}, http.StatusInternalServerError
+	}
+	if !capped {
+		return gin.H{"username": username, "capped": false}, http.StatusOK
+	}
+	return gin.H{
+		"username":        username,
+		"capped":          true,
+		"plan":            quota.Plan,
+		"limit_bytes":     quota.LimitBytes,
+		"used_bytes":      quota.UsedBytes,
+		"remaining_bytes": quota.RemainingBytes(),
+		"exhausted":       quota.Exhausted(),
+		"since":           quota.Since,
+		"expires_at":      quota.ExpiresAt,
+	}, http.StatusOK
+}
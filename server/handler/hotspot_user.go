@@ -12,6 +12,7 @@ import (
 	"gorm.io/gorm"
 	dto "github.com/ortupik/wifigo/server/dto"
 	radiusmodel "github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/service"
 
 )
 
@@ -489,10 +490,14 @@ func DeleteHotspotUser(username string) (gin.H, int) {
 		return gin.H{"error": "Failed to commit transaction: " + err.Error()}, http.StatusInternalServerError
 	}
 
-	return gin.H{
+	resp := gin.H{
 		"message":  "Hotspot user deleted successfully",
 		"username": username,
-	}, http.StatusOK
+	}
+	if results := disconnectActiveSessions(username); results != nil {
+		resp["disconnect"] = results
+	}
+	return resp, http.StatusOK
 }
 
 
@@ -609,12 +614,16 @@ func AddOrUpdateRadReplyAttribute(username string, input dto.RadReplyInput) (gin
 		}
 	}
 
-	return gin.H{
+	resp := gin.H{
 		"message":   "Reply attribute updated successfully",
 		"username":  username,
 		"attribute": input.Attribute,
 		"value":     input.Value,
-	}, http.StatusOK
+	}
+	if results := updateActiveSessions(username); results != nil {
+		resp["coa"] = results
+	}
+	return resp, http.StatusOK
 }
 
 // DeleteRadReplyAttribute deletes a reply attribute
@@ -643,11 +652,15 @@ func DeleteRadReplyAttribute(username string, attribute string) (gin.H, int) {
 		return gin.H{"error": "Failed to delete attribute: " + err.Error()}, http.StatusInternalServerError
 	}
 
-	return gin.H{
+	resp := gin.H{
 		"message":   "Reply attribute deleted successfully",
 		"username":  username,
 		"attribute": attribute,
-	}, http.StatusOK
+	}
+	if results := updateActiveSessions(username); results != nil {
+		resp["coa"] = results
+	}
+	return resp, http.StatusOK
 }
 
 // AddRadUserGroup adds a user to a group
@@ -686,12 +699,16 @@ func AddRadUserGroup(username string, input dto.RadUserGroupInput) (gin.H, int)
 		}
 	}
 
-	return gin.H{
+	resp := gin.H{
 		"message":   "User added to group successfully",
 		"username":  username,
 		"groupname": input.Groupname,
 		"priority":  priority,
-	}, http.StatusOK
+	}
+	if results := updateActiveSessions(username); results != nil {
+		resp["coa"] = results
+	}
+	return resp, http.StatusOK
 }
 
 // DeleteRadUserGroup removes a user from a group
@@ -720,11 +737,15 @@ func DeleteRadUserGroup(username string, groupname string) (gin.H, int) {
 		return gin.H{"error": "Failed to delete user from group: " + err.Error()}, http.StatusInternalServerError
 	}
 
-	return gin.H{
+	resp := gin.H{
 		"message":   "User removed from group successfully",
 		"username":  username,
 		"groupname": groupname,
-	}, http.StatusOK
+	}
+	if results := updateActiveSessions(username); results != nil {
+		resp["coa"] = results
+	}
+	return resp, http.StatusOK
 }
 
 // --- Helper Functions for Database Operations ---
@@ -1069,7 +1090,7 @@ func IsUserExpired(username string) (string, error)  {
 
 	loc := time.Now().Location() // e.g., "Africa/Nairobi" if you're in EAT
 
-	expireTime, err := time.ParseInLocation("Jan 2 2006 15:04:05", expiration, loc)
+	expireTime, err := time.ParseInLocation(radiusmodel.RadiusExpirationLayout, expiration, loc)
 	if err != nil {
 		return "error", fmt.Errorf("failed to parse expiration for user %s: %w", username, err)
 	}
@@ -1084,3 +1105,46 @@ func IsUserExpired(username string) (string, error)  {
 	return "NOT_EXPIRED", nil
 }
 
+
+// AuthorizeHotspotUser returns nil when tenant may manage the hotspot user
+// username, and the response refusing it otherwise. Users of other ISPs are
+// not found.
+func AuthorizeHotspotUser(tenant service.Tenant, username string) (gin.H, int) {
+	owned, err := service.TenantOwnsUsername(gdatabase.GetDB(config.AppDB), tenant, username)
+	if err != nil {
+		return gin.H{"error": "Failed to check the ISP of the user: " + err.Error()}, http.StatusInternalServerError
+	}
+	if !owned {
+		return gin.H{"error": "User not found"}, http.StatusNotFound
+	}
+	return nil, http.StatusOK
+}
+
+// AuthorizeNewHotspotUser returns nil when tenant may create the hotspot user
+// username: ISP accounts create users in the realm of their ISP
+func AuthorizeNewHotspotUser(tenant service.Tenant, username string) (gin.H, int) {
+	if tenant.Platform() {
+		return nil, http.StatusOK
+	}
+	isp, err := service.TenantISP(gdatabase.GetDB(config.AppDB), tenant)
+	if err != nil {
+		return gin.H{"error": err.Error()}, http.StatusInternalServerError
+	}
+	if !isp.HasSubscriber(username) {
+		return gin.H{"error": "Username must end with @" + isp.UsernameRealm()}, http.StatusForbidden
+	}
+	return nil, http.StatusOK
+}
+
+// AuthorizeRadiusGroups returns nil when tenant may put users in groups, the
+// RADIUS groups of its ISP's service plans
+func AuthorizeRadiusGroups(tenant service.Tenant, groups ...string) (gin.H, int) {
+	foreign, err := service.TenantForeignGroup(gdatabase.GetDB(config.AppDB), tenant, groups)
+	if err != nil {
+		return gin.H{"error": err.Error()}, http.StatusInternalServerError
+	}
+	if foreign != "" {
+		return gin.H{"error": "Group " + foreign + " is not a service plan of your ISP"}, http.StatusForbidden
+	}
+	return nil, http.StatusOK
+}
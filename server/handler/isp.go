@@ -48,4 +48,11 @@ func GetISPAndPlan(c *gin.Context,ispID, planID int64) (ISPAndPlanData, error) {
 
 	// Return the data.
 	return ISPAndPlanData{ISP: isp, Plan: servicePlan}, nil
-}
\ No newline at end of file
+}
+// GetISP retrieves a single ISP by its ID.
+func GetISP(ispID int64) (model.ISP, error) {
+	db := gdatabase.GetDB(config.AppDB)
+	var isp model.ISP
+	err := db.Where("id = ?", ispID).First(&isp).Error
+	return isp, err
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,27 +12,64 @@ import (
 	"github.com/ortupik/wifigo/config"
 	gdatabase "github.com/ortupik/wifigo/database"
 	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/queue"
 	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
 )
 
 type MikrotikQueueHandler struct {
 	manager *mikrotik.Manager
+	queue   *queue.Client
 }
 
-func NewMikrotikQueueHandler(manager *mikrotik.Manager) *MikrotikQueueHandler {
+func NewMikrotikQueueHandler(manager *mikrotik.Manager, queueClient *queue.Client) *MikrotikQueueHandler {
 	return &MikrotikQueueHandler{
 		manager: manager,
+		queue:   queueClient,
 	}
 }
 
+// findDevice returns deviceID when the caller may manage it. It answers the
+// request and returns nil otherwise; devices of other ISPs are not found.
+func findDevice(c *gin.Context, tx *gorm.DB, deviceID string) *model.MikroTikDevice {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return nil
+	}
+	var device model.MikroTikDevice
+	err := tx.Where("id = ?", deviceID).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !tenant.CanAccessDevice(device)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device: " + err.Error()})
+		return nil
+	}
+	return &device
+}
+
+// ispAllowed reports whether the caller may put something under ispID. It
+// answers the request with 403 when not.
+func ispAllowed(c *gin.Context, ispID *int64) bool {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return false
+	}
+	if ispID != nil && !tenant.CanAccess(*ispID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "ISP belongs to another tenant"})
+		return false
+	}
+	return true
+}
+
 // GetMikroTikDevice retrieves a device based on ID
 func GetMikroTikDevice(deviceID string, c *gin.Context) {
 
 	tx := gdatabase.GetDB(config.AppDB)
 
-	var device model.MikroTikDevice
-	if err := tx.Where("id = ?", deviceID).First(&device).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	device := findDevice(c, tx, deviceID)
+	if device == nil {
 		return
 	}
 
@@ -42,6 +80,7 @@ func GetMikroTikDevice(deviceID string, c *gin.Context) {
 		"username":   device.Username,
 		"pool_size":  device.PoolSize,
 		"status":     device.Status,
+		"isp_id":     device.ISPID,
 		"created_at": device.CreatedAt,
 		"updated_at": device.UpdatedAt,
 	})
@@ -53,6 +92,11 @@ func GetMikroTikDevices(c *gin.Context, tx *gorm.DB) {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
 	// Parse pagination parameters
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
@@ -64,7 +108,7 @@ func GetMikroTikDevices(c *gin.Context, tx *gorm.DB) {
 	var devices []model.MikroTikDevice
 	var count int64
 
-	query := tx.Model(&model.MikroTikDevice{})
+	query := tenant.Scope(tx.Model(&model.MikroTikDevice{}), "isp_id")
 
 	// Apply status filter if provided
 	if status != "" {
@@ -72,10 +116,10 @@ func GetMikroTikDevices(c *gin.Context, tx *gorm.DB) {
 	}
 
 	// Get total count
-	query.Count(&count)
+	query.Session(&gorm.Session{}).Count(&count)
 
 	// Get paginated devices (exclude password from response)
-	if err := query.Select("id, name, address, username, pool_size, status, created_at, updated_at").
+	if err := query.Session(&gorm.Session{}).Select("id, name, address, username, pool_size, status, isp_id, created_at, updated_at").
 		Offset(offset).Limit(limit).Find(&devices).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve devices"})
 		return
@@ -97,12 +141,25 @@ func CreateMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
 	var deviceInput model.MikroTikDevice
 	if err := c.BindJSON(&deviceInput); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// ISP accounts add devices to their own ISP
+	if !ispAllowed(c, deviceInput.ISPID) {
+		return
+	}
+	if !tenant.Platform() {
+		deviceInput.ISPID = &tenant.ISPID
+	}
+
 	// Check if device with same ID already exists
 	var existingDevice model.MikroTikDevice
 	if err := tx.Where("id = ?", deviceInput.ID).First(&existingDevice).Error; err == nil {
@@ -131,6 +188,7 @@ func CreateMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 		"username":   deviceInput.Username,
 		"pool_size":  deviceInput.PoolSize,
 		"status":     deviceInput.Status,
+		"isp_id":     deviceInput.ISPID,
 		"created_at": deviceInput.CreatedAt,
 		"updated_at": deviceInput.UpdatedAt,
 	}
@@ -157,9 +215,11 @@ func UpdateMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 	}
 
 	// Check if device exists
-	var existingDevice model.MikroTikDevice
-	if err := tx.Where("id = ?", deviceID).First(&existingDevice).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	existingDevice := findDevice(c, tx, deviceID)
+	if existingDevice == nil {
+		return
+	}
+	if !ispAllowed(c, deviceInput.ISPID) {
 		return
 	}
 
@@ -167,13 +227,13 @@ func UpdateMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 	deviceInput.ID = deviceID
 
 	// Update the device
-	if err := tx.Model(&existingDevice).Updates(deviceInput).Error; err != nil {
+	if err := tx.Model(existingDevice).Updates(deviceInput).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
 		return
 	}
 
 	// Fetch the updated device to return
-	if err := tx.Where("id = ?", deviceID).First(&existingDevice).Error; err != nil {
+	if err := tx.Where("id = ?", deviceID).First(existingDevice).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve updated device"})
 		return
 	}
@@ -186,6 +246,7 @@ func UpdateMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 		"username":   existingDevice.Username,
 		"pool_size":  existingDevice.PoolSize,
 		"status":     existingDevice.Status,
+		"isp_id":     existingDevice.ISPID,
 		"created_at": existingDevice.CreatedAt,
 		"updated_at": existingDevice.UpdatedAt,
 	}
@@ -200,16 +261,15 @@ func DeleteMikroTikDevice(c *gin.Context, tx *gorm.DB) {
 	}
 
 	deviceID := c.Param("id")
-	var device model.MikroTikDevice
 
 	// Check if device exists
-	if err := tx.Where("id = ?", deviceID).First(&device).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	device := findDevice(c, tx, deviceID)
+	if device == nil {
 		return
 	}
 
 	// Delete the device
-	if err := tx.Delete(&device).Error; err != nil {
+	if err := tx.Delete(device).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
 		return
 	}
@@ -235,14 +295,13 @@ func UpdateMikroTikDeviceStatus(c *gin.Context, tx *gorm.DB) {
 	}
 
 	// Check if device exists
-	var device model.MikroTikDevice
-	if err := tx.Where("id = ?", deviceID).First(&device).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	device := findDevice(c, tx, deviceID)
+	if device == nil {
 		return
 	}
 
 	// Update only the status
-	if err := tx.Model(&device).Update("status", statusInput.Status).Error; err != nil {
+	if err := tx.Model(device).Update("status", statusInput.Status).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device status"})
 		return
 	}
@@ -260,8 +319,13 @@ func GetMikroTikDevicesByStatus(status model.DeviceStatus, c *gin.Context, tx *g
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
 	var devices []model.MikroTikDevice
-	if err := tx.Select("id, name, address, username, pool_size, status, created_at, updated_at").
+	if err := tenant.Scope(tx, "isp_id").Select("id, name, address, username, pool_size, status, isp_id, created_at, updated_at").
 		Where("status = ?", status).Find(&devices).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve devices"})
 		return
@@ -280,6 +344,14 @@ func GetMikroTikDeviceStats(c *gin.Context, tx *gorm.DB) {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	devices := func() *gorm.DB {
+		return tenant.Scope(tx.Model(&model.MikroTikDevice{}), "isp_id")
+	}
+
 	var stats struct {
 		Total       int64 `json:"total"`
 		Active      int64 `json:"active"`
@@ -288,12 +360,12 @@ func GetMikroTikDeviceStats(c *gin.Context, tx *gorm.DB) {
 	}
 
 	// Get total count
-	tx.Model(&model.MikroTikDevice{}).Count(&stats.Total)
+	devices().Count(&stats.Total)
 
 	// Get counts by status
-	tx.Model(&model.MikroTikDevice{}).Where("status = ?", model.StatusActive).Count(&stats.Active)
-	tx.Model(&model.MikroTikDevice{}).Where("status = ?", model.StatusInactive).Count(&stats.Inactive)
-	tx.Model(&model.MikroTikDevice{}).Where("status = ?", model.StatusMaintenance).Count(&stats.Maintenance)
+	devices().Where("status = ?", model.StatusActive).Count(&stats.Active)
+	devices().Where("status = ?", model.StatusInactive).Count(&stats.Inactive)
+	devices().Where("status = ?", model.StatusMaintenance).Count(&stats.Maintenance)
 
 	c.JSON(http.StatusOK, stats)
 }
@@ -307,9 +379,8 @@ func TestMikroTikDeviceConnection(c *gin.Context, tx *gorm.DB) {
 	deviceID := c.Param("id")
 
 	// Get device details
-	var device model.MikroTikDevice
-	if err := tx.Where("id = ?", deviceID).First(&device).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	device := findDevice(c, tx, deviceID)
+	if device == nil {
 		return
 	}
 
@@ -322,3 +393,93 @@ func TestMikroTikDeviceConnection(c *gin.Context, tx *gorm.DB) {
 		"timestamp":         time.Now(),
 	})
 }
+
+// GetMikroTikDevicesHealth returns the connection pool health of every loaded device
+func (h *MikrotikQueueHandler) GetMikroTikDevicesHealth(c *gin.Context) {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	report := h.manager.HealthReport()
+	if !tenant.Platform() {
+		ispID := strconv.FormatInt(tenant.ISPID, 10)
+		own := report[:0]
+		for _, health := range report {
+			if health.ISPID == ispID {
+				own = append(own, health)
+			}
+		}
+		report = own
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  report,
+		"count": len(report),
+	})
+}
+
+// GetMikroTikDeviceHealth returns the connection pool health of a single device
+func (h *MikrotikQueueHandler) GetMikroTikDeviceHealth(deviceID string, c *gin.Context) {
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil {
+		return
+	}
+	health, err := h.manager.GetDeviceHealth(deviceID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device is not loaded in the manager"})
+		return
+	}
+
+	c.JSON(http.StatusOK, health)
+}
+
+// DisconnectHotspotUser enqueues a logout (or a session kick) for a user on a device
+func (h *MikrotikQueueHandler) DisconnectHotspotUser(deviceID string, c *gin.Context) {
+	var input struct {
+		Username   string `json:"username"`
+		Address    string `json:"address"`
+		MacAddress string `json:"mac_address"`
+		Reason     string `json:"reason"`
+		Kick       bool   `json:"kick"` // Only drop the session, keep login cookies
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Username == "" && input.Address == "" && input.MacAddress == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username, address or mac_address is required"})
+		return
+	}
+
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil {
+		return
+	}
+	if _, err := h.manager.GetDevice(deviceID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device is not loaded in the manager"})
+		return
+	}
+
+	action := queue.ActionMikrotikLogoutUser
+	if input.Kick {
+		action = queue.ActionMikrotikKickSession
+	}
+
+	payload := dto.MikrotikLogout{
+		DeviceID:   deviceID,
+		Username:   input.Username,
+		Address:    input.Address,
+		MacAddress: input.MacAddress,
+		Reason:     input.Reason,
+	}
+	info, err := h.queue.EnqueueMikrotikCommand(c.Request.Context(), action, payload, queue.QueueCritical)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue logout: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   "Logout enqueued",
+		"task_id":   info.ID,
+		"device_id": deviceID,
+		"action":    action,
+	})
+}
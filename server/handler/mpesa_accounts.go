@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/badger"
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// MpesaAccountStore looks up the M-Pesa accounts ISPs collect payments into.
+// It is implemented by the Badger store.
+type MpesaAccountStore interface {
+	GetMpesaConfigByISP(ispID string) (*badger.MpesaConfigWrapper, error)
+}
+
+// UseAccountStore makes the handler resolve per ISP credentials from store,
+// see ForISP
+func (h *MpesaStkHandler) UseAccountStore(store MpesaAccountStore) {
+	h.accounts = store
+}
+
+// ForISP returns a handler using the M-Pesa account of the ISP. ISPs without an
+// account of their own, and all of them when no account store is set, use the
+// configured account.
+func (h *MpesaStkHandler) ForISP(ispID string) (*MpesaStkHandler, error) {
+	if ispID == "" || h.accounts == nil {
+		return h, nil
+	}
+	account, err := h.accounts.GetMpesaConfigByISP(ispID)
+	if errors.Is(err, badger.ErrConfigNotFound) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load M-Pesa account of ISP %s: %w", ispID, err)
+	}
+
+	cfg, err := h.mpesaConfig.WithAccount(*account)
+	if err != nil {
+		return nil, fmt.Errorf("M-Pesa account of ISP %s: %w", ispID, err)
+	}
+	if err := cfg.Validate(h.serverEnv); err != nil {
+		return nil, fmt.Errorf("M-Pesa account of ISP %s: %w", ispID, err)
+	}
+	return &MpesaStkHandler{
+		mpesaConfig: cfg,
+		httpClient:  h.httpClient,
+		serverEnv:   h.serverEnv,
+		accounts:    h.accounts,
+		tokens:      h.tokens,
+	}, nil
+}
+
+// ForOrder returns a handler using the M-Pesa account of the order's ISP
+func (h *MpesaStkHandler) ForOrder(order model.Order) (*MpesaStkHandler, error) {
+	return h.ForISP(order.ISP)
+}
+
+// WithAccount returns a copy of the configuration that collects into account.
+// Credentials come from the account alone, so that money is never collected
+// into another ISP's till; the environment and callback URL default to the
+// configured ones.
+func (c *MpesaConfig) WithAccount(account badger.MpesaConfigWrapper) (*MpesaConfig, error) {
+	cfg := *c
+	cfg.Environment = orDefault(account.Environment, c.Environment)
+	cfg.CallbackURL = orDefault(account.CallbackURL, c.CallbackURL)
+
+	creds := MpesaCredentials{
+		BaseURL:            account.BaseURL,
+		Shortcode:          account.Shortcode,
+		TillNo:             account.TillNo,
+		Passkey:            account.Passkey,
+		ConsumerKey:        account.ConsumerKey,
+		ConsumerSecret:     account.ConsumerSecret,
+		TransactionType:    orDefault(account.TransactionType, c.TransactionType),
+		InitiatorName:      account.InitiatorName,
+		SecurityCredential: account.SecurityCredential,
+		B2CShortcode:       account.B2CShortcode,
+	}
+	cfg.Sandbox, cfg.Live = creds, creds
+	cfg.BaseURL, cfg.Shortcode, cfg.TillNo, cfg.Passkey = "", "", "", ""
+	cfg.ConsumerKey, cfg.ConsumerSecret = "", ""
+	cfg.InitiatorName, cfg.SecurityCredential, cfg.B2CShortcode = "", "", ""
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+	cfg.TillNo = orDefault(cfg.TillNo, cfg.Shortcode)
+
+	if cfg.Shortcode == "" || cfg.Passkey == "" {
+		return nil, fmt.Errorf("mpesa short code and passkey are required")
+	}
+	return &cfg, nil
+}
+
+// MpesaAccountInput is the body of SaveMpesaAccount
+type MpesaAccountInput struct {
+	Name               string `json:"name"`
+	Environment        string `json:"environment" binding:"required"`
+	BaseURL            string `json:"base_url"`
+	Shortcode          string `json:"short_code"`
+	TillNo             string `json:"till_no"`
+	Passkey            string `json:"passkey"`
+	ConsumerKey        string `json:"consumer_key" binding:"required"`
+	ConsumerSecret     string `json:"consumer_secret" binding:"required"`
+	TransactionType    string `json:"transaction_type"`
+	CallbackURL        string `json:"callback_url"`
+	InitiatorName      string `json:"initiator_name"`
+	SecurityCredential string `json:"security_credential"`
+	B2CShortcode       string `json:"b2c_short_code"`
+}
+
+// MpesaAccountView is an ISP's M-Pesa account with the secrets left out
+type MpesaAccountView struct {
+	ISPID                 string `json:"isp_id"`
+	Name                  string `json:"name"`
+	Environment           string `json:"environment"`
+	BaseURL               string `json:"base_url,omitempty"`
+	Shortcode             string `json:"short_code"`
+	TillNo                string `json:"till_no"`
+	TransactionType       string `json:"transaction_type"`
+	CallbackURL           string `json:"callback_url,omitempty"`
+	InitiatorName         string `json:"initiator_name,omitempty"`
+	B2CShortcode          string `json:"b2c_short_code,omitempty"`
+	ConsumerKey           string `json:"consumer_key"` // Last four characters
+	HasPasskey            bool   `json:"has_passkey"`
+	HasConsumerSecret     bool   `json:"has_consumer_secret"`
+	HasSecurityCredential bool   `json:"has_security_credential"`
+}
+
+// NewMpesaAccountView masks the secrets of account
+func NewMpesaAccountView(account badger.MpesaConfigWrapper) MpesaAccountView {
+	key := account.ConsumerKey
+	if len(key) > 4 {
+		key = "****" + key[len(key)-4:]
+	}
+	return MpesaAccountView{
+		ISPID:                 account.ISPID,
+		Name:                  account.Name,
+		Environment:           account.Environment,
+		BaseURL:               account.BaseURL,
+		Shortcode:             account.Shortcode,
+		TillNo:                account.TillNo,
+		TransactionType:       account.TransactionType,
+		CallbackURL:           account.CallbackURL,
+		InitiatorName:         account.InitiatorName,
+		B2CShortcode:          account.B2CShortcode,
+		ConsumerKey:           key,
+		HasPasskey:            account.Passkey != "",
+		HasConsumerSecret:     account.ConsumerSecret != "",
+		HasSecurityCredential: account.SecurityCredential != "",
+	}
+}
+
+// MpesaAccountHandler manages the M-Pesa accounts of ISPs in the Badger store
+type MpesaAccountHandler struct {
+	store *badger.Store
+	stk   *MpesaStkHandler
+}
+
+// NewMpesaAccountHandler creates a new instance of MpesaAccountHandler. New
+// accounts are checked against the configuration of stk.
+func NewMpesaAccountHandler(store *badger.Store, stk *MpesaStkHandler) *MpesaAccountHandler {
+	return &MpesaAccountHandler{
+		store: store,
+		stk:   stk,
+	}
+}
+
+// SaveMpesaAccount sets the M-Pesa account of the ISP named in the path
+func (h *MpesaAccountHandler) SaveMpesaAccount(c *gin.Context) {
+	ispID, ok := h.ispID(c)
+	if !ok {
+		return
+	}
+
+	var input MpesaAccountInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	account := badger.MpesaConfigWrapper{
+		ISPID:              ispID,
+		Name:               input.Name,
+		Environment:        input.Environment,
+		BaseURL:            input.BaseURL,
+		Shortcode:          input.Shortcode,
+		TillNo:             input.TillNo,
+		Passkey:            input.Passkey,
+		ConsumerKey:        input.ConsumerKey,
+		ConsumerSecret:     input.ConsumerSecret,
+		TransactionType:    input.TransactionType,
+		CallbackURL:        input.CallbackURL,
+		InitiatorName:      input.InitiatorName,
+		SecurityCredential: input.SecurityCredential,
+		B2CShortcode:       input.B2CShortcode,
+	}
+
+	cfg, err := h.stk.Config().WithAccount(account)
+	if err == nil {
+		err = cfg.Validate(h.stk.serverEnv)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Store the resolved environment so the account reads back as it is used
+	account.Environment = cfg.Environment
+
+	if err := h.store.SaveMpesaConfigForISP(account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save M-Pesa account", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, NewMpesaAccountView(account))
+}
+
+// GetMpesaAccount returns the M-Pesa account of the ISP named in the path,
+// without its secrets
+func (h *MpesaAccountHandler) GetMpesaAccount(c *gin.Context) {
+	ispID, ok := h.ispID(c)
+	if !ok {
+		return
+	}
+	account, err := h.store.GetMpesaConfigByISP(ispID)
+	if errors.Is(err, badger.ErrConfigNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ISP has no M-Pesa account, payments use the default account"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load M-Pesa account", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, NewMpesaAccountView(*account))
+}
+
+// DeleteMpesaAccount removes the M-Pesa account of the ISP named in the path,
+// after which its payments use the default account
+func (h *MpesaAccountHandler) DeleteMpesaAccount(c *gin.Context) {
+	ispID, ok := h.ispID(c)
+	if !ok {
+		return
+	}
+	if _, err := h.store.GetMpesaConfigByISP(ispID); errors.Is(err, badger.ErrConfigNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ISP has no M-Pesa account"})
+		return
+	}
+	if err := h.store.DeleteMpesaConfigForISP(ispID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete M-Pesa account", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "M-Pesa account deleted"})
+}
+
+// ispID returns the ISP named in the path after checking it exists and the
+// caller may manage it
+func (h *MpesaAccountHandler) ispID(c *gin.Context) (string, bool) {
+	ispID := c.Param("ispId")
+	id, err := strconv.ParseInt(ispID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ISP ID"})
+		return "", false
+	}
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return "", false
+	}
+	if !tenant.CanAccess(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ISP not found"})
+		return "", false
+	}
+
+	db := gdatabase.GetDB(config.AppDB)
+	if db == nil {
+		return ispID, true
+	}
+	if err := db.First(&model.ISP{}, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ISP not found"})
+			return "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return ispID, true
+}
@@ -0,0 +1,126 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/badger"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+)
+
+// accountStore holds M-Pesa accounts by ISP in memory
+type accountStore map[string]badger.MpesaConfigWrapper
+
+func (s accountStore) GetMpesaConfigByISP(ispID string) (*badger.MpesaConfigWrapper, error) {
+	account, ok := s[ispID]
+	if !ok {
+		return nil, badger.ErrConfigNotFound
+	}
+	return &account, nil
+}
+
+// ispAccount is an account of the given fake Daraja with its own credentials
+func ispAccount(daraja *darajatest.Server) badger.MpesaConfigWrapper {
+	return badger.MpesaConfigWrapper{
+		ISPID:          "2",
+		Environment:    handler.MpesaEnvSandbox,
+		BaseURL:        daraja.URL,
+		Shortcode:      daraja.Shortcode,
+		Passkey:        daraja.Passkey,
+		ConsumerKey:    daraja.ConsumerKey,
+		ConsumerSecret: daraja.ConsumerSecret,
+		CallbackURL:    "https://isp.example.com/api/v1/mpesa/callback",
+	}
+}
+
+func TestForISPUsesTheISPAccount(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	ispDaraja := darajatest.NewServer()
+	defer ispDaraja.Close()
+	ispDaraja.Shortcode, ispDaraja.ConsumerKey, ispDaraja.ConsumerSecret = "600100", "isp-key", "isp-secret"
+
+	h := newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")
+	h.UseAccountStore(accountStore{"2": ispAccount(ispDaraja)})
+
+	isp, err := h.ForISP("2")
+	if err != nil {
+		t.Fatalf("ForISP() error = %v", err)
+	}
+	if _, err := isp.SendStkPush("0712345678", "10"); err != nil {
+		t.Fatalf("SendStkPush() for the ISP error = %v", err)
+	}
+	// ISPs without an account, and orders without an ISP, use the configured one
+	for _, ispID := range []string{"1", ""} {
+		other, err := h.ForISP(ispID)
+		if err != nil {
+			t.Fatalf("ForISP(%q) error = %v", ispID, err)
+		}
+		if _, err := other.SendStkPush("0712345678", "10"); err != nil {
+			t.Fatalf("SendStkPush() for ISP %q error = %v", ispID, err)
+		}
+	}
+
+	pushes := ispDaraja.Pushes()
+	if len(pushes) != 1 || pushes[0].BusinessShortCode != "600100" || !strings.HasPrefix(pushes[0].CallBackURL, "https://isp.example.com/") {
+		t.Errorf("ISP pushes = %+v, want one push to 600100 with the ISP's callback URL", pushes)
+	}
+	if n := len(daraja.Pushes()); n != 2 {
+		t.Errorf("default account pushes = %d, want 2", n)
+	}
+	// Each account got and kept its own access token
+	if daraja.TokenRequests() != 1 || ispDaraja.TokenRequests() != 1 {
+		t.Errorf("token requests = %d and %d, want one per account", daraja.TokenRequests(), ispDaraja.TokenRequests())
+	}
+}
+
+func TestWithAccountDoesNotBorrowCredentials(t *testing.T) {
+	cfg := &handler.MpesaConfig{
+		Environment:    handler.MpesaEnvLive,
+		Shortcode:      "5478910",
+		Passkey:        "default-passkey",
+		ConsumerKey:    "default-key",
+		ConsumerSecret: "default-secret",
+	}
+
+	// A live account without a passkey must not collect into the default till
+	_, err := cfg.WithAccount(badger.MpesaConfigWrapper{
+		Environment:    handler.MpesaEnvLive,
+		Shortcode:      "600100",
+		ConsumerKey:    "isp-key",
+		ConsumerSecret: "isp-secret",
+	})
+	if err == nil {
+		t.Error("WithAccount() without a passkey succeeded, want an error")
+	}
+
+	got, err := cfg.WithAccount(badger.MpesaConfigWrapper{
+		Shortcode:      "600100",
+		Passkey:        "isp-passkey",
+		ConsumerKey:    "isp-key",
+		ConsumerSecret: "isp-secret",
+	})
+	if err != nil {
+		t.Fatalf("WithAccount() error = %v", err)
+	}
+	if got.Shortcode != "600100" || got.TillNo != "600100" || got.ConsumerKey != "isp-key" || got.Environment != handler.MpesaEnvLive {
+		t.Errorf("WithAccount() = %+v, want the ISP's live account", got)
+	}
+	if cfg.Shortcode != "5478910" {
+		t.Errorf("WithAccount() changed the default account to %+v", cfg)
+	}
+}
+
+func TestNewMpesaAccountViewHidesSecrets(t *testing.T) {
+	view := handler.NewMpesaAccountView(badger.MpesaConfigWrapper{
+		ISPID:          "2",
+		Shortcode:      "600100",
+		Passkey:        "isp-passkey",
+		ConsumerKey:    "isp-consumer-key",
+		ConsumerSecret: "isp-secret",
+	})
+	if view.ConsumerKey != "****-key" || !view.HasPasskey || !view.HasConsumerSecret || view.HasSecurityCredential {
+		t.Errorf("NewMpesaAccountView() = %+v, want the secrets masked", view)
+	}
+}
@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// c2bMatchWindow bounds how far back a C2B payment is matched against orders by phone
+const c2bMatchWindow = 24 * time.Hour
+
+// C2BCheckoutRequestID is the CheckoutRequestID a C2B payment is recorded under
+func C2BCheckoutRequestID(transID string) string {
+	return "C2B-" + transID
+}
+
+// RegisterC2BURLs registers the configured C2B validation and confirmation URLs
+// for the short code, so that payments made to it from the M-Pesa menu reach
+// MpesaC2BValidation and MpesaC2BConfirmation.
+func (h *MpesaStkHandler) RegisterC2BURLs() (map[string]interface{}, error) {
+	cfg := h.mpesaConfig
+	if cfg.C2BConfirmationURL == "" || cfg.C2BValidationURL == "" {
+		return nil, fmt.Errorf("c2b_confirmation_url and c2b_validation_url must be set to register C2B URLs")
+	}
+	responseType := cfg.C2BResponseType
+	if responseType == "" {
+		responseType = "Completed"
+	}
+	confirmationURL, validationURL := cfg.C2BConfirmationURL, cfg.C2BValidationURL
+	if cfg.C2BURLToken != "" {
+		confirmationURL = callbackURLWithToken(confirmationURL, cfg.C2BURLToken)
+		validationURL = callbackURLWithToken(validationURL, cfg.C2BURLToken)
+	}
+
+	accessToken, err := h.GetAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+	payload := map[string]interface{}{
+		"ShortCode":       cfg.Shortcode,
+		"ResponseType":    responseType,
+		"ConfirmationURL": confirmationURL,
+		"ValidationURL":   validationURL,
+	}
+	response, err := h.postJSON(darajaC2BRegister, accessToken, payload)
+	if err != nil {
+		return nil, fmt.Errorf("C2B URL registration failed: %w", err)
+	}
+	if errCode, ok := response["errorCode"]; ok {
+		return response, fmt.Errorf("C2B URL registration rejected: %v %v", errCode, response["errorMessage"])
+	}
+	return response, nil
+}
+
+// RequireC2BToken makes the C2B endpoints reject requests whose URL does not
+// carry token, the c2b_url_token the URLs were registered with.
+func (h *MpesaCallbackHandler) RequireC2BToken(token string) {
+	h.c2bToken = token
+}
+
+// c2bAuthorized checks the sender and URL token of a C2B request, recording
+// and answering rejected ones
+func (h *MpesaCallbackHandler) c2bAuthorized(c *gin.Context, body []byte) bool {
+	reason, details := "", ""
+	switch {
+	case !h.sourceAllowed(c.ClientIP()):
+		reason, details = model.CallbackRejectSourceIP, "sender is not in callback_allowed_ips"
+	case h.c2bToken != "" && subtle.ConstantTimeCompare([]byte(h.c2bToken), []byte(c.Param("token"))) != 1:
+		reason, details = model.CallbackRejectToken, "C2B URL token does not match c2b_url_token"
+	default:
+		return true
+	}
+
+	service.RecordCallbackRejection(model.MpesaCallbackRejection{
+		SourceIP: c.ClientIP(),
+		Reason:   reason,
+		Details:  details,
+		Body:     auditBody(body),
+	})
+	c.JSON(http.StatusForbidden, gin.H{"error": "Callback rejected."})
+	return false
+}
+
+// MpesaC2BValidation answers Safaricom's validation request for a C2B payment.
+// Every payment is accepted: one that matches no order is parked on confirmation.
+func (h *MpesaCallbackHandler) MpesaC2BValidation(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B validation payload."})
+		return
+	}
+	if !h.c2bAuthorized(c, body) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ResultCode": "0", "ResultDesc": "Accepted"})
+}
+
+// MpesaC2BConfirmation records a C2B payment and settles the order it matches
+// through the same path as an STK callback. Payments that match no order
+// awaiting payment are parked for manual allocation.
+func (h *MpesaCallbackHandler) MpesaC2BConfirmation(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B confirmation payload."})
+		return
+	}
+	if !h.c2bAuthorized(c, body) {
+		return
+	}
+
+	var confirmation model.C2BConfirmation
+	if err := json.Unmarshal(body, &confirmation); err != nil || confirmation.TransID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B confirmation payload."})
+		return
+	}
+	amount, err := decimal.NewFromString(strings.TrimSpace(confirmation.TransAmount))
+	if err != nil || !amount.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid C2B transaction amount.", "details": confirmation.TransAmount})
+		return
+	}
+
+	payment, duplicate, err := service.RecordC2BPayment(&model.MpesaC2BPayment{
+		TransID:       confirmation.TransID,
+		TransType:     confirmation.TransactionType,
+		TransTime:     confirmation.TransTime,
+		Amount:        amount,
+		ShortCode:     confirmation.BusinessShortCode,
+		BillRefNumber: strings.TrimSpace(confirmation.BillRefNumber),
+		InvoiceNumber: confirmation.InvoiceNumber,
+		MSISDN:        strings.TrimSpace(confirmation.MSISDN),
+		FirstName:     confirmation.FirstName,
+		Status:        model.C2BStatusReceived,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record C2B payment.", "details": err.Error()})
+		return
+	}
+	// A repeated confirmation is only processed again if the first one failed half way
+	if duplicate && payment.Status != model.C2BStatusReceived {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Success"})
+		return
+	}
+
+	order, err := matchC2BOrder(payment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match C2B payment.", "details": err.Error()})
+		return
+	}
+	if order == nil || !orderAwaitsResult(*order, 0) {
+		parkC2BPayment(payment, order)
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Success"})
+		return
+	}
+
+	settled, status, response := h.settleC2BPayment(c.Request.Context(), payment, *order)
+	if status >= http.StatusInternalServerError {
+		// Left as received so that a repeated confirmation retries it
+		c.JSON(status, response)
+		return
+	}
+	if settled {
+		if err := service.SetC2BPaymentStatus(payment.ID, model.C2BStatusMatched, &order.ID); err != nil {
+			log.Printf("C2B payment %s settled order %s but was not marked matched: %v", payment.TransID, order.OrderNumber, err)
+		}
+		log.Printf("C2B payment %s matched order %s", payment.TransID, order.OrderNumber)
+	}
+	c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Success"})
+}
+
+// settleC2BPayment settles order with payment. It reports whether the payment
+// was applied, as opposed to being answered as a duplicate of one in flight.
+func (h *MpesaCallbackHandler) settleC2BPayment(ctx context.Context, payment *model.MpesaC2BPayment, order model.Order) (bool, int, gin.H) {
+	phone := payment.MSISDN
+	if !isPhoneNumber(phone) {
+		phone = formatPhoneNumber(order.Phone)
+	}
+	date := payment.TransTime
+	if t, err := time.Parse("20060102150405", date); err == nil {
+		date = t.Format("2006-01-02 15:04:05")
+	}
+
+	status, response := h.settleOrder(ctx, order, &model.MpesaCallbackPayload{
+		CheckoutRequestID:  C2BCheckoutRequestID(payment.TransID),
+		ResultCode:         0,
+		ResultDesc:         fmt.Sprintf("C2B %s payment", payment.TransType),
+		Amount:             payment.Amount,
+		MpesaReceiptNumber: payment.TransID,
+		TransactionDate:    date,
+		PhoneNumber:        phone,
+		OrderID:            order.ID,
+	})
+	settled := status < http.StatusInternalServerError && response["status"] != "duplicate"
+	return settled, status, response
+}
+
+// parkC2BPayment leaves a payment for an administrator to allocate
+func parkC2BPayment(payment *model.MpesaC2BPayment, order *model.Order) {
+	reason := "no order matches"
+	if order != nil {
+		reason = fmt.Sprintf("order %s is %s", order.OrderNumber, order.Status)
+	}
+	log.Printf("C2B payment %s of KES %s from %s (ref %q) is unmatched: %s",
+		payment.TransID, payment.Amount.StringFixed(0), payment.MSISDN, payment.BillRefNumber, reason)
+	if err := service.SetC2BPaymentStatus(payment.ID, model.C2BStatusUnmatched, nil); err != nil {
+		log.Printf("Failed to park C2B payment %s: %v", payment.TransID, err)
+	}
+}
+
+// matchC2BOrder finds the order a C2B payment is for. An account number that
+// is an order number names the order outright. Otherwise the latest order
+// awaiting payment from the phone given as account number, or failing that
+// from the paying number, is used. A masked number that fits several
+// customers matches nothing.
+func matchC2BOrder(payment *model.MpesaC2BPayment) (*model.Order, error) {
+	ref := payment.BillRefNumber
+	if ref != "" && !isPhoneNumber(formatPhoneNumber(ref)) {
+		order, err := service.FindOrderByNumber(ref)
+		if err == nil {
+			return order, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	orders, err := service.FindUnsettledOrders(time.Now().Add(-c2bMatchWindow))
+	if err != nil {
+		return nil, err
+	}
+	if isPhoneNumber(formatPhoneNumber(ref)) {
+		if order := latestOrderFrom(orders, func(phone string) bool { return phone == formatPhoneNumber(ref) }); order != nil {
+			return order, nil
+		}
+	}
+	return latestOrderFrom(orders, func(phone string) bool { return MSISDNMatches(payment.MSISDN, phone) }), nil
+}
+
+// latestOrderFrom returns the first of orders, newest first, whose phone
+// matches, or nil when the matching orders belong to more than one phone
+func latestOrderFrom(orders []model.Order, matches func(phone string) bool) *model.Order {
+	var latest *model.Order
+	for i := range orders {
+		phone := formatPhoneNumber(orders[i].Phone)
+		if !matches(phone) {
+			continue
+		}
+		if latest == nil {
+			latest = &orders[i]
+		} else if formatPhoneNumber(latest.Phone) != phone {
+			return nil
+		}
+	}
+	return latest
+}
+
+// MSISDNMatches reports whether the MSISDN of a C2B payment belongs to phone.
+// Depending on the account Safaricom sends the number in full, masked with
+// '*' or as the hex SHA-256 of its 2547XXXXXXXX form.
+func MSISDNMatches(msisdn, phone string) bool {
+	msisdn = strings.TrimSpace(msisdn)
+	if msisdn == "" {
+		return false
+	}
+	phone = formatPhoneNumber(phone)
+	if len(msisdn) == 2*sha256.Size {
+		if _, err := hex.DecodeString(msisdn); err == nil {
+			sum := sha256.Sum256([]byte(phone))
+			return strings.EqualFold(msisdn, hex.EncodeToString(sum[:]))
+		}
+	}
+	return phonesMatch(formatPhoneNumber(msisdn), phone)
+}
+
+// isPhoneNumber reports whether s is a phone number in 2547XXXXXXXX form
+func isPhoneNumber(s string) bool {
+	if len(s) != 12 || !strings.HasPrefix(s, "254") {
+		return false
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// AllocateC2BPayment applies an unmatched C2B payment to the order named by
+// order_number in the request, provisioning it like a matched payment.
+func (h *MpesaCallbackHandler) AllocateC2BPayment(c *gin.Context) {
+	var input struct {
+		OrderNumber string `json:"order_number"`
+	}
+	if err := c.BindJSON(&input); err != nil || input.OrderNumber == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order_number is required"})
+		return
+	}
+
+	payment, err := service.FindC2BPayment(c.Param("transId"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "C2B payment not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if payment.Status != model.C2BStatusUnmatched {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("C2B payment is %s, only unmatched payments can be allocated", payment.Status)})
+		return
+	}
+
+	order, err := service.FindOrderByNumber(input.OrderNumber)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !orderAwaitsResult(*order, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Order %s is %s and cannot take a payment", order.OrderNumber, order.Status)})
+		return
+	}
+
+	settled, status, response := h.settleC2BPayment(c.Request.Context(), payment, *order)
+	if status >= http.StatusInternalServerError {
+		c.JSON(status, response)
+		return
+	}
+	if !settled {
+		c.JSON(http.StatusConflict, response)
+		return
+	}
+	if err := service.SetC2BPaymentStatus(payment.ID, model.C2BStatusAllocated, &order.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  model.C2BStatusAllocated,
+		"transId": payment.TransID,
+		"order":   order.OrderNumber,
+		"result":  response,
+	})
+}
+
+// GetC2BPayments lists C2B payments with the status query parameter, unmatched
+// by default, newest first and paginated like GetOrders.
+func GetC2BPayments(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	status := c.DefaultQuery("status", model.C2BStatusUnmatched)
+	switch status {
+	case model.C2BStatusReceived, model.C2BStatusMatched, model.C2BStatusUnmatched, model.C2BStatusAllocated:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be received, matched, unmatched or allocated"})
+		return
+	}
+
+	query := tx.Model(&model.MpesaC2BPayment{}).Where("status = ?", status)
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count C2B payments"})
+		return
+	}
+
+	var payments []model.MpesaC2BPayment
+	if err := query.Session(&gorm.Session{}).Order("id DESC").Offset(offset).Limit(limit).Find(&payments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve C2B payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": payments,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
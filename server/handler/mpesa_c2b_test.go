@@ -0,0 +1,135 @@
+package handler_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+)
+
+func TestRegisterC2BURLs(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	h := newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")
+	cfg := h.Config()
+	cfg.C2BConfirmationURL = "https://example.com/api/v1/mpesa/c2b/confirmation"
+	cfg.C2BValidationURL = "https://example.com/api/v1/mpesa/c2b/validation"
+	cfg.C2BURLToken = "s3cret"
+
+	res, err := h.RegisterC2BURLs()
+	if err != nil {
+		t.Fatalf("RegisterC2BURLs() error = %v", err)
+	}
+	if res["ResponseCode"] != "0" {
+		t.Errorf("RegisterC2BURLs() = %v, want ResponseCode 0", res)
+	}
+
+	registrations := daraja.C2BRegistrations()
+	if len(registrations) != 1 {
+		t.Fatalf("registrations = %d, want 1", len(registrations))
+	}
+	want := darajatest.C2BRegistration{
+		ShortCode:       daraja.Shortcode,
+		ResponseType:    "Completed",
+		ConfirmationURL: "https://example.com/api/v1/mpesa/c2b/confirmation/s3cret",
+		ValidationURL:   "https://example.com/api/v1/mpesa/c2b/validation/s3cret",
+	}
+	if registrations[0] != want {
+		t.Errorf("registration = %+v, want %+v", registrations[0], want)
+	}
+}
+
+func TestRegisterC2BURLsRequiresURLs(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	h := newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")
+	if _, err := h.RegisterC2BURLs(); err == nil {
+		t.Error("RegisterC2BURLs() succeeded without C2B URLs, want an error")
+	}
+	if n := len(daraja.C2BRegistrations()); n != 0 {
+		t.Errorf("registrations = %d, want none", n)
+	}
+}
+
+func TestMpesaC2BValidationAccepts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/api/v1/mpesa/c2b/validation", handler.NewMpesaCallbackHandler(nil, nil).MpesaC2BValidation)
+
+	body := darajatest.C2BBody(darajatest.DefaultShortcode, darajatest.C2BPayment{TransID: "TST123", Amount: "10", MSISDN: "254712345678"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/mpesa/c2b/validation", strings.NewReader(string(body))))
+
+	var got struct{ ResultCode, ResultDesc string }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode validation response %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusOK || got.ResultCode != "0" {
+		t.Errorf("validation = %d %+v, want the payment accepted", w.Code, got)
+	}
+}
+
+func TestMpesaC2BConfirmationRequiresToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	callbacks := handler.NewMpesaCallbackHandler(nil, nil)
+	callbacks.RequireC2BToken("s3cret")
+	r := gin.New()
+	r.POST("/api/v1/mpesa/c2b/confirmation", callbacks.MpesaC2BConfirmation)
+	r.POST("/api/v1/mpesa/c2b/confirmation/:token", callbacks.MpesaC2BConfirmation)
+
+	body := string(darajatest.C2BBody(darajatest.DefaultShortcode, darajatest.C2BPayment{TransID: "TST123", Amount: "10", MSISDN: "254712345678"}))
+	for _, path := range []string{"/api/v1/mpesa/c2b/confirmation", "/api/v1/mpesa/c2b/confirmation/guess"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("POST %s returned %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+
+	// With the right token an unparsable body shows the request got past the check
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/mpesa/c2b/confirmation/s3cret", strings.NewReader("not json")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("confirmation with the token returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMSISDNMatches(t *testing.T) {
+	sum := sha256.Sum256([]byte("254712345678"))
+	hashed := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		msisdn string
+		phone  string
+		want   bool
+	}{
+		{name: "same number", msisdn: "254712345678", phone: "0712345678", want: true},
+		{name: "other number", msisdn: "254712345679", phone: "0712345678", want: false},
+		{name: "masked", msisdn: "2547****5678", phone: "0712345678", want: true},
+		{name: "masked other", msisdn: "2547****5679", phone: "0712345678", want: false},
+		{name: "hashed", msisdn: hashed, phone: "0712345678", want: true},
+		{name: "hashed upper case", msisdn: strings.ToUpper(hashed), phone: "254712345678", want: true},
+		{name: "hashed other", msisdn: hashed, phone: "0712345679", want: false},
+		{name: "empty", msisdn: "", phone: "0712345678", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handler.MSISDNMatches(tt.msisdn, tt.phone); got != tt.want {
+				t.Errorf("MSISDNMatches(%q, %q) = %v, want %v", tt.msisdn, tt.phone, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync" // Import sync for WaitGroup
 	"time" // For parsing TransactionDate
 
 	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
 
@@ -18,6 +20,7 @@ import (
 	"github.com/ortupik/wifigo/queue"
 	"github.com/ortupik/wifigo/server/database/model"
 	dto "github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
 	"github.com/ortupik/wifigo/websocket"
 )
 
@@ -25,6 +28,10 @@ import (
 type MpesaCallbackHandler struct {
 	queue *queue.Client
 	wsHub *websocket.Hub
+
+	allowedSources []*net.IPNet      // Empty accepts callbacks from any address
+	providers      *PaymentProviders // Request top-ups of underpaid orders, see UseStkHandler and UseProviders
+	c2bToken       string           // Required in the C2B URLs when set, see RequireC2BToken
 }
 
 // NewMpesaCallbackHandler creates a new instance of MpesaCallbackHandler.
@@ -35,51 +42,144 @@ func NewMpesaCallbackHandler(queueClient *queue.Client, wsHub *websocket.Hub) *M
 	}
 }
 
-// MpesaStkHandlerCallback processes incoming M-Pesa STK push callbacks.
+// MpesaStkHandlerCallback processes incoming M-Pesa STK push callbacks. The
+// sender must pass the source allowlist and the callback must match its order
+// before it is processed; rejected callbacks are recorded for audit.
 func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
-	// 1. Parse raw Safaricom callback
-	var raw map[string]interface{}
-	if err := c.ShouldBindJSON(&raw); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid M-Pesa callback payload."})
 		return
 	}
 
-	data, err := json.Marshal(raw) // Marshal back to bytes for ParseCallback
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to serialize callback data."})
+	// 1. Check the sender before trusting anything in the body
+	if !h.sourceAllowed(c.ClientIP()) {
+		service.RecordCallbackRejection(model.MpesaCallbackRejection{
+			SourceIP: c.ClientIP(),
+			Reason:   model.CallbackRejectSourceIP,
+			Details:  "sender is not in callback_allowed_ips",
+			Body:     auditBody(body),
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Callback rejected."})
 		return
 	}
 
-	payload, err := ParseCallback(data)
+	// 2. Parse raw Safaricom callback
+	payload, err := ParseCallback(body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse M-Pesa callback details.", "details": err.Error()})
 		return
 	}
 
+	// 3. Check the callback against its order before anything is provisioned
+	if err := attachPush(c.Request.Context(), payload, c.Param("token")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify M-Pesa callback.", "details": err.Error()})
+		return
+	}
+	reason, details, err := verifyCallback(c.Request.Context(), payload, c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify M-Pesa callback.", "details": err.Error()})
+		return
+	}
+	if reason != "" {
+		service.RecordCallbackRejection(model.MpesaCallbackRejection{
+			CheckoutRequestID: payload.CheckoutRequestID,
+			SourceIP:          c.ClientIP(),
+			Reason:            reason,
+			Details:           details,
+			Body:              auditBody(body),
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Callback rejected."})
+		return
+	}
+
+	status, response := h.ProcessCallback(c.Request.Context(), payload)
+	c.JSON(status, response)
+}
+
+// ProcessCallback applies an STK push result to its order: failures are recorded,
+// successes provision the RADIUS user, save the payment and log the device in.
+// It is shared by the callback endpoint and the reconciliation of stuck orders,
+// and returns the HTTP status and body to acknowledge the result with.
+func (h *MpesaCallbackHandler) ProcessCallback(ctx context.Context, payload *model.MpesaCallbackPayload) (int, gin.H) {
 	// 2. Look up matching order
 	db := gdatabase.GetDB(config.AppDB)
 	var order model.Order
 	if err := db.Preload("ServicePlan").Where("CheckoutRequestID = ?", payload.CheckoutRequestID).First(&order).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Associated order not found for this M-Pesa callback."})
-			return
+			return http.StatusNotFound, gin.H{"error": "Associated order not found for this M-Pesa callback."}
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order from database.", "details": err.Error()})
-		return
+		return http.StatusInternalServerError, gin.H{"error": "Failed to fetch order from database.", "details": err.Error()}
+	}
+
+	return h.settleOrder(ctx, order, payload)
+}
+
+// settleOrder applies a payment result to order. payload.CheckoutRequestID
+// identifies the payment, which for C2B payments is not the order's STK push.
+func (h *MpesaCallbackHandler) settleOrder(ctx context.Context, order model.Order, payload *model.MpesaCallbackPayload) (int, gin.H) {
+	// Safaricom retries callbacks: a result that was already applied, or is being
+	// applied by another delivery, is acknowledged without provisioning again.
+	// A successful payment that was not recorded yet is a payment of its own,
+	// even when another payment settled the order first.
+	extra := false
+	if !orderAwaitsResult(order, payload.ResultCode) && !retriesProvisioning(order, payload) {
+		var recorded *model.Payment
+		if payload.ResultCode == 0 {
+			var err error
+			if recorded, err = service.FindPaymentByCheckoutRequestID(payload.CheckoutRequestID); err != nil {
+				return http.StatusInternalServerError, gin.H{"error": "Failed to fetch payment from database.", "details": err.Error()}
+			}
+		}
+		if payload.ResultCode != 0 || recorded != nil {
+			fmt.Printf("Ignoring replayed M-Pesa callback for %s, order %s is %s\n", payload.CheckoutRequestID, order.OrderNumber, order.Status)
+			return http.StatusOK, gin.H{"status": "duplicate", "message": "Callback already processed."}
+		}
+		extra = true
+	}
+	claimed, err := claimCallback(ctx, payload.CheckoutRequestID)
+	if err != nil {
+		return http.StatusInternalServerError, gin.H{"error": "Failed to record M-Pesa callback.", "details": err.Error()}
+	}
+	if !claimed {
+		fmt.Printf("Ignoring replayed M-Pesa callback for %s, already being processed\n", payload.CheckoutRequestID)
+		return http.StatusOK, gin.H{"status": "duplicate", "message": "Callback already processed."}
+	}
+	// Task IDs keep a retried delivery from queueing the same work twice
+	saveTaskID := asynq.TaskID("mpesa:save:" + payload.CheckoutRequestID)
+	loginTaskID := asynq.TaskID("mpesa:login:" + payload.CheckoutRequestID)
+
+	// A payment for an order settled by another one is saved and credited, nothing is provisioned
+	if extra {
+		if _, err := h.queue.EnqueueDatabaseOperation(ctx, queue.ActionSaveMpesaCallback, *payload, queue.QueueCritical, saveTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+			releaseCallback(ctx, payload.CheckoutRequestID)
+			return http.StatusInternalServerError, gin.H{"error": "Failed to enqueue extra payment.", "details": err.Error()}
+		}
+		fmt.Printf("Crediting M-Pesa payment %s, order %s is %s already\n", payload.CheckoutRequestID, order.OrderNumber, order.Status)
+		return http.StatusOK, gin.H{"status": model.MismatchCredited, "message": "Order already paid, the payment was credited."}
+	}
+
+	// An underpayment is recorded and the rest requested, nothing is provisioned yet
+	if payload.ResultCode == 0 && payload.Amount.LessThan(decimal.NewFromInt(int64(order.Amount))) {
+		if _, err := h.queue.EnqueueDatabaseOperation(ctx, queue.ActionSaveMpesaCallback, *payload, queue.QueueCritical, saveTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+			releaseCallback(ctx, payload.CheckoutRequestID)
+			return http.StatusInternalServerError, gin.H{"error": "Failed to enqueue partial payment.", "details": err.Error()}
+		}
+		go h.requestTopUp(order, payload.Amount)
+		return http.StatusOK, gin.H{"status": model.OrderStatusPartiallyPaid, "message": "Partial payment received, top-up requested."}
 	}
 
 	// 3. Handle failed M-Pesa payments (ResultCode != 0)
 	if payload.ResultCode != 0 {
 		// Enqueue for reporting/audit. This is independent and non-critical for the HTTP response.
 		go func() {
-			_, err := h.queue.EnqueueDatabaseOperation(context.Background(), queue.ActionSaveMpesaCallback, *payload, queue.QueueReporting)
-			if err != nil {
+			_, err := h.queue.EnqueueDatabaseOperation(context.Background(), queue.ActionSaveMpesaCallback, *payload, queue.QueueReporting, saveTaskID)
+			if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
 				fmt.Printf("WARNING: Failed to enqueue failed M-Pesa callback for reporting: %v\n", err)
 			}
 		}()
 		h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"payment", "status": "failed", "message": %q}`, payload.ResultDesc)))
-		c.JSON(http.StatusOK, gin.H{"status": "Failed payment received and processed.", "ResultDesc": payload.ResultDesc})
-		return
+		return http.StatusOK, gin.H{"status": "Failed payment received and processed.", "ResultDesc": payload.ResultDesc}
 	}
 
 	// 4. Prepare subscription and manage hotspot user (synchronous RADIUS operation)
@@ -88,18 +188,33 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 		Username:    order.Username,
 		IsHomeUser:  order.IsHomeUser,
 		ISP:         order.ISP,
-		ServiceName: order.ServicePlan.Name,
+		ServiceName: order.ServicePlan.GroupName(),
 		Duration:    order.ServicePlan.Duration,
 		Devices:     order.Devices,
+		DataLimitMB: order.ServicePlan.DataLimitMB,
 	}
 
 	// ManageHotspotUser is assumed to be a blocking call to a RADIUS management API
 	resp, manageStatus := ManageHotspotUser(subscription, true) // Renamed 'status' to 'manageStatus' to avoid conflict
 	if manageStatus == http.StatusInternalServerError {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create/manage RADIUS user."})
+		// The customer has paid: record the payment and flag the order for a
+		// refund, while a retried callback may still provision it
+		if _, err := h.queue.EnqueueDatabaseOperation(ctx, queue.ActionSaveMpesaCallback, *payload, queue.QueueCritical, saveTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+			fmt.Printf("ERROR: Failed to enqueue payment of unprovisioned order %s: %v\n", order.OrderNumber, err)
+		}
+		if err := service.MarkProvisioningFailed(order.ID, fmt.Sprintf("RADIUS user could not be created: %v", resp["error"])); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+		releaseCallback(ctx, payload.CheckoutRequestID)
 		h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"create_account", "status": "failed", "message": %q}`, "Failed to create Account")))
-		return
-	} else if manageStatus == http.StatusConflict {
+		return http.StatusInternalServerError, gin.H{"error": "Failed to create/manage RADIUS user."}
+	}
+	if order.ProvisioningFailedAt != nil {
+		if err := service.ClearProvisioningFailure(order.ID); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+		}
+	}
+	if manageStatus == http.StatusConflict {
 		h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"create_account", "status": "failed", "message": %q}`, "User already subscribed")))
 		h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"payment", "status": "success", "message": %q}`, "Payment already done")))
 	} else { // http.StatusOK or other success codes from ManageHotspotUser
@@ -114,6 +229,7 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 		Address:  order.Ip,
 		Username: order.Username, // 'username' already defined from order.Username
 		Password: password,
+		OrderID:  order.ID,
 	}
 
 	// 5. Enqueue Mikrotik Command and Database Operation Independently and Concurrently
@@ -127,7 +243,7 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 	// Goroutine for Mikrotik Login Command
 	go func() {
 		defer wg.Done()
-		if _, err := h.queue.EnqueueMikrotikCommand(c.Request.Context(), queue.ActionMikrotikLoginUser, loginPayload, queue.QueueCritical); err != nil {
+		if _, err := h.queue.EnqueueMikrotikCommand(ctx, queue.ActionMikrotikLoginUser, loginPayload, queue.QueueCritical, loginTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
 			mikrotikErrCh <- fmt.Errorf("failed to enqueue Mikrotik login command: %w", err)
 		} else {
 			mikrotikErrCh <- nil // Send nil on success
@@ -139,7 +255,7 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 		defer wg.Done()
 		// Only enqueue DB operation if it's not a conflict (i.e., not already paid)
 		if manageStatus != http.StatusConflict {
-			if _, err := h.queue.EnqueueDatabaseOperation(c.Request.Context(), queue.ActionSaveMpesaCallback, *payload, queue.QueueCritical); err != nil {
+			if _, err := h.queue.EnqueueDatabaseOperation(ctx, queue.ActionSaveMpesaCallback, *payload, queue.QueueCritical, saveTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
 				dbErrCh <- fmt.Errorf("failed to enqueue DB save operation for Mpesa callback: %w", err)
 			} else {
 				dbErrCh <- nil // Send nil on success
@@ -169,6 +285,8 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 		responseErrors["mikrotik_queue_error"] = mikrotikQueueError.Error()
 		responseStatus = http.StatusInternalServerError // Mikrotik failure is critical
 		responseMessage = "Payment processed, but Mikrotik command failed to enqueue."
+		// Let Safaricom's retry queue the login again; the RADIUS user is not extended twice
+		releaseCallback(ctx, payload.CheckoutRequestID)
 	}
 
 	if dbQueueError != nil {
@@ -182,14 +300,13 @@ func (h *MpesaCallbackHandler) MpesaStkHandlerCallback(c *gin.Context) {
 	}
 
 	if len(responseErrors) > 0 {
-		c.JSON(responseStatus, gin.H{
+		return responseStatus, gin.H{
 			"status":  "partial_failure",
 			"message": responseMessage,
 			"errors":  responseErrors,
-		})
-	} else {
-		c.JSON(responseStatus, gin.H{"status": "success", "message": responseMessage})
+		}
 	}
+	return responseStatus, gin.H{"status": "success", "message": responseMessage}
 }
 
 // --- Safaricom M-Pesa Callback Parser (moved to be a method of the handler if it needs access to members, or keep as global if stateless) ---
@@ -227,7 +344,10 @@ func ParseCallback(data []byte) (*model.MpesaCallbackPayload, error) {
 					payload.MpesaReceiptNumber = val
 				}
 			case "TransactionDate":
-				// M-Pesa transaction date format: YYYYMMDDHHmmss
+				// M-Pesa transaction date format: YYYYMMDDHHmmss, sent as a number by Daraja
+				if num, ok := item.Value.(float64); ok {
+					item.Value = fmt.Sprintf("%.0f", num)
+				}
 				if val, ok := item.Value.(string); ok {
 					t, err := time.Parse("20060102150405", val)
 					if err == nil {
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// StkCallbackTokenKey is the key of the callback token in SendStkPush's response
+const StkCallbackTokenKey = "CallbackToken"
+
+// maxAuditBodySize caps how much of a rejected request body is stored
+const maxAuditBodySize = 16 << 10
+
+// newCallbackToken returns an unguessable token for an STK push callback
+func newCallbackToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate callback token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// callbackURLWithToken appends token as the last path segment of callbackURL
+func callbackURLWithToken(callbackURL, token string) string {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return strings.TrimRight(callbackURL, "/") + "/" + token
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + token
+	return u.String()
+}
+
+// parseSources parses callback allowlist entries, single addresses or CIDR ranges
+func parseSources(sources []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid callback source address %q", source)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			source = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid callback source range %q: %w", source, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// AllowSources restricts the callback endpoint to the given addresses or CIDR
+// ranges. An empty list accepts callbacks from any address.
+func (h *MpesaCallbackHandler) AllowSources(sources []string) error {
+	nets, err := parseSources(sources)
+	if err != nil {
+		return err
+	}
+	h.allowedSources = nets
+	return nil
+}
+
+// sourceAllowed reports whether a callback from ip passes the allowlist
+func (h *MpesaCallbackHandler) sourceAllowed(ip string) bool {
+	if len(h.allowedSources) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range h.allowedSources {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachPush records the CheckoutRequestID of a callback on the order that
+// was stored with the callback's token before its push was sent, when the
+// callback arrives before the order is updated with Daraja's answer
+func attachPush(ctx context.Context, payload *model.MpesaCallbackPayload, token string) error {
+	if token == "" || payload.CheckoutRequestID == "" {
+		return nil
+	}
+	err := gdatabase.GetDB(config.AppDB).WithContext(ctx).Model(&model.Order{}).
+		Where("callbackToken = ? AND CheckoutRequestID = ''", token).
+		Update("CheckoutRequestID", payload.CheckoutRequestID).Error
+	if err != nil {
+		return fmt.Errorf("failed to attach callback to its order: %w", err)
+	}
+	return nil
+}
+
+// verifyCallback checks a callback against the order it settles: the token of
+// its CallBackURL and, for payments, the phone the push was sent to. Amounts
+// that differ from the order are genuine and handled by ProcessCallback.
+// It returns the rejection reason and details, or empty strings when the
+// callback is genuine. Unknown orders are left for ProcessCallback to report.
+func verifyCallback(ctx context.Context, payload *model.MpesaCallbackPayload, token string) (string, string, error) {
+	db := gdatabase.GetDB(config.AppDB)
+	var order model.Order
+	if err := db.WithContext(ctx).Where("CheckoutRequestID = ?", payload.CheckoutRequestID).First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("failed to fetch order: %w", err)
+	}
+
+	if want, got := orDefault(order.Provider, model.PaymentProviderMpesa), orDefault(payload.Provider, model.PaymentProviderMpesa); got != want {
+		return model.CallbackRejectProvider, fmt.Sprintf("%s callback for order %s paid with %s", got, order.OrderNumber, want), nil
+	}
+
+	// Orders created before callback tokens were introduced have none
+	if order.CallbackToken != "" && subtle.ConstantTimeCompare([]byte(order.CallbackToken), []byte(token)) != 1 {
+		return model.CallbackRejectToken, fmt.Sprintf("callback token does not match order %s", order.OrderNumber), nil
+	}
+
+	if payload.ResultCode != 0 {
+		return "", "", nil
+	}
+	if want := formatPhoneNumber(order.Phone); !phonesMatch(payload.PhoneNumber, want) {
+		return model.CallbackRejectPhone, fmt.Sprintf("paid from %s, order %s is for %s", payload.PhoneNumber, order.OrderNumber, want), nil
+	}
+	return "", "", nil
+}
+
+// phonesMatch compares a callback phone number with the one the push was sent
+// to. Safaricom may mask digits with '*', which match any digit.
+func phonesMatch(callbackPhone, orderPhone string) bool {
+	callbackPhone = strings.ReplaceAll(callbackPhone, " ", "")
+	if callbackPhone == "" {
+		// Not every callback carries the number, the token check still applies
+		return true
+	}
+	if !strings.Contains(callbackPhone, "*") {
+		return callbackPhone == orderPhone
+	}
+	if len(callbackPhone) != len(orderPhone) {
+		return false
+	}
+	for i := range callbackPhone {
+		if callbackPhone[i] != '*' && callbackPhone[i] != orderPhone[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// auditBody truncates a request body for the rejection audit
+func auditBody(body []byte) string {
+	if len(body) > maxAuditBodySize {
+		body = body[:maxAuditBodySize]
+	}
+	return string(body)
+}
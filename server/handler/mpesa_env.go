@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// M-Pesa environments accepted in the `environment` setting
+const (
+	MpesaEnvSandbox = "sandbox"
+	MpesaEnvLive    = "live"
+)
+
+// DarajaSandboxURL is the Safaricom Daraja sandbox host
+const DarajaSandboxURL = "https://sandbox.safaricom.co.ke"
+
+// Public test credentials Safaricom publishes for the Daraja sandbox
+const (
+	SandboxShortcode       = "174379"
+	SandboxPasskey         = "bfb279f9aa9bdbcf158e97dd71a467cd2e0c893059b10f78e6b72ada1ed2c919"
+	SandboxTransactionType = "CustomerPayBillOnline"
+)
+
+// MpesaCredentials are the environment specific M-Pesa settings read from the
+// `mpesa.sandbox` and `mpesa.live` blocks.
+type MpesaCredentials struct {
+	BaseURL         string `mapstructure:"base_url"`
+	Shortcode       string `mapstructure:"short_code"`
+	TillNo          string `mapstructure:"till_no"`
+	Passkey         string `mapstructure:"passkey"`
+	ConsumerKey     string `mapstructure:"consumer_key"`
+	ConsumerSecret  string `mapstructure:"consumer_secret"`
+	TransactionType string `mapstructure:"transaction_type"`
+
+	InitiatorName      string `mapstructure:"initiator_name"`
+	SecurityCredential string `mapstructure:"security_credential"`
+	B2CShortcode       string `mapstructure:"b2c_short_code"`
+}
+
+// IsSandbox reports whether the configuration targets the Daraja sandbox
+func (c *MpesaConfig) IsSandbox() bool {
+	return c.Environment == MpesaEnvSandbox
+}
+
+// Resolve normalises the environment and fills in the endpoints and
+// credentials it implies. The top level settings and the `live` block apply to
+// the live environment; the sandbox uses its own block and otherwise falls back
+// to Safaricom's public test values. A top level base_url wins in both, so tests
+// can point the handler at a local server.
+func (c *MpesaConfig) Resolve() error {
+	env := strings.ToLower(strings.TrimSpace(c.Environment))
+	switch env {
+	case MpesaEnvSandbox:
+	case MpesaEnvLive, "production":
+		env = MpesaEnvLive
+	case "":
+		return fmt.Errorf("mpesa environment is not set, use %q or %q", MpesaEnvSandbox, MpesaEnvLive)
+	default:
+		return fmt.Errorf("unknown mpesa environment %q, use %q or %q", c.Environment, MpesaEnvSandbox, MpesaEnvLive)
+	}
+	c.Environment = env
+
+	if env == MpesaEnvSandbox {
+		// The top level settings are the live ones; sandbox only uses its own block and the public test values
+		c.Shortcode = orDefault(c.Sandbox.Shortcode, SandboxShortcode)
+		c.Passkey = orDefault(c.Sandbox.Passkey, SandboxPasskey)
+		c.TransactionType = orDefault(c.Sandbox.TransactionType, SandboxTransactionType)
+		c.TillNo = orDefault(c.Sandbox.TillNo, c.Shortcode)
+		c.ConsumerKey = c.Sandbox.ConsumerKey
+		c.ConsumerSecret = c.Sandbox.ConsumerSecret
+		c.InitiatorName = c.Sandbox.InitiatorName
+		c.SecurityCredential = c.Sandbox.SecurityCredential
+		c.B2CShortcode = orDefault(c.Sandbox.B2CShortcode, c.Shortcode)
+		c.BaseURL = orDefault(c.BaseURL, orDefault(c.Sandbox.BaseURL, DarajaSandboxURL))
+		return nil
+	}
+
+	c.Shortcode = orDefault(c.Live.Shortcode, c.Shortcode)
+	c.Passkey = orDefault(c.Live.Passkey, c.Passkey)
+	c.TransactionType = orDefault(c.Live.TransactionType, c.TransactionType)
+	c.TillNo = orDefault(c.Live.TillNo, c.TillNo)
+	c.ConsumerKey = orDefault(c.Live.ConsumerKey, c.ConsumerKey)
+	c.ConsumerSecret = orDefault(c.Live.ConsumerSecret, c.ConsumerSecret)
+	c.InitiatorName = orDefault(c.Live.InitiatorName, c.InitiatorName)
+	c.SecurityCredential = orDefault(c.Live.SecurityCredential, c.SecurityCredential)
+	c.B2CShortcode = orDefault(c.Live.B2CShortcode, orDefault(c.B2CShortcode, c.Shortcode))
+	c.BaseURL = orDefault(c.BaseURL, orDefault(c.Live.BaseURL, DarajaLiveURL))
+	return nil
+}
+
+// Validate refuses configurations that would take test payments in production
+// or real money outside it. serverEnv is the APP_ENV of the running server.
+func (c *MpesaConfig) Validate(serverEnv string) error {
+	production := strings.ToLower(strings.TrimSpace(serverEnv)) == "production"
+
+	if production && c.usesSandbox() {
+		return fmt.Errorf("refusing to use M-Pesa sandbox credentials in production (environment %q, short code %s, host %s)",
+			c.Environment, c.Shortcode, c.APIURL(""))
+	}
+	if !production && c.Environment == MpesaEnvLive {
+		return fmt.Errorf("refusing to use live M-Pesa credentials with APP_ENV %q, set mpesa environment to %q", serverEnv, MpesaEnvSandbox)
+	}
+	if !production && strings.HasPrefix(c.APIURL(""), DarajaLiveURL) {
+		return fmt.Errorf("refusing to call the live Daraja host with APP_ENV %q", serverEnv)
+	}
+
+	if c.ConsumerKey == "" || c.ConsumerSecret == "" {
+		return fmt.Errorf("mpesa consumer key and secret are required for the %s environment", c.Environment)
+	}
+	return nil
+}
+
+// usesSandbox reports whether any setting points at the sandbox
+func (c *MpesaConfig) usesSandbox() bool {
+	return c.IsSandbox() ||
+		c.Shortcode == SandboxShortcode ||
+		c.Passkey == SandboxPasskey ||
+		strings.HasPrefix(c.APIURL(""), DarajaSandboxURL)
+}
+
+func orDefault(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
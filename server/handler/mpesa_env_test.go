@@ -0,0 +1,163 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+func liveConfig() *handler.MpesaConfig {
+	return &handler.MpesaConfig{
+		Environment:     "live",
+		Shortcode:       "5478910",
+		TillNo:          "3192988",
+		Passkey:         "live-passkey",
+		ConsumerKey:     "live-key",
+		ConsumerSecret:  "live-secret",
+		TransactionType: "CustomerBuyGoodsOnline",
+		Sandbox: handler.MpesaCredentials{
+			ConsumerKey:    "sandbox-key",
+			ConsumerSecret: "sandbox-secret",
+		},
+	}
+}
+
+func TestMpesaConfigResolve(t *testing.T) {
+	live := liveConfig()
+	if err := live.Resolve(); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if live.IsSandbox() || live.APIURL("") != handler.DarajaLiveURL || live.Shortcode != "5478910" || live.ConsumerKey != "live-key" {
+		t.Errorf("live config resolved to %+v, want the live host and credentials", live)
+	}
+
+	sandbox := liveConfig()
+	sandbox.Environment = " Sandbox "
+	if err := sandbox.Resolve(); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if !sandbox.IsSandbox() || sandbox.APIURL("") != handler.DarajaSandboxURL {
+		t.Errorf("sandbox config uses %q, want the sandbox host", sandbox.APIURL(""))
+	}
+	if sandbox.ConsumerKey != "sandbox-key" || sandbox.ConsumerSecret != "sandbox-secret" {
+		t.Errorf("sandbox credentials = %s/%s, want the sandbox block", sandbox.ConsumerKey, sandbox.ConsumerSecret)
+	}
+	// The top level settings are live ones and must not leak into the sandbox
+	if sandbox.Shortcode != handler.SandboxShortcode || sandbox.Passkey != handler.SandboxPasskey || sandbox.TillNo != handler.SandboxShortcode {
+		t.Errorf("sandbox short code %s, passkey %s, till %s, want the public sandbox values", sandbox.Shortcode, sandbox.Passkey, sandbox.TillNo)
+	}
+
+	bare := &handler.MpesaConfig{Environment: "sandbox"}
+	if err := bare.Resolve(); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if bare.Shortcode != handler.SandboxShortcode || bare.Passkey != handler.SandboxPasskey ||
+		bare.TillNo != handler.SandboxShortcode || bare.TransactionType != handler.SandboxTransactionType {
+		t.Errorf("bare sandbox config = %+v, want Safaricom's public sandbox values", bare)
+	}
+
+	for _, env := range []string{"", "staging"} {
+		if err := (&handler.MpesaConfig{Environment: env}).Resolve(); err == nil {
+			t.Errorf("Resolve() with environment %q succeeded", env)
+		}
+	}
+}
+
+func TestMpesaConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    func() *handler.MpesaConfig
+		serverEnv string
+		wantErr   string
+	}{
+		{
+			name:      "live in production",
+			config:    liveConfig,
+			serverEnv: "production",
+		},
+		{
+			name: "sandbox in development",
+			config: func() *handler.MpesaConfig {
+				c := liveConfig()
+				c.Environment = "sandbox"
+				return c
+			},
+			serverEnv: "development",
+		},
+		{
+			name: "sandbox in production",
+			config: func() *handler.MpesaConfig {
+				c := liveConfig()
+				c.Environment = "sandbox"
+				return c
+			},
+			serverEnv: "production",
+			wantErr:   "sandbox credentials in production",
+		},
+		{
+			name: "sandbox short code in production",
+			config: func() *handler.MpesaConfig {
+				c := liveConfig()
+				c.Shortcode = handler.SandboxShortcode
+				return c
+			},
+			serverEnv: "production",
+			wantErr:   "sandbox credentials in production",
+		},
+		{
+			name: "sandbox host in production",
+			config: func() *handler.MpesaConfig {
+				c := liveConfig()
+				c.Live.BaseURL = handler.DarajaSandboxURL
+				return c
+			},
+			serverEnv: "production",
+			wantErr:   "sandbox credentials in production",
+		},
+		{
+			name:      "live in development",
+			config:    liveConfig,
+			serverEnv: "development",
+			wantErr:   "live M-Pesa credentials",
+		},
+		{
+			name: "live host from a sandbox environment",
+			config: func() *handler.MpesaConfig {
+				c := liveConfig()
+				c.Environment = "sandbox"
+				c.Sandbox.BaseURL = handler.DarajaLiveURL
+				return c
+			},
+			serverEnv: "development",
+			wantErr:   "live Daraja host",
+		},
+		{
+			name: "missing sandbox credentials",
+			config: func() *handler.MpesaConfig {
+				return &handler.MpesaConfig{Environment: "sandbox"}
+			},
+			serverEnv: "development",
+			wantErr:   "consumer key and secret are required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config()
+			if err := c.Resolve(); err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			err := c.Validate(tt.serverEnv)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
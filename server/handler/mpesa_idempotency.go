@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v4"
+
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// callbackMarkerTTL outlives Safaricom's callback retries by a wide margin
+const callbackMarkerTTL = 24 * time.Hour
+
+// processedCallbacks is the in-memory marker store used when Redis is not configured
+var processedCallbacks = struct {
+	sync.Mutex
+	claimed map[string]time.Time
+}{claimed: make(map[string]time.Time)}
+
+func callbackMarkerKey(checkoutRequestID string) string {
+	return "mpesa:callback:" + checkoutRequestID
+}
+
+// claimCallback marks the result of an STK push as being processed. It reports
+// false when another delivery of the same result has claimed it already.
+func claimCallback(ctx context.Context, checkoutRequestID string) (bool, error) {
+	if gdatabase.GetRedis() == nil {
+		processedCallbacks.Lock()
+		defer processedCallbacks.Unlock()
+
+		now := time.Now()
+		for id, at := range processedCallbacks.claimed {
+			if now.Sub(at) > callbackMarkerTTL {
+				delete(processedCallbacks.claimed, id)
+			}
+		}
+		if _, ok := processedCallbacks.claimed[checkoutRequestID]; ok {
+			return false, nil
+		}
+		processedCallbacks.claimed[checkoutRequestID] = now
+		return true, nil
+	}
+
+	redisClient := *gdatabase.GetRedis()
+	rConnTTL := gconfig.GetConfig().Database.REDIS.Conn.ConnTTL
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rConnTTL)*time.Second)
+	defer cancel()
+
+	var reply string
+	maybe := radix.Maybe{Rcv: &reply}
+	err := redisClient.Do(ctx, radix.FlatCmd(&maybe, "SET", callbackMarkerKey(checkoutRequestID), time.Now().Unix(),
+		"NX", "EX", int(callbackMarkerTTL.Seconds())))
+	if err != nil {
+		return false, err
+	}
+	return !maybe.Null, nil
+}
+
+// releaseCallback drops the marker so that a retry can process the result again
+func releaseCallback(ctx context.Context, checkoutRequestID string) {
+	if gdatabase.GetRedis() == nil {
+		processedCallbacks.Lock()
+		delete(processedCallbacks.claimed, checkoutRequestID)
+		processedCallbacks.Unlock()
+		return
+	}
+
+	redisClient := *gdatabase.GetRedis()
+	rConnTTL := gconfig.GetConfig().Database.REDIS.Conn.ConnTTL
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rConnTTL)*time.Second)
+	defer cancel()
+	_ = redisClient.Do(ctx, radix.Cmd(nil, "DEL", callbackMarkerKey(checkoutRequestID)))
+}
+
+// orderAwaitsResult reports whether an order can still be settled by a payment
+// result. A success may still settle an order that timed out or whose STK push
+// failed, since the customer has paid, for instance through C2B.
+func orderAwaitsResult(order model.Order, resultCode int) bool {
+	switch order.Status {
+	case model.OrderStatusPending:
+		return true
+	case model.OrderStatusTimeout, model.OrderStatusPaymentFailed:
+		return resultCode == 0
+	}
+	return false
+}
+
+// retriesProvisioning reports whether payload repeats the payment of an order
+// that was paid but could not be provisioned and is not being refunded, so
+// that the retry may provision it after all
+func retriesProvisioning(order model.Order, payload *model.MpesaCallbackPayload) bool {
+	if payload.ResultCode != 0 || order.Status != model.OrderStatusPaid || order.ProvisioningFailedAt == nil || order.RefundStatus != "" {
+		return false
+	}
+	payment, err := service.FindSettledPayment(order.ID)
+	return err == nil && payment.CheckoutRequestID == payload.CheckoutRequestID
+}
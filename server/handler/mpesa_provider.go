@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// MpesaProvider is the M-Pesa STK push PaymentProvider. Orders are paid into
+// the M-Pesa account of their ISP, see MpesaStkHandler.ForISP.
+type MpesaProvider struct {
+	stk *MpesaStkHandler
+}
+
+// NewMpesaProvider creates a new instance of MpesaProvider.
+func NewMpesaProvider(stk *MpesaStkHandler) *MpesaProvider {
+	return &MpesaProvider{stk: stk}
+}
+
+// Name implements PaymentProvider
+func (p *MpesaProvider) Name() string {
+	return model.PaymentProviderMpesa
+}
+
+// Initiate sends an STK push for the order. A callback token already set on
+// the order is used for the push.
+func (p *MpesaProvider) Initiate(order *model.Order) error {
+	stk, err := p.stk.ForOrder(*order)
+	if err != nil {
+		return err
+	}
+	res, err := stk.sendStkPush(order.Phone, fmt.Sprintf("%d", order.Amount), order.CallbackToken)
+	if err != nil {
+		return err
+	}
+	if errCode, exists := res["errorCode"]; exists {
+		return &PaymentRequestError{
+			Code:      fmt.Sprint(errCode),
+			Message:   fmt.Sprint(res["errorMessage"]),
+			RequestID: fmt.Sprint(res["requestId"]),
+		}
+	}
+
+	order.ResultDesc = fmt.Sprint(res["ResponseDescription"])
+	order.CheckoutRequestID = fmt.Sprint(res["CheckoutRequestID"])
+	order.MerchantRequestID = fmt.Sprint(res["MerchantRequestID"])
+	order.ResponseCode = fmt.Sprint(res["ResponseCode"])
+	order.CallbackToken = fmt.Sprint(res[StkCallbackTokenKey])
+	return nil
+}
+
+// ParseCallback parses an STK push callback. Its token and sender are checked
+// by MpesaCallbackHandler.MpesaStkHandlerCallback.
+func (p *MpesaProvider) ParseCallback(r *http.Request, body []byte) (*model.MpesaCallbackPayload, error) {
+	return ParseCallback(body)
+}
+
+// QueryStatus queries the order's STK push
+func (p *MpesaProvider) QueryStatus(order model.Order) (*PaymentStatus, error) {
+	stk, err := p.stk.ForOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	result, err := stk.QueryStkPush(order.CheckoutRequestID)
+	if result == nil {
+		return nil, err
+	}
+	// A rejected query still returns a status, so old orders can be timed out
+	return &PaymentStatus{
+		Paid:              result.Paid(),
+		Completed:         result.Completed(),
+		ResultDesc:        result.ResultDesc,
+		MerchantRequestID: result.MerchantRequestID,
+	}, err
+}
+
+// Refund reverses the payment's M-Pesa transaction, or pays the amount back
+// with B2C. The result is posted to the refund result URL.
+func (p *MpesaProvider) Refund(order model.Order, payment model.Payment, method, remarks, token string) (*RefundSubmission, error) {
+	stk, err := p.stk.ForOrder(order)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *AsyncRequestResult
+	switch method {
+	case model.RefundMethodReversal:
+		if payment.MpesaReceiptNumber == nil || *payment.MpesaReceiptNumber == "" {
+			return nil, fmt.Errorf("payment %d has no M-Pesa receipt to reverse", payment.ID)
+		}
+		result, err = stk.ReverseTransaction(*payment.MpesaReceiptNumber, payment.Amount, remarks, token)
+	case model.RefundMethodB2C:
+		result, err = stk.SendB2CPayment(order.Phone, payment.Amount, remarks, token)
+	default:
+		return nil, fmt.Errorf("unknown refund method %q", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RefundSubmission{
+		ConversationID:           result.ConversationID,
+		OriginatorConversationID: result.OriginatorConversationID,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/shopspring/decimal"
+
+	"github.com/ortupik/wifigo/queue"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+// Defaults for the reconciliation of orders whose STK callback never arrived
+const (
+	DefaultReconcileAfter = 2 * time.Minute // Safaricom normally calls back well within this
+	DefaultReconcileLimit = 50              // Orders queried per run
+	DefaultPendingMaxAge  = 24 * time.Hour  // Orders still unanswered after this are timed out
+)
+
+// MpesaReconcileHandler queries the payment provider of orders stuck in
+// PENDING and settles them as if the callback had arrived. It implements
+// queue.Handler.
+type MpesaReconcileHandler struct {
+	providers *PaymentProviders
+	callbacks *MpesaCallbackHandler
+	wsHub     *websocket.Hub
+}
+
+// NewMpesaReconcileHandler creates a new instance of MpesaReconcileHandler.
+// Orders are queried with M-Pesa until UseProviders is called.
+func NewMpesaReconcileHandler(stk *MpesaStkHandler, callbacks *MpesaCallbackHandler, wsHub *websocket.Hub) *MpesaReconcileHandler {
+	return &MpesaReconcileHandler{
+		providers: NewPaymentProviders(NewMpesaProvider(stk)),
+		callbacks: callbacks,
+		wsHub:     wsHub,
+	}
+}
+
+// UseProviders sets the providers orders are queried with
+func (h *MpesaReconcileHandler) UseProviders(providers *PaymentProviders) {
+	h.providers = providers
+}
+
+// HandleTask queries the result of every order pending for longer than the
+// payload's threshold and settles the ones the operator has an answer for.
+func (h *MpesaReconcileHandler) HandleTask(ctx context.Context, task *asynq.Task) error {
+	var payload queue.MpesaReconcilePayload
+	if len(task.Payload()) > 0 {
+		if err := json.Unmarshal(task.Payload(), &payload); err != nil {
+			return fmt.Errorf("failed to unmarshal reconcile payload: %w", err)
+		}
+	}
+	olderThan := payload.OlderThan
+	if olderThan <= 0 {
+		olderThan = DefaultReconcileAfter
+	}
+	limit := payload.Limit
+	if limit <= 0 {
+		limit = DefaultReconcileLimit
+	}
+
+	orders, err := service.FindStalePendingOrders(time.Now().Add(-olderThan), limit)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, order := range orders {
+		if err := h.ReconcileOrder(ctx, order); err != nil {
+			log.Printf("Failed to reconcile order %s: %v", order.OrderNumber, err)
+			failed++
+		}
+	}
+
+	if len(orders) > 0 {
+		log.Printf("M-Pesa reconciliation: %d pending orders, %d failed", len(orders), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to reconcile %d of %d orders", failed, len(orders))
+	}
+	return nil
+}
+
+// ReconcileOrder queries the payment of a pending order. A successful payment
+// goes through the same path as the callback; a failed one, or one left
+// unanswered for longer than DefaultPendingMaxAge, times the order out.
+func (h *MpesaReconcileHandler) ReconcileOrder(ctx context.Context, order model.Order) error {
+	provider, err := h.providers.ForOrder(order)
+	if err != nil {
+		return err
+	}
+	noResponse := "No response from " + providerLabel(provider.Name())
+	result, err := provider.QueryStatus(order)
+	if err != nil {
+		// Daraja stops answering for old pushes, so a rejected query must not keep the order pending forever
+		if result != nil && time.Since(order.CreatedAt) > DefaultPendingMaxAge {
+			return h.timeout(order, noResponse)
+		}
+		return err
+	}
+
+	switch {
+	case result.Paid:
+		payload := &model.MpesaCallbackPayload{
+			MerchantRequestID: result.MerchantRequestID,
+			CheckoutRequestID: order.CheckoutRequestID,
+			ResultCode:        0,
+			ResultDesc:        result.ResultDesc,
+			// The query does not echo the payment details, the request asked for these
+			Amount:             decimal.NewFromInt(int64(order.Amount)),
+			PhoneNumber:        formatPhoneNumber(order.Phone),
+			TransactionDate:    time.Now().Format("2006-01-02 15:04:05"),
+			MpesaReceiptNumber: result.TransactionID,
+			Provider:           provider.Name(),
+		}
+		status, response := h.callbacks.ProcessCallback(ctx, payload)
+		if status != http.StatusOK {
+			return fmt.Errorf("failed to settle paid order: %v", response)
+		}
+		log.Printf("Order %s settled from %s status query", order.OrderNumber, provider.Name())
+		return nil
+
+	case result.Completed:
+		return h.timeout(order, result.ResultDesc)
+
+	case time.Since(order.CreatedAt) > DefaultPendingMaxAge:
+		return h.timeout(order, noResponse)
+	}
+
+	// Still waiting for the customer, try again on the next run
+	return nil
+}
+
+func (h *MpesaReconcileHandler) timeout(order model.Order, resultDesc string) error {
+	updated, err := service.MarkOrderTimedOut(order.ID, resultDesc)
+	if err != nil || !updated {
+		return err
+	}
+
+	log.Printf("Order %s timed out: %s", order.OrderNumber, resultDesc)
+	if order.Ip != "" && h.wsHub != nil {
+		h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"payment", "status": "failed", "message": %q}`, resultDesc)))
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/queue"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+// DefaultAutoRefundLimit is the number of orders refunded per automatic run
+const DefaultAutoRefundLimit = 20
+
+// MpesaRefundHandler returns payments of orders that were paid but could not
+// be provisioned, on request or automatically. It implements queue.Handler
+// for the automatic refunds.
+type MpesaRefundHandler struct {
+	stk       *MpesaStkHandler
+	providers *PaymentProviders
+	wsHub     *websocket.Hub
+}
+
+// NewMpesaRefundHandler creates a new instance of MpesaRefundHandler. Orders
+// are refunded with M-Pesa until UseProviders is called.
+func NewMpesaRefundHandler(stk *MpesaStkHandler, wsHub *websocket.Hub) *MpesaRefundHandler {
+	return &MpesaRefundHandler{
+		stk:       stk,
+		providers: NewPaymentProviders(NewMpesaProvider(stk)),
+		wsHub:     wsHub,
+	}
+}
+
+// UseProviders sets the providers orders are refunded with
+func (h *MpesaRefundHandler) UseProviders(providers *PaymentProviders) {
+	h.providers = providers
+}
+
+// RefundOrder refunds the successful payment of order with method, reversal or
+// b2c, or the configured refund_method when empty. The refund is recorded
+// before it is sent; it is submitted once the provider accepts it and finishes
+// when the result is posted to the refund result URL, or at once for providers
+// that answer synchronously.
+func (h *MpesaRefundHandler) RefundOrder(order model.Order, method, reason, requestedBy string, automatic bool) (*model.Refund, error) {
+	if method == "" {
+		method = orDefault(h.stk.Config().RefundMethod, model.RefundMethodReversal)
+	}
+	if method != model.RefundMethodReversal && method != model.RefundMethodB2C {
+		return nil, fmt.Errorf("unknown refund method %q, use %q or %q", method, model.RefundMethodReversal, model.RefundMethodB2C)
+	}
+
+	// Refunds are made by the provider that collected the payment
+	provider, err := h.providers.ForOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	payment, err := service.FindSettledPayment(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	if method == model.RefundMethodReversal && (payment.MpesaReceiptNumber == nil || *payment.MpesaReceiptNumber == "") {
+		return nil, fmt.Errorf("payment %d has no %s receipt to reverse", payment.ID, providerLabel(provider.Name()))
+	}
+	token, err := newCallbackToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &model.Refund{
+		OrderID:     order.ID,
+		PaymentID:   payment.ID,
+		Phone:       formatPhoneNumber(order.Phone),
+		Amount:      payment.Amount,
+		Method:      method,
+		Reason:      reason,
+		Automatic:   automatic,
+		RequestedBy: requestedBy,
+		Token:       token,
+	}
+	if err := service.CreateRefund(refund); err != nil {
+		return nil, err
+	}
+
+	remarks := fmt.Sprintf("Refund of order %s", order.OrderNumber)
+	result, err := provider.Refund(order, *payment, method, remarks, token)
+	if err != nil {
+		if _, finishErr := service.FinishRefund(refund, false, -1, err.Error(), ""); finishErr != nil {
+			log.Printf("Failed to record rejected refund %d: %v", refund.ID, finishErr)
+		}
+		return refund, fmt.Errorf("refund of order %s failed: %w", order.OrderNumber, err)
+	}
+	if err := service.MarkRefundSubmitted(refund, result.ConversationID, result.OriginatorConversationID); err != nil {
+		return refund, err
+	}
+	if result.Final {
+		resultCode := 0
+		if !result.Completed {
+			resultCode = 1
+		}
+		if _, err := service.FinishRefund(refund, result.Completed, resultCode, result.ResultDesc, result.TransactionID); err != nil {
+			return refund, err
+		}
+	}
+
+	log.Printf("Refund %d of KES %s for order %s submitted by %s", refund.ID, refund.Amount.StringFixed(0), order.OrderNumber, method)
+	return refund, nil
+}
+
+// RequestRefund refunds the order named in the path. The JSON body may set the
+// method and the reason.
+func (h *MpesaRefundHandler) RequestRefund(c *gin.Context) {
+	var input struct {
+		Method string `json:"method"`
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+			return
+		}
+	}
+	if input.Reason == "" {
+		input.Reason = "Refund requested by an administrator"
+	}
+
+	order, err := service.FindOrderByNumber(c.Param("orderNumber"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestedBy := c.GetString("email")
+	if requestedBy == "" {
+		if authID, ok := c.Get("authID"); ok {
+			requestedBy = fmt.Sprint(authID)
+		}
+	}
+
+	refund, err := h.RefundOrder(*order, input.Method, input.Reason, requestedBy, false)
+	switch {
+	case errors.Is(err, service.ErrRefundExists), errors.Is(err, service.ErrNothingToRefund):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil && refund == nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "refund": refund})
+	default:
+		c.JSON(http.StatusAccepted, refund)
+	}
+}
+
+// HandleTask refunds orders whose provisioning failed longer ago than the
+// configured auto_refund_after and that were not provisioned since.
+func (h *MpesaRefundHandler) HandleTask(ctx context.Context, task *asynq.Task) error {
+	after := h.stk.Config().AutoRefundAfter
+	if after <= 0 {
+		return nil
+	}
+	var payload queue.MpesaAutoRefundPayload
+	if len(task.Payload()) > 0 {
+		if err := json.Unmarshal(task.Payload(), &payload); err != nil {
+			return fmt.Errorf("failed to unmarshal auto refund payload: %w", err)
+		}
+	}
+	limit := payload.Limit
+	if limit <= 0 {
+		limit = DefaultAutoRefundLimit
+	}
+
+	orders, err := service.FindRefundableOrders(time.Now().Add(-after), limit)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, order := range orders {
+		reason := fmt.Sprintf("Automatic refund, provisioning failed: %s", order.ProvisioningError)
+		if _, err := h.RefundOrder(order, "", reason, "system", true); err != nil {
+			log.Printf("Failed to refund order %s: %v", order.OrderNumber, err)
+			failed++
+			continue
+		}
+		if order.Ip != "" && h.wsHub != nil {
+			h.wsHub.SendToIP(order.Ip, []byte(fmt.Sprintf(`{"type":"refund", "status": "submitted", "message": %q}`,
+				"We could not connect you, your payment is being refunded")))
+		}
+	}
+
+	if len(orders) > 0 {
+		log.Printf("M-Pesa automatic refunds: %d orders, %d failed", len(orders), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to refund %d of %d orders", failed, len(orders))
+	}
+	return nil
+}
+
+// MpesaRefundResult records the result of a refund posted by Daraja to the
+// refund result URL. The URL token identifies the refund.
+func (h *MpesaCallbackHandler) MpesaRefundResult(c *gin.Context) {
+	h.finishRefund(c, false)
+}
+
+// MpesaRefundTimeout records a refund that timed out in the M-Pesa queue and
+// was therefore not made. It may be requested again.
+func (h *MpesaCallbackHandler) MpesaRefundTimeout(c *gin.Context) {
+	h.finishRefund(c, true)
+}
+
+func (h *MpesaCallbackHandler) finishRefund(c *gin.Context, timedOut bool) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid M-Pesa result payload."})
+		return
+	}
+	reject := func(reason, details string) {
+		service.RecordCallbackRejection(model.MpesaCallbackRejection{
+			SourceIP: c.ClientIP(),
+			Reason:   reason,
+			Details:  details,
+			Body:     auditBody(body),
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Callback rejected."})
+	}
+	if !h.sourceAllowed(c.ClientIP()) {
+		reject(model.CallbackRejectSourceIP, "sender is not in callback_allowed_ips")
+		return
+	}
+
+	refund, err := service.FindRefundByToken(c.Param("token"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			reject(model.CallbackRejectToken, "refund result token matches no refund")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refund.", "details": err.Error()})
+		return
+	}
+
+	completed, resultCode, resultDesc, transactionID := false, -1, "Request timed out in the M-Pesa queue", ""
+	if !timedOut {
+		result, err := ParseAsyncResult(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse M-Pesa result.", "details": err.Error()})
+			return
+		}
+		if refund.ConversationID != "" && result.ConversationID != refund.ConversationID {
+			reject(model.CallbackRejectToken, fmt.Sprintf("result for conversation %s, refund %d is %s", result.ConversationID, refund.ID, refund.ConversationID))
+			return
+		}
+		completed, resultCode, resultDesc, transactionID = result.ResultCode == 0, result.ResultCode, result.ResultDesc, result.TransactionID
+	}
+
+	updated, err := service.FinishRefund(refund, completed, resultCode, resultDesc, transactionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund result.", "details": err.Error()})
+		return
+	}
+	if updated {
+		log.Printf("Refund %d of order %d %s: %s", refund.ID, refund.OrderID, refund.Status, resultDesc)
+	}
+	c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
+
+// GetRefunds lists refunds, newest first, filtered by the status query
+// parameter and paginated like GetOrders.
+func GetRefunds(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	query := tx.Model(&model.Refund{})
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case model.RefundStatusRequested, model.RefundStatusSubmitted, model.RefundStatusCompleted, model.RefundStatusFailed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be requested, submitted, completed or failed"})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count refunds"})
+		return
+	}
+	var refunds []model.Refund
+	if err := query.Session(&gorm.Session{}).Order("id DESC").Offset(offset).Limit(limit).Find(&refunds).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve refunds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": refunds,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
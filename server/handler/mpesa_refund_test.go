@@ -0,0 +1,138 @@
+package handler_test
+
+import (
+	"testing"
+
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+	"github.com/shopspring/decimal"
+)
+
+func newRefundHandler(daraja *darajatest.Server) *handler.MpesaStkHandler {
+	h := newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")
+	cfg := h.Config()
+	cfg.InitiatorName = "testapi"
+	cfg.SecurityCredential = "credential"
+	cfg.RefundResultURL = "https://example.com/api/v1/mpesa/refunds/result"
+	cfg.RefundTimeoutURL = "https://example.com/api/v1/mpesa/refunds/timeout"
+	return h
+}
+
+func TestSendB2CPayment(t *testing.T) {
+	daraja := darajatest.NewServer()
+	daraja.AutoCallback = false
+	defer daraja.Close()
+
+	h := newRefundHandler(daraja)
+	res, err := h.SendB2CPayment("0712345678", decimal.NewFromFloat(49.5), "Refund of order 1", "tok")
+	if err != nil {
+		t.Fatalf("SendB2CPayment() error = %v", err)
+	}
+
+	refunds := daraja.Refunds()
+	if len(refunds) != 1 {
+		t.Fatalf("refund requests = %d, want 1", len(refunds))
+	}
+	got := refunds[0]
+	if res.ConversationID != got.ConversationID || res.ResponseCode != "0" {
+		t.Errorf("SendB2CPayment() = %+v, want ConversationID %s", res, got.ConversationID)
+	}
+	if got.CommandID != "BusinessPayment" || got.PartyB != "254712345678" || got.Amount != "50" || got.PartyA != daraja.Shortcode {
+		t.Errorf("request = %+v, want 50 paid from %s to 254712345678", got, daraja.Shortcode)
+	}
+	if got.InitiatorName != "testapi" || got.SecurityCredential != "credential" {
+		t.Errorf("request initiator = %q/%q, want the configured initiator", got.InitiatorName, got.SecurityCredential)
+	}
+	if got.ResultURL != "https://example.com/api/v1/mpesa/refunds/result/tok" ||
+		got.QueueTimeOutURL != "https://example.com/api/v1/mpesa/refunds/timeout/tok" {
+		t.Errorf("request URLs = %q, %q, want the token appended", got.ResultURL, got.QueueTimeOutURL)
+	}
+}
+
+func TestReverseTransaction(t *testing.T) {
+	daraja := darajatest.NewServer()
+	daraja.AutoCallback = false
+	defer daraja.Close()
+
+	h := newRefundHandler(daraja)
+	if _, err := h.ReverseTransaction("TST123ABC", decimal.NewFromInt(10), "Refund of order 1", "tok"); err != nil {
+		t.Fatalf("ReverseTransaction() error = %v", err)
+	}
+
+	refunds := daraja.Refunds()
+	if len(refunds) != 1 {
+		t.Fatalf("refund requests = %d, want 1", len(refunds))
+	}
+	got := refunds[0]
+	if got.CommandID != "TransactionReversal" || got.TransactionID != "TST123ABC" || got.Amount != "10" || got.Initiator != "testapi" {
+		t.Errorf("request = %+v, want TST123ABC reversed by testapi", got)
+	}
+}
+
+func TestRefundRequiresInitiator(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	h := newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")
+	if _, err := h.SendB2CPayment("0712345678", decimal.NewFromInt(10), "Refund", "tok"); err == nil {
+		t.Error("SendB2CPayment() succeeded without an initiator, want an error")
+	}
+	if _, err := h.ReverseTransaction("TST123ABC", decimal.NewFromInt(10), "Refund", "tok"); err == nil {
+		t.Error("ReverseTransaction() succeeded without an initiator, want an error")
+	}
+	if n := len(daraja.Refunds()); n != 0 {
+		t.Errorf("refund requests = %d, want none", n)
+	}
+}
+
+func TestParseAsyncResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantErr  bool
+	}{
+		{
+			name:     "numeric codes",
+			body:     `{"Result":{"ResultType":0,"ResultCode":0,"ResultDesc":"ok","ConversationID":"AG_1","TransactionID":"RTX1"}}`,
+			wantCode: 0,
+		},
+		{
+			name:     "string codes",
+			body:     `{"Result":{"ResultType":"0","ResultCode":"2001","ResultDesc":"The initiator information is invalid.","ConversationID":"AG_1"}}`,
+			wantCode: 2001,
+		},
+		{name: "no result", body: `{"Body":{}}`, wantErr: true},
+		{name: "bad code", body: `{"Result":{"ResultCode":"x"}}`, wantErr: true},
+		{name: "not json", body: `nope`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := handler.ParseAsyncResult([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseAsyncResult() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAsyncResult() error = %v", err)
+			}
+			if got.ResultCode != tt.wantCode || got.ConversationID != "AG_1" {
+				t.Errorf("ParseAsyncResult() = %+v, want code %d for AG_1", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRefundResultBodyParses(t *testing.T) {
+	req := darajatest.RefundRequest{ConversationID: "AG_1", OriginatorConversationID: "1-1-1"}
+	got, err := handler.ParseAsyncResult(darajatest.RefundResultBody(req, darajatest.ResultSuccess))
+	if err != nil {
+		t.Fatalf("ParseAsyncResult() error = %v", err)
+	}
+	if got.ResultCode != 0 || got.ConversationID != "AG_1" || got.TransactionID == "" {
+		t.Errorf("ParseAsyncResult() = %+v, want a completed result for AG_1", got)
+	}
+}
@@ -3,15 +3,20 @@ package handler
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mediocregopher/radix/v4"
+	"gorm.io/gorm"
 
 	gconfig "github.com/ortupik/wifigo/config"
 	gdatabase "github.com/ortupik/wifigo/database"
@@ -19,8 +24,25 @@ import (
 	"github.com/ortupik/wifigo/server/database/model"
 )
 
+// DarajaLiveURL is the production Safaricom Daraja API host
+const DarajaLiveURL = "https://api.safaricom.co.ke"
+
+// Daraja API paths, relative to the base URL
+const (
+	darajaOAuthPath    = "/oauth/v1/generate?grant_type=client_credentials"
+	darajaStkPushPath  = "/mpesa/stkpush/v1/processrequest"
+	darajaStkQueryPath = "/mpesa/stkpushquery/v1/query"
+	darajaC2BRegister  = "/mpesa/c2b/v1/registerurl"
+	darajaB2CPath      = "/mpesa/b2c/v1/paymentrequest"
+	darajaReversalPath = "/mpesa/reversal/v1/request"
+)
+
+// accessTokenTTL is kept below Daraja's one hour token lifetime
+const accessTokenTTL = 55 * time.Minute
+
 // MpesaConfig holds the general M-Pesa configuration loaded from Viper.
 type MpesaConfig struct {
+	BaseURL          string `mapstructure:"base_url"` // Daraja API host, defaults to the environment's host
 	Shortcode        string `mapstructure:"short_code"`
 	Passkey          string `mapstructure:"passkey"`
 	CallbackURL      string `mapstructure:"callback_url"`
@@ -31,6 +53,36 @@ type MpesaConfig struct {
 	TransactionType  string `mapstructure:"transaction_type"`
 	AccountReference string `mapstructure:"account_reference"`
 	TransactionDesc  string `mapstructure:"transaction_desc"`
+
+	// CallbackAllowedIPs restricts callbacks to these addresses or CIDR ranges; empty allows any sender
+	CallbackAllowedIPs []string `mapstructure:"callback_allowed_ips"`
+
+	// C2B payments made to the short code without an STK push, see RegisterC2BURLs
+	C2BConfirmationURL string `mapstructure:"c2b_confirmation_url"`
+	C2BValidationURL   string `mapstructure:"c2b_validation_url"`
+	C2BResponseType    string `mapstructure:"c2b_response_type"` // What M-Pesa does when validation is unreachable, Completed or Cancelled
+	C2BURLToken        string `mapstructure:"c2b_url_token"`     // Appended to both URLs and required on incoming requests when set
+
+	// Refunds through transaction reversals and B2C payouts, made by the initiator
+	InitiatorName      string        `mapstructure:"initiator_name"`
+	SecurityCredential string        `mapstructure:"security_credential"` // Initiator password encrypted with Safaricom's certificate
+	B2CShortcode       string        `mapstructure:"b2c_short_code"`      // Pays B2C refunds, defaults to short_code
+	RefundMethod       string        `mapstructure:"refund_method"`       // reversal (default) or b2c
+	RefundResultURL    string        `mapstructure:"refund_result_url"`
+	RefundTimeoutURL   string        `mapstructure:"refund_timeout_url"`
+	AutoRefundAfter    time.Duration `mapstructure:"auto_refund_after"` // Refund orders whose provisioning failed this long ago, 0 disables
+
+	Sandbox MpesaCredentials `mapstructure:"sandbox"`
+	Live    MpesaCredentials `mapstructure:"live"`
+}
+
+// APIURL returns the Daraja URL for path
+func (c *MpesaConfig) APIURL(path string) string {
+	base := strings.TrimRight(c.BaseURL, "/")
+	if base == "" {
+		base = DarajaLiveURL
+	}
+	return base + path
 }
 
 // NewMpesaStkHandler creates a new MpesaStkHandler with its dependencies.
@@ -39,14 +91,49 @@ func NewMpesaStkHandler() (*MpesaStkHandler, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load Mpesa config: %w", err)
 	}
+	serverEnv := gconfig.GetConfig().Server.ServerEnv
+	if err := mpesaConfig.Validate(serverEnv); err != nil {
+		return nil, err
+	}
+	h := NewMpesaStkHandlerWithConfig(mpesaConfig)
+	h.serverEnv = serverEnv
+	return h, nil
+}
+
+// NewMpesaStkHandlerWithConfig creates a MpesaStkHandler for the given configuration.
+func NewMpesaStkHandlerWithConfig(mpesaConfig *MpesaConfig) *MpesaStkHandler {
 	return &MpesaStkHandler{
 		mpesaConfig: mpesaConfig,
-	}, nil
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		tokens:      &tokenCache{tokens: make(map[string]cachedToken)},
+	}
 }
 
 // MpesaStkHandler will contain dependencies for M-Pesa related logic.
 type MpesaStkHandler struct {
 	mpesaConfig *MpesaConfig
+	httpClient  *http.Client
+	serverEnv   string            // APP_ENV the ISP accounts are validated against
+	accounts    MpesaAccountStore // Per ISP accounts, see ForISP
+
+	// Token cache used when Redis is not activated, shared with the ISP handlers
+	tokens *tokenCache
+}
+
+// tokenCache holds access tokens by credential set, see MpesaConfig.tokenKey
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// Config returns the handler's M-Pesa configuration.
+func (h *MpesaStkHandler) Config() *MpesaConfig {
+	return h.mpesaConfig
 }
 
 func LoadMpesaConfig() (*MpesaConfig, error) {
@@ -58,39 +145,85 @@ func LoadMpesaConfig() (*MpesaConfig, error) {
 	if err := sub.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal mpesa config: %w", err)
 	}
+	if err := config.Resolve(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
+// tokenKey is the cache key of the access token for these credentials, so
+// that every ISP's account gets its own token
+func (c *MpesaConfig) tokenKey() string {
+	sum := sha256.Sum256([]byte(c.APIURL("") + "|" + c.ConsumerKey))
+	return "mpesa:access_token:" + hex.EncodeToString(sum[:8])
+}
+
 // GetAccessToken retrieves the M-Pesa access token from Redis, or fetches a new one if expired.
+// Without Redis the token is cached in memory. Tokens are cached per credential set.
 func (h *MpesaStkHandler) GetAccessToken() (string, error) {
+	key := h.mpesaConfig.tokenKey()
+	if gdatabase.GetRedis() == nil {
+		h.tokens.mu.Lock()
+		defer h.tokens.mu.Unlock()
+
+		if cached, ok := h.tokens.tokens[key]; ok && time.Now().Before(cached.expiry) {
+			return cached.token, nil
+		}
+		token, err := h.fetchAccessToken()
+		if err != nil {
+			return "", err
+		}
+		h.tokens.tokens[key] = cachedToken{token: token, expiry: time.Now().Add(accessTokenTTL)}
+		return token, nil
+	}
+
 	redisClient := *gdatabase.GetRedis()
 	rConnTTL := gconfig.GetConfig().Database.REDIS.Conn.ConnTTL
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rConnTTL)*time.Second)
 	defer cancel()
 
 	var token string
-	err := redisClient.Do(ctx, radix.Cmd(&token, "GET", "mpesa:access_token"))
+	err := redisClient.Do(ctx, radix.Cmd(&token, "GET", key))
 	if err == nil && token != "" {
 		return token, nil
 	}
 
+	token, err = h.fetchAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = redisClient.Do(ctx, radix.Cmd(nil, "SETEX", key, strconv.Itoa(int(accessTokenTTL.Seconds())), token))
+	if err != nil {
+		return "", fmt.Errorf("failed to save M-Pesa access token to Redis with TTL: %w", err)
+	}
+
+	return token, nil
+}
+
+// fetchAccessToken requests a new OAuth access token from Daraja.
+func (h *MpesaStkHandler) fetchAccessToken() (string, error) {
 	consumerKey := h.mpesaConfig.ConsumerKey
 	consumerSecret := h.mpesaConfig.ConsumerSecret
 	basicAuth := base64.StdEncoding.EncodeToString([]byte(consumerKey + ":" + consumerSecret))
 
-	req, err := http.NewRequest("GET", "https://api.safaricom.co.ke/oauth/v1/generate?grant_type=client_credentials", nil)
+	req, err := http.NewRequest("GET", h.mpesaConfig.APIURL(darajaOAuthPath), nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create M-Pesa access token request: %w", err)
 	}
 	req.Header.Set("Authorization", "Basic "+basicAuth)
 
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
+	resp, err := h.httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch new M-Pesa access token: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("M-Pesa access token request failed with status %d: %s", resp.StatusCode, body)
+	}
+
 	var tokenResp struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   string `json:"expires_in"`
@@ -100,90 +233,201 @@ func (h *MpesaStkHandler) GetAccessToken() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to decode M-Pesa access token response: %w", err)
 	}
-
-	expiresIn := time.Minute * 55
-	err = redisClient.Do(ctx, radix.Cmd(nil, "SETEX", "mpesa:access_token", strconv.Itoa(int(expiresIn.Seconds())), tokenResp.AccessToken))
-	if err != nil {
-		return "", fmt.Errorf("failed to save M-Pesa access token to Redis with TTL: %w", err)
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("M-Pesa access token response has no token")
 	}
 
 	return tokenResp.AccessToken, nil
 }
 
-// SendStkPush sends the STK push request to M-Pesa.
+// SendStkPush sends the STK push request to M-Pesa. Every push gets its own
+// callback token, appended to the CallBackURL and returned under
+// StkCallbackTokenKey, which the order must store to accept the callback.
 func (h *MpesaStkHandler) SendStkPush(phone, amount string) (map[string]interface{}, error) {
+	return h.sendStkPush(phone, amount, "")
+}
+
+// sendStkPush is SendStkPush with the callback token of an order that was
+// stored before its push, a new token is generated when it is empty
+func (h *MpesaStkHandler) sendStkPush(phone, amount, callbackToken string) (map[string]interface{}, error) {
 	accessToken, err := h.GetAccessToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get access token: %w", err)
 	}
+	if callbackToken == "" {
+		if callbackToken, err = newCallbackToken(); err != nil {
+			return nil, err
+		}
+	}
 
+	timestamp := time.Now().Format("20060102150405")
 	payload := map[string]interface{}{
 		"BusinessShortCode": h.mpesaConfig.Shortcode,
-		"Password":          generatePassword(h.mpesaConfig.Shortcode, h.mpesaConfig.Passkey, time.Now().Format("20060102150405")),
-		"Timestamp":         time.Now().Format("20060102150405"),
+		"Password":          generatePassword(h.mpesaConfig.Shortcode, h.mpesaConfig.Passkey, timestamp),
+		"Timestamp":         timestamp,
 		"TransactionType":   h.mpesaConfig.TransactionType,
 		"Amount":            amount,
 		"PartyA":            phone,
 		"PartyB":            h.mpesaConfig.TillNo,
 		"PhoneNumber":       formatPhoneNumber(phone),
-		"CallBackURL":       h.mpesaConfig.CallbackURL,
+		"CallBackURL":       callbackURLWithToken(h.mpesaConfig.CallbackURL, callbackToken),
 		"AccountReference":  h.mpesaConfig.AccountReference,
 		"TransactionDesc":   h.mpesaConfig.TransactionDesc,
 	}
-	payloadBytes, err := json.Marshal(payload)
+	stkResponse, err := h.postJSON(darajaStkPushPath, accessToken, payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal STK push payload: %w", err)
+		return stkResponse, fmt.Errorf("STK push request failed: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", "https://api.safaricom.co.ke/mpesa/stkpush/v1/processrequest", bytes.NewBuffer(payloadBytes))
+	stkResponse[StkCallbackTokenKey] = callbackToken
+	return stkResponse, nil
+}
+
+// StkQueryResult is Daraja's answer to an STK push status query
+type StkQueryResult struct {
+	ResponseCode        string
+	ResponseDescription string
+	MerchantRequestID   string
+	CheckoutRequestID   string
+	ResultCode          string
+	ResultDesc          string
+
+	// Set instead of the fields above when Daraja rejects the query
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// stkQueryProcessingCode is returned while the customer has not answered the prompt
+const stkQueryProcessingCode = "500.001.1001"
+
+// Processing reports whether the payment is still awaiting the customer
+func (r *StkQueryResult) Processing() bool {
+	return r.ErrorCode == stkQueryProcessingCode
+}
+
+// Completed reports whether Safaricom returned a final result for the payment
+func (r *StkQueryResult) Completed() bool {
+	return r.ErrorCode == "" && r.ResponseCode == "0" && r.ResultCode != ""
+}
+
+// Paid reports whether the payment completed successfully
+func (r *StkQueryResult) Paid() bool {
+	return r.Completed() && r.ResultCode == "0"
+}
+
+// QueryStkPush asks Daraja for the result of the STK push with the given CheckoutRequestID
+func (h *MpesaStkHandler) QueryStkPush(checkoutRequestID string) (*StkQueryResult, error) {
+	accessToken, err := h.GetAccessToken()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create STK push request: %w", err)
+		return nil, fmt.Errorf("failed to get access token: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	timestamp := time.Now().Format("20060102150405")
+	payload := map[string]interface{}{
+		"BusinessShortCode": h.mpesaConfig.Shortcode,
+		"Password":          generatePassword(h.mpesaConfig.Shortcode, h.mpesaConfig.Passkey, timestamp),
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": checkoutRequestID,
+	}
+	response, err := h.postJSON(darajaStkQueryPath, accessToken, payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send STK push request: %w", err)
+		return nil, fmt.Errorf("STK push query failed: %w", err)
 	}
-	defer resp.Body.Close()
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	field := func(key string) string {
+		if v, ok := response[key]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	result := &StkQueryResult{
+		ResponseCode:        field("ResponseCode"),
+		ResponseDescription: field("ResponseDescription"),
+		MerchantRequestID:   field("MerchantRequestID"),
+		CheckoutRequestID:   field("CheckoutRequestID"),
+		ResultCode:          field("ResultCode"),
+		ResultDesc:          field("ResultDesc"),
+		ErrorCode:           field("errorCode"),
+		ErrorMessage:        field("errorMessage"),
+	}
+	if result.ErrorCode != "" && !result.Processing() {
+		return result, fmt.Errorf("STK push query rejected: %s %s", result.ErrorCode, result.ErrorMessage)
+	}
+	return result, nil
+}
+
+// postJSON posts payload to a Daraja endpoint and decodes the JSON response.
+// A rejected access token is refreshed once and the request retried.
+func (h *MpesaStkHandler) postJSON(path, accessToken string, payload interface{}) (map[string]interface{}, error) {
+	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read STK push response body: %w", err)
+		return nil, fmt.Errorf("failed to marshal request payload: %w", err)
 	}
 
-	var stkResponse map[string]interface{}
-	if err := json.Unmarshal(responseBody, &stkResponse); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal STK push response: %w", err)
+	send := func(token string) (*http.Response, map[string]interface{}, error) {
+		req, err := http.NewRequest("POST", h.mpesaConfig.APIURL(path), bytes.NewReader(payloadBytes))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := h.httpClient.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		responseBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(responseBody, &response); err != nil {
+			return resp, nil, fmt.Errorf("failed to unmarshal response (status %d): %w", resp.StatusCode, err)
+		}
+		return resp, response, nil
+	}
+
+	resp, response, err := send(accessToken)
+	if err != nil {
+		return nil, err
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized || (stkResponse["errorCode"] != nil && stkResponse["errorCode"].(string) == "invalid_access_token") {
+	if resp.StatusCode == http.StatusUnauthorized || fmt.Sprint(response["errorCode"]) == "404.001.03" || response["errorCode"] == "invalid_access_token" {
 		fmt.Println("Safaricom rejected the access token. Refreshing...")
 		if err := h.forceAccessTokenRefresh(); err != nil {
 			fmt.Printf("Failed to force access token refresh: %v\n", err)
-			return stkResponse, fmt.Errorf("authentication error and failed to refresh token: %w", err)
+			return response, fmt.Errorf("authentication error and failed to refresh token: %w", err)
 		}
-		// Retry the STK push with the new token (recursive call or re-executing the logic)
 		newAccessToken, err := h.GetAccessToken()
 		if err != nil {
 			return nil, fmt.Errorf("failed to get new access token after refresh: %w", err)
 		}
-		req.Header.Set("Authorization", "Bearer "+newAccessToken)
-		resp, err = client.Do(req) // Retry the request
-		// ... process the response of the retry ...
+		_, response, err = send(newAccessToken)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return stkResponse, nil
+	return response, nil
 }
 
 func (h *MpesaStkHandler) forceAccessTokenRefresh() error {
+	key := h.mpesaConfig.tokenKey()
+	if gdatabase.GetRedis() == nil {
+		h.tokens.mu.Lock()
+		delete(h.tokens.tokens, key)
+		h.tokens.mu.Unlock()
+		return nil
+	}
+
 	redisClient := *gdatabase.GetRedis()
 	rConnTTL := gconfig.GetConfig().Database.REDIS.Conn.ConnTTL
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rConnTTL)*time.Second)
 	defer cancel()
-	err := redisClient.Do(ctx, radix.Cmd(nil, "DEL", "mpesa:access_token"))
+	err := redisClient.Do(ctx, radix.Cmd(nil, "DEL", key))
 	return err
 }
 
@@ -194,6 +438,29 @@ func (h *MpesaStkHandler) GetServicePlan(planId int) (model.ServicePlan, error)
 	return plan, result.Error
 }
 
+// GetISP returns the ISP with the given ID
+func (h *MpesaStkHandler) GetISP(ispID int64) (model.ISP, error) {
+	var isp model.ISP
+	db := gdatabase.GetDB(gconfig.AppDB)
+	result := db.First(&isp, "id = ?", ispID)
+	return isp, result.Error
+}
+
+// GetCheckoutISP returns the ISP selling plan: the plan's own, or ispID for
+// plans that belong to no ISP. It returns gorm.ErrRecordNotFound when there
+// is neither.
+func (h *MpesaStkHandler) GetCheckoutISP(plan model.ServicePlan, ispID string) (model.ISP, error) {
+	id := plan.ISPID
+	if id == 0 {
+		parsed, err := strconv.ParseInt(ispID, 10, 64)
+		if err != nil {
+			return model.ISP{}, gorm.ErrRecordNotFound
+		}
+		id = parsed
+	}
+	return h.GetISP(id)
+}
+
 func generatePassword(shortcode, passkey string, timestamp string) string {
 	password := fmt.Sprintf("%s%s%s", shortcode, passkey, timestamp)
 	encoded := base64.StdEncoding.EncodeToString([]byte(password))
@@ -0,0 +1,334 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+)
+
+func newStkHandler(daraja *darajatest.Server, callbackURL string) *handler.MpesaStkHandler {
+	return handler.NewMpesaStkHandlerWithConfig(&handler.MpesaConfig{
+		BaseURL:          daraja.URL,
+		Shortcode:        daraja.Shortcode,
+		Passkey:          daraja.Passkey,
+		ConsumerKey:      daraja.ConsumerKey,
+		ConsumerSecret:   daraja.ConsumerSecret,
+		CallbackURL:      callbackURL,
+		TillNo:           "3192988",
+		TransactionType:  "CustomerBuyGoodsOnline",
+		AccountReference: "Test Hotspot",
+		TransactionDesc:  "Wifi Payment",
+	})
+}
+
+func TestMpesaConfigAPIURL(t *testing.T) {
+	cfg := &handler.MpesaConfig{}
+	if got := cfg.APIURL("/oauth/v1/generate"); got != handler.DarajaLiveURL+"/oauth/v1/generate" {
+		t.Errorf("APIURL() = %q, want the live host by default", got)
+	}
+
+	cfg.BaseURL = "http://127.0.0.1:9000/"
+	if got := cfg.APIURL("/mpesa/stkpush/v1/processrequest"); got != "http://127.0.0.1:9000/mpesa/stkpush/v1/processrequest" {
+		t.Errorf("APIURL() = %q, want the configured host", got)
+	}
+}
+
+func TestSendStkPush(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	daraja.AutoCallback = false
+
+	h := newStkHandler(daraja, "http://127.0.0.1:1/api/v1/mpesa/callback")
+
+	for i := 0; i < 2; i++ {
+		res, err := h.SendStkPush("0712345678", "50")
+		if err != nil {
+			t.Fatalf("SendStkPush() error = %v", err)
+		}
+		if res["ResponseCode"] != "0" || res["CheckoutRequestID"] == "" {
+			t.Fatalf("SendStkPush() = %v, want an accepted request", res)
+		}
+	}
+
+	if got := daraja.TokenRequests(); got != 1 {
+		t.Errorf("token requests = %d, want the token cached across pushes", got)
+	}
+
+	pushes := daraja.Pushes()
+	if len(pushes) != 2 {
+		t.Fatalf("pushes = %d, want 2", len(pushes))
+	}
+	push := pushes[0]
+	if push.PhoneNumber != "254712345678" || push.Amount != "50" || push.PartyB != "3192988" {
+		t.Errorf("push = %+v, want the formatted phone, amount and till", push)
+	}
+	wantPassword := base64.StdEncoding.EncodeToString([]byte(daraja.Shortcode + daraja.Passkey + push.Timestamp))
+	if push.Password != wantPassword {
+		t.Errorf("push password = %q, want %q", push.Password, wantPassword)
+	}
+}
+
+func TestSendStkPushEmbedsCallbackToken(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	daraja.AutoCallback = false
+
+	h := newStkHandler(daraja, "https://hotspot.example.com/api/v1/mpesa/callback/")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		res, err := h.SendStkPush("0712345678", "50")
+		if err != nil {
+			t.Fatalf("SendStkPush() error = %v", err)
+		}
+		token, _ := res[handler.StkCallbackTokenKey].(string)
+		if len(token) < 32 || seen[token] {
+			t.Fatalf("callback token = %q, want a fresh unguessable token", token)
+		}
+		seen[token] = true
+
+		push := daraja.Pushes()[i]
+		if want := "https://hotspot.example.com/api/v1/mpesa/callback/" + token; push.CallBackURL != want {
+			t.Errorf("CallBackURL = %q, want %q", push.CallBackURL, want)
+		}
+	}
+}
+
+func TestSendStkPushRefreshesRejectedToken(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	daraja.AutoCallback = false
+
+	h := newStkHandler(daraja, "http://127.0.0.1:1/api/v1/mpesa/callback")
+	if _, err := h.SendStkPush("0712345678", "50"); err != nil {
+		t.Fatalf("SendStkPush() error = %v", err)
+	}
+
+	daraja.ExpireTokens()
+	res, err := h.SendStkPush("0712345678", "50")
+	if err != nil {
+		t.Fatalf("SendStkPush() after the token expired error = %v", err)
+	}
+	if res["ResponseCode"] != "0" {
+		t.Errorf("SendStkPush() = %v, want the retried request accepted", res)
+	}
+	if got := daraja.TokenRequests(); got != 2 {
+		t.Errorf("token requests = %d, want a refresh after the rejection", got)
+	}
+}
+
+func TestGetAccessTokenRejectsBadCredentials(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	h := newStkHandler(daraja, "")
+	h.Config().ConsumerSecret = "wrong"
+
+	if _, err := h.GetAccessToken(); err == nil {
+		t.Fatal("GetAccessToken() with a wrong secret succeeded")
+	}
+	if _, err := h.SendStkPush("0712345678", "50"); err == nil {
+		t.Fatal("SendStkPush() without a token succeeded")
+	}
+}
+
+func TestQueryStkPush(t *testing.T) {
+	tests := []struct {
+		name           string
+		result         darajatest.Result
+		wantPaid       bool
+		wantCompleted  bool
+		wantProcessing bool
+	}{
+		{name: "paid", result: darajatest.ResultSuccess, wantPaid: true, wantCompleted: true},
+		{name: "cancelled", result: darajatest.ResultCancelled, wantCompleted: true},
+		{name: "unreachable", result: darajatest.ResultUnreachable, wantCompleted: true},
+		{name: "awaiting the customer", result: darajatest.ResultPending, wantProcessing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daraja := darajatest.NewServer()
+			defer daraja.Close()
+			daraja.AutoCallback = false
+			daraja.SetResult("254712345678", tt.result)
+
+			h := newStkHandler(daraja, "http://127.0.0.1:1/api/v1/mpesa/callback")
+			push, err := h.SendStkPush("0712345678", "50")
+			if err != nil {
+				t.Fatalf("SendStkPush() error = %v", err)
+			}
+			checkoutID := push["CheckoutRequestID"].(string)
+
+			got, err := h.QueryStkPush(checkoutID)
+			if err != nil {
+				t.Fatalf("QueryStkPush() error = %v", err)
+			}
+			if got.Paid() != tt.wantPaid || got.Completed() != tt.wantCompleted || got.Processing() != tt.wantProcessing {
+				t.Errorf("QueryStkPush() = %+v, paid %v completed %v processing %v", got, got.Paid(), got.Completed(), got.Processing())
+			}
+			if tt.wantCompleted && (got.CheckoutRequestID != checkoutID || got.ResultDesc != tt.result.ResultDesc) {
+				t.Errorf("QueryStkPush() = %+v, want the result of %s", got, checkoutID)
+			}
+		})
+	}
+}
+
+func TestQueryStkPushUnknownRequest(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	h := newStkHandler(daraja, "")
+	got, err := h.QueryStkPush("ws_CO_unknown")
+	if err == nil {
+		t.Fatalf("QueryStkPush() of an unknown request = %+v, want an error", got)
+	}
+	if got == nil || got.ErrorCode == "" {
+		t.Errorf("QueryStkPush() = %+v, want Daraja's error code", got)
+	}
+}
+
+func TestStkCallbackRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mu sync.Mutex
+	received := make(map[string]*model.MpesaCallbackPayload)
+	tokens := make(map[string]string)
+
+	r := gin.New()
+	r.POST("/api/v1/mpesa/callback/:token", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		payload, err := handler.ParseCallback(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		mu.Lock()
+		received[payload.CheckoutRequestID] = payload
+		tokens[payload.CheckoutRequestID] = c.Param("token")
+		mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	app := httptest.NewServer(r)
+	defer app.Close()
+
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	daraja.SetResult("254700000001", darajatest.ResultCancelled)
+
+	h := newStkHandler(daraja, app.URL+"/api/v1/mpesa/callback")
+	paid, err := h.SendStkPush("0712345678", "100")
+	if err != nil {
+		t.Fatalf("SendStkPush() error = %v", err)
+	}
+	cancelled, err := h.SendStkPush("0700000001", "100")
+	if err != nil {
+		t.Fatalf("SendStkPush() error = %v", err)
+	}
+
+	callbacks := daraja.WaitCallbacks(2, 5*time.Second)
+	if len(callbacks) != 2 {
+		t.Fatalf("callbacks delivered = %d, want 2", len(callbacks))
+	}
+	for _, cb := range callbacks {
+		if cb.Err != nil || cb.StatusCode != http.StatusOK {
+			t.Errorf("callback %s = %+v, want it accepted", cb.CheckoutRequestID, cb)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	got := received[paid["CheckoutRequestID"].(string)]
+	if got == nil {
+		t.Fatal("no callback received for the paid push")
+	}
+	if got.ResultCode != 0 || got.Amount.IntPart() != 100 || got.PhoneNumber != "254712345678" || !strings.HasPrefix(got.MpesaReceiptNumber, "TST") {
+		t.Errorf("paid callback = %+v, want amount, phone and receipt", got)
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05", got.TransactionDate); err != nil {
+		t.Errorf("TransactionDate = %q, want it normalised: %v", got.TransactionDate, err)
+	}
+	if token := tokens[got.CheckoutRequestID]; token == "" || token != paid[handler.StkCallbackTokenKey] {
+		t.Errorf("callback token = %q, want the push's token %v", token, paid[handler.StkCallbackTokenKey])
+	}
+
+	got = received[cancelled["CheckoutRequestID"].(string)]
+	if got == nil {
+		t.Fatal("no callback received for the cancelled push")
+	}
+	if got.ResultCode != darajatest.ResultCancelled.ResultCode || got.MpesaReceiptNumber != "" {
+		t.Errorf("cancelled callback = %+v, want result code 1032 and no receipt", got)
+	}
+}
+
+func TestMpesaStkHandlerCallbackSourceAllowlist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    int
+	}{
+		{name: "no allowlist", sources: nil, want: http.StatusBadRequest},
+		{name: "allowed range", sources: []string{"192.0.2.0/24"}, want: http.StatusBadRequest},
+		{name: "allowed address", sources: []string{"196.201.214.200", "192.0.2.1"}, want: http.StatusBadRequest},
+		{name: "other sender", sources: []string{"196.201.214.200", "196.201.212.0/24"}, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callbacks := handler.NewMpesaCallbackHandler(nil, nil)
+			if err := callbacks.AllowSources(tt.sources); err != nil {
+				t.Fatalf("AllowSources() error = %v", err)
+			}
+			r := gin.New()
+			r.POST("/api/v1/mpesa/callback/:token", callbacks.MpesaStkHandlerCallback)
+
+			// httptest requests come from 192.0.2.1; an unparsable body shows the sender got past the allowlist
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/mpesa/callback/abc", strings.NewReader("not json"))
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("callback returned %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowSourcesRejectsInvalidEntries(t *testing.T) {
+	for _, source := range []string{"safaricom", "196.201.214.300", "196.201.214.0/33"} {
+		if err := handler.NewMpesaCallbackHandler(nil, nil).AllowSources([]string{source}); err == nil {
+			t.Errorf("AllowSources(%q) succeeded, want an error", source)
+		}
+	}
+}
+
+func TestMpesaStkHandlerCallbackRejectsInvalidPayload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/api/v1/mpesa/callback", handler.NewMpesaCallbackHandler(nil, nil).MpesaStkHandlerCallback)
+
+	for _, body := range []string{"not json", `{"Body": 5}`} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/mpesa/callback", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("callback with body %q returned %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
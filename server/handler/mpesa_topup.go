@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// UseStkHandler lets the callback handler send top-up STK pushes for underpaid
+// orders. Without it an underpaid order stays partially paid.
+func (h *MpesaCallbackHandler) UseStkHandler(stk *MpesaStkHandler) {
+	h.providers = NewPaymentProviders(NewMpesaProvider(stk))
+}
+
+// requestTopUp asks the customer for the rest of an underpaid order. The top-up
+// is a new order for the remaining amount, linked to the underpaid one, so its
+// callback settles and provisions the subscription like any other order.
+func (h *MpesaCallbackHandler) requestTopUp(order model.Order, paid decimal.Decimal) {
+	remaining := decimal.NewFromInt(int64(order.Amount)).Sub(paid).Ceil()
+	if h.providers == nil {
+		log.Printf("Order %s is short of KES %s and no payment provider is set for top-ups", order.OrderNumber, remaining)
+		return
+	}
+
+	parentID := order.ID
+	topUp := model.Order{
+		OrderNumber:   fmt.Sprintf("%s-T%d", order.OrderNumber, time.Now().Unix()),
+		Status:        model.OrderStatusPending,
+		Amount:        int(remaining.IntPart()),
+		Username:      order.Username,
+		Ip:            order.Ip,
+		DnsName:       order.DnsName,
+		Mac:           order.Mac,
+		Phone:         order.Phone,
+		ISP:           order.ISP,
+		Zone:          order.Zone,
+		DeviceID:      order.DeviceID,
+		IsHomeUser:    order.IsHomeUser,
+		Devices:       order.Devices,
+		ServicePlanID: order.ServicePlanID,
+		ParentOrderID: &parentID,
+	}
+
+	// The rest is requested from the provider the customer paid with
+	provider, err := h.providers.ForOrder(order)
+	if err != nil {
+		log.Printf("Failed to send top-up of KES %s for order %s: %v", remaining, order.OrderNumber, err)
+		h.notify(order.Ip, fmt.Sprintf(`{"type":"payment", "status": "partial", "message": %q}`,
+			fmt.Sprintf("Received KES %s of KES %d, please pay the remaining KES %s", paid.StringFixed(0), order.Amount, remaining)))
+		return
+	}
+	topUp.Provider = provider.Name()
+
+	// The order is stored before the push so that its callback always finds
+	// it. An M-Pesa push carries the stored token, which matches a callback
+	// arriving before the push returns to the order.
+	if topUp.Provider == model.PaymentProviderMpesa {
+		if topUp.CallbackToken, err = newCallbackToken(); err != nil {
+			log.Printf("Failed to create top-up order for %s: %v", order.OrderNumber, err)
+			return
+		}
+	}
+	db := gdatabase.GetDB(config.AppDB)
+	if err := db.Create(&topUp).Error; err != nil {
+		log.Printf("Failed to create top-up order for %s: %v", order.OrderNumber, err)
+		return
+	}
+
+	if err := provider.Initiate(&topUp); err != nil {
+		log.Printf("Failed to send top-up of KES %s for order %s: %v", remaining, order.OrderNumber, err)
+		if updateErr := db.Model(&model.Order{}).Where("id = ? AND status = ?", topUp.ID, model.OrderStatusPending).
+			Updates(map[string]interface{}{"status": model.OrderStatusPaymentFailed, "ResultDesc": err.Error()}).Error; updateErr != nil {
+			log.Printf("Failed to mark top-up order %s as failed: %v", topUp.OrderNumber, updateErr)
+		}
+		h.notify(order.Ip, fmt.Sprintf(`{"type":"payment", "status": "partial", "message": %q}`,
+			fmt.Sprintf("Received KES %s of KES %d, please pay the remaining KES %s", paid.StringFixed(0), order.Amount, remaining)))
+		return
+	}
+	// Only the push's details are written, the callback may have settled the order already
+	if err := db.Model(&topUp).Select("CheckoutRequestID", "MerchantRequestID", "ResponseCode").Updates(&topUp).Error; err != nil {
+		log.Printf("Failed to update top-up order %s with its push: %v", topUp.OrderNumber, err)
+		return
+	}
+
+	log.Printf("Requested top-up %s of KES %s for order %s", topUp.OrderNumber, remaining, order.OrderNumber)
+	h.notify(order.Ip, fmt.Sprintf(`{"type":"payment", "status": "partial", "message": %q, "order": %q}`,
+		fmt.Sprintf("Received KES %s of KES %d, complete the payment of KES %s on your phone", paid.StringFixed(0), order.Amount, remaining),
+		topUp.OrderNumber))
+}
+
+func (h *MpesaCallbackHandler) notify(ip, message string) {
+	if ip != "" && h.wsHub != nil {
+		h.wsHub.SendToIP(ip, []byte(message))
+	}
+}
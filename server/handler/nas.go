@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/mikrotik/radiusclient"
+	nconfig "github.com/ortupik/wifigo/server/config"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// LoadNasConfig returns the RADIUS client configuration from the `radius.nas`
+// block of Viper, the defaults when it is missing
+func LoadNasConfig() (service.NasConfig, error) {
+	var cfg service.NasConfig
+	sub := nconfig.GetConfig().Sub("radius.nas")
+	if sub == nil {
+		return cfg, nil
+	}
+	if err := sub.Unmarshal(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to unmarshal radius nas config: %w", err)
+	}
+	return cfg, nil
+}
+
+// nasResponse is a RADIUS client registration. The secret and the command
+// carrying it are only returned when they are set.
+func nasResponse(nas *model.Nas, cfg service.NasConfig, withSecret bool) gin.H {
+	resp := gin.H{"nas": nas}
+	if withSecret {
+		resp["secret"] = nas.Secret
+		resp["routeros_command"] = radiusclient.Command(service.RouterRadiusEntry(cfg, *nas))
+	}
+	return resp
+}
+
+// pushNas runs push against the device when wanted. It answers the request and
+// returns false when the device cannot be reached.
+func (h *MikrotikQueueHandler) pushNas(c *gin.Context, deviceID string, cfg service.NasConfig, wanted *bool, push func(ctx context.Context, pool radiusclient.Runner) (interface{}, error)) (interface{}, bool) {
+	if wanted != nil && !*wanted {
+		return nil, true
+	}
+	pool, err := h.manager.GetDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is not loaded in the manager; set push to false to only register it with RADIUS"})
+		return nil, false
+	}
+
+	timeout := cfg.PushTimeout
+	if timeout <= 0 {
+		timeout = service.DefaultNasPushTimeout
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	result, err := push(ctx, pool)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to configure the router: " + err.Error()})
+		return nil, false
+	}
+	return result, true
+}
+
+// deviceISP returns the ID of the ISP that runs device, nil for none
+func deviceISP(device *model.MikroTikDevice) (*int64, error) {
+	if device.ISPID != nil {
+		return device.ISPID, nil
+	}
+	var isp model.ISP
+	err := gdatabase.GetDB(config.AppDB).Where("deviceId = ?", device.ID).First(&isp).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &isp.ID, nil
+}
+
+// GetDeviceNas returns the RADIUS client registration of a device
+func (h *MikrotikQueueHandler) GetDeviceNas(deviceID string, c *gin.Context) {
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil {
+		return
+	}
+	nas, err := service.FindDeviceNas(gdatabase.GetDB(config.RadiusDB), deviceID)
+	if errors.Is(err, service.ErrNasNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, nasResponse(nas, service.NasConfig{}, false))
+}
+
+// CreateDeviceNas registers a device as a RADIUS client and points the router
+// at the RADIUS server with the same secret
+func (h *MikrotikQueueHandler) CreateDeviceNas(deviceID string, c *gin.Context) {
+	var input dto.NasInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cfg, err := LoadNasConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	device := findDevice(c, gdatabase.GetDB(config.AppDB), deviceID)
+	if device == nil || !ispAllowed(c, input.ISPID) {
+		return
+	}
+
+	nas := model.Nas{
+		NasName:  device.Address,
+		Type:     service.DefaultNasType,
+		DeviceID: &device.ID,
+		ISPID:    input.ISPID,
+	}
+	if name := device.GetName(); name != "" {
+		nas.ShortName = &name
+	}
+	applyNasInput(&nas, input)
+	if nas.ISPID == nil {
+		if nas.ISPID, err = deviceISP(device); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch the ISP of the device: " + err.Error()})
+			return
+		}
+	}
+	if input.Secret != nil && *input.Secret != "" {
+		nas.Secret = *input.Secret
+	} else if nas.Secret, err = service.GenerateNasSecret(cfg.SecretLength); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	nas.SecretRotatedAt = &now
+
+	tx := gdatabase.GetDB(config.RadiusDB).Begin()
+	defer tx.Rollback()
+	if _, err := service.FindDeviceNas(tx, deviceID); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": service.ErrNasExists.Error()})
+		return
+	} else if !errors.Is(err, service.ErrNasNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Create(&nas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register RADIUS client: " + err.Error()})
+		return
+	}
+
+	// The row is only committed once the router has the same secret
+	pushed, ok := h.pushNas(c, deviceID, cfg, input.Push, func(ctx context.Context, pool radiusclient.Runner) (interface{}, error) {
+		return service.PushNasToRouter(ctx, pool, cfg, nas)
+	})
+	if !ok {
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register RADIUS client: " + err.Error()})
+		return
+	}
+
+	resp := nasResponse(&nas, cfg, true)
+	resp["push"] = pushed
+	c.JSON(http.StatusCreated, resp)
+}
+
+// UpdateDeviceNas changes the RADIUS client registration of a device. The
+// router is configured again, in case it lost its entry.
+func (h *MikrotikQueueHandler) UpdateDeviceNas(deviceID string, c *gin.Context) {
+	var input dto.NasInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Secret != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use the rotate-secret endpoint to change the secret"})
+		return
+	}
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil || !ispAllowed(c, input.ISPID) {
+		return
+	}
+	cfg, err := LoadNasConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := gdatabase.GetDB(config.RadiusDB).Begin()
+	defer tx.Rollback()
+	nas, err := service.FindDeviceNas(tx, deviceID)
+	if errors.Is(err, service.ErrNasNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	applyNasInput(nas, input)
+	if input.ISPID != nil {
+		nas.ISPID = input.ISPID
+	}
+	if err := tx.Save(nas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update RADIUS client: " + err.Error()})
+		return
+	}
+
+	pushed, ok := h.pushNas(c, deviceID, cfg, input.Push, func(ctx context.Context, pool radiusclient.Runner) (interface{}, error) {
+		return service.PushNasToRouter(ctx, pool, cfg, *nas)
+	})
+	if !ok {
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update RADIUS client: " + err.Error()})
+		return
+	}
+
+	resp := nasResponse(nas, cfg, false)
+	resp["push"] = pushed
+	c.JSON(http.StatusOK, resp)
+}
+
+// RotateDeviceNasSecret gives a device a new RADIUS secret, on the router and
+// in the nas table together
+func (h *MikrotikQueueHandler) RotateDeviceNasSecret(deviceID string, c *gin.Context) {
+	var input dto.NasSecretInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil {
+		return
+	}
+	cfg, err := LoadNasConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := gdatabase.GetDB(config.RadiusDB).Begin()
+	defer tx.Rollback()
+	nas, err := service.FindDeviceNas(tx, deviceID)
+	if errors.Is(err, service.ErrNasNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Secret != nil && *input.Secret != "" {
+		nas.Secret = *input.Secret
+	} else if nas.Secret, err = service.GenerateNasSecret(cfg.SecretLength); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	nas.SecretRotatedAt = &now
+	if err := tx.Save(nas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate secret: " + err.Error()})
+		return
+	}
+
+	pushed, ok := h.pushNas(c, deviceID, cfg, input.Push, func(ctx context.Context, pool radiusclient.Runner) (interface{}, error) {
+		return service.PushNasToRouter(ctx, pool, cfg, *nas)
+	})
+	if !ok {
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate secret: " + err.Error()})
+		return
+	}
+
+	resp := nasResponse(nas, cfg, true)
+	resp["push"] = pushed
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteDeviceNas removes the RADIUS client registration of a device and its
+// /radius entry on the router. ?push=false leaves the router alone.
+func (h *MikrotikQueueHandler) DeleteDeviceNas(deviceID string, c *gin.Context) {
+	var push *bool
+	if v := c.Query("push"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "push must be true or false"})
+			return
+		}
+		push = &b
+	}
+	if findDevice(c, gdatabase.GetDB(config.AppDB), deviceID) == nil {
+		return
+	}
+	cfg, err := LoadNasConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := gdatabase.GetDB(config.RadiusDB).Begin()
+	defer tx.Rollback()
+	nas, err := service.FindDeviceNas(tx, deviceID)
+	if errors.Is(err, service.ErrNasNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Delete(nas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove RADIUS client: " + err.Error()})
+		return
+	}
+
+	removed, ok := h.pushNas(c, deviceID, cfg, push, func(ctx context.Context, pool radiusclient.Runner) (interface{}, error) {
+		return service.RemoveNasFromRouter(ctx, pool, deviceID)
+	})
+	if !ok {
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove RADIUS client: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "RADIUS client removed", "router_entries_removed": removed})
+}
+
+// applyNasInput copies the fields set in input, other than the secret and ISP
+func applyNasInput(nas *model.Nas, input dto.NasInput) {
+	if input.NasName != nil && *input.NasName != "" {
+		nas.NasName = *input.NasName
+	}
+	if input.ShortName != nil {
+		nas.ShortName = input.ShortName
+	}
+	if input.Type != nil && *input.Type != "" {
+		nas.Type = *input.Type
+	}
+	if input.Community != nil {
+		nas.Community = input.Community
+	}
+	if input.Description != nil {
+		nas.Description = input.Description
+	}
+}
@@ -11,7 +11,8 @@ import (
 	"gorm.io/gorm"
 )
 
-// GetOrder retrieves an order based on input
+// GetOrder retrieves an order based on input. It is the captive portal's
+// payment status lookup, so it is found by its order number alone.
 func GetOrder(orderNumber string, c *gin.Context, tx *gorm.DB) {
 	db := gdatabase.GetDB(config.AppDB)
 	var order model.Order
@@ -39,6 +40,12 @@ func GetOrders(c *gin.Context, tx *gorm.DB) {
 	if tx == nil {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	query := tenant.ScopeOrders(tx.Model(&model.Order{}))
 	
 	// Parse pagination parameters
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
@@ -49,10 +56,10 @@ func GetOrders(c *gin.Context, tx *gorm.DB) {
 	var count int64
 	
 	// Get total count
-	tx.Model(&model.Order{}).Count(&count)
+	query.Session(&gorm.Session{}).Count(&count)
 	
 	// Get paginated orders
-	if err := tx.Offset(offset).Limit(limit).Find(&orders).Error; err != nil {
+	if err := query.Session(&gorm.Session{}).Offset(offset).Limit(limit).Find(&orders).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve orders"})
 		return
 	}
@@ -88,15 +95,24 @@ func UpdateOrder(c *gin.Context, tx *gorm.DB) {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 	
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	
 	var orderInput model.Order
 	if err := c.BindJSON(&orderInput); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Only platform admins move orders between ISPs
+	if !tenant.Platform() {
+		orderInput.ISP = ""
+	}
 	
 	// Check if order exists
 	var existingOrder model.Order
-	if err := tx.Where("id = ?", orderInput.ID).First(&existingOrder).Error; err != nil {
+	if err := tenant.ScopeOrders(tx).Where("id = ?", orderInput.ID).First(&existingOrder).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
 	}
@@ -122,11 +138,16 @@ func DeleteOrder(c *gin.Context, tx *gorm.DB) {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 	
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	
 	id := c.Param("id")
 	var order model.Order
 	
 	// Check if order exists
-	if err := tx.Where("id = ?", id).First(&order).Error; err != nil {
+	if err := tenant.ScopeOrders(tx).Where("id = ?", id).First(&order).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
 	}
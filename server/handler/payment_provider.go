@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// PaymentProvider collects the payment of an order from a mobile money
+// operator. Results are reported as a model.MpesaCallbackPayload so that every
+// provider's payments are settled by MpesaCallbackHandler.ProcessCallback.
+type PaymentProvider interface {
+	// Name is stored on the orders and payments of the provider
+	Name() string
+
+	// Initiate asks the customer to pay order.Amount from order.Phone. It sets
+	// the order's CheckoutRequestID, under which the result is reported, and
+	// the other request details. A request the operator refused is returned
+	// as a *PaymentRequestError.
+	Initiate(order *model.Order) error
+
+	// ParseCallback parses a payment result the operator posted to the
+	// provider's callback URL. Callbacks failing the provider's own checks are
+	// returned as a *CallbackRejectedError.
+	ParseCallback(r *http.Request, body []byte) (*model.MpesaCallbackPayload, error)
+
+	// QueryStatus asks the operator for the result of the order's payment
+	QueryStatus(order model.Order) (*PaymentStatus, error)
+
+	// Refund returns payment to the customer with method, see RefundMethodReversal.
+	// token identifies the refund in its result URLs.
+	Refund(order model.Order, payment model.Payment, method, remarks, token string) (*RefundSubmission, error)
+}
+
+// PaymentStatus is the result of a payment as reported by QueryStatus
+type PaymentStatus struct {
+	Paid              bool // Completed successfully
+	Completed         bool // The operator has a final result, paid or not
+	ResultDesc        string
+	MerchantRequestID string
+	TransactionID     string // The operator's receipt, when it reports one
+}
+
+// RefundSubmission is the operator's answer to a refund request. Refunds with
+// a final result are settled at once, the others when their result is posted.
+type RefundSubmission struct {
+	ConversationID           string
+	OriginatorConversationID string
+
+	Final         bool
+	Completed     bool
+	ResultDesc    string
+	TransactionID string
+}
+
+// PaymentRequestError is a payment request the operator refused
+type PaymentRequestError struct {
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *PaymentRequestError) Error() string {
+	return fmt.Sprintf("payment request rejected: %s %s", e.Code, e.Message)
+}
+
+// CallbackRejectedError is a callback that failed the provider's checks, it is
+// recorded for audit
+type CallbackRejectedError struct {
+	Reason  string
+	Details string
+}
+
+func (e *CallbackRejectedError) Error() string {
+	return fmt.Sprintf("callback rejected: %s", e.Details)
+}
+
+// callbackSourceChecker is implemented by providers that restrict the
+// addresses their callbacks may come from
+type callbackSourceChecker interface {
+	SourceAllowed(ip string) bool
+}
+
+// providerLabels name the providers to customers
+var providerLabels = map[string]string{
+	model.PaymentProviderMpesa:  "M-Pesa",
+	model.PaymentProviderAirtel: "Airtel Money",
+}
+
+func providerLabel(name string) string {
+	return orDefault(providerLabels[name], name)
+}
+
+// PaymentProviders are the configured payment providers by name
+type PaymentProviders struct {
+	providers map[string]PaymentProvider
+	names     []string // In the order given, the first is the default
+}
+
+// NewPaymentProviders returns the given providers, the first being the default
+func NewPaymentProviders(providers ...PaymentProvider) *PaymentProviders {
+	p := &PaymentProviders{providers: make(map[string]PaymentProvider)}
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		p.providers[provider.Name()] = provider
+		p.names = append(p.names, provider.Name())
+	}
+	return p
+}
+
+// LoadPaymentProviders returns M-Pesa, through stk, followed by the other
+// configured providers
+func LoadPaymentProviders(stk *MpesaStkHandler) (*PaymentProviders, error) {
+	airtel, err := NewAirtelProvider(stk.serverEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up Airtel Money: %w", err)
+	}
+	if airtel == nil {
+		return NewPaymentProviders(NewMpesaProvider(stk)), nil
+	}
+	return NewPaymentProviders(NewMpesaProvider(stk), airtel), nil
+}
+
+// Names returns the names of the configured providers
+func (p *PaymentProviders) Names() []string {
+	return append([]string(nil), p.names...)
+}
+
+// Get returns the provider with the given name
+func (p *PaymentProviders) Get(name string) (PaymentProvider, error) {
+	provider, ok := p.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("payment provider %q is not configured", name)
+	}
+	return provider, nil
+}
+
+// ForOrder returns the provider an order is paid with. Orders from before
+// providers were recorded are M-Pesa orders.
+func (p *PaymentProviders) ForOrder(order model.Order) (PaymentProvider, error) {
+	return p.Get(orDefault(order.Provider, model.PaymentProviderMpesa))
+}
+
+// ForCheckout picks the provider of a new order: the requested one, or the
+// first one the plan, then the ISP, accepts. Providers the plan or ISP does not
+// list are refused.
+func (p *PaymentProviders) ForCheckout(requested string, plan model.ServicePlan, isp *model.ISP) (PaymentProvider, error) {
+	accepted := p.names
+	if isp != nil && isp.PaymentProviders != "" {
+		accepted = intersect(accepted, splitProviders(isp.PaymentProviders))
+	}
+	if plan.PaymentProviders != "" {
+		accepted = intersect(splitProviders(plan.PaymentProviders), accepted)
+	}
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("no payment provider is available for this plan")
+	}
+
+	requested = strings.ToLower(strings.TrimSpace(requested))
+	if requested == "" {
+		return p.Get(accepted[0])
+	}
+	for _, name := range accepted {
+		if name == requested {
+			return p.Get(name)
+		}
+	}
+	return nil, fmt.Errorf("%s is not accepted for this plan, use %s", providerLabel(requested), strings.Join(accepted, " or "))
+}
+
+func splitProviders(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// intersect returns the names of a that are also in b, in the order of a
+func intersect(a, b []string) []string {
+	var names []string
+	for _, name := range a {
+		for _, other := range b {
+			if name == other {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// UseProviders sets the providers top-ups are requested with. UseStkHandler
+// sets M-Pesa alone.
+func (h *MpesaCallbackHandler) UseProviders(providers *PaymentProviders) {
+	h.providers = providers
+}
+
+// PaymentCallback returns the callback endpoint of provider. Callbacks are
+// checked by the provider and against their order, then settled like M-Pesa
+// STK callbacks.
+func (h *MpesaCallbackHandler) PaymentCallback(provider PaymentProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment callback payload."})
+			return
+		}
+		reject := func(checkoutRequestID, reason, details string) {
+			service.RecordCallbackRejection(model.MpesaCallbackRejection{
+				CheckoutRequestID: checkoutRequestID,
+				SourceIP:          c.ClientIP(),
+				Reason:            reason,
+				Details:           fmt.Sprintf("%s: %s", provider.Name(), details),
+				Body:              auditBody(body),
+			})
+			c.JSON(http.StatusForbidden, gin.H{"error": "Callback rejected."})
+		}
+
+		if checker, ok := provider.(callbackSourceChecker); ok && !checker.SourceAllowed(c.ClientIP()) {
+			reject("", model.CallbackRejectSourceIP, "sender is not in callback_allowed_ips")
+			return
+		}
+
+		payload, err := provider.ParseCallback(c.Request, body)
+		var rejected *CallbackRejectedError
+		if errors.As(err, &rejected) {
+			reject("", rejected.Reason, rejected.Details)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse payment callback.", "details": err.Error()})
+			return
+		}
+		payload.Provider = provider.Name()
+
+		reason, details, err := verifyCallback(c.Request.Context(), payload, c.Param("token"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify payment callback.", "details": err.Error()})
+			return
+		}
+		if reason != "" {
+			reject(payload.CheckoutRequestID, reason, details)
+			return
+		}
+
+		status, response := h.ProcessCallback(c.Request.Context(), payload)
+		c.JSON(status, response)
+	}
+}
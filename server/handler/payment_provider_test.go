@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/handler/airteltest"
+	"github.com/ortupik/wifigo/server/handler/darajatest"
+)
+
+func TestForCheckout(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+	airtel := airteltest.NewServer()
+	defer airtel.Close()
+
+	providers := handler.NewPaymentProviders(
+		handler.NewMpesaProvider(newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")),
+		newAirtelProvider(t, airtel, ""),
+	)
+
+	tests := []struct {
+		name      string
+		requested string
+		plan      string
+		isp       string
+		want      string // Empty when the checkout is refused
+	}{
+		{name: "default", want: model.PaymentProviderMpesa},
+		{name: "requested", requested: "Airtel", want: model.PaymentProviderAirtel},
+		{name: "plan order", plan: "airtel,mpesa", want: model.PaymentProviderAirtel},
+		{name: "isp limits", isp: "airtel", want: model.PaymentProviderAirtel},
+		{name: "isp refuses requested", requested: "mpesa", isp: "airtel"},
+		{name: "plan refuses requested", requested: "airtel", plan: "mpesa"},
+		{name: "plan outside isp", plan: "mpesa", isp: "airtel"},
+		{name: "unconfigured", plan: "tkash"},
+		{name: "unknown requested", requested: "tkash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var isp *model.ISP
+			if tt.isp != "" {
+				isp = &model.ISP{PaymentProviders: tt.isp}
+			}
+			got, err := providers.ForCheckout(tt.requested, model.ServicePlan{PaymentProviders: tt.plan}, isp)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("ForCheckout() = %s, want an error", got.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ForCheckout() error = %v", err)
+			}
+			if got.Name() != tt.want {
+				t.Errorf("ForCheckout() = %s, want %s", got.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentProvidersForOrder(t *testing.T) {
+	daraja := darajatest.NewServer()
+	defer daraja.Close()
+
+	providers := handler.NewPaymentProviders(handler.NewMpesaProvider(newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback")))
+	if got, err := providers.ForOrder(model.Order{}); err != nil || got.Name() != model.PaymentProviderMpesa {
+		t.Errorf("ForOrder() of an order without a provider = %v, %v, want M-Pesa", got, err)
+	}
+	if _, err := providers.ForOrder(model.Order{Provider: model.PaymentProviderAirtel}); err == nil {
+		t.Error("ForOrder() of an Airtel order without Airtel configured succeeded, want an error")
+	}
+}
+
+func TestMpesaProviderInitiate(t *testing.T) {
+	daraja := darajatest.NewServer()
+	daraja.AutoCallback = false
+	defer daraja.Close()
+
+	provider := handler.NewMpesaProvider(newStkHandler(daraja, "https://example.com/api/v1/mpesa/callback"))
+	order := model.Order{Phone: "0712345678", Amount: 20}
+	if err := provider.Initiate(&order); err != nil {
+		t.Fatalf("Initiate() error = %v", err)
+	}
+
+	pushes := daraja.Pushes()
+	if len(pushes) != 1 {
+		t.Fatalf("STK pushes = %d, want 1", len(pushes))
+	}
+	if order.CheckoutRequestID != pushes[0].CheckoutRequestID || order.ResponseCode != "0" || order.CallbackToken == "" {
+		t.Errorf("Initiate() order = %+v, want the push's CheckoutRequestID and a callback token", order)
+	}
+
+	// An order stored before its push keeps its token
+	stored := model.Order{Phone: "0712345678", Amount: 20, CallbackToken: "stored-token"}
+	if err := provider.Initiate(&stored); err != nil {
+		t.Fatalf("Initiate() error = %v", err)
+	}
+	if pushes := daraja.Pushes(); stored.CallbackToken != "stored-token" || !strings.HasSuffix(pushes[len(pushes)-1].CallBackURL, "/stored-token") {
+		t.Errorf("Initiate() of a stored order sent %s with token %q, want its own token", pushes[len(pushes)-1].CallBackURL, stored.CallbackToken)
+	}
+
+	// Daraja refuses pushes for another short code
+	daraja.Shortcode = "600999"
+	err := provider.Initiate(&model.Order{Phone: "0712345678", Amount: 20})
+	var rejected *handler.PaymentRequestError
+	if !errors.As(err, &rejected) {
+		t.Errorf("Initiate() of a refused push error = %v, want a PaymentRequestError", err)
+	}
+}
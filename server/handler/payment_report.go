@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// PaymentMismatchReport is a row of the payment amount mismatch report
+type PaymentMismatchReport struct {
+	model.PaymentMismatch
+	TopUpOrder  string `json:"TopUpOrder,omitempty"`  // Latest top-up requested for an underpayment
+	TopUpStatus string `json:"TopUpStatus,omitempty"` // Status of that top-up order
+}
+
+// GetPaymentMismatches lists payments whose amount differed from their order,
+// newest first. It is filtered by the kind, phone, from and to (YYYY-MM-DD)
+// query parameters and paginated like GetOrders.
+func GetPaymentMismatches(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	query := tx.Model(&model.PaymentMismatch{})
+	if kind := c.Query("kind"); kind != "" {
+		if kind != model.MismatchUnderpaid && kind != model.MismatchOverpaid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be underpaid or overpaid"})
+			return
+		}
+		query = query.Where("kind = ?", kind)
+	}
+	if phone := c.Query("phone"); phone != "" {
+		query = query.Where("phone = ?", phone)
+	}
+	for param, cond := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be a date in YYYY-MM-DD format"})
+			return
+		}
+		if param == "to" {
+			day = day.AddDate(0, 0, 1) // Include the whole day
+		}
+		query = query.Where(cond, day)
+	}
+
+	// Totals over the whole filtered range, not just the page
+	var totals []struct {
+		Kind       string
+		Count      int64
+		Difference decimal.Decimal
+	}
+	if err := query.Session(&gorm.Session{}).Select("kind, COUNT(*) AS count, SUM(difference) AS difference").
+		Group("kind").Scan(&totals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarise payment mismatches"})
+		return
+	}
+	summary := gin.H{}
+	var count int64
+	for _, total := range totals {
+		summary[total.Kind] = gin.H{"count": total.Count, "amount": total.Difference.Abs()}
+		count += total.Count
+	}
+
+	var mismatches []model.PaymentMismatch
+	if err := query.Session(&gorm.Session{}).Order("id DESC").Offset(offset).Limit(limit).Find(&mismatches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve payment mismatches"})
+		return
+	}
+
+	// Show how the top-up of each underpayment is going
+	var orderIDs []int
+	for _, mismatch := range mismatches {
+		if mismatch.Kind == model.MismatchUnderpaid {
+			orderIDs = append(orderIDs, mismatch.OrderID)
+		}
+	}
+	topUps := make(map[int]model.Order)
+	if len(orderIDs) > 0 {
+		var orders []model.Order
+		if err := tx.Where("parentOrderId IN ?", orderIDs).Order("id ASC").Find(&orders).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve top-up orders"})
+			return
+		}
+		for _, order := range orders {
+			topUps[*order.ParentOrderID] = order // Latest wins
+		}
+	}
+
+	rows := make([]PaymentMismatchReport, 0, len(mismatches))
+	for _, mismatch := range mismatches {
+		row := PaymentMismatchReport{PaymentMismatch: mismatch}
+		if topUp, ok := topUps[mismatch.OrderID]; ok {
+			row.TopUpOrder = topUp.OrderNumber
+			row.TopUpStatus = topUp.Status
+		}
+		rows = append(rows, row)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    rows,
+		"summary": summary,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
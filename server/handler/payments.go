@@ -22,8 +22,13 @@ func GetPayment(c *gin.Context, tx *gorm.DB) {
 		return
 	}
 	
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	
 	var payment model.Payment
-	if err := tx.Where(&paymentInput).First(&payment).Error; err != nil {
+	if err := tenant.ScopePayments(tx).Where(&paymentInput).First(&payment).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
 	}
@@ -31,20 +36,19 @@ func GetPayment(c *gin.Context, tx *gorm.DB) {
 	c.JSON(http.StatusOK, payment)
 }
 
-// GetPayments retrieves all payments with optional filtering
+// GetPayments retrieves all payments of the caller's ISP
 func GetPayments(c *gin.Context, tx *gorm.DB) {
 	if tx == nil {
 		tx = gdatabase.GetDB(config.AppDB)
 	}
 	
-	var paymentInput model.Payment
-	if err := c.BindJSON(&paymentInput); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	tenant, ok := CallerTenant(c)
+	if !ok {
 		return
 	}
 	
 	var payments []model.Payment
-	query := tx
+	query := tenant.ScopePayments(tx)
 	
 	// Execute the query
 	if err := query.Find(&payments).Error; err != nil {
@@ -67,6 +71,10 @@ func CreatePayment(c *gin.Context, tx *gorm.DB) {
 		return
 	}
 	
+	if !paymentOrderAllowed(c, tx, paymentInput.OrderID) {
+		return
+	}
+	
 	if err := tx.Create(&paymentInput).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment"})
 		return
@@ -87,12 +95,20 @@ func UpdatePayment(c *gin.Context, tx *gorm.DB) {
 		return
 	}
 	
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	
 	// Check if payment exists
 	var existingPayment model.Payment
-	if err := tx.Where("id = ?", paymentInput.ID).First(&existingPayment).Error; err != nil {
+	if err := tenant.ScopePayments(tx).Where("id = ?", paymentInput.ID).First(&existingPayment).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
 	}
+	if paymentInput.OrderID != nil && !paymentOrderAllowed(c, tx, paymentInput.OrderID) {
+		return
+	}
 	
 	// Update the payment
 	if err := tx.Model(&existingPayment).Updates(paymentInput).Error; err != nil {
@@ -121,9 +137,14 @@ func DeletePayment(c *gin.Context, tx *gorm.DB) {
 		return
 	}
 	
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+	
 	// Check if payment exists
 	var existingPayment model.Payment
-	if err := tx.Where("id = ?", paymentInput.ID).First(&existingPayment).Error; err != nil {
+	if err := tenant.ScopePayments(tx).Where("id = ?", paymentInput.ID).First(&existingPayment).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
 	}
@@ -137,3 +158,28 @@ func DeletePayment(c *gin.Context, tx *gorm.DB) {
 	c.JSON(http.StatusOK, gin.H{"message": "Payment deleted successfully"})
 }
 
+// paymentOrderAllowed reports whether the caller may record a payment towards
+// orderID. Payments towards no order are left to platform admins.
+func paymentOrderAllowed(c *gin.Context, tx *gorm.DB, orderID *int) bool {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return false
+	}
+	if orderID == nil {
+		if !tenant.Platform() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "A payment must be towards an order of your ISP"})
+			return false
+		}
+		return true
+	}
+	var count int64
+	if err := tenant.ScopeOrders(tx.Model(&model.Order{})).Where("id = ?", *orderID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up order"})
+		return false
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return false
+	}
+	return true
+}
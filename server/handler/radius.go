@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	radiusmodel "github.com/ortupik/wifigo/server/database/model"
 	dto "github.com/ortupik/wifigo/server/dto"
+	"github.com/ortupik/wifigo/server/service"
 )
 
 func ManageHotspotUser(req dto.HotspotSubscriptionRequest, isSubscribing bool) (gin.H, int) {
@@ -41,7 +43,7 @@ func ManageHotspotUser(req dto.HotspotSubscriptionRequest, isSubscribing bool) (
 			{
 				Attribute: "Expiration",
 				Op:        ":=",
-				Value:     time.Now().Add(time.Duration(duration) * time.Second).Format("Jan 2 2006 15:04:05"),
+				Value:     time.Now().Add(time.Duration(duration) * time.Second).Format(radiusmodel.RadiusExpirationLayout),
 			},
 			{
 				Attribute: "Simultaneous-Use",
@@ -76,6 +78,13 @@ func ManageHotspotUser(req dto.HotspotSubscriptionRequest, isSubscribing bool) (
 		return gin.H{"error": err}, http.StatusInternalServerError
 	}
 
+	// A new subscription starts with the plan's whole data cap, replacing what
+	// was left of the previous one
+	dataLimit := service.DataLimitBytes(radiusmodel.ServicePlan{DataLimitMB: req.DataLimitMB})
+	if _, err := service.SetUserDataLimit(nil, username, dataLimit, dataLimit > 0); err != nil {
+		return gin.H{"error": err.Error()}, http.StatusInternalServerError
+	}
+
 	return gin.H{
 		"message":  "Subscription made successfully",
 		"username": username,
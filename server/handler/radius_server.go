@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"fmt"
+
+	nconfig "github.com/ortupik/wifigo/server/config"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// LoadRadiusServerConfig returns the embedded RADIUS server configuration
+// from the `radius.server` block of Viper, or nil when it is missing or
+// disabled
+func LoadRadiusServerConfig() (*service.RadiusServerConfig, error) {
+	sub := nconfig.GetConfig().Sub("radius.server")
+	if sub == nil {
+		return nil, nil
+	}
+	var cfg service.RadiusServerConfig
+	if err := sub.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal radius server config: %w", err)
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return &cfg, nil
+}
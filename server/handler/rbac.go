@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// Authorize lets through callers whose role may take action on resource, and
+// keeps their tenant on the context like TenantRequired. It goes after the JWT
+// middleware; roles are read from the token, so a new role applies from the
+// next login or refresh.
+func Authorize(resource service.Resource, action service.Action) gin.HandlerFunc {
+	permission := service.Permission{Resource: resource, Action: action}
+	return func(c *gin.Context) {
+		tenant, err := resolveTenant(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if !tenant.Can(resource, action) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "permission denied", "permission": permission.String()})
+			return
+		}
+		c.Set(tenantKey, tenant)
+		c.Next()
+	}
+}
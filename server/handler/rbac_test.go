@@ -0,0 +1,96 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		role       string
+		scope      string
+		wantRead   int
+		wantDelete int
+		wantRadius int
+	}{
+		{name: "platform admin", role: gmodel.RolePlatformAdmin, wantRead: http.StatusOK, wantDelete: http.StatusOK, wantRadius: http.StatusOK},
+		{name: "isp admin", role: gmodel.RoleISPAdmin, scope: gmodel.ISPScope(2), wantRead: http.StatusOK, wantDelete: http.StatusOK, wantRadius: http.StatusOK},
+		{name: "isp support", role: gmodel.RoleISPSupport, scope: gmodel.ISPScope(2), wantRead: http.StatusOK, wantDelete: http.StatusForbidden, wantRadius: http.StatusOK},
+		{name: "no role", scope: gmodel.ISPScope(2), wantRead: http.StatusForbidden, wantDelete: http.StatusForbidden, wantRadius: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(asAccount(9, tt.role, tt.scope))
+			ok := func(c *gin.Context) {
+				if _, found := handler.CallerTenant(c); found {
+					c.Status(http.StatusOK)
+				}
+			}
+			r.GET("/devices/:id", handler.Authorize(service.ResourceDevices, service.ActionRead), ok)
+			r.DELETE("/devices/:id", handler.Authorize(service.ResourceDevices, service.ActionDelete), ok)
+			r.POST("/hotspot/users/:username/check", handler.Authorize(service.ResourceHotspotUsers, service.ActionWrite), ok)
+
+			for _, req := range []struct {
+				method, path string
+				want         int
+			}{
+				{http.MethodGet, "/devices/router1", tt.wantRead},
+				{http.MethodDelete, "/devices/router1", tt.wantDelete},
+				{http.MethodPost, "/hotspot/users/0712345678@Tecsurf/check", tt.wantRadius},
+			} {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(req.method, req.path, nil))
+				if w.Code != req.want {
+					t.Errorf("%s %s = %d %s, want %d", req.method, req.path, w.Code, w.Body.String(), req.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAssignRoleRejects(t *testing.T) {
+	ispAdmin := service.Tenant{AuthID: 1, Role: gmodel.RoleISPAdmin, ISPID: 2}
+	platform := service.Tenant{AuthID: 1, Role: gmodel.RolePlatformAdmin}
+	tests := []struct {
+		name   string
+		tenant service.Tenant
+		authID uint64
+		input  handler.RoleInput
+		want   int
+	}{
+		{name: "unknown role", tenant: platform, authID: 5, input: handler.RoleInput{Role: "root"}, want: http.StatusBadRequest},
+		{name: "own role", tenant: ispAdmin, authID: 1, input: handler.RoleInput{Role: gmodel.RoleISPSupport}, want: http.StatusForbidden},
+		{name: "isp admin makes a platform admin", tenant: ispAdmin, authID: 5, input: handler.RoleInput{Role: gmodel.RolePlatformAdmin}, want: http.StatusForbidden},
+		{name: "isp role without isp", tenant: platform, authID: 5, input: handler.RoleInput{Role: gmodel.RoleISPAdmin}, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := handler.AssignRole(tt.tenant, tt.authID, tt.input); got != tt.want {
+				t.Errorf("AssignRole() status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRoles(t *testing.T) {
+	resp, status := handler.GetRoles()
+	roles, ok := resp.Message.([]handler.RoleDefinition)
+	if status != http.StatusOK || !ok || len(roles) != len(service.Roles) {
+		t.Fatalf("GetRoles() = %v, %d, want every role", resp.Message, status)
+	}
+	for _, role := range roles {
+		if len(role.Permissions) == 0 {
+			t.Errorf("role %s has no permissions", role.Role)
+		}
+	}
+}
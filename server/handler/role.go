@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	gmodel "github.com/ortupik/wifigo/database/model"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// RoleInput is the role given to an account
+type RoleInput struct {
+	Role  string `json:"role"`   // Empty to take the role away
+	ISPID *int64 `json:"isp_id"` // ISP of the ISP roles, always the caller's for ISP admins
+}
+
+// RoleDefinition is a role with what it may do
+type RoleDefinition struct {
+	Role        string               `json:"role"`
+	Permissions []service.Permission `json:"permissions"`
+}
+
+// AccountRole is the role of an account
+type AccountRole struct {
+	AuthID      uint64               `json:"auth_id"`
+	Role        string               `json:"role"`
+	ISPID       *int64               `json:"isp_id"`
+	Permissions []service.Permission `json:"permissions"`
+}
+
+// NewAccountRole returns the role of auth
+func NewAccountRole(auth gmodel.Auth) AccountRole {
+	return AccountRole{
+		AuthID:      auth.AuthID,
+		Role:        auth.Role,
+		ISPID:       auth.ISPID,
+		Permissions: service.RolePermissions(auth.Role),
+	}
+}
+
+// GetRoles handles jobs for controller.GetRoles
+func GetRoles() (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+	roles := make([]RoleDefinition, 0, len(service.Roles))
+	for _, role := range service.Roles {
+		roles = append(roles, RoleDefinition{Role: role, Permissions: service.RolePermissions(role)})
+	}
+
+	httpResponse.Message = roles
+	httpStatusCode = http.StatusOK
+	return
+}
+
+// GetAccountRole handles jobs for controller.GetAccountRole
+func GetAccountRole(tenant service.Tenant, authID uint64) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	auth, err := findAccount(db, tenant, authID)
+	if err != nil {
+		return accountError(err)
+	}
+
+	httpResponse.Message = NewAccountRole(*auth)
+	httpStatusCode = http.StatusOK
+	return
+}
+
+// AssignRole handles jobs for controller.AssignRole. Platform admins give any
+// role to any account. ISP admins give ISP roles to accounts of their own ISP
+// only; accounts of no ISP are brought into an ISP by a platform admin.
+func AssignRole(tenant service.Tenant, authID uint64, input RoleInput) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+	if input.Role != "" && !service.IsRole(input.Role) {
+		httpResponse.Message = "unknown role"
+		httpStatusCode = http.StatusBadRequest
+		return
+	}
+	if authID == tenant.AuthID {
+		httpResponse.Message = "you cannot change your own role"
+		httpStatusCode = http.StatusForbidden
+		return
+	}
+	if !tenant.Platform() {
+		if input.Role == gmodel.RolePlatformAdmin {
+			httpResponse.Message = "only platform admins can make platform admins"
+			httpStatusCode = http.StatusForbidden
+			return
+		}
+		ispID := tenant.ISPID
+		input.ISPID = &ispID
+	}
+	switch input.Role {
+	case "", gmodel.RolePlatformAdmin:
+		// platform admins and accounts without a role act for no single ISP
+		input.ISPID = nil
+	default:
+		if input.ISPID == nil {
+			httpResponse.Message = "isp_id is required for ISP roles"
+			httpStatusCode = http.StatusBadRequest
+			return
+		}
+	}
+
+	db := gdatabase.GetDB(config.AppDB)
+	auth, err := findAccount(db, tenant, authID)
+	if err != nil {
+		return accountError(err)
+	}
+	if input.ISPID != nil {
+		if err := db.First(&model.ISP{}, *input.ISPID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				httpResponse.Message = "ISP not found"
+				httpStatusCode = http.StatusBadRequest
+				return
+			}
+			log.WithError(err).Error("error code: 1132")
+			httpResponse.Message = "internal server error"
+			httpStatusCode = http.StatusInternalServerError
+			return
+		}
+	}
+
+	if err := db.Model(auth).Updates(map[string]interface{}{"role": input.Role, "isp_id": input.ISPID}).Error; err != nil {
+		log.WithError(err).Error("error code: 1133")
+		httpResponse.Message = "internal server error"
+		httpStatusCode = http.StatusInternalServerError
+		return
+	}
+	auth.Role = input.Role
+	auth.ISPID = input.ISPID
+
+	httpResponse.Message = NewAccountRole(*auth)
+	httpStatusCode = http.StatusOK
+	return
+}
+
+// errAccountNotFound is returned for accounts that do not exist or that the
+// caller may not see
+var errAccountNotFound = errors.New("account not found")
+
+// findAccount returns the account authID when tenant may manage its role:
+// any account for platform admins, accounts of their own ISP for everyone
+// else
+func findAccount(db *gorm.DB, tenant service.Tenant, authID uint64) (*gmodel.Auth, error) {
+	var auth gmodel.Auth
+	if err := db.Where("auth_id = ?", authID).First(&auth).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errAccountNotFound
+		}
+		return nil, err
+	}
+	if tenant.Platform() {
+		return &auth, nil
+	}
+	if auth.ISPID != nil && tenant.CanAccess(*auth.ISPID) {
+		return &auth, nil
+	}
+	return nil, errAccountNotFound
+}
+
+// accountError returns the response for an error of findAccount
+func accountError(err error) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+	if errors.Is(err, errAccountNotFound) {
+		httpResponse.Message = err.Error()
+		httpStatusCode = http.StatusNotFound
+		return
+	}
+	log.WithError(err).Error("error code: 1131")
+	httpResponse.Message = "internal server error"
+	httpStatusCode = http.StatusInternalServerError
+	return
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// ApplyServicePlanInput copies the fields set in input onto plan and checks
+// that the RADIUS group attributes can be generated from the result
+func ApplyServicePlanInput(plan *model.ServicePlan, input dto.ServicePlanInput) error {
+	if input.ISPID != nil {
+		plan.ISPID = *input.ISPID
+	}
+	if input.Name != nil {
+		plan.Name = *input.Name
+	}
+	if input.ServiceType != nil {
+		plan.ServiceType = model.ServiceType(*input.ServiceType)
+	}
+	if input.Description != nil {
+		plan.Description = *input.Description
+	}
+	if input.Price != nil {
+		plan.Price = *input.Price
+	}
+	if input.Duration != nil {
+		plan.Duration = *input.Duration
+	}
+	if input.DataLimitMB != nil {
+		plan.DataLimitMB = input.DataLimitMB
+		if *input.DataLimitMB <= 0 {
+			plan.DataLimitMB = nil
+		}
+	}
+	if input.SpeedLimitMbps != nil {
+		plan.SpeedLimitMbps = *input.SpeedLimitMbps
+	}
+	if input.BurstLimitMbps != nil {
+		plan.BurstLimitMbps = *input.BurstLimitMbps
+	}
+	if input.BurstThresholdMbps != nil {
+		plan.BurstThresholdMbps = *input.BurstThresholdMbps
+	}
+	if input.BurstTime != nil {
+		plan.BurstTime = *input.BurstTime
+	}
+	if input.IdleTimeout != nil {
+		plan.IdleTimeout = *input.IdleTimeout
+	}
+	if input.Devices != nil {
+		plan.Devices = *input.Devices
+	}
+	if input.IsActive != nil {
+		plan.IsActive = *input.IsActive
+	}
+	if input.Validity != nil {
+		plan.Validity = *input.Validity
+	}
+	if input.Speed != nil {
+		plan.Speed = *input.Speed
+	}
+	if input.PaymentProviders != nil {
+		plan.PaymentProviders = *input.PaymentProviders
+	}
+
+	if plan.Name == "" {
+		return errors.New("name is required")
+	}
+	if plan.ISPID == 0 {
+		return errors.New("isp_id is required")
+	}
+	if plan.ServiceType != model.ServiceTypeHotspot && plan.ServiceType != model.ServiceTypeHome {
+		return fmt.Errorf("service_type must be %s or %s", model.ServiceTypeHotspot, model.ServiceTypeHome)
+	}
+	if plan.Price < 0 {
+		return errors.New("price must not be negative")
+	}
+	_, _, err := service.PlanGroupAttributes(*plan)
+	return err
+}
+
+// saveServicePlan saves plan and regenerates its RADIUS group. The group is
+// committed first: should the plan fail to commit afterwards, the next edit
+// or sync puts the group right.
+func saveServicePlan(tx *gorm.DB, plan *model.ServicePlan, previousName string) error {
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if radiusDB == nil {
+		return errors.New("database connection not available")
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(plan).Error; err != nil {
+			return fmt.Errorf("failed to save service plan: %w", err)
+		}
+		if !plan.IsActive {
+			// Creating a plan applies the column default to a false IsActive
+			if err := tx.Model(plan).Update("isActive", false).Error; err != nil {
+				return fmt.Errorf("failed to save service plan: %w", err)
+			}
+		}
+		return radiusDB.Transaction(func(rtx *gorm.DB) error {
+			return service.SyncPlanGroup(rtx, *plan, previousName)
+		})
+	})
+}
+
+// CreateServicePlan creates a service plan and its RADIUS group from the JSON body
+func CreateServicePlan(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	var input dto.ServicePlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	// ISP accounts add plans to their own ISP
+	if !ispAllowed(c, input.ISPID) {
+		return
+	}
+	if input.ISPID == nil && !tenant.Platform() {
+		input.ISPID = &tenant.ISPID
+	}
+	plan := model.ServicePlan{ServiceType: model.ServiceTypeHotspot, IsActive: true}
+	if err := ApplyServicePlanInput(&plan, input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if ok := servicePlanISPExists(c, tx, plan.ISPID); !ok {
+		return
+	}
+
+	if err := saveServicePlan(tx, &plan, ""); err != nil {
+		if service.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A service plan with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Service plan %d (%s) created with its RADIUS group", plan.ID, plan.Name)
+	c.JSON(http.StatusCreated, plan)
+}
+
+// UpdateServicePlan edits the service plan named in the path and regenerates
+// its RADIUS group. Renaming a plan moves the members of its group.
+func UpdateServicePlan(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	plan, ok := findServicePlan(c, tx)
+	if !ok {
+		return
+	}
+	var input dto.ServicePlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	if !ispAllowed(c, input.ISPID) {
+		return
+	}
+	previousName := plan.GroupName()
+	if err := ApplyServicePlanInput(plan, input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.ISPID != nil {
+		if ok := servicePlanISPExists(c, tx, plan.ISPID); !ok {
+			return
+		}
+	}
+
+	if err := saveServicePlan(tx, plan, previousName); err != nil {
+		if service.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A service plan with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// GetServicePlans lists the service plans of the caller's ISP, filtered by
+// the isp_id query parameter and paginated like GetOrders
+func GetServicePlans(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	query := tenant.Scope(tx.Model(&model.ServicePlan{}), "isp_id")
+	if ispID := c.Query("isp_id"); ispID != "" {
+		query = query.Where("isp_id = ?", ispID)
+	}
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count service plans"})
+		return
+	}
+	var plans []model.ServicePlan
+	if err := query.Session(&gorm.Session{}).Order("id").Offset(offset).Limit(limit).Find(&plans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve service plans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": plans,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
+
+// GetServicePlan returns the service plan named in the path
+func GetServicePlan(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	plan, ok := findServicePlan(c, tx)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// SyncServicePlanGroups regenerates the RADIUS groups of all service plans
+func SyncServicePlanGroups(c *gin.Context) {
+	synced, err := service.SyncAllPlanGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to synchronise RADIUS groups", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "RADIUS groups synchronised", "plans": synced})
+}
+
+// GetRadiusGroupDrift reports service plans whose RADIUS group attributes
+// no longer match the plan, and groups that belong to no plan
+func GetRadiusGroupDrift(c *gin.Context) {
+	report, err := service.FindRadiusGroupDrift()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare RADIUS groups", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// findServicePlan returns the plan named in the path when the caller may
+// manage it; plans of other ISPs are not found
+func findServicePlan(c *gin.Context, tx *gorm.DB) (*model.ServicePlan, bool) {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return nil, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service plan id"})
+		return nil, false
+	}
+	var plan model.ServicePlan
+	if err := tenant.Scope(tx, "isp_id").First(&plan, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service plan not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &plan, true
+}
+
+func servicePlanISPExists(c *gin.Context, tx *gorm.DB, ispID int64) bool {
+	var count int64
+	if err := tx.Model(&model.ISP{}).Where("id = ?", ispID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ISP not found"})
+		return false
+	}
+	return true
+}
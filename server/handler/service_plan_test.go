@@ -0,0 +1,46 @@
+package handler_test
+
+import (
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+func TestApplyServicePlanInput(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(n int) *int { return &n }
+	isp := int64(1)
+
+	tests := []struct {
+		name    string
+		input   dto.ServicePlanInput
+		wantErr bool
+	}{
+		{name: "valid", input: dto.ServicePlanInput{ISPID: &isp, Name: str("hour2"), Duration: num(7200), SpeedLimitMbps: str("3"), BurstLimitMbps: str("6")}},
+		{name: "no name", input: dto.ServicePlanInput{ISPID: &isp, Duration: num(7200)}, wantErr: true},
+		{name: "no isp", input: dto.ServicePlanInput{Name: str("hour2"), Duration: num(7200)}, wantErr: true},
+		{name: "no duration", input: dto.ServicePlanInput{ISPID: &isp, Name: str("hour2")}, wantErr: true},
+		{name: "bad speed", input: dto.ServicePlanInput{ISPID: &isp, Name: str("hour2"), Duration: num(7200), SpeedLimitMbps: str("3 Mbps")}, wantErr: true},
+		{name: "bad type", input: dto.ServicePlanInput{ISPID: &isp, Name: str("hour2"), Duration: num(7200), ServiceType: str("Fibre")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := model.ServicePlan{ServiceType: model.ServiceTypeHotspot}
+			if err := handler.ApplyServicePlanInput(&plan, tt.input); (err != nil) != tt.wantErr {
+				t.Errorf("ApplyServicePlanInput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// An edit keeps the fields it leaves out and clears the data limit with 0
+	limit := 1024
+	plan := model.ServicePlan{ISPID: 1, Name: "weekly", ServiceType: model.ServiceTypeHome, Duration: 604800, SpeedLimitMbps: "5", DataLimitMB: &limit}
+	if err := handler.ApplyServicePlanInput(&plan, dto.ServicePlanInput{Price: num(250), DataLimitMB: num(0)}); err != nil {
+		t.Fatalf("ApplyServicePlanInput() error = %v", err)
+	}
+	if plan.Price != 250 || plan.SpeedLimitMbps != "5" || plan.Name != "weekly" || plan.DataLimitMB != nil {
+		t.Errorf("ApplyServicePlanInput() = %+v, want the price changed, the data limit cleared and the rest kept", plan)
+	}
+}
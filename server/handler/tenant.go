@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/service"
+)
+
+// tenantKey is the gin context key TenantRequired stores the caller's tenant under
+const tenantKey = "tenant"
+
+// resolveTenant returns the tenant of the caller from the claims the JWT
+// middleware put on the context
+func resolveTenant(c *gin.Context) (service.Tenant, error) {
+	if t, ok := c.Get(tenantKey); ok {
+		if tenant, ok := t.(service.Tenant); ok {
+			return tenant, nil
+		}
+	}
+	authID := c.GetUint64("authID")
+	if authID == 0 {
+		return service.Tenant{}, service.ErrTenantMissing
+	}
+	return service.TenantFromClaims(authID, c.GetString("role"), c.GetString("scope"))
+}
+
+// TenantRequired lets through callers who act for an ISP, or for all of them,
+// and keeps their tenant on the context. It goes after the JWT middleware.
+func TenantRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, err := resolveTenant(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(tenantKey, tenant)
+		c.Next()
+	}
+}
+
+// PlatformAdminRequired only lets platform admins through, for routes whose
+// data is not split by ISP
+func PlatformAdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, err := resolveTenant(c)
+		if err != nil || !tenant.Platform() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "platform admin role required"})
+			return
+		}
+		c.Set(tenantKey, tenant)
+		c.Next()
+	}
+}
+
+// CallerTenant returns the tenant of the caller. It answers the request and
+// returns false when the caller acts for no ISP.
+func CallerTenant(c *gin.Context) (service.Tenant, bool) {
+	tenant, err := resolveTenant(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return tenant, false
+	}
+	return tenant, true
+}
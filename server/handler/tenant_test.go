@@ -0,0 +1,78 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+// asAccount sets the claims the JWT middleware puts on the context
+func asAccount(authID uint64, role, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authID != 0 {
+			c.Set("authID", authID)
+		}
+		c.Set("role", role)
+		c.Set("scope", scope)
+		c.Next()
+	}
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name         string
+		authID       uint64
+		role         string
+		scope        string
+		wantTenant   int
+		wantPlatform int
+	}{
+		{name: "platform admin", authID: 1, role: gmodel.RolePlatformAdmin, wantTenant: http.StatusOK, wantPlatform: http.StatusOK},
+		{name: "isp admin", authID: 2, role: gmodel.RoleISPAdmin, scope: gmodel.ISPScope(2), wantTenant: http.StatusOK, wantPlatform: http.StatusForbidden},
+		{name: "isp admin without isp", authID: 3, role: gmodel.RoleISPAdmin, wantTenant: http.StatusForbidden, wantPlatform: http.StatusForbidden},
+		{name: "no role", authID: 4, scope: gmodel.ISPScope(2), wantTenant: http.StatusForbidden, wantPlatform: http.StatusForbidden},
+		{name: "no token", role: gmodel.RolePlatformAdmin, wantTenant: http.StatusForbidden, wantPlatform: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(asAccount(tt.authID, tt.role, tt.scope))
+			ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+			r.GET("/tenant", handler.TenantRequired(), ok)
+			r.GET("/platform", handler.PlatformAdminRequired(), ok)
+
+			for path, want := range map[string]int{"/tenant": tt.wantTenant, "/platform": tt.wantPlatform} {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != want {
+					t.Errorf("GET %s = %d, want %d", path, w.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMpesaAccountOfOtherISP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := handler.NewMpesaAccountHandler(nil, nil)
+	r := gin.New()
+	r.Use(asAccount(2, gmodel.RoleISPAdmin, gmodel.ISPScope(2)))
+	isps := r.Group("/isps", handler.TenantRequired())
+	isps.GET("/:ispId/account", h.GetMpesaAccount)
+	isps.PUT("/:ispId/account", h.SaveMpesaAccount)
+	isps.DELETE("/:ispId/account", h.DeleteMpesaAccount)
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/isps/3/account", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s /isps/3/account as ISP 2 = %d, want %d", method, w.Code, http.StatusNotFound)
+		}
+	}
+}
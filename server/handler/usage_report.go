@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/service"
+)
+
+const (
+	// DefaultUsageReportDays is the range of a usage report without dates
+	DefaultUsageReportDays = 30
+	// MaxUsageReportDays bounds the range of a usage report
+	MaxUsageReportDays = 366
+	// UsageExportLimit bounds the rows of a CSV usage export
+	UsageExportLimit = 10000
+)
+
+// ParseUsageFilter reads the from and to (YYYY-MM-DD, both inclusive),
+// username, nas and realm query parameters of a usage report. Without dates
+// the report covers the last DefaultUsageReportDays days up to now.
+func ParseUsageFilter(c *gin.Context, now time.Time) (service.UsageFilter, error) {
+	filter := service.UsageFilter{
+		Username:     c.Query("username"),
+		NasIPAddress: c.Query("nas"),
+		Realm:        c.Query("realm"),
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	filter.To = today.AddDate(0, 0, 1)
+	if value := c.Query("to"); value != "" {
+		day, err := time.ParseInLocation("2006-01-02", value, now.Location())
+		if err != nil {
+			return filter, errors.New("to must be a date in YYYY-MM-DD format")
+		}
+		filter.To = day.AddDate(0, 0, 1) // Include the whole day
+	}
+	filter.From = filter.To.AddDate(0, 0, -DefaultUsageReportDays)
+	if value := c.Query("from"); value != "" {
+		day, err := time.ParseInLocation("2006-01-02", value, now.Location())
+		if err != nil {
+			return filter, errors.New("from must be a date in YYYY-MM-DD format")
+		}
+		filter.From = day
+	}
+
+	if !filter.From.Before(filter.To) {
+		return filter, errors.New("from must not be after to")
+	}
+	if filter.To.Sub(filter.From) > MaxUsageReportDays*24*time.Hour {
+		return filter, fmt.Errorf("a usage report covers at most %d days", MaxUsageReportDays)
+	}
+	return filter, nil
+}
+
+// GetUsageSummary totals the accounting sessions matching the filters of
+// ParseUsageFilter, with the most sessions open at once
+func GetUsageSummary(c *gin.Context) {
+	now := time.Now()
+	filter, err := ParseUsageFilter(c, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := service.SummariseUsage(filter, now)
+	if err != nil {
+		log.Printf("Failed to summarise usage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarise usage"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": summary,
+		"meta": gin.H{
+			"from": filter.From,
+			"to":   filter.To,
+		},
+	})
+}
+
+// GetUsageReport aggregates the accounting sessions matching the filters of
+// ParseUsageFilter by the dimension in the path: users, nas, realms, hourly,
+// daily, monthly or peak-hours. It is sorted by the sort query parameter and
+// paginated like GetOrders, or exported whole with format=csv.
+func GetUsageReport(c *gin.Context) {
+	dimension := c.Param("dimension")
+	filter, err := ParseUsageFilter(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	export := c.Query("format") == "csv"
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	if export {
+		page, limit = 1, UsageExportLimit
+	}
+	offset := (page - 1) * limit
+
+	rows, total, err := service.UsageReport(dimension, filter, c.Query("sort"), offset, limit)
+	switch {
+	case errors.Is(err, service.ErrUnknownUsageDimension):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "dimensions": service.UsageDimensions()})
+		return
+	case errors.Is(err, service.ErrUnknownUsageSort):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to report usage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to report usage"})
+		return
+	}
+
+	if export {
+		if total > int64(len(rows)) {
+			c.Header("X-Truncated", "true")
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s-%s.csv"`,
+			dimension, filter.From.Format("2006-01-02"), filter.To.AddDate(0, 0, -1).Format("2006-01-02")))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := WriteUsageCSV(c.Writer, dimension, rows); err != nil {
+			log.Printf("Failed to export %s usage: %v", dimension, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": rows,
+		"meta": gin.H{
+			"total": total,
+			"page":  page,
+			"limit": limit,
+			"from":  filter.From,
+			"to":    filter.To,
+		},
+	})
+}
+
+// WriteUsageCSV writes the rows of a usage report by dimension as CSV
+func WriteUsageCSV(w io.Writer, dimension string, rows []service.UsageRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{dimension, "sessions", "active_sessions", "users", "session_time", "upload_octets", "download_octets", "total_octets"}); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err := cw.Write([]string{
+			row.Bucket,
+			strconv.FormatInt(row.Sessions, 10),
+			strconv.FormatInt(row.ActiveSessions, 10),
+			strconv.FormatInt(row.Users, 10),
+			strconv.FormatInt(row.SessionTime, 10),
+			strconv.FormatInt(row.UploadOctets, 10),
+			strconv.FormatInt(row.DownloadOctets, 10),
+			strconv.FormatInt(row.TotalOctets(), 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,92 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ortupik/wifigo/server/handler"
+	"github.com/ortupik/wifigo/server/service"
+)
+
+func TestParseUsageFilter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 15, 4, 5, 0, time.UTC)
+	day := func(d string) time.Time {
+		v, _ := time.ParseInLocation("2006-01-02", d, time.UTC)
+		return v
+	}
+	tests := []struct {
+		name     string
+		query    string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{name: "default", query: "", wantFrom: day("2026-09-18"), wantTo: day("2026-10-18")},
+		{name: "range", query: "from=2026-10-01&to=2026-10-07", wantFrom: day("2026-10-01"), wantTo: day("2026-10-08")},
+		{name: "single day", query: "from=2026-10-07&to=2026-10-07", wantFrom: day("2026-10-07"), wantTo: day("2026-10-08")},
+		{name: "only to", query: "to=2026-06-30", wantFrom: day("2026-06-01"), wantTo: day("2026-07-01")},
+		{name: "bad date", query: "from=17/10/2026", wantErr: true},
+		{name: "reversed", query: "from=2026-10-08&to=2026-10-07", wantErr: true},
+		{name: "too long", query: "from=2024-01-01&to=2026-10-07", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/reports/usage/users?"+tt.query, nil)
+
+			filter, err := handler.ParseUsageFilter(c, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUsageFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (!filter.From.Equal(tt.wantFrom) || !filter.To.Equal(tt.wantTo)) {
+				t.Errorf("ParseUsageFilter() = %s to %s, want %s to %s", filter.From, filter.To, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestParseUsageFilterNarrowing(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/reports/usage/daily?username=0712345678@Tecsurf&nas=10.0.0.1&realm=Tecsurf", nil)
+
+	filter, err := handler.ParseUsageFilter(c, time.Now())
+	if err != nil {
+		t.Fatalf("ParseUsageFilter() error = %v", err)
+	}
+	if filter.Username != "0712345678@Tecsurf" || filter.NasIPAddress != "10.0.0.1" || filter.Realm != "Tecsurf" {
+		t.Errorf("ParseUsageFilter() = %+v, want the username, nas and realm", filter)
+	}
+}
+
+func TestWriteUsageCSV(t *testing.T) {
+	rows := []service.UsageRow{
+		{Bucket: "0712345678@Tecsurf", UsageTotals: service.UsageTotals{Sessions: 3, ActiveSessions: 1, Users: 1, SessionTime: 5400, UploadOctets: 1000, DownloadOctets: 9000}},
+		{Bucket: "0722000000@Tecsurf", UsageTotals: service.UsageTotals{Sessions: 1, Users: 1, SessionTime: 60}},
+	}
+
+	var buf bytes.Buffer
+	if err := handler.WriteUsageCSV(&buf, service.UsageByUser, rows); err != nil {
+		t.Fatalf("WriteUsageCSV() error = %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read CSV: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want a header and 2 rows", len(records))
+	}
+	if records[0][0] != service.UsageByUser {
+		t.Errorf("header = %v, want the dimension first", records[0])
+	}
+	want := []string{"0712345678@Tecsurf", "3", "1", "1", "5400", "1000", "9000", "10000"}
+	for i, v := range want {
+		if records[1][i] != v {
+			t.Errorf("row[%d] = %q, want %q", i, records[1][i], v)
+		}
+	}
+}
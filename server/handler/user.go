@@ -12,14 +12,15 @@ import (
 	gmodel "github.com/ortupik/wifigo/database/model"
 
 	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/service"
 )
 
 // GetUsers handles jobs for controller.GetUsers
-func GetUsers() (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+func GetUsers(tenant service.Tenant) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
 	db := gdatabase.GetDB(config.AppDB)
 	users := []model.User{}
 
-	if err := db.Find(&users).Error; err != nil {
+	if err := tenant.ScopeAccounts(db, "id_auth").Find(&users).Error; err != nil {
 		log.WithError(err).Error("error code: 1101")
 		httpResponse.Message = "internal server error"
 		httpStatusCode = http.StatusInternalServerError
@@ -38,11 +39,11 @@ func GetUsers() (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
 }
 
 // GetUser handles jobs for controller.GetUser
-func GetUser(id string) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
+func GetUser(tenant service.Tenant, id string) (httpResponse gmodel.HTTPResponse, httpStatusCode int) {
 	db := gdatabase.GetDB(config.AppDB)
 	user := model.User{}
 
-	if err := db.Where("user_id = ?", id).First(&user).Error; err != nil {
+	if err := tenant.ScopeAccounts(db, "id_auth").Where("user_id = ?", id).First(&user).Error; err != nil {
 		httpResponse.Message = "user not found"
 		httpStatusCode = http.StatusNotFound
 		return
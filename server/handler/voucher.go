@@ -0,0 +1,653 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/queue"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/ortupik/wifigo/websocket"
+)
+
+// Voucher batch defaults and limits
+const (
+	DefaultVoucherCodeLength = 8
+	MinVoucherCodeLength     = 6
+	MaxVoucherCodeLength     = 16
+	MaxVoucherBatchSize      = 1000
+	maxVoucherPrefixLength   = 8
+)
+
+// VoucherBatchRequest is the body of a request to generate vouchers
+type VoucherBatchRequest struct {
+	ServicePlanID int    `json:"service_plan_id" binding:"required"`
+	ISPID         int64  `json:"isp_id"` // Optional, checked against the plan's ISP
+	Quantity      int    `json:"quantity" binding:"required"`
+	Name          string `json:"name"`
+	Seller        string `json:"seller"`
+	Prefix        string `json:"prefix"`
+	CodeLength    int    `json:"code_length"`
+	Devices       int    `json:"devices"`
+}
+
+// Validate checks the request and fills in the defaults
+func (req *VoucherBatchRequest) Validate() error {
+	if req.Quantity < 1 || req.Quantity > MaxVoucherBatchSize {
+		return fmt.Errorf("quantity must be between 1 and %d", MaxVoucherBatchSize)
+	}
+	if req.CodeLength == 0 {
+		req.CodeLength = DefaultVoucherCodeLength
+	}
+	if req.CodeLength < MinVoucherCodeLength || req.CodeLength > MaxVoucherCodeLength {
+		return fmt.Errorf("code_length must be between %d and %d", MinVoucherCodeLength, MaxVoucherCodeLength)
+	}
+	req.Prefix = service.NormalizeVoucherCode(req.Prefix)
+	if len(req.Prefix) > maxVoucherPrefixLength {
+		return fmt.Errorf("prefix must be at most %d characters", maxVoucherPrefixLength)
+	}
+	for _, r := range req.Prefix {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return errors.New("prefix may only contain letters and digits")
+		}
+	}
+	if req.Devices == 0 {
+		req.Devices = 1
+	}
+	if req.Devices < 1 {
+		return errors.New("devices must be at least 1")
+	}
+	return nil
+}
+
+// GenerateVoucherBatch draws the codes of a new batch for plan and creates a
+// RADIUS user in the plan's group for each. The users are rejected until the
+// voucher is redeemed.
+func GenerateVoucherBatch(req VoucherBatchRequest, plan model.ServicePlan, createdBy string) (*model.VoucherBatch, []model.Voucher, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return nil, nil, errors.New("database is not initialised")
+	}
+
+	codes, err := service.GenerateVoucherCodes(req.Quantity, req.CodeLength, req.Prefix, service.TakenVoucherCodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch := &model.VoucherBatch{
+		Name:          req.Name,
+		ISPID:         plan.ISPID,
+		ServicePlanID: plan.ID,
+		Quantity:      len(codes),
+		Devices:       req.Devices,
+		Seller:        req.Seller,
+		CreatedBy:     createdBy,
+	}
+	if batch.Name == "" {
+		batch.Name = fmt.Sprintf("%s %s", plan.Name, time.Now().Format("2006-01-02 15:04"))
+	}
+	vouchers := make([]model.Voucher, len(codes))
+	for i, code := range codes {
+		vouchers[i] = model.Voucher{
+			Code:          code,
+			ISPID:         plan.ISPID,
+			ServicePlanID: plan.ID,
+			Status:        model.VoucherStatusUnused,
+			Seller:        req.Seller,
+		}
+	}
+
+	// The RADIUS users are committed first: should the batch fail to commit
+	// afterwards, they are left rejected and cannot be used
+	err = appDB.Transaction(func(tx *gorm.DB) error {
+		if err := service.CreateVoucherBatch(tx, batch, vouchers); err != nil {
+			return err
+		}
+		return radiusDB.Transaction(func(rtx *gorm.DB) error {
+			for _, code := range codes {
+				if err := insertRadCheck(rtx, code, AttrCleartextPassword, defaultOp, code); err != nil {
+					return err
+				}
+				if err := insertRadCheck(rtx, code, AttrAuthType, defaultOp, "Reject"); err != nil {
+					return err
+				}
+				if err := insertRadUserGroup(rtx, code, plan.GroupName(), 1); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch.ServicePlan = plan
+	log.Printf("Voucher batch %d: %d vouchers for plan %s generated by %s", batch.ID, len(vouchers), plan.Name, createdBy)
+	return batch, vouchers, nil
+}
+
+// activateVoucherUser lets the RADIUS user of a voucher in until expiresAt,
+// with dataLimit bytes to use when the plan has a data cap
+func activateVoucherUser(code string, expiresAt time.Time, devices int, dataLimit uint64) error {
+	db := gdatabase.GetDB(config.RadiusDB)
+	if db == nil {
+		return errors.New("database connection not available")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := deleteRadCheckAttributeTx(tx, code, AttrAuthType); err != nil {
+			return err
+		}
+		if err := deleteRadCheckAttributeTx(tx, code, AttrExpirationDate); err != nil {
+			return err
+		}
+		if err := deleteRadCheckAttributeTx(tx, code, AttrSimultaneousUse); err != nil {
+			return err
+		}
+		if err := insertRadCheck(tx, code, AttrExpirationDate, defaultOp, expiresAt.Format(model.RadiusExpirationLayout)); err != nil {
+			return err
+		}
+		if err := insertRadCheck(tx, code, AttrSimultaneousUse, defaultOp, strconv.Itoa(devices)); err != nil {
+			return err
+		}
+		_, err := service.SetUserDataLimit(tx, code, dataLimit, dataLimit > 0)
+		return err
+	})
+}
+
+// WriteVoucherCSV writes the vouchers of batch as CSV, one row per voucher
+func WriteVoucherCSV(w io.Writer, batch *model.VoucherBatch, vouchers []model.Voucher) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"code", "batch", "plan", "price", "validity", "devices", "status", "seller", "redeemed_at", "expires_at"}); err != nil {
+		return err
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, v := range vouchers {
+		err := cw.Write([]string{
+			v.Code,
+			batch.Name,
+			batch.ServicePlan.Name,
+			strconv.Itoa(batch.ServicePlan.Price),
+			batch.ServicePlan.Validity,
+			strconv.Itoa(batch.Devices),
+			v.Status,
+			v.Seller,
+			formatTime(v.RedeemedAt),
+			formatTime(v.ExpiresAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// CreateVoucherBatch generates a batch of vouchers for the service plan in the
+// JSON body and returns it with the codes
+func CreateVoucherBatch(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	var req VoucherBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// ISP accounts generate vouchers for the plans of their own ISP, which the
+	// batch and its vouchers then belong to
+	var plan model.ServicePlan
+	if err := tenant.Scope(tx, "isp_id").First(&plan, req.ServicePlanID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service plan not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ISPID != 0 && req.ISPID != plan.ISPID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Service plan does not belong to this ISP"})
+		return
+	}
+
+	createdBy := c.GetString("email")
+	if createdBy == "" {
+		if authID, ok := c.Get("authID"); ok {
+			createdBy = fmt.Sprint(authID)
+		}
+	}
+
+	batch, vouchers, err := GenerateVoucherBatch(req, plan, createdBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate vouchers", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"batch": batch, "vouchers": vouchers})
+}
+
+// GetVoucherBatches lists the voucher batches of the caller's ISP, newest
+// first, filtered by the isp_id, plan_id and seller query parameters and
+// paginated like GetOrders
+func GetVoucherBatches(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	page, limit, offset := voucherPage(c)
+	query := tenant.Scope(tx.Model(&model.VoucherBatch{}), "isp_id")
+	if ispID := c.Query("isp_id"); ispID != "" {
+		query = query.Where("isp_id = ?", ispID)
+	}
+	if planID := c.Query("plan_id"); planID != "" {
+		query = query.Where("servicePlanId = ?", planID)
+	}
+	if seller := c.Query("seller"); seller != "" {
+		query = query.Where("seller = ?", seller)
+	}
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count voucher batches"})
+		return
+	}
+	var batches []model.VoucherBatch
+	if err := query.Session(&gorm.Session{}).Preload("ServicePlan").Order("id DESC").Offset(offset).Limit(limit).Find(&batches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve voucher batches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": batches,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
+
+// GetVoucherBatch returns the batch named in the path with the number of its
+// vouchers in each status
+func GetVoucherBatch(c *gin.Context) {
+	batch, ok := findVoucherBatch(c, gdatabase.GetDB(config.AppDB))
+	if !ok {
+		return
+	}
+	counts, err := service.CountVouchersByStatus(batch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"batch": batch, "statuses": counts})
+}
+
+// GetVouchers lists the vouchers of the caller's ISP filtered by the
+// batch_id, status, seller and code query parameters and paginated like
+// GetOrders
+func GetVouchers(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	page, limit, offset := voucherPage(c)
+	query := tenant.Scope(tx.Model(&model.Voucher{}), "isp_id")
+	if batchID := c.Query("batch_id"); batchID != "" {
+		query = query.Where("batchId = ?", batchID)
+	}
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case model.VoucherStatusUnused, model.VoucherStatusRedeemed, model.VoucherStatusVoid, model.VoucherStatusExhausted, model.VoucherStatusExpired:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be unused, redeemed, void, exhausted or expired"})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+	if seller := c.Query("seller"); seller != "" {
+		query = query.Where("seller = ?", seller)
+	}
+	if code := c.Query("code"); code != "" {
+		query = query.Where("code = ?", service.NormalizeVoucherCode(code))
+	}
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count vouchers"})
+		return
+	}
+	var vouchers []model.Voucher
+	if err := query.Session(&gorm.Session{}).Order("id DESC").Offset(offset).Limit(limit).Find(&vouchers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve vouchers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": vouchers,
+		"meta": gin.H{
+			"total": count,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
+
+// UpdateVoucher assigns the voucher named in the path to another seller or,
+// with status void, withdraws it while it is unused. Vouchers of other ISPs
+// are not found.
+func UpdateVoucher(c *gin.Context, tx *gorm.DB) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.AppDB)
+	}
+
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Seller *string `json:"seller"`
+		Status string  `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	if input.Status != "" && input.Status != model.VoucherStatusVoid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status can only be set to void"})
+		return
+	}
+
+	voucher, err := service.FindVoucherByCode(tenant.Scope(tx, "isp_id"), service.NormalizeVoucherCode(c.Param("code")))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Voucher not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if input.Seller != nil {
+		updates["seller"] = *input.Seller
+	}
+	query := tx.Model(&model.Voucher{}).Where("id = ?", voucher.ID)
+	if input.Status == model.VoucherStatusVoid {
+		// The RADIUS user of an unused voucher is already rejected
+		updates["status"] = model.VoucherStatusVoid
+		query = query.Where("status IN ?", []string{model.VoucherStatusUnused, model.VoucherStatusVoid})
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusOK, voucher)
+		return
+	}
+
+	result := query.Updates(updates)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update voucher"})
+		return
+	}
+	if result.RowsAffected == 0 && input.Status == model.VoucherStatusVoid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only unused vouchers can be voided"})
+		return
+	}
+
+	voucher, err = service.FindVoucherByCode(tx, voucher.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, voucher)
+}
+
+// ExportVoucherBatchCSV downloads the vouchers of the batch named in the path
+// as a CSV file
+func ExportVoucherBatchCSV(c *gin.Context) {
+	batch, ok := findVoucherBatch(c, gdatabase.GetDB(config.AppDB))
+	if !ok {
+		return
+	}
+	vouchers, err := service.FindBatchVouchers(batch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="vouchers-%d.csv"`, batch.ID))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := WriteVoucherCSV(c.Writer, batch, vouchers); err != nil {
+		log.Printf("Failed to export voucher batch %d: %v", batch.ID, err)
+	}
+}
+
+// PrintVoucherBatch renders the unused vouchers of the batch named in the path
+// as cards on an A4 sheet, to be printed or saved as PDF from the browser
+func PrintVoucherBatch(c *gin.Context) {
+	batch, ok := findVoucherBatch(c, gdatabase.GetDB(config.AppDB))
+	if !ok {
+		return
+	}
+	vouchers, err := service.FindBatchVouchers(batch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	unused := vouchers[:0]
+	for _, v := range vouchers {
+		if v.Status == model.VoucherStatusUnused {
+			unused = append(unused, v)
+		}
+	}
+
+	var isp model.ISP
+	if err := gdatabase.GetDB(config.AppDB).First(&isp, batch.ISPID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.HTML(http.StatusOK, "vouchers_print.html", gin.H{
+		"Batch":    batch,
+		"Plan":     batch.ServicePlan,
+		"ISP":      isp,
+		"Vouchers": unused,
+	})
+}
+
+// findVoucherBatch loads the batch named by the id path parameter when the
+// caller may manage it, writing the error response when there is none;
+// batches of other ISPs are not found
+func findVoucherBatch(c *gin.Context, tx *gorm.DB) (*model.VoucherBatch, bool) {
+	tenant, ok := CallerTenant(c)
+	if !ok {
+		return nil, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch id"})
+		return nil, false
+	}
+	batch, err := service.FindVoucherBatch(tenant.Scope(tx, "isp_id"), id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Voucher batch not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return batch, true
+}
+
+func voucherPage(c *gin.Context) (page, limit, offset int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ = strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	return page, limit, (page - 1) * limit
+}
+
+// VoucherHandler redeems vouchers from the captive portal
+type VoucherHandler struct {
+	queue    *queue.Client
+	wsHub    *websocket.Hub
+	throttle *RedeemThrottle
+}
+
+// NewVoucherHandler creates a new instance of VoucherHandler, throttling
+// failed redemptions at the default rates
+func NewVoucherHandler(queueClient *queue.Client, wsHub *websocket.Hub) *VoucherHandler {
+	return &VoucherHandler{
+		queue:    queueClient,
+		wsHub:    wsHub,
+		throttle: NewRedeemThrottle(DefaultRedeemDeviceRate, DefaultRedeemSenderRate),
+	}
+}
+
+// UseThrottle replaces the throttle of failed redemptions
+func (h *VoucherHandler) UseThrottle(throttle *RedeemThrottle) {
+	h.throttle = throttle
+}
+
+// RedeemVoucher activates the voucher in the JSON body for the device at ip
+// and logs the device in on the hotspot through the MikroTik login queue. A
+// voucher whose session is still running logs another device in, up to the
+// batch's device limit which RADIUS enforces. Only the hotspots of the
+// voucher's ISP accept it, and devices that fail too often are turned away.
+func (h *VoucherHandler) RedeemVoucher(c *gin.Context) {
+	var req dto.VoucherRedeemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "err": err.Error()})
+		return
+	}
+	code := service.NormalizeVoucherCode(req.Code)
+
+	ctx := c.Request.Context()
+	if !h.throttle.Allowed(ctx, c.ClientIP(), req.Ip, req.Mac) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts, try again later"})
+		return
+	}
+	refuse := func(status int, err error) {
+		h.throttle.Failed(ctx, c.ClientIP(), req.Ip, req.Mac)
+		c.JSON(status, gin.H{"error": err.Error()})
+	}
+
+	db := gdatabase.GetDB(config.AppDB)
+	voucher, err := service.FindVoucherByCode(db, code)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			refuse(http.StatusNotFound, service.ErrVoucherNotFound)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := service.CheckVoucherDevice(db, voucher, req.DeviceID); err != nil {
+		if errors.Is(err, service.ErrVoucherNotFound) {
+			refuse(http.StatusNotFound, err)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	batch, err := service.FindVoucherBatch(db, voucher.BatchID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch voucher batch", "details": err.Error()})
+		return
+	}
+
+	voucher, redeemed, err := service.RedeemVoucher(code, req.Ip, req.Mac, req.DeviceID, batch.ServicePlan.Duration, time.Now())
+	switch {
+	case errors.Is(err, service.ErrVoucherNotFound):
+		refuse(http.StatusNotFound, err)
+		return
+	case errors.Is(err, service.ErrVoucherUsed), errors.Is(err, service.ErrVoucherVoid):
+		refuse(http.StatusConflict, err)
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if redeemed {
+		if err := activateVoucherUser(code, *voucher.ExpiresAt, batch.Devices, service.DataLimitBytes(batch.ServicePlan)); err != nil {
+			if releaseErr := service.ReleaseVoucher(voucher.ID); releaseErr != nil {
+				log.Printf("Failed to release voucher %s: %v", code, releaseErr)
+			}
+			h.wsHub.SendToIP(req.Ip, []byte(fmt.Sprintf(`{"type":"create_account", "status": "failed", "message": %q}`, "Failed to activate voucher")))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate voucher", "details": err.Error()})
+			return
+		}
+		log.Printf("Voucher %s of batch %d redeemed by %s (%s)", code, batch.ID, req.Ip, req.Mac)
+	}
+	h.wsHub.SendToIP(req.Ip, []byte(fmt.Sprintf(`{"type":"create_account", "status": "success", "message": %q}`, "Voucher activated")))
+
+	loginPayload := dto.MikrotikLogin{
+		DeviceID: req.DeviceID,
+		Address:  req.Ip,
+		Username: code,
+		Password: code,
+	}
+	enqueueCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	loginTaskID := asynq.TaskID(fmt.Sprintf("voucher-login-%s-%s", code, req.Ip))
+	if _, err := h.queue.EnqueueMikrotikCommand(enqueueCtx, queue.ActionMikrotikLoginUser, loginPayload, queue.QueueCritical, loginTaskID); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Voucher activated but the login could not be queued", "details": err.Error(), "username": code})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Voucher activated",
+		"username":   code,
+		"password":   code,
+		"plan":       batch.ServicePlan.Name,
+		"devices":    batch.Devices,
+		"expires_at": voucher.ExpiresAt,
+	})
+}
@@ -0,0 +1,124 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/handler"
+)
+
+func TestVoucherBatchRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     handler.VoucherBatchRequest
+		wantErr bool
+	}{
+		{name: "defaults", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10}},
+		{name: "prefix", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, Prefix: "ts-1"}},
+		{name: "no vouchers", req: handler.VoucherBatchRequest{ServicePlanID: 1}, wantErr: true},
+		{name: "too many", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: handler.MaxVoucherBatchSize + 1}, wantErr: true},
+		{name: "short codes", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, CodeLength: 4}, wantErr: true},
+		{name: "long prefix", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, Prefix: "TECSURF123"}, wantErr: true},
+		{name: "symbols in prefix", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, Prefix: "T$"}, wantErr: true},
+		{name: "negative devices", req: handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, Devices: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := req.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (req.CodeLength == 0 || req.Devices == 0) {
+				t.Errorf("Validate() = %+v, want the defaults filled in", req)
+			}
+		})
+	}
+
+	req := handler.VoucherBatchRequest{ServicePlanID: 1, Quantity: 10, Prefix: "ts-1"}
+	if err := req.Validate(); err != nil || req.Prefix != "TS1" {
+		t.Errorf("Validate() prefix = %q, %v, want TS1", req.Prefix, err)
+	}
+}
+
+func TestWriteVoucherCSV(t *testing.T) {
+	redeemedAt := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	expiresAt := redeemedAt.Add(time.Hour)
+	batch := &model.VoucherBatch{
+		ID:          3,
+		Name:        "June",
+		Devices:     2,
+		ServicePlan: model.ServicePlan{Name: "1 Hour", Price: 10, Validity: "1 hour"},
+	}
+	vouchers := []model.Voucher{
+		{Code: "AB23CD45", Status: model.VoucherStatusUnused, Seller: "Shop A"},
+		{Code: "EF67GH89", Status: model.VoucherStatusRedeemed, Seller: "Shop A", RedeemedAt: &redeemedAt, ExpiresAt: &expiresAt},
+	}
+
+	var buf bytes.Buffer
+	if err := handler.WriteVoucherCSV(&buf, batch, vouchers); err != nil {
+		t.Fatalf("WriteVoucherCSV() error = %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("exported CSV does not parse: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "code" {
+		t.Fatalf("rows = %v, want a header and 2 vouchers", rows)
+	}
+	want := []string{"EF67GH89", "June", "1 Hour", "10", "1 hour", "2", "redeemed", "Shop A", "2025-06-01T10:00:00Z", "2025-06-01T11:00:00Z"}
+	for i, v := range want {
+		if rows[2][i] != v {
+			t.Errorf("row %v, column %d = %q, want %q", rows[2], i, rows[2][i], v)
+		}
+	}
+	if rows[1][8] != "" {
+		t.Errorf("redeemed_at of an unused voucher = %q, want empty", rows[1][8])
+	}
+}
+
+func TestRedeemThrottle(t *testing.T) {
+	ctx := context.Background()
+	throttle := handler.NewRedeemThrottle(limiter.Rate{Period: time.Hour, Limit: 2}, limiter.Rate{Period: time.Hour, Limit: 4})
+
+	// A device is turned away after two failures, by address or by MAC
+	for i := 0; i < 2; i++ {
+		if !throttle.Allowed(ctx, "41.90.0.1", "10.5.50.2", "aa:bb:cc:00:00:01") {
+			t.Fatalf("attempt %d refused, want it allowed", i+1)
+		}
+		throttle.Failed(ctx, "41.90.0.1", "10.5.50.2", "aa:bb:cc:00:00:01")
+	}
+	tests := []struct {
+		name    string
+		sender  string
+		ip      string
+		mac     string
+		allowed bool
+	}{
+		{name: "same device", sender: "41.90.0.1", ip: "10.5.50.2", mac: "aa:bb:cc:00:00:01"},
+		{name: "new address, same mac", sender: "41.90.0.1", ip: "10.5.50.3", mac: "AA:BB:CC:00:00:01"},
+		{name: "same address, no mac", sender: "41.90.0.1", ip: "10.5.50.2"},
+		{name: "other device", sender: "41.90.0.1", ip: "10.5.50.4", mac: "aa:bb:cc:00:00:02", allowed: true},
+		{name: "other hotspot", sender: "41.90.0.2", ip: "10.5.50.4", mac: "aa:bb:cc:00:00:02", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := throttle.Allowed(ctx, tt.sender, tt.ip, tt.mac); got != tt.allowed {
+				t.Errorf("Allowed() = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+
+	// Devices that each stay under their limit still exhaust their sender's
+	throttle.Failed(ctx, "41.90.0.1", "10.5.50.5", "")
+	throttle.Failed(ctx, "41.90.0.1", "10.5.50.6", "")
+	if throttle.Allowed(ctx, "41.90.0.1", "10.5.50.7", "") {
+		t.Error("Allowed() = true after the sender's limit was reached, want false")
+	}
+}
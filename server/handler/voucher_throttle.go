@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+// Default limits on failed voucher redemptions. A device is known by its
+// hotspot address and MAC; the sender is the address the requests come from,
+// which all the devices behind a hotspot may share.
+var (
+	DefaultRedeemDeviceRate = limiter.Rate{Period: time.Hour, Limit: 10}
+	DefaultRedeemSenderRate = limiter.Rate{Period: time.Hour, Limit: 100}
+)
+
+// RedeemThrottle counts the failed voucher redemptions of each device and
+// sender, and turns them away once they have failed too often, so codes
+// cannot be guessed. Successful redemptions are not counted.
+type RedeemThrottle struct {
+	device *limiter.Limiter
+	sender *limiter.Limiter
+}
+
+// NewRedeemThrottle creates a RedeemThrottle allowing deviceRate failures per
+// device address and MAC, and senderRate failures per sender
+func NewRedeemThrottle(deviceRate, senderRate limiter.Rate) *RedeemThrottle {
+	store := memory.NewStore()
+	return &RedeemThrottle{
+		device: limiter.New(store, deviceRate),
+		sender: limiter.New(store, senderRate),
+	}
+}
+
+type throttleKey struct {
+	limiter *limiter.Limiter
+	key     string
+}
+
+func (t *RedeemThrottle) keys(sender, ip, mac string) []throttleKey {
+	keys := []throttleKey{
+		{t.sender, "voucher-sender:" + sender},
+		{t.device, "voucher-ip:" + ip},
+	}
+	if mac != "" {
+		keys = append(keys, throttleKey{t.device, "voucher-mac:" + strings.ToUpper(mac)})
+	}
+	return keys
+}
+
+// Allowed reports whether the device at ip with mac may try a code, asked by
+// sender. The store failing lets the request through.
+func (t *RedeemThrottle) Allowed(ctx context.Context, sender, ip, mac string) bool {
+	for _, k := range t.keys(sender, ip, mac) {
+		lc, err := k.limiter.Peek(ctx, k.key)
+		if err != nil {
+			log.Printf("Failed to check voucher redemptions of %s: %v", k.key, err)
+			continue
+		}
+		if lc.Remaining == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed counts a failed redemption against the device and the sender
+func (t *RedeemThrottle) Failed(ctx context.Context, sender, ip, mac string) {
+	for _, k := range t.keys(sender, ip, mac) {
+		if _, err := k.limiter.Increment(ctx, k.key, 1); err != nil {
+			log.Printf("Failed to count voucher redemption of %s: %v", k.key, err)
+		}
+	}
+}
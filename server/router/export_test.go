@@ -0,0 +1,4 @@
+package router
+
+// RegisterOrderRoutes exposes registerOrderRoutes to the tests
+var RegisterOrderRoutes = registerOrderRoutes
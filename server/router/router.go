@@ -1,6 +1,8 @@
 package router
 
 import (
+	"fmt"
+
 	"github.com/gin-gonic/gin"
 
 	storage "github.com/ortupik/wifigo/badger"
@@ -10,18 +12,23 @@ import (
 	gmiddleware "github.com/ortupik/wifigo/lib/middleware"
 	queue "github.com/ortupik/wifigo/queue"
 	"github.com/ortupik/wifigo/server/controller"
+	"github.com/ortupik/wifigo/server/database/model"
 	gservice "github.com/ortupik/wifigo/service"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	mikrotik "github.com/ortupik/wifigo/mikrotik"
 	handler "github.com/ortupik/wifigo/server/handler"
+	service "github.com/ortupik/wifigo/server/service"
 	"github.com/ortupik/wifigo/websocket"
 )
 
 var (
 	mikrotikController   *controller.MikroTikController
 	mpesaCallbackHandler *handler.MpesaCallbackHandler
+	mpesaRefundHandler   *handler.MpesaRefundHandler
+	mpesaAccountHandler  *handler.MpesaAccountHandler
+	voucherHandler       *handler.VoucherHandler
 	mpesaController      *controller.MpesaController // Use the correct controller package
 )
 
@@ -54,8 +61,32 @@ func SetupRouter(configure *gconfig.Configuration, store *storage.Store,
 
 	// Initialize handlers and controllers
 	mpesaCallbackHandler = handler.NewMpesaCallbackHandler(queueClient, wsHub)
-	mpesaController = controller.NewMpesaController()
-	mikrotikController = controller.NewMikroTikController(manager)
+	var err error
+	mpesaController, err = controller.NewMpesaController()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up M-Pesa: %w", err)
+	}
+	if err := mpesaCallbackHandler.AllowSources(mpesaController.MpesaStkHandler.Config().CallbackAllowedIPs); err != nil {
+		return nil, fmt.Errorf("failed to set up M-Pesa callbacks: %w", err)
+	}
+	if store != nil {
+		// ISPs with an M-Pesa account of their own collect into it
+		mpesaController.MpesaStkHandler.UseAccountStore(store)
+		mpesaAccountHandler = handler.NewMpesaAccountHandler(store, mpesaController.MpesaStkHandler)
+	}
+	mpesaCallbackHandler.UseProviders(mpesaController.Providers)
+	mpesaCallbackHandler.RequireC2BToken(mpesaController.MpesaStkHandler.Config().C2BURLToken)
+	mpesaRefundHandler = handler.NewMpesaRefundHandler(mpesaController.MpesaStkHandler, wsHub)
+	mpesaRefundHandler.UseProviders(mpesaController.Providers)
+	voucherHandler = handler.NewVoucherHandler(queueClient, wsHub)
+	coaConfig, err := handler.LoadCoAConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up RADIUS CoA: %w", err)
+	}
+	if coaConfig != nil {
+		handler.UseSessionController(service.NewSessionController(*coaConfig))
+	}
+	mikrotikController = controller.NewMikroTikController(manager, queueClient)
 
 	// Disable trusted proxies for security unless specifically configured
 	if err := r.SetTrustedProxies(nil); err != nil {
@@ -148,6 +179,11 @@ func registerAPIRoutes(r *gin.Engine, configure *gconfig.Configuration, mikrotik
 		registerHotspotRoutes(v1, configure)
 		registerMikrotikRoutes(v1, configure)
 		registerMpesaRoutes(v1, configure)
+		registerOrderRoutes(v1, createAuthMiddleware(configure)...)
+		registerAirtelRoutes(v1)
+		registerVoucherRoutes(v1, configure)
+		registerServicePlanRoutes(v1, configure)
+		registerReportRoutes(v1, configure)
 	}
 
 	// Playground routes for development and testing
@@ -258,17 +294,127 @@ func registerUserRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
 	// User CRUD operations
 	userGroup := v1.Group("users")
 	userGroup.Use(createAuthMiddleware(configure)...)
-	userGroup.GET("", controller.GetUsers)
-	userGroup.GET("/:id", controller.GetUser)
+	// Profiles are listed by ISP; accounts create and edit their own
+	userGroup.GET("", handler.Authorize(service.ResourceUsers, service.ActionRead), controller.GetUsers)
+	userGroup.GET("/:id", handler.Authorize(service.ResourceUsers, service.ActionRead), controller.GetUser)
 	userGroup.POST("", controller.CreateUser)
 	userGroup.PUT("", controller.UpdateUser)
+
+	// Roles and the accounts they are given to
+	roleGroup := v1.Group("roles")
+	roleGroup.Use(createAuthMiddleware(configure)...)
+	roleGroup.GET("", handler.Authorize(service.ResourceRoles, service.ActionRead), controller.GetRoles)
+
+	accountGroup := v1.Group("accounts")
+	accountGroup.Use(createAuthMiddleware(configure)...)
+	accountGroup.GET("/:id/role", handler.Authorize(service.ResourceRoles, service.ActionRead), controller.GetAccountRole)
+	accountGroup.PUT("/:id/role", handler.Authorize(service.ResourceRoles, service.ActionWrite), controller.AssignRole)
 }
 func registerMpesaRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
 	mpesaGroup := v1.Group("mpesa")
 	mpesaGroup.POST("/checkout", mpesaController.ExpressStkHandler)
 	mpesaGroup.GET("/transaction", mpesaController.GetTransactionStatus)
 	mpesaGroup.POST("/callback", mpesaCallbackHandler.MpesaStkHandlerCallback)
+	mpesaGroup.POST("/callback/:token", mpesaCallbackHandler.MpesaStkHandlerCallback)
+	mpesaGroup.POST("/c2b/validation", mpesaCallbackHandler.MpesaC2BValidation)
+	mpesaGroup.POST("/c2b/validation/:token", mpesaCallbackHandler.MpesaC2BValidation)
+	mpesaGroup.POST("/c2b/confirmation", mpesaCallbackHandler.MpesaC2BConfirmation)
+	mpesaGroup.POST("/c2b/confirmation/:token", mpesaCallbackHandler.MpesaC2BConfirmation)
+	mpesaGroup.POST("/refunds/result/:token", mpesaCallbackHandler.MpesaRefundResult)
+	mpesaGroup.POST("/refunds/timeout/:token", mpesaCallbackHandler.MpesaRefundTimeout)
 	mpesaGroup.Use(createAuthMiddleware(configure)...)
+
+	// Reports, C2B and refunds span every ISP
+	read := handler.Authorize(service.ResourcePayments, service.ActionRead)
+	write := handler.Authorize(service.ResourcePayments, service.ActionWrite)
+	mpesaAdmin := mpesaGroup.Group("", handler.PlatformAdminRequired())
+	mpesaAdmin.GET("/reports/amount-mismatches", read, mpesaController.GetAmountMismatchReport)
+	mpesaAdmin.POST("/c2b/register", write, mpesaController.RegisterC2BURLs)
+	mpesaAdmin.GET("/c2b/payments", read, mpesaController.GetC2BPayments)
+	mpesaAdmin.POST("/c2b/payments/:transId/allocate", write, mpesaCallbackHandler.AllocateC2BPayment)
+	mpesaAdmin.GET("/refunds", read, mpesaController.GetRefunds)
+	mpesaAdmin.POST("/orders/:orderNumber/refund", write, mpesaRefundHandler.RequestRefund)
+	if mpesaAccountHandler != nil {
+		ispAccounts := mpesaGroup.Group("/isps")
+		ispAccounts.GET("/:ispId/account", read, mpesaAccountHandler.GetMpesaAccount)
+		ispAccounts.PUT("/:ispId/account", write, mpesaAccountHandler.SaveMpesaAccount)
+		ispAccounts.DELETE("/:ispId/account", handler.Authorize(service.ResourcePayments, service.ActionDelete), mpesaAccountHandler.DeleteMpesaAccount)
+	}
+}
+
+// registerOrderRoutes sets up order and payment administration behind auth.
+// Callers only see and change the orders of their own ISP.
+func registerOrderRoutes(v1 *gin.RouterGroup, auth ...gin.HandlerFunc) {
+	read := handler.Authorize(service.ResourcePayments, service.ActionRead)
+	write := handler.Authorize(service.ResourcePayments, service.ActionWrite)
+	remove := handler.Authorize(service.ResourcePayments, service.ActionDelete)
+
+	orderGroup := v1.Group("orders")
+	orderGroup.Use(auth...)
+	orderGroup.GET("", read, controller.GetOrders)
+	orderGroup.PUT("", write, controller.UpdateOrder)
+	orderGroup.DELETE("/:id", remove, controller.DeleteOrder)
+
+	paymentGroup := v1.Group("payments")
+	paymentGroup.Use(auth...)
+	paymentGroup.GET("", read, controller.GetPayments)
+	paymentGroup.POST("/find", read, controller.GetPayment)
+	paymentGroup.POST("", write, controller.CreatePayment)
+	paymentGroup.PUT("", write, controller.UpdatePayment)
+	paymentGroup.DELETE("", remove, controller.DeletePayment)
+}
+
+// registerAirtelRoutes sets up the Airtel Money callback when it is configured
+func registerAirtelRoutes(v1 *gin.RouterGroup) {
+	airtel, err := mpesaController.Providers.Get(model.PaymentProviderAirtel)
+	if err != nil {
+		return
+	}
+	airtelGroup := v1.Group("airtel")
+	airtelGroup.POST("/callback", mpesaCallbackHandler.PaymentCallback(airtel))
+	airtelGroup.POST("/callback/:token", mpesaCallbackHandler.PaymentCallback(airtel))
+}
+
+// registerVoucherRoutes sets up voucher management and the captive portal
+// redemption endpoint
+func registerVoucherRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
+	voucherGroup := v1.Group("vouchers")
+	voucherGroup.POST("/redeem", voucherHandler.RedeemVoucher)
+	voucherGroup.Use(createAuthMiddleware(configure)...)
+	read := handler.Authorize(service.ResourceVouchers, service.ActionRead)
+	write := handler.Authorize(service.ResourceVouchers, service.ActionWrite)
+	voucherGroup.GET("", read, controller.GetVouchers)
+	voucherGroup.PATCH("/:code", write, controller.UpdateVoucher)
+	voucherGroup.POST("/batches", write, controller.CreateVoucherBatch)
+	voucherGroup.GET("/batches", read, controller.GetVoucherBatches)
+	voucherGroup.GET("/batches/:id", read, controller.GetVoucherBatch)
+	voucherGroup.GET("/batches/:id/csv", read, controller.ExportVoucherBatchCSV)
+	voucherGroup.GET("/batches/:id/print", read, controller.PrintVoucherBatch)
+}
+
+// registerServicePlanRoutes sets up service plan management, which keeps the
+// plans' RADIUS groups in step
+func registerServicePlanRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
+	planGroup := v1.Group("plans")
+	planGroup.Use(createAuthMiddleware(configure)...)
+	read := handler.Authorize(service.ResourcePlans, service.ActionRead)
+	write := handler.Authorize(service.ResourcePlans, service.ActionWrite)
+	planGroup.GET("", read, controller.GetServicePlans)
+	planGroup.POST("", write, controller.CreateServicePlan)
+	planGroup.GET("/radius/drift", handler.PlatformAdminRequired(), read, controller.GetRadiusGroupDrift)
+	planGroup.POST("/radius/sync", handler.PlatformAdminRequired(), write, controller.SyncServicePlanGroups)
+	planGroup.GET("/:id", read, controller.GetServicePlan)
+	planGroup.PUT("/:id", write, controller.UpdateServicePlan)
+}
+
+// registerReportRoutes sets up the RADIUS accounting usage reports
+func registerReportRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
+	reportGroup := v1.Group("reports")
+	reportGroup.Use(createAuthMiddleware(configure)...).
+		Use(handler.PlatformAdminRequired()).
+		Use(handler.Authorize(service.ResourceReports, service.ActionRead))
+	reportGroup.GET("/usage", controller.GetUsageSummary)
+	reportGroup.GET("/usage/:dimension", controller.GetUsageReport)
 }
 
 // registerResourceRoutes sets up resource-related routes
@@ -282,41 +428,61 @@ func registerResourceRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuratio
 func registerHotspotRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
 	hotspotUsers := v1.Group("hotspot/users")
 	hotspotUsers.Use(createAuthMiddleware(configure)...)
+	read := handler.Authorize(service.ResourceHotspotUsers, service.ActionRead)
+	write := handler.Authorize(service.ResourceHotspotUsers, service.ActionWrite)
 
 	// Hotspot user CRUD
-	hotspotUsers.POST("/", controller.CreateHotspotUser)
-	hotspotUsers.GET("/:username", controller.GetHotspotUser)
-	hotspotUsers.PUT("/:username", controller.UpdateHotspotUser)
-	hotspotUsers.DELETE("/:username", controller.DeleteHotspotUser)
-
-	// Hotspot user attributes and groups
-	hotspotUsers.POST("/:username/check", controller.AddOrUpdateRadCheckAttribute)
-	hotspotUsers.DELETE("/:username/check/:attribute", controller.DeleteRadCheckAttribute)
-	hotspotUsers.POST("/:username/reply", controller.AddOrUpdateRadReplyAttribute)
-	hotspotUsers.DELETE("/:username/reply/:attribute", controller.DeleteRadReplyAttribute)
-	hotspotUsers.POST("/:username/group", controller.AddRadUserGroup)
-	hotspotUsers.DELETE("/:username/group/:groupname", controller.DeleteRadUserGroup)
+	hotspotUsers.POST("/", write, controller.CreateHotspotUser)
+	hotspotUsers.GET("/:username", read, controller.GetHotspotUser)
+	hotspotUsers.PUT("/:username", write, controller.UpdateHotspotUser)
+	hotspotUsers.DELETE("/:username", handler.Authorize(service.ResourceHotspotUsers, service.ActionDelete), controller.DeleteHotspotUser)
+
+	// Hotspot user attributes and groups, which are part of the user
+	hotspotUsers.POST("/:username/check", write, controller.AddOrUpdateRadCheckAttribute)
+	hotspotUsers.DELETE("/:username/check/:attribute", write, controller.DeleteRadCheckAttribute)
+	hotspotUsers.POST("/:username/reply", write, controller.AddOrUpdateRadReplyAttribute)
+	hotspotUsers.DELETE("/:username/reply/:attribute", write, controller.DeleteRadReplyAttribute)
+	hotspotUsers.POST("/:username/group", write, controller.AddRadUserGroup)
+	hotspotUsers.DELETE("/:username/group/:groupname", write, controller.DeleteRadUserGroup)
+	hotspotUsers.GET("/:username/usage", read, controller.GetHotspotUserUsage)
 }
 
 func registerMikrotikRoutes(v1 *gin.RouterGroup, configure *gconfig.Configuration) {
 	// Create mikrotik API group
 	mikrotikAPI := v1.Group("/mikrotik")
 	mikrotikAPI.Use(createAuthMiddleware(configure)...)
+	read := handler.Authorize(service.ResourceDevices, service.ActionRead)
+	write := handler.Authorize(service.ResourceDevices, service.ActionWrite)
+	remove := handler.Authorize(service.ResourceDevices, service.ActionDelete)
 
 	// Device CRUD routes
-	mikrotikAPI.GET("/devices", mikrotikController.GetDevices)
-	mikrotikAPI.POST("/devices", mikrotikController.CreateDevice)
-	mikrotikAPI.GET("/devices/:id", mikrotikController.GetDevice)
-	mikrotikAPI.PUT("/devices/:id", mikrotikController.UpdateDevice)
-	mikrotikAPI.DELETE("/devices/:id", mikrotikController.DeleteDevice)
+	mikrotikAPI.GET("/devices", read, mikrotikController.GetDevices)
+	mikrotikAPI.POST("/devices", write, mikrotikController.CreateDevice)
+	mikrotikAPI.GET("/devices/:id", read, mikrotikController.GetDevice)
+	mikrotikAPI.PUT("/devices/:id", write, mikrotikController.UpdateDevice)
+	mikrotikAPI.DELETE("/devices/:id", remove, mikrotikController.DeleteDevice)
 
 	// Device status routes
-	mikrotikAPI.PATCH("/devices/:id/status", mikrotikController.UpdateDeviceStatus)
-	mikrotikAPI.GET("/devices/status/:status", mikrotikController.GetDevicesByStatus)
+	mikrotikAPI.PATCH("/devices/:id/status", write, mikrotikController.UpdateDeviceStatus)
+	mikrotikAPI.GET("/devices/status/:status", read, mikrotikController.GetDevicesByStatus)
 
 	// Device statistics and utilities
-	mikrotikAPI.GET("/devices/stats", mikrotikController.GetDeviceStats)
-	mikrotikAPI.POST("/devices/:id/test", mikrotikController.TestDeviceConnection)
+	mikrotikAPI.GET("/devices/stats", read, mikrotikController.GetDeviceStats)
+	mikrotikAPI.POST("/devices/:id/test", read, mikrotikController.TestDeviceConnection)
+
+	// Connection pool health
+	mikrotikAPI.GET("/devices/health", read, mikrotikController.GetDevicesHealth)
+	mikrotikAPI.GET("/devices/:id/health", read, mikrotikController.GetDeviceHealth)
+
+	// Hotspot session control
+	mikrotikAPI.POST("/devices/:id/logout", handler.Authorize(service.ResourceSessions, service.ActionDelete), mikrotikController.DisconnectUser)
+
+	// RADIUS client registration, kept in sync with the router's /radius
+	mikrotikAPI.GET("/devices/:id/radius", read, mikrotikController.GetDeviceNas)
+	mikrotikAPI.POST("/devices/:id/radius", write, mikrotikController.CreateDeviceNas)
+	mikrotikAPI.PUT("/devices/:id/radius", write, mikrotikController.UpdateDeviceNas)
+	mikrotikAPI.DELETE("/devices/:id/radius", remove, mikrotikController.DeleteDeviceNas)
+	mikrotikAPI.POST("/devices/:id/radius/rotate-secret", write, mikrotikController.RotateDeviceNasSecret)
 }
 
 // registerPlaygroundRoutes sets up development and testing routes
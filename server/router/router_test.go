@@ -0,0 +1,121 @@
+//go:build integration
+
+// Route tests against the repository's MySQL databases, configured by its .env
+// and config.yaml. They are skipped when the databases are not available.
+//
+//	go test -tags integration ./server/router/
+package router_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+
+	gconfig "github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/ortupik/wifigo/server/router"
+)
+
+func TestMain(m *testing.M) {
+	// .env and config.yaml are looked up from the repository root
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// signedIn stands in for the JWT middleware, as an account of ispID with role
+func signedIn(role string, ispID int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("authID", uint64(1))
+		c.Set("role", role)
+		c.Set("scope", gmodel.ISPScope(ispID))
+		c.Next()
+	}
+}
+
+func TestOrderRoutesAreScopedToTheCallersISP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := gconfig.Config(); err != nil {
+		t.Skipf("configuration not available: %v", err)
+	}
+	if err := gdatabase.InitDB(); err != nil || gdatabase.GetDB(gconfig.AppDB) == nil {
+		t.Skipf("app database not available: %v", err)
+	}
+	db := gdatabase.GetDB(gconfig.AppDB)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	orders := make(map[string]model.Order)
+	var ispA int64
+	for _, name := range []string{"a", "b"} {
+		isp := model.ISP{Name: "itest-" + name + suffix, Realm: "itest" + name + suffix}
+		if err := db.Create(&isp).Error; err != nil {
+			t.Fatalf("failed to create ISP: %v", err)
+		}
+		t.Cleanup(func() { db.Delete(&isp) })
+		order := model.Order{OrderNumber: "itest-order-" + name + suffix, Status: model.OrderStatusPaid, ISP: strconv.FormatInt(isp.ID, 10)}
+		if err := db.Omit(clause.Associations).Create(&order).Error; err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+		t.Cleanup(func() { db.Delete(&order) })
+		orders[name] = order
+		if name == "a" {
+			ispA = isp.ID
+		}
+	}
+
+	call := func(role, method, path string) *httptest.ResponseRecorder {
+		r := gin.New()
+		router.RegisterOrderRoutes(r.Group("/api/v1/"), signedIn(role, ispA))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// ISP A's admin lists orders and sees only its own
+	w := call(gmodel.RoleISPAdmin, http.MethodGet, "/api/v1/orders?limit=1000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /orders = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	var list struct {
+		Data []model.Order
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode orders: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, order := range list.Data {
+		seen[order.OrderNumber] = true
+		if order.ISP != orders["a"].ISP {
+			t.Errorf("GET /orders returned order %s of ISP %s to ISP %s", order.OrderNumber, order.ISP, orders["a"].ISP)
+		}
+	}
+	if !seen[orders["a"].OrderNumber] || seen[orders["b"].OrderNumber] {
+		t.Errorf("GET /orders listed %v, want %s and not %s", seen, orders["a"].OrderNumber, orders["b"].OrderNumber)
+	}
+
+	// Nor can it delete ISP B's order
+	if w := call(gmodel.RoleISPAdmin, http.MethodDelete, fmt.Sprintf("/api/v1/orders/%d", orders["b"].ID)); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of another ISP's order = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	var count int64
+	if db.Model(&model.Order{}).Where("id = ?", orders["b"].ID).Count(&count); count != 1 {
+		t.Errorf("another ISP's order was deleted")
+	}
+
+	// Support staff may not see payments at all
+	if w := call(gmodel.RoleISPSupport, http.MethodGet, "/api/v1/orders"); w.Code != http.StatusForbidden {
+		t.Errorf("GET /orders as ISP support = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
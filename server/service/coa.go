@@ -0,0 +1,287 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// CoAConfig configures the Disconnect and CoA requests sent to the NAS of a
+// user's active sessions
+type CoAConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Port          int           `mapstructure:"port"`    // Defaults to 3799
+	Timeout       time.Duration `mapstructure:"timeout"` // Per attempt, defaults to 2s
+	Retries       *int          `mapstructure:"retries"` // Defaults to 2
+	DefaultSecret string        `mapstructure:"default_secret"`
+}
+
+// ActiveSession is an accounting session without a stop record
+type ActiveSession struct {
+	Username        string
+	AcctSessionID   string
+	NasIPAddress    string
+	FramedIPAddress string
+}
+
+// SessionResult is the answer of a NAS to a Disconnect or CoA request for one
+// session
+type SessionResult struct {
+	AcctSessionID string `json:"acct_session_id"`
+	NasIPAddress  string `json:"nas_ip_address"`
+	Status        string `json:"status"` // ack, nak or error
+	ErrorCause    uint32 `json:"error_cause,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// SessionResult statuses
+const (
+	SessionResultACK   = "ack"
+	SessionResultNAK   = "nak"
+	SessionResultError = "error"
+)
+
+// SessionController changes or ends the live sessions of hotspot users by
+// sending RFC 5176 requests to the NAS each session is on
+type SessionController struct {
+	client        *radius.Client
+	port          int
+	defaultSecret string
+
+	// Secret returns the shared secret of the NAS at nasIP, empty when it
+	// has none of its own; defaults to NasSecret
+	Secret func(nasIP string) (string, error)
+	// Addr returns the host:port Disconnect and CoA requests for the NAS at
+	// nasIP are sent to; defaults to nasIP on the configured port
+	Addr func(nasIP string) string
+}
+
+// NewSessionController creates a SessionController from cfg
+func NewSessionController(cfg CoAConfig) *SessionController {
+	client := radius.NewClient()
+	if cfg.Timeout > 0 {
+		client.Timeout = cfg.Timeout
+	}
+	if cfg.Retries != nil && *cfg.Retries >= 0 {
+		client.Retries = *cfg.Retries
+	}
+	port := cfg.Port
+	if port <= 0 {
+		port = radius.DefaultCoAPort
+	}
+
+	s := &SessionController{client: client, port: port, defaultSecret: cfg.DefaultSecret}
+	s.Secret = NasSecret
+	s.Addr = func(nasIP string) string {
+		return net.JoinHostPort(nasIP, strconv.Itoa(s.port))
+	}
+	return s
+}
+
+// NasSecret returns the secret of the NAS at nasIP from the nas table, empty
+// when it is not listed
+func NasSecret(nasIP string) (string, error) {
+	db := gdatabase.GetDB(config.RadiusDB)
+
+	var nas model.Nas
+	err := db.Where("nasname = ?", nasIP).First(&nas).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch NAS %s: %w", nasIP, err)
+	}
+	return nas.Secret, nil
+}
+
+// FindActiveSessions returns the accounting sessions of username that have not
+// stopped
+func FindActiveSessions(username string) ([]ActiveSession, error) {
+	db := gdatabase.GetDB(config.RadiusDB)
+
+	var rows []model.RadAcct
+	err := db.Where("username = ? AND acctstoptime IS NULL", username).Order("acctstarttime DESC").Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch active sessions of %s: %w", username, err)
+	}
+	sessions := make([]ActiveSession, 0, len(rows))
+	for _, row := range rows {
+		session := ActiveSession{
+			Username:      row.Username,
+			AcctSessionID: row.AcctSessionID,
+			NasIPAddress:  row.NasIPAddress,
+		}
+		if row.FramedIPAddress != nil {
+			session.FramedIPAddress = *row.FramedIPAddress
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// sessionAttributes identify session to its NAS
+func sessionAttributes(session ActiveSession) []radius.Attribute {
+	attrs := []radius.Attribute{
+		radius.String(radius.AttrUserName, session.Username),
+		radius.String(radius.AttrAcctSessionID, session.AcctSessionID),
+	}
+	if ip := net.ParseIP(session.FramedIPAddress); ip != nil {
+		if attr, err := radius.IPAddr(radius.AttrFramedIPAddress, ip); err == nil {
+			attrs = append(attrs, attr)
+		}
+	}
+	if ip := net.ParseIP(session.NasIPAddress); ip != nil {
+		if attr, err := radius.IPAddr(radius.AttrNASIPAddress, ip); err == nil {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// DisconnectSession sends a Disconnect-Request for session
+func (s *SessionController) DisconnectSession(ctx context.Context, session ActiveSession) SessionResult {
+	return s.send(ctx, session, s.client.Disconnect, nil)
+}
+
+// UpdateSession sends a CoA-Request applying attrs to session
+func (s *SessionController) UpdateSession(ctx context.Context, session ActiveSession, attrs []radius.Attribute) SessionResult {
+	return s.send(ctx, session, s.client.CoA, attrs)
+}
+
+type sendFunc func(ctx context.Context, addr string, secret []byte, attrs []radius.Attribute) error
+
+func (s *SessionController) send(ctx context.Context, session ActiveSession, send sendFunc, attrs []radius.Attribute) SessionResult {
+	result := SessionResult{AcctSessionID: session.AcctSessionID, NasIPAddress: session.NasIPAddress, Status: SessionResultError}
+
+	secret, err := s.Secret(session.NasIPAddress)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if secret == "" {
+		secret = s.defaultSecret
+	}
+	if secret == "" {
+		result.Error = fmt.Sprintf("no shared secret for NAS %s", session.NasIPAddress)
+		return result
+	}
+
+	err = send(ctx, s.Addr(session.NasIPAddress), []byte(secret), append(sessionAttributes(session), attrs...))
+	var nak *radius.NAKError
+	switch {
+	case err == nil:
+		result.Status = SessionResultACK
+	case errors.As(err, &nak):
+		result.Status = SessionResultNAK
+		result.ErrorCause = nak.ErrorCause
+		result.Error = nak.Error()
+	default:
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// DisconnectUser ends every active session of username
+func (s *SessionController) DisconnectUser(ctx context.Context, username string) ([]SessionResult, error) {
+	sessions, err := FindActiveSessions(username)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SessionResult, 0, len(sessions))
+	for _, session := range sessions {
+		results = append(results, s.DisconnectSession(ctx, session))
+	}
+	return results, nil
+}
+
+// UpdateUser pushes the current reply attributes of username to its active
+// sessions
+func (s *SessionController) UpdateUser(ctx context.Context, username string) ([]SessionResult, error) {
+	sessions, err := FindActiveSessions(username)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	attrs, err := UserReplyAttributes(username)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SessionResult, 0, len(sessions))
+	for _, session := range sessions {
+		results = append(results, s.UpdateSession(ctx, session, attrs))
+	}
+	return results, nil
+}
+
+// ReplyAttribute is an attribute FreeRADIUS replies with
+type ReplyAttribute struct {
+	Attribute string
+	Value     string
+}
+
+// EffectiveReplies returns the reply attributes of a user the way FreeRADIUS
+// picks them: the user's own radreply, then the radgroupreply of each of its
+// groups in priority order, each attribute taken from the first that sets it
+func EffectiveReplies(user []model.RadReply, groups []model.RadGroupReply) []ReplyAttribute {
+	seen := make(map[string]bool)
+	var replies []ReplyAttribute
+	for _, r := range user {
+		if !seen[r.Attribute] {
+			seen[r.Attribute] = true
+			replies = append(replies, ReplyAttribute{Attribute: r.Attribute, Value: r.Value})
+		}
+	}
+	for _, r := range groups {
+		if !seen[r.Attribute] {
+			seen[r.Attribute] = true
+			replies = append(replies, ReplyAttribute{Attribute: r.Attribute, Value: r.Value})
+		}
+	}
+	return replies
+}
+
+// UserReplyAttributes returns the reply attributes of username that can be
+// sent in a CoA-Request. Attributes the radius dictionary does not know are
+// left out.
+func UserReplyAttributes(username string) ([]radius.Attribute, error) {
+	db := gdatabase.GetDB(config.RadiusDB)
+
+	var user []model.RadReply
+	if err := db.Where("username = ?", username).Order("id ASC").Find(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch reply attributes of %s: %w", username, err)
+	}
+	var memberships []model.RadUserGroup
+	if err := db.Where("username = ?", username).Order("priority ASC").Find(&memberships).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch groups of %s: %w", username, err)
+	}
+	var groups []model.RadGroupReply
+	for _, membership := range memberships {
+		var replies []model.RadGroupReply
+		if err := db.Where("groupname = ?", membership.Groupname).Order("id ASC").Find(&replies).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch reply attributes of group %s: %w", membership.Groupname, err)
+		}
+		groups = append(groups, replies...)
+	}
+
+	var attrs []radius.Attribute
+	for _, reply := range EffectiveReplies(user, groups) {
+		attr, err := radius.EncodeAttribute(reply.Attribute, reply.Value)
+		if errors.Is(err, radius.ErrUnknownAttribute) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reply attribute of %s: %w", username, err)
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
@@ -0,0 +1,109 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/radius/radiustest"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// newTestSessionController sends every request to nas, whatever the NAS of
+// the session
+func newTestSessionController(nas *radiustest.NAS, secret string) *service.SessionController {
+	retries := 0
+	s := service.NewSessionController(service.CoAConfig{Timeout: 100 * time.Millisecond, Retries: &retries})
+	s.Secret = func(nasIP string) (string, error) { return secret, nil }
+	s.Addr = func(nasIP string) string { return nas.Addr() }
+	return s
+}
+
+var testSession = service.ActiveSession{
+	Username:        "0712345678@Tecsurf",
+	AcctSessionID:   "81a00003",
+	NasIPAddress:    "10.0.0.1",
+	FramedIPAddress: "10.5.50.2",
+}
+
+func TestSessionControllerUpdateSession(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	s := newTestSessionController(nas, nas.Secret())
+
+	rateLimit, _ := radius.EncodeAttribute("Mikrotik-Rate-Limit", "5120k/5120k")
+	result := s.UpdateSession(context.Background(), testSession, []radius.Attribute{rateLimit})
+	if result.Status != service.SessionResultACK {
+		t.Fatalf("UpdateSession() = %+v, want ack", result)
+	}
+
+	requests := nas.Requests()
+	if len(requests) != 1 || requests[0].Code != radius.CodeCoARequest {
+		t.Fatalf("NAS received %d requests, want one CoA-Request", len(requests))
+	}
+	req := requests[0]
+	if req.GetString(radius.AttrUserName) != testSession.Username || req.GetString(radius.AttrAcctSessionID) != testSession.AcctSessionID {
+		t.Errorf("CoA-Request does not identify session %s of %s", testSession.AcctSessionID, testSession.Username)
+	}
+	if ip, _ := req.Get(radius.AttrFramedIPAddress); len(ip) != 4 || ip[3] != 2 {
+		t.Errorf("Framed-IP-Address = %v, want 10.5.50.2", ip)
+	}
+	if v, ok := req.GetVendor(radius.VendorMikrotik, radius.MikrotikRateLimit); !ok || string(v) != "5120k/5120k" {
+		t.Errorf("Mikrotik-Rate-Limit = %q, want 5120k/5120k", v)
+	}
+}
+
+func TestSessionControllerDisconnectSession(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	nas.Handle(func(req *radius.Packet) *radius.Packet {
+		return radiustest.NAK(req, radius.ErrorCauseSessionNotFound)
+	})
+	s := newTestSessionController(nas, nas.Secret())
+
+	result := s.DisconnectSession(context.Background(), testSession)
+	if result.Status != service.SessionResultNAK || result.ErrorCause != radius.ErrorCauseSessionNotFound {
+		t.Errorf("DisconnectSession() = %+v, want a nak with Error-Cause 503", result)
+	}
+	if requests := nas.Requests(); len(requests) != 1 || requests[0].Code != radius.CodeDisconnectRequest {
+		t.Errorf("NAS received %v, want one Disconnect-Request", requests)
+	}
+}
+
+func TestSessionControllerWithoutSecret(t *testing.T) {
+	nas := radiustest.NewNAS("")
+	defer nas.Close()
+	s := newTestSessionController(nas, "")
+
+	result := s.DisconnectSession(context.Background(), testSession)
+	if result.Status != service.SessionResultError || result.Error == "" {
+		t.Errorf("DisconnectSession() = %+v, want an error", result)
+	}
+	if len(nas.Requests()) != 0 {
+		t.Error("a request was sent without a secret")
+	}
+}
+
+func TestEffectiveReplies(t *testing.T) {
+	user := []model.RadReply{
+		{Attribute: "Mikrotik-Total-Limit", Op: ":=", Value: "1000"},
+	}
+	groups := []model.RadGroupReply{
+		{Groupname: "daily", Attribute: "Mikrotik-Rate-Limit", Op: ":=", Value: "3072k/3072k"},
+		{Groupname: "daily", Attribute: "Mikrotik-Total-Limit", Op: "=", Value: "5000"},
+		{Groupname: "fallback", Attribute: "Mikrotik-Rate-Limit", Op: ":=", Value: "1024k/1024k"},
+	}
+
+	got := service.EffectiveReplies(user, groups)
+	want := map[string]string{"Mikrotik-Total-Limit": "1000", "Mikrotik-Rate-Limit": "3072k/3072k"}
+	if len(got) != len(want) {
+		t.Fatalf("EffectiveReplies() = %+v, want %v", got, want)
+	}
+	for _, reply := range got {
+		if want[reply.Attribute] != reply.Value {
+			t.Errorf("%s = %s, want %s", reply.Attribute, reply.Value, want[reply.Attribute])
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// SplitTotalLimit splits a limit in bytes into the 32 bit Mikrotik-Total-Limit
+// and the 4 GiB multiples of Mikrotik-Total-Limit-Gigawords
+func SplitTotalLimit(bytes uint64) (limit, gigawords uint64) {
+	return bytes & math.MaxUint32, bytes >> 32
+}
+
+// DataLimitBytes returns the data cap of plan in bytes, 0 when it has none
+func DataLimitBytes(plan model.ServicePlan) uint64 {
+	if plan.DataLimitMB == nil || *plan.DataLimitMB <= 0 {
+		return 0
+	}
+	return uint64(*plan.DataLimitMB) * 1024 * 1024
+}
+
+// DataQuota is the data a capped subscription may use and has used
+type DataQuota struct {
+	Username   string    `json:"username"`
+	Plan       string    `json:"plan"`
+	LimitBytes uint64    `json:"limit_bytes"`
+	UsedBytes  uint64    `json:"used_bytes"`
+	Since      time.Time `json:"since"`      // Start of the subscription, usage is counted from here
+	ExpiresAt  time.Time `json:"expires_at"` // End of the subscription
+}
+
+// RemainingBytes returns the data left, 0 once the cap is reached
+func (q DataQuota) RemainingBytes() uint64 {
+	if q.UsedBytes >= q.LimitBytes {
+		return 0
+	}
+	return q.LimitBytes - q.UsedBytes
+}
+
+// Exhausted reports whether the subscription has used up its data
+func (q DataQuota) Exhausted() bool {
+	return q.UsedBytes >= q.LimitBytes
+}
+
+// UsedOctets sums the input and output octets of the accounting sessions of
+// username that started at or after since
+func UsedOctets(username string, since time.Time) (uint64, error) {
+	db := gdatabase.GetDB(config.RadiusDB)
+
+	var used int64
+	err := db.Model(&model.RadAcct{}).
+		Select("COALESCE(SUM(COALESCE(acctinputoctets, 0) + COALESCE(acctoutputoctets, 0)), 0)").
+		Where("username = ? AND acctstarttime >= ?", username, since).
+		Scan(&used).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum usage of %s: %w", username, err)
+	}
+	if used < 0 {
+		return 0, nil
+	}
+	return uint64(used), nil
+}
+
+// FindCappedSubscriptions returns the quota of every subscription on a plan
+// with a data cap that has not expired at now. A subscription started when its
+// Expiration was set, one plan duration before it.
+func FindCappedSubscriptions(now time.Time) ([]DataQuota, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return nil, fmt.Errorf("database is not initialised")
+	}
+
+	var plans []model.ServicePlan
+	if err := appDB.Where("dataLimitMB > 0").Find(&plans).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch capped plans: %w", err)
+	}
+	if len(plans) == 0 {
+		return nil, nil
+	}
+	plansByGroup := make(map[string]model.ServicePlan, len(plans))
+	groups := make([]string, 0, len(plans))
+	for _, plan := range plans {
+		plansByGroup[plan.GroupName()] = plan
+		groups = append(groups, plan.GroupName())
+	}
+
+	var members []model.RadUserGroup
+	if err := radiusDB.Where("groupname IN ?", groups).Find(&members).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch members of capped plans: %w", err)
+	}
+
+	var quotas []DataQuota
+	for _, member := range members {
+		quota, ok, err := subscriptionQuota(radiusDB, member.Username, plansByGroup[member.Groupname], now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas, nil
+}
+
+// FindUserQuota returns the quota of the subscription of username, false when
+// the user has no running subscription on a capped plan
+func FindUserQuota(username string, now time.Time) (DataQuota, bool, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return DataQuota{}, false, fmt.Errorf("database is not initialised")
+	}
+
+	var groups []string
+	if err := radiusDB.Model(&model.RadUserGroup{}).Where("username = ?", username).Pluck("groupname", &groups).Error; err != nil {
+		return DataQuota{}, false, fmt.Errorf("failed to fetch groups of %s: %w", username, err)
+	}
+	if len(groups) == 0 {
+		return DataQuota{}, false, nil
+	}
+	var plans []model.ServicePlan
+	if err := appDB.Where("name IN ? AND dataLimitMB > 0", groups).Find(&plans).Error; err != nil {
+		return DataQuota{}, false, fmt.Errorf("failed to fetch plan of %s: %w", username, err)
+	}
+	for _, plan := range plans {
+		quota, ok, err := subscriptionQuota(radiusDB, username, plan, now)
+		if err != nil || ok {
+			return quota, ok, err
+		}
+	}
+	return DataQuota{}, false, nil
+}
+
+func subscriptionQuota(radiusDB *gorm.DB, username string, plan model.ServicePlan, now time.Time) (DataQuota, bool, error) {
+	var expiration model.RadCheck
+	result := radiusDB.Where("username = ? AND attribute = ?", username, "Expiration").Limit(1).Find(&expiration)
+	if result.Error != nil {
+		return DataQuota{}, false, fmt.Errorf("failed to fetch expiration of %s: %w", username, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return DataQuota{}, false, nil
+	}
+	expiresAt, err := time.ParseInLocation(model.RadiusExpirationLayout, expiration.Value, now.Location())
+	if err != nil || !expiresAt.After(now) {
+		return DataQuota{}, false, nil
+	}
+
+	since := expiresAt.Add(-time.Duration(plan.Duration) * time.Second)
+	used, err := UsedOctets(username, since)
+	if err != nil {
+		return DataQuota{}, false, err
+	}
+	return DataQuota{
+		Username:   username,
+		Plan:       plan.Name,
+		LimitBytes: DataLimitBytes(plan),
+		UsedBytes:  used,
+		Since:      since,
+		ExpiresAt:  expiresAt,
+	}, true, nil
+}
+
+// SetUserDataLimit gives username remaining bytes for its next session with
+// radreply Mikrotik-Total-Limit and Mikrotik-Total-Limit-Gigawords, which
+// take precedence over the limit of the plan's group. A limit of 0 removes
+// them. It reports whether the attributes changed.
+func SetUserDataLimit(tx *gorm.DB, username string, remaining uint64, capped bool) (bool, error) {
+	if tx == nil {
+		tx = gdatabase.GetDB(config.RadiusDB)
+	}
+
+	var current []model.RadReply
+	err := tx.Where("username = ? AND attribute IN ?", username, []string{AttrMikrotikTotalLimit, AttrMikrotikTotalLimitG}).
+		Find(&current).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch data limit of %s: %w", username, err)
+	}
+
+	var want []model.RadReply
+	if capped {
+		limit, gigawords := SplitTotalLimit(remaining)
+		want = []model.RadReply{
+			{Username: username, Attribute: AttrMikrotikTotalLimit, Op: ":=", Value: strconv.FormatUint(limit, 10)},
+			{Username: username, Attribute: AttrMikrotikTotalLimitG, Op: ":=", Value: strconv.FormatUint(gigawords, 10)},
+		}
+	}
+	if sameReplies(current, want) {
+		return false, nil
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ? AND attribute IN ?", username, []string{AttrMikrotikTotalLimit, AttrMikrotikTotalLimitG}).
+			Delete(&model.RadReply{}).Error; err != nil {
+			return err
+		}
+		if len(want) == 0 {
+			return nil
+		}
+		return tx.Create(&want).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to set data limit of %s: %w", username, err)
+	}
+	return true, nil
+}
+
+func sameReplies(current, want []model.RadReply) bool {
+	if len(current) != len(want) {
+		return false
+	}
+	values := make(map[string]string, len(current))
+	for _, r := range current {
+		values[r.Attribute] = r.Op + " " + r.Value
+	}
+	for _, r := range want {
+		if values[r.Attribute] != r.Op+" "+r.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// ExhaustedSubscription is a subscription over its data cap, with the order
+// or voucher that paid for it to find the device it is connected through
+type ExhaustedSubscription struct {
+	Quota   DataQuota
+	Order   *model.Order
+	Voucher *model.Voucher
+}
+
+// DeviceID returns the hotspot device the subscription was last logged in on
+func (s ExhaustedSubscription) DeviceID() string {
+	switch {
+	case s.Order != nil:
+		return s.Order.DeviceID
+	case s.Voucher != nil:
+		return s.Voucher.DeviceID
+	}
+	return ""
+}
+
+// Address returns the address the subscription was last logged in from
+func (s ExhaustedSubscription) Address() string {
+	switch {
+	case s.Order != nil:
+		return s.Order.Ip
+	case s.Voucher != nil:
+		return s.Voucher.Ip
+	}
+	return ""
+}
+
+// MarkSubscriptionExhausted ends the subscription of quota at now: its
+// Expiration is brought forward, so RADIUS refuses new sessions and the user
+// may subscribe again, and its paid order or redeemed voucher is marked
+// exhausted. It returns what paid for the subscription.
+func MarkSubscriptionExhausted(quota DataQuota, now time.Time) (*ExhaustedSubscription, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+
+	err := radiusDB.Model(&model.RadCheck{}).
+		Where("username = ? AND attribute = ?", quota.Username, "Expiration").
+		Update("value", now.Format(model.RadiusExpirationLayout)).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to end subscription of %s: %w", quota.Username, err)
+	}
+
+	exhausted := &ExhaustedSubscription{Quota: quota}
+	var order model.Order
+	result := appDB.Where("username = ? AND status = ?", quota.Username, model.OrderStatusPaid).Order("id DESC").Limit(1).Find(&order)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch order of %s: %w", quota.Username, result.Error)
+	}
+	if result.RowsAffected > 0 {
+		// Older paid orders end with it, or the expiry scan would find them
+		err := appDB.Model(&model.Order{}).
+			Where("username = ? AND status = ? AND id <= ?", quota.Username, model.OrderStatusPaid, order.ID).
+			Update("status", model.OrderStatusExhausted).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark orders of %s exhausted: %w", quota.Username, err)
+		}
+		order.Status = model.OrderStatusExhausted
+		exhausted.Order = &order
+		return exhausted, nil
+	}
+
+	var voucher model.Voucher
+	result = appDB.Where("code = ? AND status = ?", quota.Username, model.VoucherStatusRedeemed).Limit(1).Find(&voucher)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch voucher %s: %w", quota.Username, result.Error)
+	}
+	if result.RowsAffected > 0 {
+		err := appDB.Model(&voucher).Updates(map[string]interface{}{"status": model.VoucherStatusExhausted, "expiresAt": now}).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark voucher %s exhausted: %w", voucher.Code, err)
+		}
+		exhausted.Voucher = &voucher
+	}
+	return exhausted, nil
+}
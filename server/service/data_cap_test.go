@@ -0,0 +1,73 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestSplitTotalLimit(t *testing.T) {
+	tests := []struct {
+		bytes         uint64
+		wantLimit     uint64
+		wantGigawords uint64
+	}{
+		{bytes: 0, wantLimit: 0, wantGigawords: 0},
+		{bytes: 500 << 20, wantLimit: 500 << 20, wantGigawords: 0},
+		{bytes: 1<<32 - 1, wantLimit: 1<<32 - 1, wantGigawords: 0},
+		{bytes: 1 << 32, wantLimit: 0, wantGigawords: 1},
+		{bytes: 10 << 30, wantLimit: 2 << 30, wantGigawords: 2},
+	}
+	for _, tt := range tests {
+		limit, gigawords := service.SplitTotalLimit(tt.bytes)
+		if limit != tt.wantLimit || gigawords != tt.wantGigawords {
+			t.Errorf("SplitTotalLimit(%d) = %d, %d, want %d, %d", tt.bytes, limit, gigawords, tt.wantLimit, tt.wantGigawords)
+		}
+	}
+}
+
+func TestDataLimitBytes(t *testing.T) {
+	mb := func(v int) *int { return &v }
+	tests := []struct {
+		name string
+		plan model.ServicePlan
+		want uint64
+	}{
+		{name: "no cap", plan: model.ServicePlan{}, want: 0},
+		{name: "zero", plan: model.ServicePlan{DataLimitMB: mb(0)}, want: 0},
+		{name: "negative", plan: model.ServicePlan{DataLimitMB: mb(-5)}, want: 0},
+		{name: "capped", plan: model.ServicePlan{DataLimitMB: mb(1024)}, want: 1 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.DataLimitBytes(tt.plan); got != tt.want {
+				t.Errorf("DataLimitBytes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataQuotaRemaining(t *testing.T) {
+	tests := []struct {
+		name          string
+		quota         service.DataQuota
+		wantRemaining uint64
+		wantExhausted bool
+	}{
+		{name: "unused", quota: service.DataQuota{LimitBytes: 1000}, wantRemaining: 1000},
+		{name: "partly used", quota: service.DataQuota{LimitBytes: 1000, UsedBytes: 400}, wantRemaining: 600},
+		{name: "used up", quota: service.DataQuota{LimitBytes: 1000, UsedBytes: 1000}, wantRemaining: 0, wantExhausted: true},
+		{name: "overshot", quota: service.DataQuota{LimitBytes: 1000, UsedBytes: 1500}, wantRemaining: 0, wantExhausted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.quota.RemainingBytes(); got != tt.wantRemaining {
+				t.Errorf("RemainingBytes() = %d, want %d", got, tt.wantRemaining)
+			}
+			if got := tt.quota.Exhausted(); got != tt.wantExhausted {
+				t.Errorf("Exhausted() = %v, want %v", got, tt.wantExhausted)
+			}
+		})
+	}
+}
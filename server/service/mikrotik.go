@@ -1,8 +1,11 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+
+	"github.com/ortupik/wifigo/mikrotik/hotspot"
 	"github.com/ortupik/wifigo/server/dto"
 )
 
@@ -16,6 +19,16 @@ func (s *MikroTikMangerService) ExecuteOnDevice(deviceID, command string, args .
 	return pool.Execute(command, args...)
 }
 
+// ExecuteOnDeviceContext executes a command on a specific device, honouring ctx deadlines and cancellation
+func (s *MikroTikMangerService) ExecuteOnDeviceContext(ctx context.Context, deviceID, command string, args ...string) ([]map[string]string, error) {
+	pool, err := s.GetDevicePool(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.ExecuteContext(ctx, command, args...)
+}
+
 // TestDeviceConnection tests the connection to a specific device
 func (s *MikroTikMangerService) TestDeviceConnection(deviceID string) error {
 	pool, err := s.GetDevicePool(deviceID)
@@ -48,35 +61,39 @@ func (s *MikroTikMangerService) GetDeviceStats(deviceID string) (map[string]stri
 	return make(map[string]string), nil
 }
 
-func LoginHotspotDeviceByAddress(s *MikroTikMangerService, payload dto.MikrotikLogin) error {
+// HotspotClient returns a typed hotspot API client for a specific device
+func (s *MikroTikMangerService) HotspotClient(deviceID string) (*hotspot.Client, error) {
+	pool, err := s.GetDevicePool(deviceID)
+	if err != nil {
+		return nil, err
+	}
 
-	pool, err := s.GetDevicePool(payload.DeviceID)
+	return hotspot.NewClient(pool), nil
+}
+
+func LoginHotspotDeviceByAddress(ctx context.Context, s *MikroTikMangerService, payload dto.MikrotikLogin) error {
+
+	client, err := s.HotspotClient(payload.DeviceID)
 	if err != nil {
 		return fmt.Errorf("failed to get device: %w", err)
 	}
 
-	hosts, err := pool.Execute("/ip/hotspot/host/print", "?address="+payload.Address)
+	host, err := client.FindHostByAddress(ctx, payload.Address)
 	if err != nil {
-		return fmt.Errorf("host print command failed: %v", err)
+		return fmt.Errorf("host print command failed: %w", err)
 	}
 
-	if len(hosts) == 0 {
+	if host == nil {
 		return fmt.Errorf("no hotspot host found with address: %s", payload.Address)
 	}
 
-	hostEntry := hosts[0]
-	toAddress, ok := hostEntry["to-address"]
-	if !ok {
+	toAddress := host.ToAddress
+	if toAddress == "" {
 		// If to-address is not found, we can't proceed with the first preferred login method.
 		// We will directly try with payload.Address.
-		// Or, you could return an error here if to-address is strictly required for a first attempt.
-		// For this requirement, we'll log it and then try payload.Address.
 		fmt.Printf("Warning: to-address not found for host with address %s. Will attempt login with %s.\n", payload.Address, payload.Address)
-		toAddress = "" // Ensure toAddress is empty if not found
 	}
 
-	macAddress, hasMac := hostEntry["mac-address"]
-
 	fmt.Printf("Found hotspot host: initial address=%s, to-address=%s\n", payload.Address, toAddress)
 
 	// --- Helper function for login attempt ---
@@ -84,25 +101,18 @@ func LoginHotspotDeviceByAddress(s *MikroTikMangerService, payload dto.MikrotikL
 		if loginIP == "" {
 			return errors.New("login IP address is empty")
 		}
-		loginCmd := "/ip/hotspot/active/login"
-		loginArgs := []string{
-			"=ip=" + loginIP,
-			"=user=" + payload.Username,
-		}
-
-		if payload.Password != "" {
-			loginArgs = append(loginArgs, "=password="+payload.Password)
-		}
-		if hasMac { // Use MAC address found from the host print command
-			loginArgs = append(loginArgs, "=mac-address="+macAddress)
-		}
 
 		fmt.Printf("Attempting login with IP: %s, User: %s\n", loginIP, payload.Username)
-		loginReply, err := pool.Execute(loginCmd, loginArgs...)
+		err := client.Login(ctx, hotspot.LoginRequest{
+			IP:         loginIP,
+			User:       payload.Username,
+			Password:   payload.Password,
+			MACAddress: host.MACAddress, // Use MAC address found from the host print command
+		})
 		if err != nil {
-			return fmt.Errorf("hotspot login command failed for IP %s: %v", loginIP, err)
+			return fmt.Errorf("hotspot login command failed for IP %s: %w", loginIP, err)
 		}
-		fmt.Printf("Login successful with IP %s. Response: %v\n", loginIP, loginReply)
+		fmt.Printf("Login successful with IP %s\n", loginIP)
 		return nil
 	}
 	// --- End of helper function ---
@@ -125,7 +135,6 @@ func LoginHotspotDeviceByAddress(s *MikroTikMangerService, payload dto.MikrotikL
 		fmt.Println("Skipping login attempt with to-address as it was not found.")
 	}
 
-
 	// 2. If first attempt failed (or was skipped), try with payload.Address
 	fmt.Printf("Attempt 2: Logging in with payload address: %s\n", payload.Address)
 	err = attemptLogin(payload.Address)
@@ -136,9 +145,78 @@ func LoginHotspotDeviceByAddress(s *MikroTikMangerService, payload dto.MikrotikL
 
 	// 3. If both attempts fail, return a consolidated error
 	if firstAttemptErr != nil {
-		return fmt.Errorf("all login attempts failed. Attempt 1 (toAddress: %s): %v. Attempt 2 (payload.Address: %s): %v", toAddress, firstAttemptErr, payload.Address, err)
+		return fmt.Errorf("all login attempts failed. Attempt 1 (toAddress: %s): %w. Attempt 2 (payload.Address: %s): %w", toAddress, firstAttemptErr, payload.Address, err)
 	}
 	// This case would be if toAddress was empty, so only payload.Address was tried and failed.
-	return fmt.Errorf("login attempt with address %s failed: %v", payload.Address, err)
+	return fmt.Errorf("login attempt with address %s failed: %w", payload.Address, err)
+
+}
 
-}
\ No newline at end of file
+// LogoutHotspotUser removes the active hotspot sessions matching the payload's username, IP or MAC.
+// When forgetCookies is set the user's login cookies are removed too, so the router
+// cannot log them straight back in. It returns the sessions that were disconnected.
+func LogoutHotspotUser(ctx context.Context, s *MikroTikMangerService, payload dto.MikrotikLogout, forgetCookies bool) ([]hotspot.ActiveSession, error) {
+	if payload.Username == "" && payload.Address == "" && payload.MacAddress == "" {
+		return nil, errors.New("username, address or mac address is required")
+	}
+
+	client, err := s.HotspotClient(payload.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+
+	q := hotspot.NewQuery()
+	terms := 0
+	if payload.Username != "" {
+		q.Eq("user", payload.Username)
+		terms++
+	}
+	if payload.Address != "" {
+		q.Eq("address", payload.Address)
+		terms++
+	}
+	if payload.MacAddress != "" {
+		q.Eq("mac-address", payload.MacAddress)
+		terms++
+	}
+	for i := 1; i < terms; i++ {
+		q.Or()
+	}
+
+	sessions, err := client.ListActive(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("active print command failed: %w", err)
+	}
+
+	if _, err := client.LogoutSessions(ctx, sessions); err != nil {
+		return nil, fmt.Errorf("active remove command failed: %w", err)
+	}
+	fmt.Printf("Disconnected %d hotspot session(s) on %s (user=%s, address=%s, mac=%s)\n",
+		len(sessions), payload.DeviceID, payload.Username, payload.Address, payload.MacAddress)
+
+	if forgetCookies {
+		users := make(map[string]bool)
+		if payload.Username != "" {
+			users[payload.Username] = true
+		}
+		for _, session := range sessions {
+			users[session.User] = true
+		}
+
+		for user := range users {
+			cookies, err := client.FindCookiesByUser(ctx, user)
+			if err != nil {
+				return sessions, fmt.Errorf("cookie print command failed: %w", err)
+			}
+			ids := make([]string, 0, len(cookies))
+			for _, cookie := range cookies {
+				ids = append(ids, cookie.ID)
+			}
+			if err := client.RemoveCookies(ctx, ids...); err != nil {
+				return sessions, fmt.Errorf("cookie remove command failed: %w", err)
+			}
+		}
+	}
+
+	return sessions, nil
+}
@@ -44,7 +44,7 @@ func (s *MikroTikMangerService) LoadAllDevices() error {
 			Password: device.Password,
 			PoolSize: device.PoolSize,
 			Port:     device.Port,
-			// Add ISPID if you have realm relationships
+			ISPID:    device.GetISPID(),
 		}
 
 		if err := s.manager.AddDevice(deviceConfig); err != nil {
@@ -74,6 +74,7 @@ func (s *MikroTikMangerService) AddDeviceToManager(device *model.MikroTikDevice)
 			Username: device.Username,
 			Password: device.Password,
 			PoolSize: device.PoolSize,
+			ISPID:    device.GetISPID(),
 		}
 
 		if err := s.manager.AddDevice(deviceConfig); err != nil {
@@ -114,6 +115,7 @@ func (s *MikroTikMangerService) UpdateDeviceInManager(deviceID string, updates *
 			Username: updates.Username,
 			Password: updates.Password,
 			PoolSize: updates.PoolSize,
+			ISPID:    updates.GetISPID(),
 		}
 
 		if err := s.manager.AddDevice(deviceConfig); err != nil {
@@ -0,0 +1,181 @@
+package service_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/mikrotik"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+	"github.com/ortupik/wifigo/server/dto"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+const loginCommand = routerostest.PathActive + "/login"
+
+func newService(t *testing.T, srv *routerostest.Server) *service.MikroTikMangerService {
+	t.Helper()
+
+	manager := mikrotik.NewManager()
+	t.Cleanup(manager.Close)
+	if err := manager.AddDevice(srv.DeviceConfig("router1")); err != nil {
+		t.Fatalf("AddDevice() error = %v", err)
+	}
+	return service.NewMikroTikManagerService(manager)
+}
+
+func loginPayload(address string) dto.MikrotikLogin {
+	return dto.MikrotikLogin{
+		DeviceID: "router1",
+		Address:  address,
+		Username: "0712345678",
+		Password: "secret",
+	}
+}
+
+// loginIPs returns the ip of every login attempt the router received
+func loginIPs(srv *routerostest.Server) []string {
+	var ips []string
+	for _, req := range srv.RequestsFor(loginCommand) {
+		ips = append(ips, req.Attrs["ip"])
+	}
+	return ips
+}
+
+func TestLoginHotspotDeviceByAddressUsesToAddress(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+
+	s := newService(t, srv)
+	if err := service.LoginHotspotDeviceByAddress(context.Background(), s, loginPayload("192.168.88.20")); err != nil {
+		t.Fatalf("LoginHotspotDeviceByAddress() error = %v", err)
+	}
+
+	if ips := loginIPs(srv); len(ips) != 1 || ips[0] != "10.5.50.20" {
+		t.Errorf("login attempts = %v, want a single attempt with the to-address", ips)
+	}
+	req := srv.RequestsFor(loginCommand)[0]
+	if req.Attrs["user"] != "0712345678" || req.Attrs["password"] != "secret" || req.Attrs["mac-address"] != "AA:BB:CC:DD:EE:01" {
+		t.Errorf("login attrs = %v, want the payload credentials and the host's MAC", req.Attrs)
+	}
+	if active := srv.Rows(routerostest.PathActive); len(active) != 1 || active[0]["user"] != "0712345678" {
+		t.Errorf("active sessions = %v, want the user logged in", active)
+	}
+}
+
+func TestLoginHotspotDeviceByAddressFallsBackToAddress(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+	srv.Handle(loginCommand, func(req routerostest.Request) routerostest.Response {
+		if req.Attrs["ip"] == "10.5.50.20" {
+			return routerostest.TrapResponse("no such host: %s", req.Attrs["ip"])
+		}
+		return srv.Default(req)
+	})
+
+	s := newService(t, srv)
+	if err := service.LoginHotspotDeviceByAddress(context.Background(), s, loginPayload("192.168.88.20")); err != nil {
+		t.Fatalf("LoginHotspotDeviceByAddress() error = %v", err)
+	}
+
+	if ips := loginIPs(srv); len(ips) != 2 || ips[0] != "10.5.50.20" || ips[1] != "192.168.88.20" {
+		t.Errorf("login attempts = %v, want the to-address then the payload address", ips)
+	}
+}
+
+func TestLoginHotspotDeviceByAddressWithoutToAddress(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.AddHost("192.168.88.20", "", "AA:BB:CC:DD:EE:01")
+
+	s := newService(t, srv)
+	if err := service.LoginHotspotDeviceByAddress(context.Background(), s, loginPayload("192.168.88.20")); err != nil {
+		t.Fatalf("LoginHotspotDeviceByAddress() error = %v", err)
+	}
+
+	if ips := loginIPs(srv); len(ips) != 1 || ips[0] != "192.168.88.20" {
+		t.Errorf("login attempts = %v, want a single attempt with the payload address", ips)
+	}
+}
+
+func TestLoginHotspotDeviceByAddressFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(srv *routerostest.Server)
+		payload dto.MikrotikLogin
+		wantErr string
+	}{
+		{
+			name:    "unknown device",
+			payload: dto.MikrotikLogin{DeviceID: "router9", Address: "192.168.88.20", Username: "u"},
+			wantErr: "failed to get device",
+		},
+		{
+			name:    "no hotspot host",
+			payload: loginPayload("192.168.88.20"),
+			wantErr: "no hotspot host found with address: 192.168.88.20",
+		},
+		{
+			name: "both attempts fail",
+			setup: func(srv *routerostest.Server) {
+				srv.AddHost("192.168.88.20", "10.5.50.20", "AA:BB:CC:DD:EE:01")
+				srv.Trap(loginCommand, "invalid username or password")
+			},
+			payload: loginPayload("192.168.88.20"),
+			wantErr: "all login attempts failed",
+		},
+		{
+			name: "already logged in",
+			setup: func(srv *routerostest.Server) {
+				srv.AddHost("192.168.88.20", "", "AA:BB:CC:DD:EE:01")
+				srv.AddActive("0712345678", "192.168.88.20", "AA:BB:CC:DD:EE:01")
+			},
+			payload: loginPayload("192.168.88.20"),
+			wantErr: "is already logged in",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := routerostest.NewServer()
+			defer srv.Close()
+			if tt.setup != nil {
+				tt.setup(srv)
+			}
+
+			s := newService(t, srv)
+			err := service.LoginHotspotDeviceByAddress(context.Background(), s, tt.payload)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoginHotspotDeviceByAddress() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogoutHotspotUser(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.AddActive("alice", "192.168.88.20", "AA:BB:CC:DD:EE:01")
+	srv.AddActive("alice", "192.168.88.21", "AA:BB:CC:DD:EE:02")
+	srv.AddActive("bob", "192.168.88.30", "AA:BB:CC:DD:EE:03")
+	srv.Add(routerostest.PathCookie, map[string]string{"user": "alice", "mac-address": "AA:BB:CC:DD:EE:01"})
+	srv.Add(routerostest.PathCookie, map[string]string{"user": "bob", "mac-address": "AA:BB:CC:DD:EE:03"})
+
+	s := newService(t, srv)
+	sessions, err := service.LogoutHotspotUser(context.Background(), s, dto.MikrotikLogout{DeviceID: "router1", Username: "alice"}, true)
+	if err != nil {
+		t.Fatalf("LogoutHotspotUser() error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("LogoutHotspotUser() returned %d sessions, want 2", len(sessions))
+	}
+
+	if active := srv.Rows(routerostest.PathActive); len(active) != 1 || active[0]["user"] != "bob" {
+		t.Errorf("active sessions = %v, want only bob left", active)
+	}
+	if cookies := srv.Rows(routerostest.PathCookie); len(cookies) != 1 || cookies[0]["user"] != "bob" {
+		t.Errorf("cookies = %v, want only bob's left", cookies)
+	}
+}
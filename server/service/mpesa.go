@@ -1,10 +1,17 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"time"
+
 	"github.com/ortupik/wifigo/config"
 	gdatabase "github.com/ortupik/wifigo/database"
 	"github.com/ortupik/wifigo/server/database/model"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
 )
 
 
@@ -47,14 +54,32 @@ func SaveMpesaPayment(payload *model.MpesaCallbackPayload) (map[string]interface
     }
 
 	var order model.Order
-	if err := db.Where("CheckoutRequestID = ?", payload.CheckoutRequestID).First(&order).Error; err != nil {
+	orderQuery := db.Where("CheckoutRequestID = ?", payload.CheckoutRequestID)
+	if payload.OrderID != 0 {
+		orderQuery = db.Where("id = ?", payload.OrderID)
+	}
+	if err := orderQuery.First(&order).Error; err != nil {
+		return nil, err
+	}
+
+	// Safaricom retries callbacks, so an STK push is only ever recorded once
+	existing, err := findPaymentByCheckoutRequestID(db, payload.CheckoutRequestID)
+	if err != nil {
 		return nil, err
 	}
+	if existing != nil {
+		return duplicatePayment(order, existing), nil
+	}
+
+	var receipt *string
+	if payload.MpesaReceiptNumber != "" {
+		receipt = &payload.MpesaReceiptNumber
+	}
 
 	// Prepare payment data
 	payment := &model.Payment{
 		Amount:             payload.Amount,
-		MpesaReceiptNumber: &payload.MpesaReceiptNumber,
+		MpesaReceiptNumber: receipt,
 		Phone:              &payload.PhoneNumber,
 		TransactionDate:    payload.TransactionDate,
 		MerchantRequestID:  &payload.MerchantRequestID,
@@ -63,6 +88,10 @@ func SaveMpesaPayment(payload *model.MpesaCallbackPayload) (map[string]interface
 		ResultDesc:         payload.ResultDesc,
 		Username:           &order.Username,
 		OrderID:            &order.ID,
+		Provider:           model.PaymentProviderMpesa,
+	}
+	if payload.Provider != "" {
+		payment.Provider = payload.Provider
 	}
 
 	// Begin a transaction
@@ -76,19 +105,66 @@ func SaveMpesaPayment(payload *model.MpesaCallbackPayload) (map[string]interface
 	// Save the payment
 	if err := tx.Create(payment).Error; err != nil {
 		tx.Rollback()
+		if IsDuplicateKeyError(err) {
+			// A concurrent retry recorded it first
+			if existing, findErr := findPaymentByCheckoutRequestID(db, payload.CheckoutRequestID); findErr == nil && existing != nil {
+				return duplicatePayment(order, existing), nil
+			}
+		}
 		return nil, err
 	}
 
-	// Update order status based on payment result
-	if payload.ResultCode == 0 {
-		order.Status = "paid"
+	// Update order status based on payment result, unless the order was settled already
+	orderStatus := model.OrderStatusPaid
+	updates := map[string]interface{}{}
+	mismatch := ""
+	var difference decimal.Decimal
+	if payload.ResultCode != 0 {
+		orderStatus = model.OrderStatusPaymentFailed
 	} else {
-		order.Status = "payment_failed"
+		mismatch, difference = ClassifyPaymentAmount(order.Amount, payload.Amount)
+		updates["amountPaid"] = int(payload.Amount.IntPart())
+		if mismatch == model.MismatchUnderpaid {
+			orderStatus = model.OrderStatusPartiallyPaid
+		}
 	}
-
-	if err := tx.Save(&order).Error; err != nil {
+	updates["status"] = orderStatus
+	settleable := []string{model.OrderStatusPending, model.OrderStatusTimeout}
+	if payload.ResultCode == 0 {
+		// The customer may pay by C2B after the STK push failed
+		settleable = append(settleable, model.OrderStatusPaymentFailed)
+	}
+	result := tx.Model(&model.Order{}).
+		Where("id = ? AND status IN ?", order.ID, settleable).
+		Updates(updates)
+	if result.Error != nil {
 		tx.Rollback()
-		return nil, err
+		return nil, result.Error
+	}
+	if payload.ResultCode == 0 && result.RowsAffected == 0 {
+		// Another payment settled the order first, all of this one is extra
+		mismatch, difference = model.MismatchOverpaid, payload.Amount
+	}
+
+	if mismatch == model.MismatchUnderpaid {
+		status = "partial"
+		message = fmt.Sprintf("Received KES %s of KES %d, complete the payment of KES %s on your phone",
+			payload.Amount.StringFixed(0), order.Amount, difference.Neg().StringFixed(0))
+	}
+	if mismatch != "" {
+		if err := recordPaymentMismatch(tx, order, payment, mismatch, difference); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if mismatch == model.MismatchOverpaid {
+		message = fmt.Sprintf("Payment received successfully, KES %s extra was added to your credit", difference.StringFixed(0))
+	}
+	if result.RowsAffected > 0 && orderStatus == model.OrderStatusPaid && order.ParentOrderID != nil {
+		if err := settleToppedUpOrders(tx, order); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
 	}
 
 	// Commit the transaction
@@ -101,6 +177,191 @@ func SaveMpesaPayment(payload *model.MpesaCallbackPayload) (map[string]interface
 		"ip":        order.Ip,
 		"paymentID": payment.ID,
 		"message":  message,
+		"mismatch":  mismatch,
 	}, nil
 }
 
+// maxTopUpChain bounds how many underpaid orders a paid top-up settles
+const maxTopUpChain = 10
+
+// settleToppedUpOrders marks the underpaid orders a paid top-up completes as
+// topped up, and their underpayments as resolved. A top-up that was underpaid
+// itself has a top-up of its own, so the chain is followed up.
+func settleToppedUpOrders(tx *gorm.DB, topUp model.Order) error {
+	parentID := topUp.ParentOrderID
+	for i := 0; parentID != nil && i < maxTopUpChain; i++ {
+		var parent model.Order
+		if err := tx.Where("id = ?", *parentID).First(&parent).Error; err != nil {
+			return fmt.Errorf("failed to fetch order %d topped up by %s: %w", *parentID, topUp.OrderNumber, err)
+		}
+		if parent.Status != model.OrderStatusPartiallyPaid {
+			return nil
+		}
+		err := tx.Model(&model.Order{}).
+			Where("id = ? AND status = ?", parent.ID, model.OrderStatusPartiallyPaid).
+			Update("status", model.OrderStatusToppedUp).Error
+		if err != nil {
+			return fmt.Errorf("failed to settle order %s: %w", parent.OrderNumber, err)
+		}
+		err = tx.Model(&model.PaymentMismatch{}).
+			Where("orderId = ? AND resolution = ?", parent.ID, model.MismatchAwaitingTopUp).
+			Update("resolution", model.MismatchToppedUp).Error
+		if err != nil {
+			return fmt.Errorf("failed to resolve the underpayment of order %s: %w", parent.OrderNumber, err)
+		}
+		parentID = parent.ParentOrderID
+	}
+	return nil
+}
+
+// ClassifyPaymentAmount compares what was paid with an order's amount. It
+// returns the mismatch kind, empty for an exact payment, and paid minus expected.
+func ClassifyPaymentAmount(expected int, paid decimal.Decimal) (string, decimal.Decimal) {
+	difference := paid.Sub(decimal.NewFromInt(int64(expected)))
+	switch difference.Sign() {
+	case -1:
+		return model.MismatchUnderpaid, difference
+	case 1:
+		return model.MismatchOverpaid, difference
+	}
+	return "", difference
+}
+
+// recordPaymentMismatch stores the mismatch for the admin report and credits an overpayment
+func recordPaymentMismatch(tx *gorm.DB, order model.Order, payment *model.Payment, kind string, difference decimal.Decimal) error {
+	resolution := model.MismatchAwaitingTopUp
+	if kind == model.MismatchOverpaid {
+		resolution = model.MismatchCredited
+	}
+
+	mismatch := model.PaymentMismatch{
+		OrderID:           order.ID,
+		OrderNumber:       order.OrderNumber,
+		CheckoutRequestID: payment.CheckoutRequestID,
+		Phone:             order.Phone,
+		Username:          order.Username,
+		Kind:              kind,
+		Expected:          decimal.NewFromInt(int64(order.Amount)),
+		Paid:              payment.Amount,
+		Difference:        difference,
+		Resolution:        resolution,
+	}
+	if err := tx.Create(&mismatch).Error; err != nil {
+		return fmt.Errorf("failed to record payment mismatch: %w", err)
+	}
+
+	if kind != model.MismatchOverpaid {
+		return nil
+	}
+	credit := model.CustomerCredit{
+		Phone:     order.Phone,
+		Username:  order.Username,
+		Amount:    difference,
+		Reason:    fmt.Sprintf("Overpayment of order %s", order.OrderNumber),
+		OrderID:   &order.ID,
+		PaymentID: &payment.ID,
+	}
+	if err := tx.Create(&credit).Error; err != nil {
+		return fmt.Errorf("failed to record customer credit: %w", err)
+	}
+	return nil
+}
+
+func findPaymentByCheckoutRequestID(db *gorm.DB, checkoutRequestID string) (*model.Payment, error) {
+	var payment model.Payment
+	result := db.Where("CheckoutRequestID = ?", checkoutRequestID).Limit(1).Find(&payment)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &payment, nil
+}
+
+func duplicatePayment(order model.Order, payment *model.Payment) map[string]interface{} {
+	return map[string]interface{}{
+		"status":    "duplicate",
+		"ip":        order.Ip,
+		"paymentID": payment.ID,
+		"message":   "Payment already recorded",
+		"duplicate": true,
+	}
+}
+
+// IsDuplicateKeyError reports whether err is a unique constraint violation
+func IsDuplicateKeyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Duplicate entry") || // MySQL 1062
+		strings.Contains(msg, "duplicate key value") // PostgreSQL 23505
+}
+
+// FindStalePendingOrders returns up to limit orders that were sent an STK push
+// before the given time and are still waiting for its result, oldest first
+func FindStalePendingOrders(before time.Time, limit int) ([]model.Order, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var orders []model.Order
+	err := db.Preload("ServicePlan").
+		Where("status = ? AND CheckoutRequestID <> '' AND created_at < ?", model.OrderStatusPending, before).
+		Order("id ASC").Limit(limit).Find(&orders).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch pending orders: %w", err)
+	}
+	return orders, nil
+}
+
+// FindOrderByCheckoutRequestID returns the order a payment request was sent for
+func FindOrderByCheckoutRequestID(checkoutRequestID string) (*model.Order, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var order model.Order
+	if err := db.Where("CheckoutRequestID = ?", checkoutRequestID).First(&order).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// FindPaymentByCheckoutRequestID returns the payment recorded for a payment
+// result, nil when there is none
+func FindPaymentByCheckoutRequestID(checkoutRequestID string) (*model.Payment, error) {
+	payment, err := findPaymentByCheckoutRequestID(gdatabase.GetDB(config.AppDB), checkoutRequestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch payment %s: %w", checkoutRequestID, err)
+	}
+	return payment, nil
+}
+
+// MarkOrderTimedOut moves a pending order to the timeout state, recording why.
+// It reports false when the order was settled in the meantime.
+func MarkOrderTimedOut(orderID int, resultDesc string) (bool, error) {
+	db := gdatabase.GetDB(config.AppDB)
+	result := db.Model(&model.Order{}).
+		Where("id = ? AND status = ?", orderID, model.OrderStatusPending).
+		Updates(map[string]interface{}{"status": model.OrderStatusTimeout, "ResultDesc": resultDesc})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to mark order %d timed out: %w", orderID, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RecordCallbackRejection stores the audit record of a rejected M-Pesa callback.
+// Failures are logged rather than returned, the callback is rejected either way.
+func RecordCallbackRejection(rejection model.MpesaCallbackRejection) {
+	log.Printf("Rejected M-Pesa callback %s from %s: %s %s",
+		rejection.CheckoutRequestID, rejection.SourceIP, rejection.Reason, rejection.Details)
+
+	db := gdatabase.GetDB(config.AppDB)
+	if db == nil {
+		return
+	}
+	if err := db.Create(&rejection).Error; err != nil {
+		log.Printf("Failed to record rejected M-Pesa callback: %v", err)
+	}
+}
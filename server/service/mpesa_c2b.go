@@ -0,0 +1,87 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// RecordC2BPayment stores a C2B confirmation. Safaricom may deliver the same
+// transaction more than once; the payment recorded first is then returned
+// with duplicate set.
+func RecordC2BPayment(payment *model.MpesaC2BPayment) (*model.MpesaC2BPayment, bool, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	err := db.Create(payment).Error
+	if err == nil {
+		return payment, false, nil
+	}
+	if !IsDuplicateKeyError(err) {
+		return nil, false, fmt.Errorf("failed to record C2B payment %s: %w", payment.TransID, err)
+	}
+
+	existing, err := FindC2BPayment(payment.TransID)
+	if err != nil {
+		return nil, false, err
+	}
+	return existing, true, nil
+}
+
+// FindC2BPayment returns the C2B payment with the given M-Pesa transaction ID
+func FindC2BPayment(transID string) (*model.MpesaC2BPayment, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var payment model.MpesaC2BPayment
+	if err := db.Where("transId = ?", transID).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fetch C2B payment %s: %w", transID, err)
+	}
+	return &payment, nil
+}
+
+// SetC2BPaymentStatus records how a C2B payment was allocated
+func SetC2BPaymentStatus(paymentID int, status string, orderID *int) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	err := db.Model(&model.MpesaC2BPayment{}).Where("id = ?", paymentID).
+		Updates(map[string]interface{}{"status": status, "orderId": orderID}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update C2B payment %d: %w", paymentID, err)
+	}
+	return nil
+}
+
+// FindOrderByNumber returns the order with the given order number and its plan
+func FindOrderByNumber(orderNumber string) (*model.Order, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var order model.Order
+	if err := db.Preload("ServicePlan").Where("orderNumber = ?", orderNumber).First(&order).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// FindUnsettledOrders returns the orders created since the given time that a
+// payment may still settle, newest first
+func FindUnsettledOrders(since time.Time) ([]model.Order, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var orders []model.Order
+	err := db.Preload("ServicePlan").
+		Where("status IN ? AND created_at >= ?",
+			[]string{model.OrderStatusPending, model.OrderStatusTimeout, model.OrderStatusPaymentFailed}, since).
+		Order("id DESC").Find(&orders).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unsettled orders: %w", err)
+	}
+	return orders, nil
+}
@@ -0,0 +1,58 @@
+package service_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "gorm translated", err: fmt.Errorf("create: %w", gorm.ErrDuplicatedKey), want: true},
+		{name: "mysql", err: errors.New("Error 1062 (23000): Duplicate entry 'ws_CO_1' for key 'payments.paymentCheckoutRequestID'"), want: true},
+		{name: "postgres", err: errors.New(`ERROR: duplicate key value violates unique constraint "paymentCheckoutRequestID" (SQLSTATE 23505)`), want: true},
+		{name: "other", err: errors.New("Error 1146: Table 'payments' doesn't exist"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.IsDuplicateKeyError(tt.err); got != tt.want {
+				t.Errorf("IsDuplicateKeyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyPaymentAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		paid     string
+		want     string
+		wantDiff string
+	}{
+		{name: "exact", expected: 70, paid: "70", want: "", wantDiff: "0"},
+		{name: "underpaid", expected: 70, paid: "50", want: model.MismatchUnderpaid, wantDiff: "-20"},
+		{name: "overpaid", expected: 70, paid: "100", want: model.MismatchOverpaid, wantDiff: "30"},
+		{name: "cents short", expected: 70, paid: "69.5", want: model.MismatchUnderpaid, wantDiff: "-0.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, diff := service.ClassifyPaymentAmount(tt.expected, decimal.RequireFromString(tt.paid))
+			if got != tt.want || diff.String() != tt.wantDiff {
+				t.Errorf("ClassifyPaymentAmount(%d, %s) = %q, %s, want %q, %s", tt.expected, tt.paid, got, diff, tt.want, tt.wantDiff)
+			}
+		})
+	}
+}
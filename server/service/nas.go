@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/mikrotik/radiusclient"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Defaults of the RADIUS client registration of a device
+const (
+	DefaultNasSecretLength = 32
+	DefaultNasService      = "hotspot"
+	DefaultNasType         = "other"
+	DefaultNasPushTimeout  = 15 * time.Second
+)
+
+// NasSecretAlphabet is the set of characters generated NAS secrets are made
+// of; none needs quoting on the RouterOS terminal or in clients.conf
+const NasSecretAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// nasCommentPrefix marks the /radius entries of a router wifigo manages
+const nasCommentPrefix = "wifigo:"
+
+// Errors of the RADIUS client registry
+var (
+	ErrNasNotFound = errors.New("device is not registered as a RADIUS client")
+	ErrNasExists   = errors.New("device is already registered as a RADIUS client")
+)
+
+// NasConfig tells routers where the RADIUS server is
+type NasConfig struct {
+	RadiusAddress string        `mapstructure:"radius_address"` // Address routers send RADIUS requests to
+	AuthPort      int           `mapstructure:"auth_port"`      // Defaults to 1812
+	AcctPort      int           `mapstructure:"acct_port"`      // Defaults to 1813
+	Service       string        `mapstructure:"service"`        // Defaults to hotspot
+	SecretLength  int           `mapstructure:"secret_length"`  // Defaults to 32
+	IncomingPort  int           `mapstructure:"incoming_port"`  // Port routers accept Disconnect and CoA requests on, 0 leaves it alone
+	PushTimeout   time.Duration `mapstructure:"push_timeout"`   // Defaults to 15s
+}
+
+// GenerateNasSecret draws a shared secret of length characters, the
+// default length when it is not positive
+func GenerateNasSecret(length int) (string, error) {
+	if length <= 0 {
+		length = DefaultNasSecretLength
+	}
+	max := big.NewInt(int64(len(NasSecretAlphabet)))
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to draw NAS secret: %w", err)
+		}
+		b.WriteByte(NasSecretAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// NasComment returns the comment of the /radius entry of deviceID on the
+// router, by which it is found again
+func NasComment(deviceID string) string {
+	return nasCommentPrefix + deviceID
+}
+
+// RouterRadiusEntry returns the /radius entry that points the router of nas
+// at the RADIUS server with its secret
+func RouterRadiusEntry(cfg NasConfig, nas model.Nas) radiusclient.Entry {
+	e := radiusclient.Entry{
+		Address:            cfg.RadiusAddress,
+		Secret:             nas.Secret,
+		Service:            cfg.Service,
+		AuthenticationPort: cfg.AuthPort,
+		AccountingPort:     cfg.AcctPort,
+	}
+	if e.Service == "" {
+		e.Service = DefaultNasService
+	}
+	if e.AuthenticationPort <= 0 {
+		e.AuthenticationPort = radiusclient.DefaultAuthenticationPort
+	}
+	if e.AccountingPort <= 0 {
+		e.AccountingPort = radiusclient.DefaultAccountingPort
+	}
+	if nas.DeviceID != nil {
+		e.Comment = NasComment(*nas.DeviceID)
+	}
+	return e
+}
+
+// FindDeviceNas returns the RADIUS client registration of deviceID
+func FindDeviceNas(tx *gorm.DB, deviceID string) (*model.Nas, error) {
+	var nas model.Nas
+	err := tx.Where("device_id = ?", deviceID).First(&nas).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNasNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch RADIUS client of device %s: %w", deviceID, err)
+	}
+	return &nas, nil
+}
+
+// NasPushResult is what pushing a registration changed on the router
+type NasPushResult struct {
+	EntryID string `json:"entry_id"`
+	Added   bool   `json:"added"` // The router had no entry for the device yet
+}
+
+// PushNasToRouter writes the /radius entry of nas to the router behind
+// runner, adding it or updating the one it already has
+func PushNasToRouter(ctx context.Context, runner radiusclient.Runner, cfg NasConfig, nas model.Nas) (NasPushResult, error) {
+	if cfg.RadiusAddress == "" {
+		return NasPushResult{}, errors.New("radius.nas.radius_address is not configured")
+	}
+	if nas.DeviceID == nil {
+		return NasPushResult{}, errors.New("RADIUS client is not tied to a device")
+	}
+	client := radiusclient.NewClient(runner)
+	id, added, err := client.Sync(ctx, RouterRadiusEntry(cfg, nas))
+	if err != nil {
+		return NasPushResult{}, err
+	}
+	if cfg.IncomingPort > 0 {
+		if err := client.AcceptIncoming(ctx, cfg.IncomingPort); err != nil {
+			return NasPushResult{}, err
+		}
+	}
+	return NasPushResult{EntryID: id, Added: added}, nil
+}
+
+// RemoveNasFromRouter removes the /radius entries of deviceID from the router
+// behind runner and returns how many there were
+func RemoveNasFromRouter(ctx context.Context, runner radiusclient.Runner, deviceID string) (int, error) {
+	return radiusclient.NewClient(runner).RemoveByComment(ctx, NasComment(deviceID))
+}
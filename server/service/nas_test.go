@@ -0,0 +1,127 @@
+package service_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ortupik/wifigo/mikrotik/radiusclient"
+	"github.com/ortupik/wifigo/mikrotik/routerostest"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+const pathRadius = "/radius"
+
+var testNasConfig = service.NasConfig{RadiusAddress: "10.0.0.2"}
+
+func testNas(secret string) model.Nas {
+	deviceID := "router1"
+	return model.Nas{NasName: "10.0.0.1", DeviceID: &deviceID, Secret: secret}
+}
+
+func TestPushNasToRouter(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.Add(pathRadius, map[string]string{"address": "10.9.9.9", "secret": "theirs", "comment": "set up by hand"})
+	pool, err := newService(t, srv).GetDevicePool("router1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	result, err := service.PushNasToRouter(ctx, pool, testNasConfig, testNas("first"))
+	if err != nil || !result.Added || result.EntryID == "" {
+		t.Fatalf("PushNasToRouter() = %+v, %v, want a new entry", result, err)
+	}
+
+	// Rotating the secret updates the same entry
+	result, err = service.PushNasToRouter(ctx, pool, testNasConfig, testNas("second"))
+	if err != nil || result.Added {
+		t.Fatalf("PushNasToRouter() = %+v, %v, want the entry updated", result, err)
+	}
+
+	rows := srv.Rows(pathRadius)
+	if len(rows) != 2 {
+		t.Fatalf("router has %d /radius entries, want its own and ours", len(rows))
+	}
+	ours := rows[1]
+	want := map[string]string{
+		"address":             "10.0.0.2",
+		"secret":              "second",
+		"service":             "hotspot",
+		"authentication-port": "1812",
+		"accounting-port":     "1813",
+		"comment":             service.NasComment("router1"),
+	}
+	for k, v := range want {
+		if ours[k] != v {
+			t.Errorf("/radius %s = %q, want %q", k, ours[k], v)
+		}
+	}
+	if rows[0]["secret"] != "theirs" {
+		t.Errorf("entry set up by hand was changed: %v", rows[0])
+	}
+
+	removed, err := service.RemoveNasFromRouter(ctx, pool, "router1")
+	if err != nil || removed != 1 {
+		t.Fatalf("RemoveNasFromRouter() = %d, %v, want 1", removed, err)
+	}
+	if rows := srv.Rows(pathRadius); len(rows) != 1 || rows[0]["comment"] != "set up by hand" {
+		t.Errorf("router /radius after removal = %v, want only the entry set up by hand", rows)
+	}
+}
+
+func TestPushNasToRouterAcceptsIncoming(t *testing.T) {
+	srv := routerostest.NewServer()
+	defer srv.Close()
+	srv.Handle(pathRadius+"/incoming/set", func(req routerostest.Request) routerostest.Response {
+		return routerostest.Response{}
+	})
+	pool, err := newService(t, srv).GetDevicePool("router1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testNasConfig
+	cfg.IncomingPort = 3799
+	if _, err := service.PushNasToRouter(context.Background(), pool, cfg, testNas("secret")); err != nil {
+		t.Fatalf("PushNasToRouter() error = %v", err)
+	}
+	reqs := srv.RequestsFor(pathRadius + "/incoming/set")
+	if len(reqs) != 1 || reqs[0].Attrs["accept"] != "yes" || reqs[0].Attrs["port"] != "3799" {
+		t.Errorf("/radius/incoming/set requests = %v, want accept=yes port=3799", reqs)
+	}
+}
+
+func TestPushNasToRouterNeedsRadiusAddress(t *testing.T) {
+	if _, err := service.PushNasToRouter(context.Background(), nil, service.NasConfig{}, testNas("secret")); err == nil {
+		t.Error("PushNasToRouter() without a RADIUS address succeeded")
+	}
+}
+
+func TestGenerateNasSecret(t *testing.T) {
+	secret, err := service.GenerateNasSecret(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != service.DefaultNasSecretLength {
+		t.Errorf("secret is %d characters, want %d", len(secret), service.DefaultNasSecretLength)
+	}
+	for _, r := range secret {
+		if !strings.ContainsRune(service.NasSecretAlphabet, r) {
+			t.Errorf("secret %q has %q outside the alphabet", secret, r)
+		}
+	}
+	if other, _ := service.GenerateNasSecret(0); other == secret {
+		t.Error("two secrets drawn alike")
+	}
+}
+
+func TestRadiusCommand(t *testing.T) {
+	got := radiusclient.Command(service.RouterRadiusEntry(testNasConfig, testNas(`a "quoted" $ecret`)))
+	want := `/radius add address=10.0.0.2 secret="a \"quoted\" \$ecret" service=hotspot authentication-port=1812 accounting-port=1813 comment=wifigo:router1`
+	if got != want {
+		t.Errorf("Command() =\n%s\nwant\n%s", got, want)
+	}
+}
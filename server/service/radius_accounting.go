@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// ErrMissingAcctStatusType is returned for an Accounting-Request without an
+// Acct-Status-Type
+var ErrMissingAcctStatusType = errors.New("accounting request has no Acct-Status-Type")
+
+// AccountingRecord is an Accounting-Request of a NAS
+type AccountingRecord struct {
+	StatusType       uint32
+	Username         string
+	SessionID        string
+	NasIPAddress     string
+	NasIdentifier    string
+	NasPortID        string
+	NasPortType      string
+	CalledStationID  string
+	CallingStationID string
+	FramedIPAddress  string
+	ConnectInfo      string
+	ServiceType      string
+	FramedProtocol   string
+	TerminateCause   string
+	SessionTime      int
+	InputOctets      int64 // Acct-Input-Gigawords included
+	OutputOctets     int64
+	EventTime        time.Time
+}
+
+// ParseAccountingRequest reads the accounting record of p, received at now
+// from remote. The NAS address is the NAS-IP-Address of the request, or the
+// address it came from.
+func ParseAccountingRequest(p *radius.Packet, remote net.Addr, now time.Time) (AccountingRecord, error) {
+	status, ok := p.GetInteger(radius.AttrAcctStatusType)
+	if !ok {
+		return AccountingRecord{}, ErrMissingAcctStatusType
+	}
+	rec := AccountingRecord{
+		StatusType:       status,
+		Username:         p.GetString(radius.AttrUserName),
+		SessionID:        p.GetString(radius.AttrAcctSessionID),
+		NasIdentifier:    p.GetString(radius.AttrNASIdentifier),
+		NasPortID:        p.GetString(radius.AttrNASPortID),
+		CalledStationID:  p.GetString(radius.AttrCalledStationID),
+		CallingStationID: p.GetString(radius.AttrCallingStationID),
+		ConnectInfo:      p.GetString(radius.AttrConnectInfo),
+	}
+
+	if ip, ok := p.Get(radius.AttrNASIPAddress); ok && len(ip) == net.IPv4len {
+		rec.NasIPAddress = net.IP(ip).String()
+	} else if udp, ok := remote.(*net.UDPAddr); ok {
+		rec.NasIPAddress = udp.IP.String()
+	}
+	if ip, ok := p.Get(radius.AttrFramedIPAddress); ok && len(ip) == net.IPv4len {
+		rec.FramedIPAddress = net.IP(ip).String()
+	}
+	if v, ok := p.GetInteger(radius.AttrNASPortType); ok {
+		rec.NasPortType = radius.NASPortType(v)
+	}
+	if v, ok := p.GetInteger(radius.AttrServiceType); ok {
+		rec.ServiceType = strconv.FormatUint(uint64(v), 10)
+	}
+	if v, ok := p.GetInteger(radius.AttrFramedProtocol); ok {
+		rec.FramedProtocol = strconv.FormatUint(uint64(v), 10)
+	}
+	if v, ok := p.GetInteger(radius.AttrAcctTerminateCause); ok {
+		rec.TerminateCause = radius.TerminateCause(v)
+	}
+	if v, ok := p.GetInteger(radius.AttrAcctSessionTime); ok {
+		rec.SessionTime = int(v)
+	}
+	rec.InputOctets = octets(p, radius.AttrAcctInputOctets, radius.AttrAcctInputGigawords)
+	rec.OutputOctets = octets(p, radius.AttrAcctOutputOctets, radius.AttrAcctOutputGigawords)
+
+	rec.EventTime = now
+	if v, ok := p.GetInteger(radius.AttrEventTimestamp); ok {
+		rec.EventTime = time.Unix(int64(v), 0)
+	} else if v, ok := p.GetInteger(radius.AttrAcctDelayTime); ok {
+		rec.EventTime = now.Add(-time.Duration(v) * time.Second)
+	}
+	return rec, nil
+}
+
+// octets joins a 32 bit octet counter with the Gigawords counting its
+// overflows
+func octets(p *radius.Packet, octetsType, gigawordsType byte) int64 {
+	low, _ := p.GetInteger(octetsType)
+	high, _ := p.GetInteger(gigawordsType)
+	return int64(high)<<32 | int64(low)
+}
+
+// AccountingUniqueID identifies the session of rec across its start, interim
+// and stop records, like the acct_unique policy of FreeRADIUS
+func AccountingUniqueID(rec AccountingRecord) string {
+	sum := md5.Sum([]byte(rec.Username + "," + rec.SessionID + "," + rec.NasIPAddress + "," + rec.NasIdentifier + "," + rec.NasPortID))
+	return hex.EncodeToString(sum[:])
+}
+
+// ApplyAccounting writes rec into row, the radacct row of its session. A new
+// row gets its start time from the event time less the session time, so a
+// session whose start record was lost is still accounted for.
+func ApplyAccounting(row *model.RadAcct, rec AccountingRecord) {
+	if row.AcctUniqueID == "" {
+		start := rec.EventTime.Add(-time.Duration(rec.SessionTime) * time.Second)
+		row.AcctUniqueID = AccountingUniqueID(rec)
+		row.AcctSessionID = rec.SessionID
+		row.Username = rec.Username
+		row.NasIPAddress = rec.NasIPAddress
+		row.NasPortID = optional(rec.NasPortID)
+		row.NasPortType = optional(rec.NasPortType)
+		row.CalledStationID = rec.CalledStationID
+		row.CallingStationID = rec.CallingStationID
+		row.ServiceType = optional(rec.ServiceType)
+		row.FramedProtocol = optional(rec.FramedProtocol)
+		row.ConnectInfoStart = optional(rec.ConnectInfo)
+		row.AcctStartTime = &start
+	}
+	if rec.FramedIPAddress != "" {
+		row.FramedIPAddress = &rec.FramedIPAddress
+	}
+
+	event := rec.EventTime
+	row.EventTimestamp = &event
+	if rec.StatusType == radius.AcctStatusStart {
+		return
+	}
+	// Counters only grow; an older record arriving late must not lower them
+	if row.AcctSessionTime == nil || rec.SessionTime >= *row.AcctSessionTime {
+		sessionTime, input, output := rec.SessionTime, rec.InputOctets, rec.OutputOctets
+		row.AcctSessionTime = &sessionTime
+		row.AcctInputOctets = &input
+		row.AcctOutputOctets = &output
+	}
+	row.AcctUpdateTime = &event
+	if rec.StatusType == radius.AcctStatusStop {
+		row.AcctStopTime = &event
+		row.AcctTerminateCause = optional(rec.TerminateCause)
+		row.ConnectInfoStop = optional(rec.ConnectInfo)
+	}
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Check attributes the embedded RADIUS server enforces
+const (
+	AttrCleartextPassword = "Cleartext-Password"
+	AttrAuthType          = "Auth-Type"
+	AttrExpiration        = "Expiration"
+)
+
+// Reasons an Access-Request is rejected, sent back as Reply-Message
+const (
+	RejectUnknownUser      = "Unknown user"
+	RejectAuthType         = "Access denied"
+	RejectNoPassword       = "No password given"
+	RejectWrongPassword    = "Wrong password"
+	RejectExpired          = "Your account has expired"
+	RejectSimultaneousUse  = "You are already logged in on the maximum number of devices"
+	RejectInvalidAttribute = "Account misconfigured"
+)
+
+// RadiusGroup is a group of a RADIUS user with its check and reply attributes
+type RadiusGroup struct {
+	Name     string
+	Priority int
+	Checks   []model.RadGroupCheck
+	Replies  []model.RadGroupReply
+}
+
+// RadiusUser is what the RADIUS server knows of a user when it authorizes an
+// Access-Request: its own attributes, its groups in priority order and how
+// many accounting sessions it has open
+type RadiusUser struct {
+	Username       string
+	Checks         []model.RadCheck
+	Replies        []model.RadReply
+	Groups         []RadiusGroup
+	ActiveSessions int
+}
+
+// AuthRequest holds the credentials of an Access-Request. Password is the
+// decrypted User-Password; a CHAP request sets CHAPPassword and CHAPChallenge
+// instead.
+type AuthRequest struct {
+	Username      string
+	Password      string
+	CHAPPassword  []byte
+	CHAPChallenge []byte
+}
+
+// AuthResult is the answer to an Access-Request
+type AuthResult struct {
+	Accept  bool
+	Reason  string // Why it was rejected
+	Replies []ReplyAttribute
+}
+
+// EffectiveChecks returns the check attributes of user the way FreeRADIUS
+// picks them: its own radcheck, then the radgroupcheck of each group in
+// priority order, each attribute taken from the first that sets it
+func EffectiveChecks(user *RadiusUser) map[string]string {
+	checks := make(map[string]string)
+	for _, c := range user.Checks {
+		if _, ok := checks[c.Attribute]; !ok {
+			checks[c.Attribute] = c.Value
+		}
+	}
+	for _, g := range user.Groups {
+		for _, c := range g.Checks {
+			if _, ok := checks[c.Attribute]; !ok {
+				checks[c.Attribute] = c.Value
+			}
+		}
+	}
+	return checks
+}
+
+// Authorize checks req against the attributes of user at now, as the
+// FreeRADIUS sql, pap, chap and expiration modules would. The Session-Timeout
+// of an accepted user is cut to the time left before it expires.
+func Authorize(user *RadiusUser, req AuthRequest, now time.Time) AuthResult {
+	if user == nil {
+		return AuthResult{Reason: RejectUnknownUser}
+	}
+	checks := EffectiveChecks(user)
+
+	switch strings.ToLower(checks[AttrAuthType]) {
+	case "reject":
+		return AuthResult{Reason: RejectAuthType}
+	case "accept":
+	default:
+		if reason := checkPassword(checks, req); reason != "" {
+			return AuthResult{Reason: reason}
+		}
+	}
+
+	var left time.Duration
+	if value, ok := checks[AttrExpiration]; ok {
+		expiresAt, err := time.ParseInLocation(model.RadiusExpirationLayout, value, now.Location())
+		if err != nil {
+			return AuthResult{Reason: RejectInvalidAttribute}
+		}
+		if !now.Before(expiresAt) {
+			return AuthResult{Reason: RejectExpired}
+		}
+		left = expiresAt.Sub(now)
+	}
+
+	if value, ok := checks[AttrSimultaneousUse]; ok {
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return AuthResult{Reason: RejectInvalidAttribute}
+		}
+		if user.ActiveSessions >= limit {
+			return AuthResult{Reason: RejectSimultaneousUse}
+		}
+	}
+
+	var groupReplies []model.RadGroupReply
+	for _, g := range user.Groups {
+		groupReplies = append(groupReplies, g.Replies...)
+	}
+	replies := EffectiveReplies(user.Replies, groupReplies)
+	if left > 0 {
+		replies = capSessionTimeout(replies, left)
+	}
+	return AuthResult{Accept: true, Replies: replies}
+}
+
+// checkPassword returns why req does not match the Cleartext-Password, empty
+// when it does
+func checkPassword(checks map[string]string, req AuthRequest) string {
+	password, ok := checks[AttrCleartextPassword]
+	if !ok {
+		return RejectNoPassword
+	}
+	if req.CHAPPassword != nil {
+		if !radius.VerifyCHAP(password, req.CHAPPassword, req.CHAPChallenge) {
+			return RejectWrongPassword
+		}
+		return ""
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(req.Password)) != 1 {
+		return RejectWrongPassword
+	}
+	return ""
+}
+
+// capSessionTimeout sets the Session-Timeout of replies to at most left,
+// rounded up to the second
+func capSessionTimeout(replies []ReplyAttribute, left time.Duration) []ReplyAttribute {
+	limit := int64((left + time.Second - 1) / time.Second)
+	for i, r := range replies {
+		if r.Attribute != AttrSessionTimeout {
+			continue
+		}
+		if v, err := strconv.ParseInt(strings.TrimSpace(r.Value), 10, 64); err == nil && v > 0 && v <= limit {
+			return replies
+		}
+		replies[i].Value = strconv.FormatInt(limit, 10)
+		return replies
+	}
+	return append(replies, ReplyAttribute{Attribute: AttrSessionTimeout, Value: strconv.FormatInt(limit, 10)})
+}
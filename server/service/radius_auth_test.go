@@ -0,0 +1,110 @@
+package service_test
+
+import (
+	"crypto/md5"
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+var authNow = time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+func radiusUser(checks map[string]string, groups ...service.RadiusGroup) *service.RadiusUser {
+	user := &service.RadiusUser{Username: "0712345678@Tecsurf", Groups: groups}
+	for attr, value := range checks {
+		user.Checks = append(user.Checks, model.RadCheck{Username: user.Username, Attribute: attr, Op: ":=", Value: value})
+	}
+	return user
+}
+
+func TestAuthorize(t *testing.T) {
+	weekly := service.RadiusGroup{
+		Name:     "weekly",
+		Priority: 1,
+		Checks:   []model.RadGroupCheck{{Groupname: "weekly", Attribute: service.AttrSimultaneousUse, Op: "=", Value: "2"}},
+	}
+	expires := authNow.Add(30 * time.Minute).Format(model.RadiusExpirationLayout)
+	expired := authNow.Add(-time.Minute).Format(model.RadiusExpirationLayout)
+
+	tests := []struct {
+		name   string
+		user   *service.RadiusUser
+		active int
+		req    service.AuthRequest
+		want   string // Reject reason, empty for accept
+	}{
+		{"unknown user", nil, 0, service.AuthRequest{Password: "secret"}, service.RejectUnknownUser},
+		{"pap", radiusUser(map[string]string{service.AttrCleartextPassword: "secret"}), 0, service.AuthRequest{Password: "secret"}, ""},
+		{"wrong password", radiusUser(map[string]string{service.AttrCleartextPassword: "secret"}), 0, service.AuthRequest{Password: "secreT"}, service.RejectWrongPassword},
+		{"no password", radiusUser(nil), 0, service.AuthRequest{Password: "secret"}, service.RejectNoPassword},
+		{"auth-type accept", radiusUser(map[string]string{service.AttrAuthType: "Accept"}), 0, service.AuthRequest{}, ""},
+		{"auth-type reject", radiusUser(map[string]string{service.AttrAuthType: "Reject", service.AttrCleartextPassword: "secret"}), 0, service.AuthRequest{Password: "secret"}, service.RejectAuthType},
+		{"not expired", radiusUser(map[string]string{service.AttrCleartextPassword: "secret", service.AttrExpiration: expires}), 0, service.AuthRequest{Password: "secret"}, ""},
+		{"expired", radiusUser(map[string]string{service.AttrCleartextPassword: "secret", service.AttrExpiration: expired}), 0, service.AuthRequest{Password: "secret"}, service.RejectExpired},
+		{"bad expiration", radiusUser(map[string]string{service.AttrCleartextPassword: "secret", service.AttrExpiration: "tomorrow"}), 0, service.AuthRequest{Password: "secret"}, service.RejectInvalidAttribute},
+		{"group simultaneous use", radiusUser(map[string]string{service.AttrCleartextPassword: "secret"}, weekly), 1, service.AuthRequest{Password: "secret"}, ""},
+		{"group simultaneous use reached", radiusUser(map[string]string{service.AttrCleartextPassword: "secret"}, weekly), 2, service.AuthRequest{Password: "secret"}, service.RejectSimultaneousUse},
+		{"user overrides group", radiusUser(map[string]string{service.AttrCleartextPassword: "secret", service.AttrSimultaneousUse: "3"}, weekly), 2, service.AuthRequest{Password: "secret"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.user != nil {
+				tt.user.ActiveSessions = tt.active
+			}
+			got := service.Authorize(tt.user, tt.req, authNow)
+			if got.Accept != (tt.want == "") || got.Reason != tt.want {
+				t.Errorf("Authorize() = %+v, want reason %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeCHAP(t *testing.T) {
+	user := radiusUser(map[string]string{service.AttrCleartextPassword: "secret"})
+	challenge := []byte("0123456789abcdef")
+	sum := md5.Sum(append(append([]byte{9}, "secret"...), challenge...))
+	req := service.AuthRequest{CHAPPassword: append([]byte{9}, sum[:]...), CHAPChallenge: challenge}
+
+	if got := service.Authorize(user, req, authNow); !got.Accept {
+		t.Errorf("Authorize() = %+v, want accept", got)
+	}
+	req.CHAPChallenge = []byte("fedcba9876543210")
+	if got := service.Authorize(user, req, authNow); got.Reason != service.RejectWrongPassword {
+		t.Errorf("Authorize() with another challenge = %+v, want %q", got, service.RejectWrongPassword)
+	}
+}
+
+func TestAuthorizeReplies(t *testing.T) {
+	user := radiusUser(map[string]string{
+		service.AttrCleartextPassword: "secret",
+		service.AttrExpiration:        authNow.Add(30 * time.Minute).Format(model.RadiusExpirationLayout),
+	},
+		service.RadiusGroup{Name: "daily", Priority: 1, Replies: []model.RadGroupReply{
+			{Groupname: "daily", Attribute: service.AttrMikrotikRateLimit, Value: "5120k/5120k"},
+			{Groupname: "daily", Attribute: service.AttrSessionTimeout, Value: "86400"},
+		}},
+		service.RadiusGroup{Name: "default", Priority: 5, Replies: []model.RadGroupReply{
+			{Groupname: "default", Attribute: service.AttrMikrotikRateLimit, Value: "1M/1M"},
+			{Groupname: "default", Attribute: service.AttrIdleTimeout, Value: "600"},
+		}},
+	)
+	user.Replies = []model.RadReply{{Attribute: service.AttrMikrotikTotalLimit, Value: "1048576"}}
+
+	got := service.Authorize(user, service.AuthRequest{Password: "secret"}, authNow)
+	want := map[string]string{
+		service.AttrMikrotikTotalLimit: "1048576",
+		service.AttrMikrotikRateLimit:  "5120k/5120k",
+		service.AttrSessionTimeout:     "1800",
+		service.AttrIdleTimeout:        "600",
+	}
+	if !got.Accept || len(got.Replies) != len(want) {
+		t.Fatalf("Authorize() = %+v, want %d replies", got, len(want))
+	}
+	for _, r := range got.Replies {
+		if want[r.Attribute] != r.Value {
+			t.Errorf("%s = %q, want %q", r.Attribute, r.Value, want[r.Attribute])
+		}
+	}
+}
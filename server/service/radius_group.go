@@ -0,0 +1,348 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Defaults of the RADIUS group of a service plan
+const (
+	DefaultIdleTimeout = 600 // Seconds
+	DefaultBurstTime   = 8   // Seconds
+)
+
+// RADIUS group attributes generated from a service plan
+const (
+	AttrSessionTimeout      = "Session-Timeout"
+	AttrIdleTimeout         = "Idle-Timeout"
+	AttrSimultaneousUse     = "Simultaneous-Use"
+	AttrMikrotikRateLimit   = "Mikrotik-Rate-Limit"
+	AttrMikrotikTotalLimit  = "Mikrotik-Total-Limit"
+	AttrMikrotikTotalLimitG = "Mikrotik-Total-Limit-Gigawords"
+)
+
+// Attributes of a plan's group that are generated from the plan. Other
+// attributes an operator adds to the group are left alone.
+var (
+	planCheckAttributes = []string{AttrSimultaneousUse}
+	planReplyAttributes = []string{AttrSessionTimeout, AttrIdleTimeout, AttrMikrotikRateLimit, AttrMikrotikTotalLimit, AttrMikrotikTotalLimitG}
+)
+
+// PlanGroupAttributes returns the radgroupcheck and radgroupreply rows of the
+// RADIUS group of plan
+func PlanGroupAttributes(plan model.ServicePlan) ([]model.RadGroupCheck, []model.RadGroupReply, error) {
+	group := plan.GroupName()
+	if group == "" {
+		return nil, nil, fmt.Errorf("service plan has no name")
+	}
+	if plan.Duration <= 0 {
+		return nil, nil, fmt.Errorf("duration of plan %s must be positive", plan.Name)
+	}
+
+	var checks []model.RadGroupCheck
+	if plan.Devices < 0 {
+		return nil, nil, fmt.Errorf("devices of plan %s must not be negative", plan.Name)
+	}
+	if plan.Devices > 0 {
+		// "=" only applies when the user has no Simultaneous-Use of their
+		// own, which subscriptions set from the devices paid for
+		checks = append(checks, model.RadGroupCheck{Groupname: group, Attribute: AttrSimultaneousUse, Op: "=", Value: strconv.Itoa(plan.Devices)})
+	}
+
+	idle := plan.IdleTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	if idle < 0 {
+		return nil, nil, fmt.Errorf("idle timeout of plan %s must not be negative", plan.Name)
+	}
+	replies := []model.RadGroupReply{
+		{Groupname: group, Attribute: AttrSessionTimeout, Op: ":=", Value: strconv.Itoa(plan.Duration)},
+		{Groupname: group, Attribute: AttrIdleTimeout, Op: ":=", Value: strconv.Itoa(idle)},
+	}
+
+	rateLimit, err := MikrotikRateLimit(plan)
+	if err != nil {
+		return nil, nil, fmt.Errorf("plan %s: %w", plan.Name, err)
+	}
+	if rateLimit != "" {
+		replies = append(replies, model.RadGroupReply{Groupname: group, Attribute: AttrMikrotikRateLimit, Op: ":=", Value: rateLimit})
+	}
+
+	if bytes := DataLimitBytes(plan); bytes > 0 {
+		// Mikrotik-Total-Limit is 32 bits wide, larger limits carry into
+		// gigawords. "=" lets the remaining quota a subscriber is given with
+		// SetUserDataLimit take precedence.
+		limit, gigawords := SplitTotalLimit(bytes)
+		replies = append(replies, model.RadGroupReply{Groupname: group, Attribute: AttrMikrotikTotalLimit, Op: "=", Value: strconv.FormatUint(limit, 10)})
+		if gigawords > 0 {
+			replies = append(replies, model.RadGroupReply{Groupname: group, Attribute: AttrMikrotikTotalLimitG, Op: "=", Value: strconv.FormatUint(gigawords, 10)})
+		}
+	}
+	return checks, replies, nil
+}
+
+// MikrotikRateLimit returns the Mikrotik-Rate-Limit of plan, empty when the
+// plan has no speed limit. Rates are in Mbps, either one rate for upload and
+// download or "upload/download".
+func MikrotikRateLimit(plan model.ServicePlan) (string, error) {
+	if strings.TrimSpace(plan.SpeedLimitMbps) == "" {
+		if plan.BurstLimitMbps != "" {
+			return "", fmt.Errorf("burst limit needs a speed limit")
+		}
+		return "", nil
+	}
+	upload, download, err := parseRate(plan.SpeedLimitMbps)
+	if err != nil {
+		return "", fmt.Errorf("invalid speed limit: %w", err)
+	}
+	limit := fmt.Sprintf("%s/%s", rateK(upload), rateK(download))
+	if strings.TrimSpace(plan.BurstLimitMbps) == "" {
+		return limit, nil
+	}
+
+	burstUp, burstDown, err := parseRate(plan.BurstLimitMbps)
+	if err != nil {
+		return "", fmt.Errorf("invalid burst limit: %w", err)
+	}
+	if burstUp <= upload || burstDown <= download {
+		return "", fmt.Errorf("burst limit %s must exceed the speed limit %s", plan.BurstLimitMbps, plan.SpeedLimitMbps)
+	}
+	thresholdUp, thresholdDown := upload*3/4, download*3/4
+	if strings.TrimSpace(plan.BurstThresholdMbps) != "" {
+		if thresholdUp, thresholdDown, err = parseRate(plan.BurstThresholdMbps); err != nil {
+			return "", fmt.Errorf("invalid burst threshold: %w", err)
+		}
+		if thresholdUp > upload || thresholdDown > download {
+			return "", fmt.Errorf("burst threshold %s must not exceed the speed limit %s", plan.BurstThresholdMbps, plan.SpeedLimitMbps)
+		}
+	}
+	burstTime := plan.BurstTime
+	if burstTime == 0 {
+		burstTime = DefaultBurstTime
+	}
+	if burstTime < 0 {
+		return "", fmt.Errorf("burst time must not be negative")
+	}
+
+	return fmt.Sprintf("%s %s/%s %s/%s %d/%d", limit,
+		rateK(burstUp), rateK(burstDown), rateK(thresholdUp), rateK(thresholdDown), burstTime, burstTime), nil
+}
+
+// parseRate parses "3" or "2/5" Mbps into the upload and download rate
+func parseRate(rate string) (upload, download float64, err error) {
+	parts := strings.Split(strings.TrimSpace(rate), "/")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("%q is not a rate or upload/download rates", rate)
+	}
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("%q is not a positive rate in Mbps", part)
+		}
+		values[i] = v
+	}
+	if len(values) == 1 {
+		return values[0], values[0], nil
+	}
+	return values[0], values[1], nil
+}
+
+// rateK formats Mbps the way MikroTik takes them, in kbps
+func rateK(mbps float64) string {
+	return fmt.Sprintf("%dk", int64(math.Round(mbps*1024)))
+}
+
+// SyncPlanGroup writes the generated attributes of plan's RADIUS group within
+// the RADIUS transaction tx. previousName is the plan's name before an edit;
+// when it changed, the old group's attributes are removed and its members
+// are moved to the new group.
+func SyncPlanGroup(tx *gorm.DB, plan model.ServicePlan, previousName string) error {
+	checks, replies, err := PlanGroupAttributes(plan)
+	if err != nil {
+		return err
+	}
+	group := plan.GroupName()
+
+	if previousName != "" && previousName != group {
+		if err := deletePlanAttributes(tx, previousName); err != nil {
+			return err
+		}
+		if err := tx.Model(&model.RadUserGroup{}).Where("groupname = ?", previousName).Update("groupname", group).Error; err != nil {
+			return fmt.Errorf("failed to move members of group %s: %w", previousName, err)
+		}
+	}
+	if err := deletePlanAttributes(tx, group); err != nil {
+		return err
+	}
+	if len(checks) > 0 {
+		if err := tx.Create(&checks).Error; err != nil {
+			return fmt.Errorf("failed to write radgroupcheck of %s: %w", group, err)
+		}
+	}
+	if err := tx.Create(&replies).Error; err != nil {
+		return fmt.Errorf("failed to write radgroupreply of %s: %w", group, err)
+	}
+	return nil
+}
+
+func deletePlanAttributes(tx *gorm.DB, group string) error {
+	if err := tx.Where("groupname = ? AND attribute IN ?", group, planCheckAttributes).Delete(&model.RadGroupCheck{}).Error; err != nil {
+		return fmt.Errorf("failed to clear radgroupcheck of %s: %w", group, err)
+	}
+	if err := tx.Where("groupname = ? AND attribute IN ?", group, planReplyAttributes).Delete(&model.RadGroupReply{}).Error; err != nil {
+		return fmt.Errorf("failed to clear radgroupreply of %s: %w", group, err)
+	}
+	return nil
+}
+
+// SyncAllPlanGroups regenerates the RADIUS groups of every service plan and
+// returns the number of plans synchronised
+func SyncAllPlanGroups() (int, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return 0, fmt.Errorf("database is not initialised")
+	}
+
+	var plans []model.ServicePlan
+	if err := appDB.Order("id").Find(&plans).Error; err != nil {
+		return 0, fmt.Errorf("failed to fetch service plans: %w", err)
+	}
+	err := radiusDB.Transaction(func(tx *gorm.DB) error {
+		for _, plan := range plans {
+			if err := SyncPlanGroup(tx, plan, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(plans), nil
+}
+
+// AttributeDrift is a generated attribute whose value in the group differs
+// from the plan's
+type AttributeDrift struct {
+	Attribute string `json:"attribute"`
+	Expected  string `json:"expected"` // Empty when the attribute should not be set
+	Actual    string `json:"actual"`   // Empty when the attribute is missing
+}
+
+// PlanGroupDrift lists the differences between a plan and its RADIUS group
+type PlanGroupDrift struct {
+	PlanID     int              `json:"plan_id"`
+	Plan       string           `json:"plan"`
+	Group      string           `json:"group"`
+	Error      string           `json:"error,omitempty"` // The plan's attributes cannot be generated
+	Attributes []AttributeDrift `json:"attributes,omitempty"`
+}
+
+// RadiusGroupDriftReport lists plans whose group no longer matches them and
+// groups with generated attributes that belong to no plan
+type RadiusGroupDriftReport struct {
+	Plans          []PlanGroupDrift `json:"plans"`
+	OrphanedGroups []string         `json:"orphaned_groups"`
+}
+
+// ComparePlanGroup compares the generated attributes of plan with the rows
+// of its group
+func ComparePlanGroup(plan model.ServicePlan, checks []model.RadGroupCheck, replies []model.RadGroupReply) PlanGroupDrift {
+	drift := PlanGroupDrift{PlanID: plan.ID, Plan: plan.Name, Group: plan.GroupName()}
+	wantChecks, wantReplies, err := PlanGroupAttributes(plan)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+
+	want := map[string]string{}
+	for _, c := range wantChecks {
+		want[c.Attribute] = c.Op + " " + c.Value
+	}
+	for _, r := range wantReplies {
+		want[r.Attribute] = r.Op + " " + r.Value
+	}
+	have := map[string]string{}
+	managed := map[string]bool{}
+	for _, attr := range append(append([]string{}, planCheckAttributes...), planReplyAttributes...) {
+		managed[attr] = true
+	}
+	for _, c := range checks {
+		if c.Groupname == drift.Group && managed[c.Attribute] {
+			have[c.Attribute] = c.Op + " " + c.Value
+		}
+	}
+	for _, r := range replies {
+		if r.Groupname == drift.Group && managed[r.Attribute] {
+			have[r.Attribute] = r.Op + " " + r.Value
+		}
+	}
+
+	for attr := range managed {
+		if want[attr] != have[attr] {
+			drift.Attributes = append(drift.Attributes, AttributeDrift{Attribute: attr, Expected: want[attr], Actual: have[attr]})
+		}
+	}
+	sort.Slice(drift.Attributes, func(i, j int) bool { return drift.Attributes[i].Attribute < drift.Attributes[j].Attribute })
+	return drift
+}
+
+// FindRadiusGroupDrift compares every service plan with its RADIUS group
+func FindRadiusGroupDrift() (*RadiusGroupDriftReport, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return nil, fmt.Errorf("database is not initialised")
+	}
+
+	var plans []model.ServicePlan
+	if err := appDB.Order("id").Find(&plans).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch service plans: %w", err)
+	}
+	var checks []model.RadGroupCheck
+	if err := radiusDB.Where("attribute IN ?", planCheckAttributes).Find(&checks).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch radgroupcheck: %w", err)
+	}
+	var replies []model.RadGroupReply
+	if err := radiusDB.Where("attribute IN ?", planReplyAttributes).Find(&replies).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch radgroupreply: %w", err)
+	}
+
+	report := &RadiusGroupDriftReport{Plans: []PlanGroupDrift{}, OrphanedGroups: []string{}}
+	planGroups := map[string]bool{}
+	for _, plan := range plans {
+		planGroups[plan.GroupName()] = true
+		if drift := ComparePlanGroup(plan, checks, replies); drift.Error != "" || len(drift.Attributes) > 0 {
+			report.Plans = append(report.Plans, drift)
+		}
+	}
+
+	orphaned := map[string]bool{}
+	for _, c := range checks {
+		if !planGroups[c.Groupname] {
+			orphaned[c.Groupname] = true
+		}
+	}
+	for _, r := range replies {
+		if !planGroups[r.Groupname] {
+			orphaned[r.Groupname] = true
+		}
+	}
+	for group := range orphaned {
+		report.OrphanedGroups = append(report.OrphanedGroups, group)
+	}
+	sort.Strings(report.OrphanedGroups)
+	return report, nil
+}
@@ -0,0 +1,117 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestMikrotikRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		plan    model.ServicePlan
+		want    string
+		wantErr bool
+	}{
+		{name: "no limit", plan: model.ServicePlan{}, want: ""},
+		{name: "symmetric", plan: model.ServicePlan{SpeedLimitMbps: "3"}, want: "3072k/3072k"},
+		{name: "upload and download", plan: model.ServicePlan{SpeedLimitMbps: "1.5/10"}, want: "1536k/10240k"},
+		{name: "burst", plan: model.ServicePlan{SpeedLimitMbps: "4", BurstLimitMbps: "8"}, want: "4096k/4096k 8192k/8192k 3072k/3072k 8/8"},
+		{name: "burst threshold and time", plan: model.ServicePlan{SpeedLimitMbps: "2/4", BurstLimitMbps: "4/8", BurstThresholdMbps: "1/2", BurstTime: 16},
+			want: "2048k/4096k 4096k/8192k 1024k/2048k 16/16"},
+		{name: "garbage", plan: model.ServicePlan{SpeedLimitMbps: "fast"}, wantErr: true},
+		{name: "three rates", plan: model.ServicePlan{SpeedLimitMbps: "1/2/3"}, wantErr: true},
+		{name: "burst below limit", plan: model.ServicePlan{SpeedLimitMbps: "4", BurstLimitMbps: "2"}, wantErr: true},
+		{name: "threshold above limit", plan: model.ServicePlan{SpeedLimitMbps: "4", BurstLimitMbps: "8", BurstThresholdMbps: "6"}, wantErr: true},
+		{name: "burst without limit", plan: model.ServicePlan{BurstLimitMbps: "8"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.MikrotikRateLimit(tt.plan)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MikrotikRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("MikrotikRateLimit() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanGroupAttributes(t *testing.T) {
+	dataLimit := 5 * 1024 // 5 GB, past the 32 bits of Mikrotik-Total-Limit
+	plan := model.ServicePlan{Name: "weekly", Duration: 604800, SpeedLimitMbps: "3", DataLimitMB: &dataLimit, Devices: 2}
+
+	checks, replies, err := service.PlanGroupAttributes(plan)
+	if err != nil {
+		t.Fatalf("PlanGroupAttributes() error = %v", err)
+	}
+	if len(checks) != 1 || checks[0].Groupname != "weekly" || checks[0].Attribute != service.AttrSimultaneousUse || checks[0].Op != "=" || checks[0].Value != "2" {
+		t.Errorf("checks = %+v, want Simultaneous-Use = 2 that users may override", checks)
+	}
+
+	want := map[string]string{
+		service.AttrSessionTimeout:      "604800",
+		service.AttrIdleTimeout:         "600",
+		service.AttrMikrotikRateLimit:   "3072k/3072k",
+		service.AttrMikrotikTotalLimit:  "1073741824",
+		service.AttrMikrotikTotalLimitG: "1",
+	}
+	if len(replies) != len(want) {
+		t.Errorf("replies = %+v, want %d attributes", replies, len(want))
+	}
+	for _, r := range replies {
+		wantOp := ":="
+		if r.Attribute == service.AttrMikrotikTotalLimit || r.Attribute == service.AttrMikrotikTotalLimitG {
+			wantOp = "=" // The remaining quota of each subscriber wins
+		}
+		if r.Groupname != "weekly" || r.Op != wantOp || want[r.Attribute] != r.Value {
+			t.Errorf("reply %s %s %s, want %s %s", r.Attribute, r.Op, r.Value, wantOp, want[r.Attribute])
+		}
+	}
+
+	if _, _, err := service.PlanGroupAttributes(model.ServicePlan{Name: "broken"}); err == nil {
+		t.Error("PlanGroupAttributes() of a plan without a duration succeeded, want an error")
+	}
+	if checks, _, _ := service.PlanGroupAttributes(model.ServicePlan{Name: "unlimited", Duration: 60}); len(checks) != 0 {
+		t.Errorf("checks of a plan without a device limit = %+v, want none", checks)
+	}
+}
+
+func TestComparePlanGroup(t *testing.T) {
+	plan := model.ServicePlan{ID: 7, Name: "hour2", Duration: 7200, SpeedLimitMbps: "3", Devices: 1}
+	checks, replies, err := service.PlanGroupAttributes(plan)
+	if err != nil {
+		t.Fatalf("PlanGroupAttributes() error = %v", err)
+	}
+	// Attributes the plan does not generate are the operator's
+	replies = append(replies, model.RadGroupReply{Groupname: "hour2", Attribute: "Acct-Interim-Interval", Op: ":=", Value: "300"})
+
+	if drift := service.ComparePlanGroup(plan, checks, replies); len(drift.Attributes) != 0 {
+		t.Errorf("ComparePlanGroup() of a synchronised group = %+v, want no drift", drift.Attributes)
+	}
+
+	drifted := append([]model.RadGroupReply{}, replies...)
+	for i := range drifted {
+		if drifted[i].Attribute == service.AttrMikrotikRateLimit {
+			drifted[i].Value = "3072k/3072k 3072k/3072k 1"
+		}
+	}
+	drifted = append(drifted, model.RadGroupReply{Groupname: "hour2", Attribute: service.AttrMikrotikTotalLimit, Op: ":=", Value: "100"})
+	drift := service.ComparePlanGroup(plan, nil, drifted)
+
+	want := map[string]service.AttributeDrift{
+		service.AttrMikrotikRateLimit:  {Attribute: service.AttrMikrotikRateLimit, Expected: ":= 3072k/3072k", Actual: ":= 3072k/3072k 3072k/3072k 1"},
+		service.AttrMikrotikTotalLimit: {Attribute: service.AttrMikrotikTotalLimit, Expected: "", Actual: ":= 100"},
+		service.AttrSimultaneousUse:    {Attribute: service.AttrSimultaneousUse, Expected: "= 1", Actual: ""},
+	}
+	if len(drift.Attributes) != len(want) {
+		t.Fatalf("ComparePlanGroup() = %+v, want %d drifted attributes", drift.Attributes, len(want))
+	}
+	for _, got := range drift.Attributes {
+		if got != want[got.Attribute] {
+			t.Errorf("drift %+v, want %+v", got, want[got.Attribute])
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Default addresses of the embedded RADIUS server
+const (
+	DefaultRadiusAuthAddr = ":1812"
+	DefaultRadiusAcctAddr = ":1813"
+)
+
+// RadiusServerConfig configures the embedded RADIUS server that serves the
+// radcheck, radreply and radusergroup tables in place of FreeRADIUS
+type RadiusServerConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	AuthAddr      string `mapstructure:"auth_addr"` // Defaults to :1812
+	AcctAddr      string `mapstructure:"acct_addr"` // Defaults to :1813
+	DefaultSecret string `mapstructure:"default_secret"`
+	// RequireMessageAuthenticator drops Access-Requests that are not signed
+	// with a Message-Authenticator
+	RequireMessageAuthenticator bool `mapstructure:"require_message_authenticator"`
+}
+
+// RadiusStore is where the embedded RADIUS server reads users and writes
+// accounting
+type RadiusStore interface {
+	// FindRadiusUser returns username with its groups, nil when it has no
+	// attributes at all
+	FindRadiusUser(ctx context.Context, username string) (*RadiusUser, error)
+	// RecordAccounting writes rec to radacct
+	RecordAccounting(ctx context.Context, rec AccountingRecord) error
+}
+
+// RadiusDBStore is the RadiusStore of the RADIUS database
+type RadiusDBStore struct{}
+
+// FindRadiusUser implements RadiusStore
+func (RadiusDBStore) FindRadiusUser(ctx context.Context, username string) (*RadiusUser, error) {
+	db := gdatabase.GetDB(config.RadiusDB).WithContext(ctx)
+
+	user := &RadiusUser{Username: username}
+	if err := db.Where("username = ?", username).Order("id ASC").Find(&user.Checks).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch check attributes of %s: %w", username, err)
+	}
+	if err := db.Where("username = ?", username).Order("id ASC").Find(&user.Replies).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch reply attributes of %s: %w", username, err)
+	}
+	var memberships []model.RadUserGroup
+	if err := db.Where("username = ?", username).Order("priority ASC").Find(&memberships).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch groups of %s: %w", username, err)
+	}
+	if len(user.Checks) == 0 && len(user.Replies) == 0 && len(memberships) == 0 {
+		return nil, nil
+	}
+
+	for _, membership := range memberships {
+		group := RadiusGroup{Name: membership.Groupname, Priority: membership.Priority}
+		if err := db.Where("groupname = ?", group.Name).Order("id ASC").Find(&group.Checks).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch check attributes of group %s: %w", group.Name, err)
+		}
+		if err := db.Where("groupname = ?", group.Name).Order("id ASC").Find(&group.Replies).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch reply attributes of group %s: %w", group.Name, err)
+		}
+		user.Groups = append(user.Groups, group)
+	}
+
+	var active int64
+	if err := db.Model(&model.RadAcct{}).Where("username = ? AND acctstoptime IS NULL", username).Count(&active).Error; err != nil {
+		return nil, fmt.Errorf("failed to count active sessions of %s: %w", username, err)
+	}
+	user.ActiveSessions = int(active)
+	return user, nil
+}
+
+// RecordAccounting implements RadiusStore
+func (RadiusDBStore) RecordAccounting(ctx context.Context, rec AccountingRecord) error {
+	db := gdatabase.GetDB(config.RadiusDB).WithContext(ctx)
+
+	if rec.StatusType == radius.AcctStatusAccountingOn || rec.StatusType == radius.AcctStatusAccountingOff {
+		// The NAS restarted: none of its sessions survived
+		err := db.Model(&model.RadAcct{}).
+			Where("nasipaddress = ? AND acctstoptime IS NULL", rec.NasIPAddress).
+			Updates(map[string]interface{}{
+				"acctstoptime":       rec.EventTime,
+				"acctupdatetime":     rec.EventTime,
+				"acctterminatecause": radius.TerminateCause(11), // NAS-Reboot
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to close sessions of NAS %s: %w", rec.NasIPAddress, err)
+		}
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var row model.RadAcct
+		err := tx.Where("acctuniqueid = ?", AccountingUniqueID(rec)).First(&row).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			ApplyAccounting(&row, rec)
+			if err := tx.Create(&row).Error; err != nil {
+				return fmt.Errorf("failed to insert accounting session %s: %w", rec.SessionID, err)
+			}
+			return nil
+		case err != nil:
+			return fmt.Errorf("failed to fetch accounting session %s: %w", rec.SessionID, err)
+		case rec.StatusType == radius.AcctStatusStart:
+			return nil // A retransmitted start
+		}
+		ApplyAccounting(&row, rec)
+		if err := tx.Save(&row).Error; err != nil {
+			return fmt.Errorf("failed to update accounting session %s: %w", rec.SessionID, err)
+		}
+		return nil
+	})
+}
+
+// RadiusHandler answers Access-Requests and Accounting-Requests from a
+// RadiusStore
+type RadiusHandler struct {
+	store         RadiusStore
+	defaultSecret string
+
+	// Secret returns the shared secret of the NAS at nasIP, empty when it
+	// has none of its own; defaults to NasSecret
+	Secret func(nasIP string) (string, error)
+	// Now returns the current time; defaults to time.Now
+	Now func() time.Time
+}
+
+// NewRadiusHandler creates a RadiusHandler serving store. Clients missing
+// from the nas table share defaultSecret, or are dropped when it is empty.
+func NewRadiusHandler(store RadiusStore, defaultSecret string) *RadiusHandler {
+	return &RadiusHandler{store: store, defaultSecret: defaultSecret, Secret: NasSecret, Now: time.Now}
+}
+
+// ClientSecret returns the secret shared with the client at addr
+func (h *RadiusHandler) ClientSecret(addr net.Addr) ([]byte, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	secret, err := h.Secret(host)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		secret = h.defaultSecret
+	}
+	return []byte(secret), nil
+}
+
+// ServeRADIUS implements radius.Handler. Requests that fail on the store are
+// left unanswered so the NAS retries them.
+func (h *RadiusHandler) ServeRADIUS(ctx context.Context, req *radius.Request) *radius.Packet {
+	switch req.Code {
+	case radius.CodeAccessRequest:
+		return h.access(ctx, req)
+	case radius.CodeAccountingRequest:
+		return h.accounting(ctx, req)
+	}
+	return nil
+}
+
+func (h *RadiusHandler) access(ctx context.Context, req *radius.Request) *radius.Packet {
+	auth := AuthRequest{Username: req.GetString(radius.AttrUserName)}
+	if chap, ok := req.Get(radius.AttrCHAPPassword); ok {
+		auth.CHAPPassword = chap
+		auth.CHAPChallenge = req.CHAPChallenge()
+	} else if value, ok := req.Get(radius.AttrUserPassword); ok {
+		password, err := radius.DecryptUserPassword(value, req.Authenticator, req.Secret)
+		if err != nil {
+			return reject(err.Error())
+		}
+		auth.Password = password
+	}
+	if auth.Username == "" {
+		return reject(RejectUnknownUser)
+	}
+
+	user, err := h.store.FindRadiusUser(ctx, auth.Username)
+	if err != nil {
+		log.Printf("RADIUS: failed to authorize %s: %v", auth.Username, err)
+		return nil
+	}
+	result := Authorize(user, auth, h.Now())
+	if !result.Accept {
+		log.Printf("RADIUS: rejected %s from %s: %s", auth.Username, req.RemoteAddr, result.Reason)
+		return reject(result.Reason)
+	}
+
+	resp := &radius.Packet{Code: radius.CodeAccessAccept}
+	for _, reply := range result.Replies {
+		attr, err := radius.EncodeAttribute(reply.Attribute, reply.Value)
+		if err != nil {
+			// FreeRADIUS would refuse to start with an unknown attribute;
+			// sending the rest beats locking the user out
+			log.Printf("RADIUS: skipped reply attribute %s of %s: %v", reply.Attribute, auth.Username, err)
+			continue
+		}
+		resp.Add(attr)
+	}
+	return resp
+}
+
+func reject(reason string) *radius.Packet {
+	resp := &radius.Packet{Code: radius.CodeAccessReject}
+	resp.Add(radius.String(radius.AttrReplyMessage, reason))
+	return resp
+}
+
+func (h *RadiusHandler) accounting(ctx context.Context, req *radius.Request) *radius.Packet {
+	rec, err := ParseAccountingRequest(req.Packet, req.RemoteAddr, h.Now())
+	if err != nil {
+		log.Printf("RADIUS: dropped accounting request from %s: %v", req.RemoteAddr, err)
+		return nil
+	}
+	if err := h.store.RecordAccounting(ctx, rec); err != nil {
+		log.Printf("RADIUS: failed to record accounting of %s: %v", rec.Username, err)
+		return nil
+	}
+	return &radius.Packet{Code: radius.CodeAccountingResponse}
+}
+
+// RadiusServer is the embedded RADIUS server listening on the authentication
+// and accounting ports
+type RadiusServer struct {
+	server   *radius.Server
+	authConn net.PacketConn
+	acctConn net.PacketConn
+}
+
+// StartRadiusServer listens on the addresses of cfg and serves h in the
+// background until Shutdown
+func StartRadiusServer(cfg RadiusServerConfig, h *RadiusHandler) (*RadiusServer, error) {
+	authAddr, acctAddr := cfg.AuthAddr, cfg.AcctAddr
+	if authAddr == "" {
+		authAddr = DefaultRadiusAuthAddr
+	}
+	if acctAddr == "" {
+		acctAddr = DefaultRadiusAcctAddr
+	}
+
+	authConn, err := net.ListenPacket("udp", authAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for RADIUS authentication on %s: %w", authAddr, err)
+	}
+	acctConn, err := net.ListenPacket("udp", acctAddr)
+	if err != nil {
+		authConn.Close()
+		return nil, fmt.Errorf("failed to listen for RADIUS accounting on %s: %w", acctAddr, err)
+	}
+
+	s := &RadiusServer{
+		server: &radius.Server{
+			Handler:                     h,
+			Secret:                      h.ClientSecret,
+			RequireMessageAuthenticator: cfg.RequireMessageAuthenticator,
+		},
+		authConn: authConn,
+		acctConn: acctConn,
+	}
+	for _, conn := range []net.PacketConn{authConn, acctConn} {
+		go func(conn net.PacketConn) {
+			if err := s.server.Serve(conn); err != nil && !errors.Is(err, radius.ErrServerClosed) {
+				log.Printf("RADIUS: server on %s stopped: %v", conn.LocalAddr(), err)
+			}
+		}(conn)
+	}
+	return s, nil
+}
+
+// AuthAddr returns the address the server takes Access-Requests on
+func (s *RadiusServer) AuthAddr() net.Addr {
+	return s.authConn.LocalAddr()
+}
+
+// AcctAddr returns the address the server takes Accounting-Requests on
+func (s *RadiusServer) AcctAddr() net.Addr {
+	return s.acctConn.LocalAddr()
+}
+
+// Shutdown stops the server, waiting for the requests being handled
+func (s *RadiusServer) Shutdown() {
+	s.server.Shutdown()
+}
@@ -0,0 +1,191 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortupik/wifigo/radius"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+// memoryRadiusStore keeps users and accounting in memory, keyed like radacct
+type memoryRadiusStore struct {
+	mu    sync.Mutex
+	users map[string]*service.RadiusUser
+	acct  map[string]*model.RadAcct
+}
+
+func (s *memoryRadiusStore) FindRadiusUser(ctx context.Context, username string) (*service.RadiusUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, nil
+	}
+	found := *user
+	for _, row := range s.acct {
+		if row.Username == username && row.AcctStopTime == nil {
+			found.ActiveSessions++
+		}
+	}
+	return &found, nil
+}
+
+func (s *memoryRadiusStore) RecordAccounting(ctx context.Context, rec service.AccountingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := service.AccountingUniqueID(rec)
+	row, ok := s.acct[id]
+	if !ok {
+		row = &model.RadAcct{}
+		s.acct[id] = row
+	} else if rec.StatusType == radius.AcctStatusStart {
+		return nil
+	}
+	service.ApplyAccounting(row, rec)
+	return nil
+}
+
+// sessions returns copies of the radacct rows
+func (s *memoryRadiusStore) sessions() []model.RadAcct {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := make([]model.RadAcct, 0, len(s.acct))
+	for _, row := range s.acct {
+		rows = append(rows, *row)
+	}
+	return rows
+}
+
+func startTestRadiusServer(t *testing.T, store service.RadiusStore) *service.RadiusServer {
+	t.Helper()
+	h := service.NewRadiusHandler(store, "testing123")
+	h.Secret = func(nasIP string) (string, error) { return "", nil }
+	h.Now = func() time.Time { return authNow }
+	s, err := service.StartRadiusServer(service.RadiusServerConfig{AuthAddr: "127.0.0.1:0", AcctAddr: "127.0.0.1:0"}, h)
+	if err != nil {
+		t.Fatalf("StartRadiusServer() error = %v", err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func accountingRequest(status, sessionTime, input, inputGigawords uint32) *radius.Packet {
+	p := radius.NewPacket(radius.CodeAccountingRequest)
+	p.Add(radius.Integer(radius.AttrAcctStatusType, status))
+	p.Add(radius.String(radius.AttrUserName, "0712345678@Tecsurf"))
+	p.Add(radius.String(radius.AttrAcctSessionID, "81a00003"))
+	nas, _ := radius.IPAddr(radius.AttrNASIPAddress, net.IPv4(10, 0, 0, 1))
+	p.Add(nas)
+	p.Add(radius.Integer(radius.AttrEventTimestamp, uint32(authNow.Unix())))
+	p.Add(radius.Integer(radius.AttrAcctSessionTime, sessionTime))
+	p.Add(radius.Integer(radius.AttrAcctInputOctets, input))
+	p.Add(radius.Integer(radius.AttrAcctInputGigawords, inputGigawords))
+	if status == radius.AcctStatusStop {
+		p.Add(radius.Integer(radius.AttrAcctTerminateCause, 5))
+	}
+	return p
+}
+
+func TestRadiusServer(t *testing.T) {
+	user := radiusUser(map[string]string{service.AttrCleartextPassword: "secret", service.AttrSimultaneousUse: "1"})
+	user.Replies = []model.RadReply{
+		{Attribute: service.AttrMikrotikRateLimit, Value: "5120k/5120k"},
+		{Attribute: "Unknown-Attribute", Value: "ignored"},
+	}
+	store := &memoryRadiusStore{
+		users: map[string]*service.RadiusUser{user.Username: user},
+		acct:  make(map[string]*model.RadAcct),
+	}
+	s := startTestRadiusServer(t, store)
+	client := &radius.Client{Timeout: 200 * time.Millisecond}
+	ctx := context.Background()
+
+	login := func(password string) *radius.Packet {
+		t.Helper()
+		req := radius.NewPacket(radius.CodeAccessRequest)
+		req.Add(radius.String(radius.AttrUserName, user.Username))
+		if err := req.AddUserPassword(password, []byte("testing123")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Exchange(ctx, s.AuthAddr().String(), []byte("testing123"), req)
+		if err != nil {
+			t.Fatalf("Access-Request error = %v", err)
+		}
+		return resp
+	}
+
+	resp := login("secret")
+	if resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("Access-Request answered %s, want Access-Accept", resp.Code)
+	}
+	if rate, ok := resp.GetVendor(radius.VendorMikrotik, radius.MikrotikRateLimit); !ok || string(rate) != "5120k/5120k" {
+		t.Errorf("Mikrotik-Rate-Limit = %q, want 5120k/5120k", rate)
+	}
+	if resp := login("wrong"); resp.Code != radius.CodeAccessReject || resp.GetString(radius.AttrReplyMessage) != service.RejectWrongPassword {
+		t.Errorf("wrong password answered %s %q, want Access-Reject", resp.Code, resp.GetString(radius.AttrReplyMessage))
+	}
+
+	account := func(req *radius.Packet) {
+		t.Helper()
+		resp, err := client.Exchange(ctx, s.AcctAddr().String(), []byte("testing123"), req)
+		if err != nil || resp.Code != radius.CodeAccountingResponse {
+			t.Fatalf("Accounting-Request answered %v, %v, want Accounting-Response", resp, err)
+		}
+	}
+	account(accountingRequest(radius.AcctStatusStart, 0, 0, 0))
+	if resp := login("secret"); resp.Code != radius.CodeAccessReject || resp.GetString(radius.AttrReplyMessage) != service.RejectSimultaneousUse {
+		t.Errorf("second login answered %s %q, want Access-Reject for Simultaneous-Use", resp.Code, resp.GetString(radius.AttrReplyMessage))
+	}
+
+	account(accountingRequest(radius.AcctStatusInterimUpdate, 300, 1000, 1))
+	account(accountingRequest(radius.AcctStatusStop, 600, 2000, 1))
+	rows := store.sessions()
+	if len(rows) != 1 {
+		t.Fatalf("radacct has %d rows, want 1", len(rows))
+	}
+	for _, row := range rows {
+		if row.AcctStopTime == nil || row.AcctTerminateCause == nil || *row.AcctTerminateCause != "Session-Timeout" {
+			t.Errorf("session stopped at %v for %v, want Session-Timeout", row.AcctStopTime, row.AcctTerminateCause)
+		}
+		if row.AcctInputOctets == nil || *row.AcctInputOctets != 1<<32+2000 {
+			t.Errorf("acctinputoctets = %v, want %d", row.AcctInputOctets, int64(1<<32+2000))
+		}
+		if row.AcctSessionTime == nil || *row.AcctSessionTime != 600 {
+			t.Errorf("acctsessiontime = %v, want 600", row.AcctSessionTime)
+		}
+	}
+	if resp := login("secret"); resp.Code != radius.CodeAccessAccept {
+		t.Errorf("login after stop answered %s, want Access-Accept", resp.Code)
+	}
+}
+
+func TestApplyAccountingWithoutStart(t *testing.T) {
+	rec, err := service.ParseAccountingRequest(accountingRequest(radius.AcctStatusInterimUpdate, 300, 1000, 0), nil, authNow)
+	if err != nil {
+		t.Fatalf("ParseAccountingRequest() error = %v", err)
+	}
+	if rec.NasIPAddress != "10.0.0.1" || rec.InputOctets != 1000 || !rec.EventTime.Equal(authNow) {
+		t.Fatalf("ParseAccountingRequest() = %+v", rec)
+	}
+
+	var row model.RadAcct
+	service.ApplyAccounting(&row, rec)
+	if row.AcctStartTime == nil || !row.AcctStartTime.Equal(authNow.Add(-300*time.Second)) {
+		t.Errorf("acctstarttime = %v, want five minutes before the interim update", row.AcctStartTime)
+	}
+	if row.AcctStopTime != nil {
+		t.Errorf("acctstoptime = %v, want an open session", row.AcctStopTime)
+	}
+
+	// A late, older interim update must not lower the counters
+	rec.SessionTime, rec.InputOctets = 60, 10
+	service.ApplyAccounting(&row, rec)
+	if *row.AcctSessionTime != 300 || *row.AcctInputOctets != 1000 {
+		t.Errorf("counters went back to %d s and %d octets", *row.AcctSessionTime, *row.AcctInputOctets)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	gmodel "github.com/ortupik/wifigo/database/model"
+)
+
+// Resource is what admin routes act on
+type Resource string
+
+// Resources of the admin routes
+const (
+	ResourceDevices      Resource = "devices"       // MikroTik routers and their RADIUS clients
+	ResourceSessions     Resource = "sessions"      // Live hotspot sessions on the routers
+	ResourceHotspotUsers Resource = "hotspot_users" // RADIUS users and their attributes
+	ResourceUsers        Resource = "users"         // Profiles of the accounts
+	ResourceRoles        Resource = "roles"         // Roles of the accounts
+	ResourcePlans        Resource = "plans"
+	ResourcePayments     Resource = "payments" // Orders, payments, payment accounts, refunds and C2B
+	ResourceVouchers     Resource = "vouchers"
+	ResourceReports      Resource = "reports"
+)
+
+// Action is what a route does to a resource
+type Action string
+
+// Actions on resources
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write" // Create and update
+	ActionDelete Action = "delete"
+)
+
+// Resources lists every resource, Actions every action
+var (
+	Resources = []Resource{ResourceDevices, ResourceSessions, ResourceHotspotUsers, ResourceUsers, ResourceRoles, ResourcePlans, ResourcePayments, ResourceVouchers, ResourceReports}
+	Actions   = []Action{ActionRead, ActionWrite, ActionDelete}
+)
+
+// Permission is an action on a resource
+type Permission struct {
+	Resource Resource `json:"resource"`
+	Action   Action   `json:"action"`
+}
+
+// String returns the permission as resource:action
+func (p Permission) String() string {
+	return string(p.Resource) + ":" + string(p.Action)
+}
+
+// Roles lists the roles accounts can be given
+var Roles = []string{gmodel.RolePlatformAdmin, gmodel.RoleISPAdmin, gmodel.RoleISPSupport}
+
+// rolePermissions holds what each role may do. Platform admins may do
+// everything.
+var rolePermissions = map[string][]Permission{
+	gmodel.RoleISPAdmin: {
+		{ResourceDevices, ActionRead}, {ResourceDevices, ActionWrite}, {ResourceDevices, ActionDelete},
+		{ResourceSessions, ActionRead}, {ResourceSessions, ActionDelete},
+		{ResourceHotspotUsers, ActionRead}, {ResourceHotspotUsers, ActionWrite}, {ResourceHotspotUsers, ActionDelete},
+		{ResourceUsers, ActionRead},
+		{ResourceRoles, ActionRead}, {ResourceRoles, ActionWrite},
+		{ResourcePlans, ActionRead}, {ResourcePlans, ActionWrite},
+		{ResourcePayments, ActionRead}, {ResourcePayments, ActionWrite}, {ResourcePayments, ActionDelete},
+		{ResourceVouchers, ActionRead}, {ResourceVouchers, ActionWrite},
+	},
+	gmodel.RoleISPSupport: {
+		{ResourceDevices, ActionRead},
+		{ResourceSessions, ActionRead}, {ResourceSessions, ActionDelete},
+		{ResourceHotspotUsers, ActionRead}, {ResourceHotspotUsers, ActionWrite},
+		{ResourceUsers, ActionRead},
+		{ResourcePlans, ActionRead},
+		{ResourceVouchers, ActionRead},
+	},
+}
+
+// RolePermissions returns what role may do
+func RolePermissions(role string) []Permission {
+	if role == gmodel.RolePlatformAdmin {
+		all := make([]Permission, 0, len(Resources)*len(Actions))
+		for _, resource := range Resources {
+			for _, action := range Actions {
+				all = append(all, Permission{resource, action})
+			}
+		}
+		return all
+	}
+	return rolePermissions[role]
+}
+
+// IsRole reports whether role is one accounts can be given
+func IsRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether role may take action on resource
+func Allowed(role string, resource Resource, action Action) bool {
+	if role == gmodel.RolePlatformAdmin {
+		return true
+	}
+	for _, p := range rolePermissions[role] {
+		if p.Resource == resource && p.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether t may take action on resource
+func (t Tenant) Can(resource Resource, action Action) bool {
+	return Allowed(t.Role, resource, action)
+}
@@ -0,0 +1,61 @@
+package service_test
+
+import (
+	"testing"
+
+	gmodel "github.com/ortupik/wifigo/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		role     string
+		resource service.Resource
+		action   service.Action
+		want     bool
+	}{
+		{gmodel.RolePlatformAdmin, service.ResourceReports, service.ActionRead, true},
+		{gmodel.RolePlatformAdmin, service.ResourceRoles, service.ActionWrite, true},
+		{gmodel.RoleISPAdmin, service.ResourceDevices, service.ActionDelete, true},
+		{gmodel.RoleISPAdmin, service.ResourceHotspotUsers, service.ActionWrite, true},
+		{gmodel.RoleISPAdmin, service.ResourceRoles, service.ActionWrite, true},
+		{gmodel.RoleISPAdmin, service.ResourceVouchers, service.ActionWrite, true},
+		{gmodel.RoleISPAdmin, service.ResourceVouchers, service.ActionDelete, false},
+		{gmodel.RoleISPAdmin, service.ResourceReports, service.ActionRead, false},
+		{gmodel.RoleISPSupport, service.ResourceDevices, service.ActionRead, true},
+		{gmodel.RoleISPSupport, service.ResourceDevices, service.ActionWrite, false},
+		{gmodel.RoleISPSupport, service.ResourceDevices, service.ActionDelete, false},
+		{gmodel.RoleISPSupport, service.ResourceHotspotUsers, service.ActionWrite, true},
+		{gmodel.RoleISPSupport, service.ResourceHotspotUsers, service.ActionDelete, false},
+		{gmodel.RoleISPSupport, service.ResourceSessions, service.ActionDelete, true},
+		{gmodel.RoleISPSupport, service.ResourceRoles, service.ActionWrite, false},
+		{gmodel.RoleISPSupport, service.ResourceVouchers, service.ActionRead, true},
+		{gmodel.RoleISPSupport, service.ResourceVouchers, service.ActionWrite, false},
+		{"", service.ResourceDevices, service.ActionRead, false},
+		{"root", service.ResourceDevices, service.ActionRead, false},
+	}
+	for _, tt := range tests {
+		if got := service.Allowed(tt.role, tt.resource, tt.action); got != tt.want {
+			t.Errorf("Allowed(%q, %s, %s) = %v, want %v", tt.role, tt.resource, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	if got, want := len(service.RolePermissions(gmodel.RolePlatformAdmin)), len(service.Resources)*len(service.Actions); got != want {
+		t.Errorf("platform admin has %d permissions, want all %d", got, want)
+	}
+	for _, role := range service.Roles {
+		for _, p := range service.RolePermissions(role) {
+			if !service.Allowed(role, p.Resource, p.Action) {
+				t.Errorf("%s is listed with %s but not allowed it", role, p)
+			}
+		}
+	}
+	if len(service.RolePermissions("")) != 0 {
+		t.Error("accounts without a role have permissions")
+	}
+	if !service.IsRole(gmodel.RoleISPSupport) || service.IsRole("root") || service.IsRole("") {
+		t.Error("IsRole() does not match Roles")
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// ErrRefundExists is returned when a payment already has a refund that is in
+// progress or completed
+var ErrRefundExists = errors.New("payment already has an active or completed refund")
+
+// ErrNothingToRefund is returned when an order has no successful payment
+var ErrNothingToRefund = errors.New("order has no successful payment to refund")
+
+// MarkProvisioningFailed flags a paid order whose RADIUS user or hotspot login
+// could not be set up, so that it can be refunded
+func MarkProvisioningFailed(orderID int, reason string) error {
+	db := gdatabase.GetDB(config.AppDB)
+	if db == nil {
+		return fmt.Errorf("database is not initialised")
+	}
+
+	err := db.Model(&model.Order{}).Where("id = ? AND provisioningFailedAt IS NULL", orderID).
+		Updates(map[string]interface{}{"provisioningFailedAt": time.Now(), "provisioningError": reason}).Error
+	if err != nil {
+		return fmt.Errorf("failed to flag order %d: %w", orderID, err)
+	}
+	log.Printf("Provisioning of order %d failed: %s", orderID, reason)
+	return nil
+}
+
+// ClearProvisioningFailure unflags an order once it was provisioned after all
+func ClearProvisioningFailure(orderID int) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	err := db.Model(&model.Order{}).Where("id = ?", orderID).
+		Updates(map[string]interface{}{"provisioningFailedAt": nil, "provisioningError": ""}).Error
+	if err != nil {
+		return fmt.Errorf("failed to unflag order %d: %w", orderID, err)
+	}
+	return nil
+}
+
+// FindSettledPayment returns the successful payment that settled an order.
+// Payments received after it are credited to the customer.
+func FindSettledPayment(orderID int) (*model.Payment, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var payment model.Payment
+	result := db.Where("orderId = ? AND ResultCode = 0", orderID).Order("id ASC").Limit(1).Find(&payment)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to fetch payment of order %d: %w", orderID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNothingToRefund
+	}
+	return &payment, nil
+}
+
+// CreateRefund records a refund request for payment. A payment is refunded at
+// most once: a new request is refused while an earlier one is in progress or
+// has completed, a failed one may be retried.
+func CreateRefund(refund *model.Refund) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var active int64
+		err := tx.Model(&model.Refund{}).
+			Where("paymentId = ? AND status <> ?", refund.PaymentID, model.RefundStatusFailed).
+			Count(&active).Error
+		if err != nil {
+			return fmt.Errorf("failed to check refunds of payment %d: %w", refund.PaymentID, err)
+		}
+		if active > 0 {
+			return ErrRefundExists
+		}
+
+		refund.Status = model.RefundStatusRequested
+		if err := tx.Create(refund).Error; err != nil {
+			return fmt.Errorf("failed to record refund: %w", err)
+		}
+		return setRefundStatus(tx, refund, model.RefundStatusRequested)
+	})
+}
+
+// MarkRefundSubmitted records that Daraja accepted a refund request
+func MarkRefundSubmitted(refund *model.Refund, conversationID, originatorConversationID string) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.Refund{}).Where("id = ? AND status = ?", refund.ID, model.RefundStatusRequested).
+			Updates(map[string]interface{}{
+				"status":                   model.RefundStatusSubmitted,
+				"conversationId":           conversationID,
+				"originatorConversationId": originatorConversationID,
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to mark refund %d submitted: %w", refund.ID, err)
+		}
+		refund.ConversationID, refund.OriginatorConversationID = conversationID, originatorConversationID
+		return setRefundStatus(tx, refund, model.RefundStatusSubmitted)
+	})
+}
+
+// FinishRefund records the outcome of a refund. A completed refund marks its
+// order refunded. It reports false when the refund had finished already, as
+// Safaricom may deliver a result more than once.
+func FinishRefund(refund *model.Refund, completed bool, resultCode int, resultDesc, transactionID string) (bool, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	status := model.RefundStatusFailed
+	if completed {
+		status = model.RefundStatusCompleted
+	}
+
+	updated := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.Refund{}).
+			Where("id = ? AND status IN ?", refund.ID, []string{model.RefundStatusRequested, model.RefundStatusSubmitted}).
+			Updates(map[string]interface{}{
+				"status":        status,
+				"resultCode":    resultCode,
+				"resultDesc":    resultDesc,
+				"transactionId": transactionID,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to finish refund %d: %w", refund.ID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		updated = true
+		refund.Status, refund.ResultCode, refund.ResultDesc, refund.TransactionID = status, resultCode, resultDesc, transactionID
+		if err := setRefundStatus(tx, refund, status); err != nil {
+			return err
+		}
+		if completed {
+			if err := tx.Model(&model.Order{}).Where("id = ?", refund.OrderID).Update("status", model.OrderStatusRefunded).Error; err != nil {
+				return fmt.Errorf("failed to mark order %d refunded: %w", refund.OrderID, err)
+			}
+		}
+		return nil
+	})
+	return updated, err
+}
+
+// FindRefundByToken returns the refund whose result URLs carry token
+func FindRefundByToken(token string) (*model.Refund, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var refund model.Refund
+	if err := db.Where("token = ?", token).First(&refund).Error; err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// FindRefundableOrders returns up to limit paid orders whose provisioning
+// failed before the given time and that have not been refunded, oldest first
+func FindRefundableOrders(failedBefore time.Time, limit int) ([]model.Order, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var orders []model.Order
+	err := db.Where("status = ? AND provisioningFailedAt < ? AND (refundStatus = '' OR refundStatus IS NULL)",
+		model.OrderStatusPaid, failedBefore).
+		Order("id ASC").Limit(limit).Find(&orders).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refundable orders: %w", err)
+	}
+	return orders, nil
+}
+
+// setRefundStatus mirrors the status of a refund on its order and payment
+func setRefundStatus(tx *gorm.DB, refund *model.Refund, status string) error {
+	if err := tx.Model(&model.Order{}).Where("id = ?", refund.OrderID).Update("refundStatus", status).Error; err != nil {
+		return fmt.Errorf("failed to update refund status of order %d: %w", refund.OrderID, err)
+	}
+	if err := tx.Model(&model.Payment{}).Where("id = ?", refund.PaymentID).Update("refundStatus", status).Error; err != nil {
+		return fmt.Errorf("failed to update refund status of payment %d: %w", refund.PaymentID, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// ExpiredSubscription is a RADIUS user whose Expiration has passed, with the
+// latest paid order or the redeemed voucher that paid for the session
+type ExpiredSubscription struct {
+	Username  string
+	ExpiredAt time.Time
+	Order     *model.Order
+	Voucher   *model.Voucher
+}
+
+// DeviceID returns the hotspot device the subscription was last logged in on
+func (s ExpiredSubscription) DeviceID() string {
+	switch {
+	case s.Order != nil:
+		return s.Order.DeviceID
+	case s.Voucher != nil:
+		return s.Voucher.DeviceID
+	}
+	return ""
+}
+
+// Address returns the address the subscription was last logged in from
+func (s ExpiredSubscription) Address() string {
+	switch {
+	case s.Order != nil:
+		return s.Order.Ip
+	case s.Voucher != nil:
+		return s.Voucher.Ip
+	}
+	return ""
+}
+
+// Reference names what paid for the subscription, an order number or a voucher code
+func (s ExpiredSubscription) Reference() string {
+	switch {
+	case s.Order != nil:
+		return s.Order.OrderNumber
+	case s.Voucher != nil:
+		return s.Voucher.Code
+	}
+	return ""
+}
+
+// expiredOrderBatch is how many usernames one paid order lookup covers
+const expiredOrderBatch = 500
+
+// ExpirationsBetween restricts tx, on radcheck, to the Expiration values
+// falling between since and now. The values are text in the location of now,
+// so they are parsed in SQL and compared with the bounds written the same way.
+func ExpirationsBetween(tx *gorm.DB, since, now time.Time) *gorm.DB {
+	const sqlLayout = "2006-01-02 15:04:05"
+	loc := now.Location()
+	return tx.Where("attribute = ?", "Expiration").
+		Where("STR_TO_DATE(value, ?) BETWEEN ? AND ?", model.RadiusExpirationSQLFormat,
+			since.In(loc).Format(sqlLayout), now.Format(sqlLayout))
+}
+
+// FindExpiredSubscriptions returns the users whose radcheck Expiration falls
+// between since and now and whose latest paid order, or redeemed voucher, has
+// not been expired yet
+func FindExpiredSubscriptions(since, now time.Time) ([]ExpiredSubscription, error) {
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	appDB := gdatabase.GetDB(config.AppDB)
+
+	var checks []model.RadCheck
+	if err := ExpirationsBetween(radiusDB, since, now).Find(&checks).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch expirations: %w", err)
+	}
+
+	loc := now.Location()
+	expiredAt := make(map[string]time.Time, len(checks))
+	usernames := make([]string, 0, len(checks))
+	for _, check := range checks {
+		expireTime, err := time.ParseInLocation(model.RadiusExpirationLayout, check.Value, loc)
+		if err != nil {
+			log.Printf("Skipping unparsable expiration %q for user %s: %v", check.Value, check.Username, err)
+			continue
+		}
+		if _, seen := expiredAt[check.Username]; !seen {
+			usernames = append(usernames, check.Username)
+		}
+		expiredAt[check.Username] = expireTime
+	}
+
+	var expired []ExpiredSubscription
+	for start := 0; start < len(usernames); start += expiredOrderBatch {
+		batch := usernames[start:min(start+expiredOrderBatch, len(usernames))]
+
+		var orders []model.Order
+		if err := appDB.Where("username IN ? AND status = ?", batch, model.OrderStatusPaid).
+			Order("id DESC").Find(&orders).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch orders of %d expired users: %w", len(batch), err)
+		}
+		// The latest paid order of each user comes first
+		latest := make(map[string]bool, len(batch))
+		for i := range orders {
+			order := &orders[i]
+			if latest[order.Username] {
+				continue
+			}
+			latest[order.Username] = true
+			expired = append(expired, ExpiredSubscription{
+				Username:  order.Username,
+				ExpiredAt: expiredAt[order.Username],
+				Order:     order,
+			})
+		}
+
+		// Voucher users have no order, their username is the voucher code
+		codes := make([]string, 0, len(batch)-len(latest))
+		for _, username := range batch {
+			if !latest[username] {
+				codes = append(codes, username)
+			}
+		}
+		if len(codes) == 0 {
+			continue
+		}
+		var vouchers []model.Voucher
+		if err := appDB.Where("code IN ? AND status = ?", codes, model.VoucherStatusRedeemed).Find(&vouchers).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch vouchers of %d expired users: %w", len(codes), err)
+		}
+		for i := range vouchers {
+			expired = append(expired, ExpiredSubscription{
+				Username:  vouchers[i].Code,
+				ExpiredAt: expiredAt[vouchers[i].Code],
+				Voucher:   &vouchers[i],
+			})
+		}
+	}
+	return expired, nil
+}
+
+// MarkSubscriptionExpired moves what paid for sub to the expired state. All
+// paid orders of the user placed before the expiration are expired together,
+// so that an older order is not found and expired again on the next scan.
+func MarkSubscriptionExpired(sub ExpiredSubscription) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	if sub.Order != nil {
+		err := db.Model(&model.Order{}).
+			Where("username = ? AND status = ?", sub.Username, model.OrderStatusPaid).
+			Where("id = ? OR created_at <= ?", sub.Order.ID, sub.ExpiredAt).
+			Update("status", model.OrderStatusExpired).Error
+		if err != nil {
+			return fmt.Errorf("failed to mark orders of %s expired: %w", sub.Username, err)
+		}
+	}
+	if sub.Voucher != nil {
+		err := db.Model(&model.Voucher{}).
+			Where("id = ? AND status = ?", sub.Voucher.ID, model.VoucherStatusRedeemed).
+			Update("status", model.VoucherStatusExpired).Error
+		if err != nil {
+			return fmt.Errorf("failed to mark voucher %s expired: %w", sub.Voucher.Code, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestExpirationsBetween(t *testing.T) {
+	nairobi := time.FixedZone("EAT", 3*3600)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, nairobi)
+	since := now.Add(-time.Hour).UTC()
+
+	sql := dryRun(t).ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return service.ExpirationsBetween(tx, since, now).Find(&[]model.RadCheck{})
+	})
+	// Both bounds are written in the location of now, like the stored values
+	want := "attribute = 'Expiration' AND (STR_TO_DATE(value, '%b %e %Y %H:%i:%s') BETWEEN '2026-10-17 11:00:00' AND '2026-10-17 12:00:00')"
+	if !strings.Contains(sql, want) {
+		t.Errorf("SQL = %s, want it to contain %s", sql, want)
+	}
+}
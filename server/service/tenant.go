@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Errors resolving the tenant of an account
+var (
+	ErrNoTenant      = errors.New("account is not assigned to an ISP")
+	ErrUnknownRole   = errors.New("account has no known role")
+	ErrTenantMissing = errors.New("request carries no tenant")
+)
+
+// Tenant is who an admin account acts for: every ISP for platform admins,
+// the ISP the account belongs to otherwise
+type Tenant struct {
+	AuthID uint64
+	Role   string
+	ISPID  int64 // Zero for platform admins
+}
+
+// TenantFromClaims returns the tenant of an account from the role and scope
+// of its token. Accounts without a role, and ISP accounts without an ISP,
+// act for nobody.
+func TenantFromClaims(authID uint64, role, scope string) (Tenant, error) {
+	t := Tenant{AuthID: authID, Role: role}
+	switch role {
+	case gmodel.RolePlatformAdmin:
+		return t, nil
+	case gmodel.RoleISPAdmin, gmodel.RoleISPSupport:
+		ispID, ok := gmodel.ParseISPScope(scope)
+		if !ok {
+			return t, ErrNoTenant
+		}
+		t.ISPID = ispID
+		return t, nil
+	default:
+		return t, ErrUnknownRole
+	}
+}
+
+// Platform reports whether t acts for every ISP
+func (t Tenant) Platform() bool {
+	return t.Role == gmodel.RolePlatformAdmin
+}
+
+// CanAccess reports whether t may see and change what belongs to ispID. Only
+// platform admins reach what belongs to no ISP (ispID zero).
+func (t Tenant) CanAccess(ispID int64) bool {
+	return t.Platform() || (t.ISPID != 0 && t.ISPID == ispID)
+}
+
+// CanAccessDevice reports whether t may manage device
+func (t Tenant) CanAccessDevice(device model.MikroTikDevice) bool {
+	if device.ISPID == nil {
+		return t.Platform()
+	}
+	return t.CanAccess(*device.ISPID)
+}
+
+// Scope restricts tx to the rows whose column holds the ISP of t, and leaves
+// it alone for platform admins
+func (t Tenant) Scope(tx *gorm.DB, column string) *gorm.DB {
+	if t.Platform() {
+		return tx
+	}
+	return tx.Where(column+" = ?", t.ISPID)
+}
+
+// ScopeOrders restricts tx to the orders of the ISP of t. Orders keep the ISP
+// ID as text.
+func (t Tenant) ScopeOrders(tx *gorm.DB) *gorm.DB {
+	if t.Platform() {
+		return tx
+	}
+	return tx.Where("isp = ?", strconv.FormatInt(t.ISPID, 10))
+}
+
+// ScopePayments restricts tx to the payments towards orders of the ISP of t
+func (t Tenant) ScopePayments(tx *gorm.DB) *gorm.DB {
+	if t.Platform() {
+		return tx
+	}
+	orders := t.ScopeOrders(tx.Session(&gorm.Session{NewDB: true}).Model(&model.Order{}).Select("id"))
+	return tx.Where("orderId IN (?)", orders)
+}
+
+// ScopeAccounts restricts tx to the rows whose column holds the auth ID of an
+// account of the ISP of t
+func (t Tenant) ScopeAccounts(tx *gorm.DB, column string) *gorm.DB {
+	if t.Platform() {
+		return tx
+	}
+	accounts := tx.Session(&gorm.Session{NewDB: true}).Model(&gmodel.Auth{}).Select("auth_id").Where("isp_id = ?", t.ISPID)
+	return tx.Where(column+" IN (?)", accounts)
+}
+
+// TenantISP returns the ISP t belongs to
+func TenantISP(tx *gorm.DB, t Tenant) (*model.ISP, error) {
+	if t.Platform() {
+		return nil, ErrNoTenant
+	}
+	var isp model.ISP
+	if err := tx.First(&isp, t.ISPID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch ISP %d: %w", t.ISPID, err)
+	}
+	return &isp, nil
+}
+
+// TenantOwnsUsername reports whether the hotspot user username belongs to the
+// ISP of t: it is in the ISP's realm, or it is a voucher code or the username
+// of an order of the ISP. tx is the app database.
+func TenantOwnsUsername(tx *gorm.DB, t Tenant, username string) (bool, error) {
+	if t.Platform() {
+		return true, nil
+	}
+	isp, err := TenantISP(tx, t)
+	if err != nil {
+		return false, err
+	}
+	if isp.HasSubscriber(username) {
+		return true, nil
+	}
+
+	var count int64
+	if err := tx.Model(&model.Voucher{}).Where("code = ? AND isp_id = ?", username, t.ISPID).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to look up voucher %s: %w", username, err)
+	}
+	if count > 0 {
+		return true, nil
+	}
+	if err := t.ScopeOrders(tx.Model(&model.Order{})).Where("username = ?", username).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to look up orders of %s: %w", username, err)
+	}
+	return count > 0, nil
+}
+
+// TenantForeignGroup returns the first of groups that is not the RADIUS group
+// of a service plan of the ISP of t, empty when there is none
+func TenantForeignGroup(tx *gorm.DB, t Tenant, groups []string) (string, error) {
+	if t.Platform() || len(groups) == 0 {
+		return "", nil
+	}
+	var plans []model.ServicePlan
+	if err := t.Scope(tx, "isp_id").Where("name IN ?", groups).Find(&plans).Error; err != nil {
+		return "", fmt.Errorf("failed to look up service plans: %w", err)
+	}
+	own := make(map[string]bool, len(plans))
+	for _, plan := range plans {
+		own[plan.GroupName()] = true
+	}
+	for _, group := range groups {
+		if !own[group] {
+			return group, nil
+		}
+	}
+	return "", nil
+}
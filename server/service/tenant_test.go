@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+
+	gmodel "github.com/ortupik/wifigo/database/model"
+	"github.com/ortupik/wifigo/server/database/model"
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestTenantFromClaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		scope    string
+		want     service.Tenant
+		wantErr  error
+		platform bool
+	}{
+		{name: "platform admin", role: gmodel.RolePlatformAdmin, want: service.Tenant{AuthID: 7, Role: gmodel.RolePlatformAdmin}, platform: true},
+		{name: "isp admin", role: gmodel.RoleISPAdmin, scope: gmodel.ISPScope(2), want: service.Tenant{AuthID: 7, Role: gmodel.RoleISPAdmin, ISPID: 2}},
+		{name: "isp support", role: gmodel.RoleISPSupport, scope: "isp:3", want: service.Tenant{AuthID: 7, Role: gmodel.RoleISPSupport, ISPID: 3}},
+		{name: "isp admin without isp", role: gmodel.RoleISPAdmin, wantErr: service.ErrNoTenant},
+		{name: "isp admin with bad scope", role: gmodel.RoleISPAdmin, scope: "isp:x", wantErr: service.ErrNoTenant},
+		{name: "no role", scope: "isp:2", wantErr: service.ErrUnknownRole},
+		{name: "unknown role", role: "root", wantErr: service.ErrUnknownRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.TenantFromClaims(7, tt.role, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TenantFromClaims() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want || got.Platform() != tt.platform {
+				t.Errorf("TenantFromClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantCanAccess(t *testing.T) {
+	platform := service.Tenant{Role: gmodel.RolePlatformAdmin}
+	isp := service.Tenant{Role: gmodel.RoleISPAdmin, ISPID: 2}
+	other := int64(3)
+	own := int64(2)
+
+	tests := []struct {
+		name   string
+		tenant service.Tenant
+		device model.MikroTikDevice
+		want   bool
+	}{
+		{name: "platform, any isp", tenant: platform, device: model.MikroTikDevice{ISPID: &other}, want: true},
+		{name: "platform, no isp", tenant: platform, device: model.MikroTikDevice{}, want: true},
+		{name: "own isp", tenant: isp, device: model.MikroTikDevice{ISPID: &own}, want: true},
+		{name: "other isp", tenant: isp, device: model.MikroTikDevice{ISPID: &other}},
+		{name: "no isp", tenant: isp, device: model.MikroTikDevice{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tenant.CanAccessDevice(tt.device); got != tt.want {
+				t.Errorf("CanAccessDevice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if (service.Tenant{Role: gmodel.RoleISPAdmin}).CanAccess(0) {
+		t.Error("tenant without an ISP can access what belongs to no ISP")
+	}
+}
+
+// dryRun returns a database that builds SQL without running it
+func dryRun(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestTenantScope(t *testing.T) {
+	db := dryRun(t)
+	platform := service.Tenant{Role: gmodel.RolePlatformAdmin}
+	isp := service.Tenant{Role: gmodel.RoleISPAdmin, ISPID: 2}
+
+	tests := []struct {
+		name  string
+		query func(t service.Tenant, tx *gorm.DB) *gorm.DB
+		model interface{}
+		want  string
+	}{
+		{
+			name:  "devices",
+			query: func(t service.Tenant, tx *gorm.DB) *gorm.DB { return t.Scope(tx, "isp_id") },
+			model: &[]model.MikroTikDevice{},
+			want:  "isp_id = 2",
+		},
+		{
+			name:  "orders",
+			query: func(t service.Tenant, tx *gorm.DB) *gorm.DB { return t.ScopeOrders(tx) },
+			model: &[]model.Order{},
+			want:  "isp = '2'",
+		},
+		{
+			name:  "payments",
+			query: func(t service.Tenant, tx *gorm.DB) *gorm.DB { return t.ScopePayments(tx) },
+			model: &[]model.Payment{},
+			want:  "orderId IN (SELECT `id` FROM `orders` WHERE isp = '2'",
+		},
+		{
+			name:  "accounts",
+			query: func(t service.Tenant, tx *gorm.DB) *gorm.DB { return t.ScopeAccounts(tx, "id_auth") },
+			model: &[]model.User{},
+			want:  "id_auth IN (SELECT `auth_id` FROM `auths` WHERE isp_id = 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB { return tt.query(isp, tx).Find(tt.model) })
+			if !strings.Contains(sql, tt.want) {
+				t.Errorf("scoped SQL = %s, want it to contain %s", sql, tt.want)
+			}
+			sql = db.ToSQL(func(tx *gorm.DB) *gorm.DB { return tt.query(platform, tx).Find(tt.model) })
+			if strings.Contains(sql, "isp") {
+				t.Errorf("platform SQL = %s, want it unscoped", sql)
+			}
+		})
+	}
+}
+
+func TestISPRealm(t *testing.T) {
+	tests := []struct {
+		name     string
+		isp      model.ISP
+		username string
+		ours     string
+	}{
+		{name: "realm", isp: model.ISP{Name: "Tec Surf", Realm: "tecsurf"}, username: "0712345678@tecsurf", ours: "0722000000@tecsurf"},
+		{name: "name without spaces", isp: model.ISP{Name: "Tec Surf"}, username: "0712345678@TecSurf", ours: "0722000000@TecSurf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.isp.SubscriberUsername("0712345678"); got != tt.username {
+				t.Errorf("SubscriberUsername() = %s, want %s", got, tt.username)
+			}
+			if !tt.isp.HasSubscriber(tt.ours) {
+				t.Errorf("HasSubscriber(%s) = false, want true", tt.ours)
+			}
+			for _, other := range []string{"0722000000@other", "0722000000", "tecsurf"} {
+				if tt.isp.HasSubscriber(other) {
+					t.Errorf("HasSubscriber(%s) = true, want false", other)
+				}
+			}
+		})
+	}
+}
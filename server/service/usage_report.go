@@ -0,0 +1,208 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// Dimensions radacct usage can be reported by
+const (
+	UsageByUser      = "users"
+	UsageByNAS       = "nas"
+	UsageByRealm     = "realms"
+	UsageByHour      = "hourly"
+	UsageByDay       = "daily"
+	UsageByMonth     = "monthly"
+	UsageByHourOfDay = "peak-hours" // Hour of the day sessions started in, over the whole range
+)
+
+// Orders usage report rows can be sorted in
+const (
+	UsageSortBucket   = "bucket"
+	UsageSortSessions = "sessions"
+	UsageSortTime     = "time"
+	UsageSortOctets   = "octets"
+	UsageSortUpload   = "upload"
+	UsageSortDownload = "download"
+)
+
+var (
+	ErrUnknownUsageDimension = errors.New("unknown usage report dimension")
+	ErrUnknownUsageSort      = errors.New("unknown usage report sort")
+)
+
+// realmExpr is the ISP realm of a session: the realm FreeRADIUS recorded, or
+// the part of the username after "@" (phone@realm)
+const realmExpr = "COALESCE(NULLIF(realm, ''), IF(LOCATE('@', username) > 0, SUBSTRING_INDEX(username, '@', -1), ''))"
+
+type usageDimension struct {
+	key  string // SQL expression rows are grouped by
+	sort string // Default sort
+}
+
+var usageDimensions = map[string]usageDimension{
+	UsageByUser:      {key: "username", sort: UsageSortOctets},
+	UsageByNAS:       {key: "nasipaddress", sort: UsageSortOctets},
+	UsageByRealm:     {key: realmExpr, sort: UsageSortOctets},
+	UsageByHour:      {key: "DATE_FORMAT(acctstarttime, '%Y-%m-%d %H:00')", sort: UsageSortBucket},
+	UsageByDay:       {key: "DATE_FORMAT(acctstarttime, '%Y-%m-%d')", sort: UsageSortBucket},
+	UsageByMonth:     {key: "DATE_FORMAT(acctstarttime, '%Y-%m')", sort: UsageSortBucket},
+	UsageByHourOfDay: {key: "LPAD(HOUR(acctstarttime), 2, '0')", sort: UsageSortSessions},
+}
+
+var usageSorts = map[string]string{
+	UsageSortBucket:   "bucket ASC",
+	UsageSortSessions: "sessions DESC, bucket ASC",
+	UsageSortTime:     "session_time DESC, bucket ASC",
+	UsageSortOctets:   "upload_octets + download_octets DESC, bucket ASC",
+	UsageSortUpload:   "upload_octets DESC, bucket ASC",
+	UsageSortDownload: "download_octets DESC, bucket ASC",
+}
+
+// usageColumns aggregates the sessions of a group. Input octets are what the
+// user sent, so upload; output octets are download.
+const usageColumns = "COUNT(*) AS sessions, " +
+	"COALESCE(SUM(acctstoptime IS NULL), 0) AS active_sessions, " +
+	"COUNT(DISTINCT username) AS users, " +
+	"COALESCE(SUM(acctsessiontime), 0) AS session_time, " +
+	"COALESCE(SUM(acctinputoctets), 0) AS upload_octets, " +
+	"COALESCE(SUM(acctoutputoctets), 0) AS download_octets"
+
+// UsageDimensions returns the dimensions usage can be reported by
+func UsageDimensions() []string {
+	return []string{UsageByUser, UsageByNAS, UsageByRealm, UsageByHour, UsageByDay, UsageByMonth, UsageByHourOfDay}
+}
+
+// UsageFilter selects the accounting sessions of a usage report. Sessions are
+// counted in the range they started in, so every query is bounded by the
+// acctstarttime index.
+type UsageFilter struct {
+	From         time.Time // Inclusive
+	To           time.Time // Exclusive
+	Username     string
+	NasIPAddress string
+	Realm        string
+}
+
+func (f UsageFilter) apply(db *gorm.DB) *gorm.DB {
+	query := db.Model(&model.RadAcct{}).Where("acctstarttime >= ? AND acctstarttime < ?", f.From, f.To)
+	if f.Username != "" {
+		query = query.Where("username = ?", f.Username)
+	}
+	if f.NasIPAddress != "" {
+		query = query.Where("nasipaddress = ?", f.NasIPAddress)
+	}
+	if f.Realm != "" {
+		query = query.Where("(realm = ? OR username LIKE ?)", f.Realm, "%@"+escapeLike(f.Realm))
+	}
+	return query
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// UsageTotals is the usage of a set of accounting sessions
+type UsageTotals struct {
+	Sessions       int64 `json:"sessions"`
+	ActiveSessions int64 `json:"active_sessions"` // Sessions without a stop record yet
+	Users          int64 `json:"users"`
+	SessionTime    int64 `json:"session_time"` // Seconds
+	UploadOctets   int64 `json:"upload_octets"`
+	DownloadOctets int64 `json:"download_octets"`
+}
+
+// TotalOctets returns the upload and download octets together
+func (t UsageTotals) TotalOctets() int64 {
+	return t.UploadOctets + t.DownloadOctets
+}
+
+// UsageRow is the usage of one user, NAS, realm or time bucket
+type UsageRow struct {
+	Bucket string `json:"bucket"`
+	UsageTotals
+}
+
+// UsageSummary is the usage of all sessions matching a filter
+type UsageSummary struct {
+	UsageTotals
+	PeakConcurrent int64      `json:"peak_concurrent"`
+	PeakAt         *time.Time `json:"peak_at"`
+}
+
+// UsageReport aggregates the sessions matching filter by dimension, sorted by
+// sort (the dimension's default when empty). It returns the rows from offset
+// and the number of rows in the whole report.
+func UsageReport(dimension string, filter UsageFilter, sort string, offset, limit int) ([]UsageRow, int64, error) {
+	dim, ok := usageDimensions[dimension]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnknownUsageDimension, dimension)
+	}
+	if sort == "" {
+		sort = dim.sort
+	}
+	order, ok := usageSorts[sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnknownUsageSort, sort)
+	}
+
+	db := gdatabase.GetDB(config.RadiusDB)
+	if db == nil {
+		return nil, 0, fmt.Errorf("database is not initialised")
+	}
+	grouped := filter.apply(db).Select(dim.key + " AS bucket, " + usageColumns).Group("bucket")
+
+	var total int64
+	if err := db.Table("(?) AS report", grouped.Session(&gorm.Session{})).Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count %s usage: %w", dimension, err)
+	}
+
+	rows := []UsageRow{}
+	if err := grouped.Session(&gorm.Session{}).Order(order).Offset(offset).Limit(limit).Scan(&rows).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to report %s usage: %w", dimension, err)
+	}
+	return rows, total, nil
+}
+
+// SummariseUsage totals the sessions matching filter and finds the most
+// sessions that were open at once. Sessions still open count until now.
+func SummariseUsage(filter UsageFilter, now time.Time) (*UsageSummary, error) {
+	db := gdatabase.GetDB(config.RadiusDB)
+	if db == nil {
+		return nil, fmt.Errorf("database is not initialised")
+	}
+
+	summary := &UsageSummary{}
+	if err := filter.apply(db).Select(usageColumns).Scan(&summary.UsageTotals).Error; err != nil {
+		return nil, fmt.Errorf("failed to total usage: %w", err)
+	}
+	if summary.Sessions == 0 {
+		return summary, nil
+	}
+
+	// Walk the session starts and stops in time order; stops sort first at the
+	// same instant so a reconnect does not count twice
+	starts := filter.apply(db).Select("acctstarttime AS event_at, 1 AS delta")
+	stops := filter.apply(db).Select("COALESCE(acctstoptime, ?) AS event_at, -1 AS delta", now)
+	var peak struct {
+		EventAt    time.Time
+		Concurrent int64
+	}
+	err := db.Raw("SELECT event_at, concurrent FROM ("+
+		"SELECT event_at, SUM(delta) OVER (ORDER BY event_at, delta ROWS UNBOUNDED PRECEDING) AS concurrent FROM (? UNION ALL ?) AS events"+
+		") AS sweep ORDER BY concurrent DESC, event_at ASC LIMIT 1", starts, stops).Scan(&peak).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find peak concurrent sessions: %w", err)
+	}
+	summary.PeakConcurrent = peak.Concurrent
+	summary.PeakAt = &peak.EventAt
+	return summary, nil
+}
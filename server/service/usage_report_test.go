@@ -0,0 +1,35 @@
+package service_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestUsageReportRejectsUnknownOptions(t *testing.T) {
+	filter := service.UsageFilter{From: time.Now().AddDate(0, 0, -1), To: time.Now()}
+
+	if _, _, err := service.UsageReport("weekly", filter, "", 0, 10); !errors.Is(err, service.ErrUnknownUsageDimension) {
+		t.Errorf("UsageReport(weekly) error = %v, want ErrUnknownUsageDimension", err)
+	}
+	if _, _, err := service.UsageReport(service.UsageByUser, filter, "name; DROP TABLE radacct", 0, 10); !errors.Is(err, service.ErrUnknownUsageSort) {
+		t.Errorf("UsageReport() with an unknown sort error = %v, want ErrUnknownUsageSort", err)
+	}
+}
+
+func TestUsageDimensions(t *testing.T) {
+	seen := map[string]bool{}
+	for _, dimension := range service.UsageDimensions() {
+		if seen[dimension] {
+			t.Errorf("dimension %s listed twice", dimension)
+		}
+		seen[dimension] = true
+	}
+	for _, want := range []string{service.UsageByUser, service.UsageByNAS, service.UsageByRealm, service.UsageByHourOfDay} {
+		if !seen[want] {
+			t.Errorf("UsageDimensions() is missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ortupik/wifigo/config"
+	gdatabase "github.com/ortupik/wifigo/database"
+	"github.com/ortupik/wifigo/server/database/model"
+)
+
+// VoucherAlphabet is the set of characters voucher codes are made of. Digits
+// and letters that are easily mistaken for each other on paper are left out.
+const VoucherAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// Errors returned when a voucher cannot be redeemed
+var (
+	ErrVoucherNotFound = errors.New("voucher not found")
+	ErrVoucherUsed     = errors.New("voucher has already been used")
+	ErrVoucherVoid     = errors.New("voucher has been withdrawn")
+)
+
+// maxCodeAttempts bounds the draws for a batch whose codes keep colliding,
+// which means the code length is too short for the vouchers already issued
+const maxCodeAttempts = 10
+
+// GenerateVoucherCodes draws n distinct codes of length random characters
+// after prefix. taken reports which of the candidates are already in use;
+// those are drawn again.
+func GenerateVoucherCodes(n, length int, prefix string, taken func(codes []string) (map[string]bool, error)) ([]string, error) {
+	codes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for attempt := 0; len(codes) < n; attempt++ {
+		if attempt == maxCodeAttempts {
+			return nil, fmt.Errorf("could not draw %d unique voucher codes of length %d", n, length)
+		}
+
+		candidates := make([]string, 0, n-len(codes))
+		for len(candidates) < n-len(codes) {
+			code, err := randomCode(length)
+			if err != nil {
+				return nil, err
+			}
+			code = prefix + code
+			if seen[code] {
+				continue
+			}
+			seen[code] = true
+			candidates = append(candidates, code)
+		}
+
+		used, err := taken(candidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, code := range candidates {
+			if !used[code] {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes, nil
+}
+
+func randomCode(length int) (string, error) {
+	max := big.NewInt(int64(len(VoucherAlphabet)))
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to draw voucher code: %w", err)
+		}
+		b.WriteByte(VoucherAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// NormalizeVoucherCode returns code as it is stored, ignoring case and the
+// spaces and dashes printed cards are often typed with
+func NormalizeVoucherCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// TakenVoucherCodes returns which of codes are voucher codes or RADIUS
+// usernames already
+func TakenVoucherCodes(codes []string) (map[string]bool, error) {
+	appDB := gdatabase.GetDB(config.AppDB)
+	radiusDB := gdatabase.GetDB(config.RadiusDB)
+	if appDB == nil || radiusDB == nil {
+		return nil, fmt.Errorf("database is not initialised")
+	}
+
+	var existing []string
+	if err := appDB.Model(&model.Voucher{}).Where("code IN ?", codes).Pluck("code", &existing).Error; err != nil {
+		return nil, fmt.Errorf("failed to check voucher codes: %w", err)
+	}
+	var usernames []string
+	if err := radiusDB.Raw("SELECT DISTINCT username FROM radcheck WHERE username IN ?", codes).Scan(&usernames).Error; err != nil {
+		return nil, fmt.Errorf("failed to check RADIUS usernames: %w", err)
+	}
+
+	taken := make(map[string]bool, len(existing)+len(usernames))
+	for _, code := range append(existing, usernames...) {
+		taken[code] = true
+	}
+	return taken, nil
+}
+
+// CreateVoucherBatch records batch and its vouchers within tx
+func CreateVoucherBatch(tx *gorm.DB, batch *model.VoucherBatch, vouchers []model.Voucher) error {
+	if err := tx.Omit("ServicePlan").Create(batch).Error; err != nil {
+		return fmt.Errorf("failed to create voucher batch: %w", err)
+	}
+	for i := range vouchers {
+		vouchers[i].BatchID = batch.ID
+	}
+	if err := tx.CreateInBatches(vouchers, 200).Error; err != nil {
+		return fmt.Errorf("failed to create vouchers: %w", err)
+	}
+	return nil
+}
+
+// FindVoucherBatch returns a batch with its service plan. tx may be scoped to
+// a tenant.
+func FindVoucherBatch(tx *gorm.DB, id int) (*model.VoucherBatch, error) {
+	var batch model.VoucherBatch
+	if err := tx.Preload("ServicePlan").First(&batch, id).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// FindBatchVouchers returns the vouchers of a batch in the order they were generated
+func FindBatchVouchers(batchID int) ([]model.Voucher, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var vouchers []model.Voucher
+	if err := db.Where("batchId = ?", batchID).Order("id").Find(&vouchers).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch vouchers of batch %d: %w", batchID, err)
+	}
+	return vouchers, nil
+}
+
+// FindVoucherByCode returns the voucher with code. tx may be scoped to a
+// tenant.
+func FindVoucherByCode(tx *gorm.DB, code string) (*model.Voucher, error) {
+	var voucher model.Voucher
+	if err := tx.Where("code = ?", code).First(&voucher).Error; err != nil {
+		return nil, err
+	}
+	return &voucher, nil
+}
+
+// CheckVoucherDevice returns ErrVoucherNotFound unless the hotspot deviceID
+// belongs to the voucher's ISP, so a code cannot be tried on, or learnt from,
+// another ISP's hotspot
+func CheckVoucherDevice(tx *gorm.DB, voucher *model.Voucher, deviceID string) error {
+	var device model.MikroTikDevice
+	err := tx.Select("id", "isp_id").Where("id = ?", deviceID).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrVoucherNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch device %s: %w", deviceID, err)
+	}
+	if device.ISPID == nil || *device.ISPID != voucher.ISPID {
+		return ErrVoucherNotFound
+	}
+	return nil
+}
+
+// RedeemVoucher marks the unused voucher with code as redeemed by the device
+// at ip, with a session of duration seconds from now. It returns
+// redeemed=false for a voucher already redeemed whose session is still
+// running, so the device may be logged in again; used and void vouchers are
+// refused.
+func RedeemVoucher(code, ip, mac, deviceID string, duration int, now time.Time) (voucher *model.Voucher, redeemed bool, err error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	expiresAt := now.Add(time.Duration(duration) * time.Second)
+	result := db.Model(&model.Voucher{}).
+		Where("code = ? AND status = ?", code, model.VoucherStatusUnused).
+		Updates(map[string]interface{}{
+			"status":     model.VoucherStatusRedeemed,
+			"redeemedAt": now,
+			"expiresAt":  expiresAt,
+			"ip":         ip,
+			"mac":        mac,
+			"DeviceID":   deviceID,
+		})
+	if result.Error != nil {
+		return nil, false, fmt.Errorf("failed to redeem voucher %s: %w", code, result.Error)
+	}
+
+	voucher, err = FindVoucherByCode(db, code)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, ErrVoucherNotFound
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch voucher %s: %w", code, err)
+	}
+	if result.RowsAffected == 1 {
+		return voucher, true, nil
+	}
+
+	switch {
+	case voucher.Status == model.VoucherStatusVoid:
+		return voucher, false, ErrVoucherVoid
+	case voucher.Status == model.VoucherStatusRedeemed && voucher.ExpiresAt != nil && voucher.ExpiresAt.After(now):
+		return voucher, false, nil
+	default:
+		return voucher, false, ErrVoucherUsed
+	}
+}
+
+// ReleaseVoucher returns a voucher whose activation failed to unused
+func ReleaseVoucher(id int) error {
+	db := gdatabase.GetDB(config.AppDB)
+
+	err := db.Model(&model.Voucher{}).Where("id = ? AND status = ?", id, model.VoucherStatusRedeemed).
+		Updates(map[string]interface{}{
+			"status":     model.VoucherStatusUnused,
+			"redeemedAt": nil,
+			"expiresAt":  nil,
+			"ip":         "",
+			"mac":        "",
+			"DeviceID":   "",
+		}).Error
+	if err != nil {
+		return fmt.Errorf("failed to release voucher %d: %w", id, err)
+	}
+	return nil
+}
+
+// CountVouchersByStatus returns how many vouchers of a batch are in each status
+func CountVouchersByStatus(batchID int) (map[string]int64, error) {
+	db := gdatabase.GetDB(config.AppDB)
+
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := db.Model(&model.Voucher{}).Select("status, COUNT(*) AS count").
+		Where("batchId = ?", batchID).Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to count vouchers of batch %d: %w", batchID, err)
+	}
+
+	counts := map[string]int64{
+		model.VoucherStatusUnused:   0,
+		model.VoucherStatusRedeemed: 0,
+		model.VoucherStatusVoid:     0,
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
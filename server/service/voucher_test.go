@@ -0,0 +1,80 @@
+package service_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	service "github.com/ortupik/wifigo/server/service"
+)
+
+func TestGenerateVoucherCodes(t *testing.T) {
+	// Every other candidate of the first draw is taken
+	calls := 0
+	taken := func(codes []string) (map[string]bool, error) {
+		calls++
+		used := map[string]bool{}
+		if calls == 1 {
+			for i, code := range codes {
+				if i%2 == 0 {
+					used[code] = true
+				}
+			}
+		}
+		return used, nil
+	}
+
+	codes, err := service.GenerateVoucherCodes(50, 8, "TS", taken)
+	if err != nil {
+		t.Fatalf("GenerateVoucherCodes() error = %v", err)
+	}
+	if len(codes) != 50 || calls != 2 {
+		t.Fatalf("GenerateVoucherCodes() = %d codes in %d draws, want 50 in 2", len(codes), calls)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if seen[code] {
+			t.Errorf("code %s drawn twice", code)
+		}
+		seen[code] = true
+		if len(code) != 10 || !strings.HasPrefix(code, "TS") {
+			t.Errorf("code %s, want TS and 8 characters", code)
+		}
+		if strings.Trim(code[2:], service.VoucherAlphabet) != "" {
+			t.Errorf("code %s has characters outside the voucher alphabet", code)
+		}
+	}
+}
+
+func TestGenerateVoucherCodesExhausted(t *testing.T) {
+	allTaken := func(codes []string) (map[string]bool, error) {
+		used := map[string]bool{}
+		for _, code := range codes {
+			used[code] = true
+		}
+		return used, nil
+	}
+	if _, err := service.GenerateVoucherCodes(5, 6, "", allTaken); err == nil {
+		t.Error("GenerateVoucherCodes() with every code taken succeeded, want an error")
+	}
+
+	failing := func([]string) (map[string]bool, error) { return nil, errors.New("db down") }
+	if _, err := service.GenerateVoucherCodes(5, 6, "", failing); err == nil {
+		t.Error("GenerateVoucherCodes() with a failing lookup succeeded, want an error")
+	}
+}
+
+func TestNormalizeVoucherCode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "ab23cd45", want: "AB23CD45"},
+		{in: " AB23-CD45 ", want: "AB23CD45"},
+		{in: "ab23 cd45", want: "AB23CD45"},
+	}
+	for _, tt := range tests {
+		if got := service.NormalizeVoucherCode(tt.in); got != tt.want {
+			t.Errorf("NormalizeVoucherCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
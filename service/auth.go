@@ -72,6 +72,17 @@ func GetEmailByAuthID(authID uint64) (string, error) {
 	return DecryptEmail(auth.EmailNonce, auth.EmailCipher)
 }
 
+// GetAuthByID fetches the account with the given authID
+func GetAuthByID(authID uint64) (*model.Auth, error) {
+	db := database.GetDB(config.AppDB)
+	var auth model.Auth
+
+	if err := db.Where("auth_id = ?", authID).First(&auth).Error; err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
 // IsAuthIDValid checks if the given authID is available in the database
 func IsAuthIDValid(authID uint64) bool {
 	db := database.GetDB(config.AppDB)
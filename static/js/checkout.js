@@ -136,7 +136,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 // Redirect to the success page
                 showAlert("M-Pesa payment initiated. Check your phone!", "success");
                 setTimeout(function() {
-                    window.location.href = '/confirm?ip='+ip+"&redirect_url="+redirectUrl+"&devices="+quantity+"&phone="+phoneNumber; // important
+                    window.location.href = '/confirm?ip='+ip+"&redirect_url="+redirectUrl+"&devices="+quantity+"&phone="+phoneNumber+"&isp="+ispId; // important
                 }, 3000)
             } else {
                 // Handle M-Pesa business logic errors (e.g., invalid phone, internal M-Pesa error)
@@ -5,6 +5,7 @@ document.addEventListener('DOMContentLoaded', function() {
     const redirectUrl = urlParams.get('redirect_url');
     const devices = urlParams.get('devices');
     let phone = urlParams.get("phone");
+    const isp = urlParams.get("isp");
     let redirectPage = redirectUrl + "/login?voucher="+phone;;
     
     // Elements
@@ -68,7 +69,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 //we shouldnt get this. prevented at checkout(fallback for unforseen cases)!
                 if(data.message === "User already subscribed"){
                     if(devices > 1){
-                        redirectPage = "/howto?redirectUrl="+redirectUrl+"&devices="+devices+"&phone="+phone;
+                        redirectPage = "/howto?redirectUrl="+redirectUrl+"&devices="+devices+"&phone="+phone+"&isp="+isp;
                     }
                     setTimeout(function() {
                      window.location.href = redirectPage;
@@ -93,7 +94,7 @@ document.addEventListener('DOMContentLoaded', function() {
         
          if(data.status === "failed"){
             if(devices > 1){
-                redirectPage = "/howto?redirectUrl="+redirectUrl+"&devices="+devices+"&phone="+phone;
+                redirectPage = "/howto?redirectUrl="+redirectUrl+"&devices="+devices+"&phone="+phone+"&isp="+isp;
              }
          }else{ 
             if(data.username){